@@ -1,73 +0,0 @@
--- phpMyAdmin SQL Dump
--- version 4.5.4.1deb2ubuntu2
--- http://www.phpmyadmin.net
---
--- Host: localhost
--- Generation Time: Sep 15, 2017 at 11:40 AM
--- Server version: 5.7.19-0ubuntu0.16.04.1
--- PHP Version: 7.0.22-0ubuntu0.16.04.1
-
-SET SQL_MODE = "NO_AUTO_VALUE_ON_ZERO";
-SET time_zone = "+00:00";
-
-
-/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;
-/*!40101 SET @OLD_CHARACTER_SET_RESULTS=@@CHARACTER_SET_RESULTS */;
-/*!40101 SET @OLD_COLLATION_CONNECTION=@@COLLATION_CONNECTION */;
-/*!40101 SET NAMES utf8 */;
-
---
--- Database: `hecomm`
---
-
--- --------------------------------------------------------
-
---
--- Table structure for table `platform`
---
-
-CREATE TABLE `platform` (
-  `id` int(11) NOT NULL,
-  `address` varchar(50) NOT NULL,
-  `tlscert` varchar(50) DEFAULT NULL,
-  `tlskey` varchar(50) DEFAULT NULL,
-  `ciargs` text,
-  `citype` int(11) NOT NULL
-) ENGINE=InnoDB DEFAULT CHARSET=latin1;
-
---
--- Truncate table before insert `platform`
---
-
-TRUNCATE TABLE `platform`;
---
--- Dumping data for table `platform`
---
-
-INSERT INTO `platform` (`id`, `address`, `tlscert`, `tlskey`, `ciargs`, `citype`) VALUES
-(1, '192.168.2.123:2001', '', '', NULL, 0),
-(2, '192.168.2.106:2000', '', '', NULL, 0);
-
---
--- Indexes for dumped tables
---
-
---
--- Indexes for table `platform`
---
-ALTER TABLE `platform`
-  ADD PRIMARY KEY (`id`),
-  ADD UNIQUE KEY `address` (`address`);
-
---
--- AUTO_INCREMENT for dumped tables
---
-
---
--- AUTO_INCREMENT for table `platform`
---
-ALTER TABLE `platform`
-  MODIFY `id` int(11) NOT NULL AUTO_INCREMENT, AUTO_INCREMENT=3;
-/*!40101 SET CHARACTER_SET_CLIENT=@OLD_CHARACTER_SET_CLIENT */;
-/*!40101 SET CHARACTER_SET_RESULTS=@OLD_CHARACTER_SET_RESULTS */;
-/*!40101 SET COLLATION_CONNECTION=@OLD_COLLATION_CONNECTION */;
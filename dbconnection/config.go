@@ -0,0 +1,36 @@
+package dbconnection
+
+import (
+	"time"
+)
+
+//Config Settings of the storage backend and its connection pool
+type Config struct {
+	Driver          string
+	Source          string //DSN of the backend, empty for the default of the driver
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	Migrate         bool //Apply pending schema migrations when opening
+}
+
+const (
+	//DefaultMaxOpenConns Maximum of simultaneous open connections in the pool
+	DefaultMaxOpenConns int = 10
+	//DefaultMaxIdleConns Connections kept open while idle
+	DefaultMaxIdleConns int = 2
+	//DefaultConnMaxLifetime Age after which a connection is recycled, below the default mysql wait_timeout
+	DefaultConnMaxLifetime time.Duration = time.Minute * 5
+)
+
+//DefaultConfig Configuration of the default MySQL backend
+func DefaultConfig() Config {
+	return Config{
+		Driver:          DriverMySQL,
+		Source:          mysqlSource,
+		MaxOpenConns:    DefaultMaxOpenConns,
+		MaxIdleConns:    DefaultMaxIdleConns,
+		ConnMaxLifetime: DefaultConnMaxLifetime,
+		Migrate:         true,
+	}
+}
@@ -1,32 +1,36 @@
 package dbconnection
 
 import (
-	"database/sql"
 	"fmt"
-	"log"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql" //Driver mysql
 	"github.com/joriwind/hecomm-fog/iotInterface"
 )
 
-//Mysql database
-
-//Platform Model of a platform in the mysql database
+//Platform Model of a platform in the database
 type Platform struct {
 	ID      int
 	Address string
+	//TLSCert, TLSKey Client key pair used to dial the platform, the fog default if empty
 	TLSCert string
 	TLSKey  string
-	CIType  int
+	//TLSCaCert CA trusted for the platform, TLSServerName pins the name in its certificate
+	TLSCaCert     string
+	TLSServerName string
+	CIType        int
+	CIArgs        map[string]interface{} //Interface specific arguments, stored as JSON
+	//Identity Certificate name (CN or SAN) the platform authenticates with, empty to match the host of Address
+	Identity string
 }
 
-//Node Model of a Node in the mysql database
+//Node Model of a Node in the database
 type Node struct {
 	ID         int
 	DevID      string
 	PlatformID int
 	IsProvider bool
 	InfType    int
+	CIArgs     map[string]interface{} //Interface specific arguments of messages to the node, stored as JSON
 }
 
 //Link Model of a Link stored in db between two communicating nodes
@@ -34,550 +38,162 @@ type Link struct {
 	ID       int
 	ProvNode int
 	ReqNode  int
+	CIArgs   map[string]interface{} //Arguments of messages over the link, before those of the destination node
 }
 
+//Certificate Certificate issued to a platform by the fog CA
+type Certificate struct {
+	Serial     string //Hexadecimal serial number
+	PlatformID int
+	CommonName string
+	NotAfter   time.Time
+	Revoked    bool
+}
+
+//QueuedMessage Downlink persisted until it is delivered to its destination node, or dead-lettered
+type QueuedMessage struct {
+	ID            int
+	NodeID        int //Destination
+	LinkID        int //Link the message was routed over, 0 if unknown
+	Origin        []byte
+	InterfaceType int
+	Data          []byte
+	Metadata      []byte //Reception details of the message as JSON, nil if none
+	Received      time.Time
+	Expires       time.Time
+	Attempts      int
+	NextAttempt   time.Time
+	LastError     string
+	Dead          bool //Moved to the dead letters, no longer retried
+	InFlight      bool //Taken by the interface, which reports later whether it was delivered
+}
+
+//DeviceKeys Over-the-air activation keys of a LoRaWAN node and its current session
+type DeviceKeys struct {
+	NodeID    int
+	AppEUI    []byte //Application EUI accepted in join requests, any if empty
+	AppKey    []byte //Root key, 16 bytes
+	DevAddr   []byte //Address of the current session, empty until the node joined
+	NwkSKey   []byte
+	AppSKey   []byte
+	DevNonces []uint16 //Nonces of the accepted join requests, never accepted again
+	FCntUp    uint32   //Next expected uplink frame counter of the session
+}
+
+//NodeError Error a network server reported for a node
+type NodeError struct {
+	ID         int
+	NodeID     int
+	PlatformID int
+	Type       string
+	Message    string
+	Time       time.Time
+}
+
+//Store Storage backend holding the platforms, nodes, links, issued certificates, queued downlinks, LoRaWAN keys and
+//network server errors of the fog
+type Store interface {
+	InsertPlatform(pl *Platform) error
+	UpdatePlatform(pl *Platform) error
+	GetPlatform(id int) (*Platform, error)
+	GetPlatforms() ([]Platform, error)
+	DeletePlatform(id int) error
+
+	InsertNode(n *Node) error
+	UpdateNode(n *Node) error
+	DeleteNode(id int) error
+	FindNode(devID []byte) (*Node, error)
+	FindAvailableProviderNode(infType int, reqNodeID int) (*Node, error)
+	FindAvailableProviderNodes(infType int, reqNodeID int) ([]Node, error)
+	GetNode(id int) (*Node, error)
+	GetNodes() ([]Node, error)
+
+	InsertLink(l *Link) error
+	UpdateLink(l *Link) error
+	GetLinks() ([]Link, error)
+	GetLinksOfNode(nodeID int) ([]Link, error)
+	DeleteLink(id int) error
+
+	InsertCertificate(c *Certificate) error
+	GetCertificate(serial string) (*Certificate, error)
+	GetCertificates() ([]Certificate, error)
+	GetCertificatesOfPlatform(platformID int) ([]Certificate, error)
+	RevokeCertificate(serial string) error
+
+	EnqueueMessage(m *QueuedMessage) error
+	UpdateQueuedMessage(m *QueuedMessage) error
+	DeleteQueuedMessage(id int) error
+	GetQueuedMessage(id int) (*QueuedMessage, error)
+	//GetQueuedMessages Pending messages of a destination, oldest first
+	GetQueuedMessages(nodeID int) ([]QueuedMessage, error)
+	//GetPendingDestinations Destinations with pending messages
+	GetPendingDestinations() ([]int, error)
+	GetDeadLetters() ([]QueuedMessage, error)
+
+	//SetDeviceKeys Insert or replace the keys of a node
+	SetDeviceKeys(k *DeviceKeys) error
+	GetDeviceKeys(nodeID int) (*DeviceKeys, error)
+	DeleteDeviceKeys(nodeID int) error
+
+	//InsertNodeError Insert an error of a node, keeping only the last keep errors of that node
+	InsertNodeError(e *NodeError, keep int) error
+	//GetNodeErrors Errors of a node, or of all nodes when 0, oldest first
+	GetNodeErrors(nodeID int) ([]NodeError, error)
+
+	Close() error
+}
+
+//Available storage backends
 const (
-	dbsource string = "hecomm:hecomm@tcp(localhost:3306)/hecomm?charset=utf8"
-	dbDriver string = "mysql"
+	DriverMySQL  string = "mysql"
+	DriverSQLite string = "sqlite3"
+	DriverMemory string = "memory"
 )
 
-//InsertPlatform Insert a new platform in the mysql database
-func InsertPlatform(pl *Platform) error {
-	db, err := sql.Open(dbDriver, dbsource)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-
-	//Prepare insert query
-	stmt, err := db.Prepare("INSERT platform SET address=?, citype=?, tlscert=?, tlskey=?")
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	//Execute insert
-	res, err := stmt.Exec(pl.Address, pl.CIType, pl.TLSCert, pl.TLSKey)
-	if err != nil {
-		return err
-	}
-
-	//Check response for confirmation insertion
-	i, err := res.LastInsertId()
-	if err != nil {
-		return err
-	}
-	pl.ID = int(i)
-	log.Printf("Inserted platform: Address: %v, citype: %v, id: %v, tlscert: %v, tlskey: %v", pl.Address, pl.CIType, pl.ID, pl.TLSCert, pl.TLSKey)
-	return nil
-
-}
-
-//UpdatePlatform Update a platform row in the database
-func UpdatePlatform(pl *Platform) error {
-	db, err := sql.Open(dbDriver, dbsource)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-	stmt, err := db.Prepare("UPDATE platform SET address=?, citype=? WHERE id=?")
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	res, err := stmt.Exec(pl.Address, pl.CIType, pl.ID)
-	if err != nil {
-		return err
-	}
-	if i, err := res.RowsAffected(); i != 1 {
-		if err != nil {
-			return err
-		}
-		log.Printf("RowsAffected does not equals one: %v\n", i)
-	}
-	return nil
-}
-
-//GetPlatform Retrieve platform via platform id
-func GetPlatform(id int) (*Platform, error) {
-	var platform Platform
-
-	db, err := sql.Open(dbDriver, dbsource)
-	if err != nil {
-		return &platform, err
-	}
-	defer db.Close()
-	stmt, err := db.Prepare("SELECT id, address, tlscert, tlskey, citype FROM platform WHERE id=?")
-	if err != nil {
-		return &platform, err
-	}
-	defer stmt.Close()
-
-	rows, err := stmt.Query(id)
-	if err != nil {
-		return &platform, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-
-		var citype int
-		var address, tlscert, tlskey string
-		if err := rows.Scan(&id, &address, &tlscert, &tlskey, &citype); err != nil {
-			return &platform, err
-		}
-		platform = Platform{
-			ID:      id,
-			Address: address,
-			TLSCert: tlscert,
-			TLSKey:  tlskey,
-			CIType:  citype,
-		}
-		fmt.Printf("Platform from query: %v, %v, %v, %v, %v\n", id, citype, address, tlscert, tlskey)
-		return &platform, nil
-	}
-	return &platform, err
-}
-
-//GetPlatforms Retrieve all platforms
-func GetPlatforms() ([]Platform, error) {
-	var platforms []Platform
-	db, err := sql.Open(dbDriver, dbsource)
-	if err != nil {
-		return platforms, err
-	}
-	defer db.Close()
-	stmt, err := db.Prepare("SELECT id, address, tlscert, tlskey, citype FROM platform")
-	if err != nil {
-		return platforms, err
-	}
-	defer stmt.Close()
-
-	rows, err := stmt.Query()
-	if err != nil {
-		return platforms, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-
-		var id, citype int
-		var address, tlscert, tlskey string
-		if err := rows.Scan(&id, &address, &tlscert, &tlskey, &citype); err != nil {
-			return platforms, err
-		}
-		platform := Platform{
-			ID:      id,
-			Address: address,
-			TLSCert: tlscert,
-			TLSKey:  tlskey,
-			CIType:  citype,
-		}
-		platforms = append(platforms, platform)
-		fmt.Printf("Platform from query: %v, %v, %v, %v, %v\n", platform.ID, platform.CIType,
-			platform.Address, platform.TLSCert, platform.TLSKey)
-	}
-	return platforms, nil
-}
-
-//DeletePlatform Delete platform via platform id
-func DeletePlatform(id int) error {
-	db, err := sql.Open(dbDriver, dbsource)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-	stmt, err := db.Prepare("DELETE FROM platform WHERE id=?")
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	res, err := stmt.Exec(id)
-
-	if err != nil {
-		return err
-	}
-	if i, err := res.RowsAffected(); i != 1 {
-		if err != nil {
-			return err
-		}
-		log.Printf("RowsAffected does not equals one: %v\n", i)
-	}
-	return nil
-}
-
-//InsertNode Insert a node into the database
-func InsertNode(n *Node) error {
-	db, err := sql.Open(dbDriver, dbsource)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-	stmt, err := db.Prepare("INSERT node SET devid=?, platformid=?, isprovider=?, inftype=?")
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	res, err := stmt.Exec(n.DevID, n.PlatformID, n.IsProvider, n.InfType)
-	if err != nil {
-		return err
-	}
-	i, err := res.LastInsertId()
-	if err != nil {
-		return err
-	}
-	n.ID = int(i)
-	return nil
-}
-
-//UpdateNode Update a node from the database
-func UpdateNode(n *Node) error {
-	db, err := sql.Open(dbDriver, dbsource)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-	stmt, err := db.Prepare("UPDATE node SET devid=?, platformid=?, isprovider=?, inftype=? WHERE id=?")
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	res, err := stmt.Exec(n.DevID, n.PlatformID, n.IsProvider, n.InfType, n.ID)
-	if err != nil {
-		return err
-	}
-	if i, err := res.RowsAffected(); i != 1 {
-		if err != nil {
-			return err
-		}
-		log.Printf("RowsAffected does not equals one: %v\n", i)
-	}
-	return nil
-}
-
-//DeleteNode Delete node via id
-func DeleteNode(id int) error {
-	db, err := sql.Open(dbDriver, dbsource)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-	stmt, err := db.Prepare("DELETE FROM node WHERE id=?")
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	res, err := stmt.Exec(id)
-
-	if err != nil {
-		return err
-	}
-	if i, err := res.RowsAffected(); i != 1 {
-		if err != nil {
-			return err
-		}
-		log.Printf("RowsAffected does not equals one: %v\n", i)
-	}
-	return nil
-}
-
-//FindNode Retrieve node via device identifier
-func FindNode(devID []byte) (*Node, error) {
-	var node Node
-	db, err := sql.Open(dbDriver, dbsource)
-	if err != nil {
-		return &node, err
+//Open Create the store of the configured backend
+func Open(config Config) (Store, error) {
+	switch config.Driver {
+	case DriverMySQL:
+		return NewMySQLStore(config)
+	case DriverSQLite:
+		return NewSQLiteStore(config)
+	case DriverMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("dbconnection: unknown storage backend: %v", config.Driver)
 	}
-	defer db.Close()
-	stmt, err := db.Prepare("SELECT * FROM node WHERE devid=?")
-	if err != nil {
-		return &node, err
-	}
-	defer stmt.Close()
-
-	row := stmt.QueryRow(devID)
-	var id, platformid, inftype int
-	var devid string
-	var isprovider bool
-	row.Scan(&id, &devid, &platformid, &isprovider, &inftype)
-	node = Node{
-		ID:         id,
-		DevID:      devid,
-		PlatformID: platformid,
-		IsProvider: isprovider,
-		InfType:    inftype,
-	}
-	return &node, err
 }
 
-//FindAvailableProviderNode Locate a node that is still available to transfer the required data
-func FindAvailableProviderNode(infType int) (*Node, error) {
-	var node Node
-	db, err := sql.Open(dbDriver, dbsource)
-	if err != nil {
-		return &node, err
-	}
-	defer db.Close()
-	stmt, err := db.Prepare("SELECT node.id, node.devid, node.platformid, node.isprovider, node.inftype, link.id FROM node LEFT JOIN link ON link.provnode = node.id WHERE node.inftype=? AND link.id is null AND node.isprovider = 1")
-	if err != nil {
-		return &node, err
-	}
-	defer stmt.Close()
+//GetDestinations Retrieve all nodes linked with the origin node of the message
+func GetDestinations(s Store, message *iotInterface.ComLinkMessage) ([]Node, error) {
 
-	rows, err := stmt.Query(infType)
+	srcnode, err := s.FindNode(message.Origin)
 	if err != nil {
-		return &node, err
+		return nil, err
 	}
-	var id, platformid, inftype, idLink int
-	var devid string
-	var isprovider bool
-
-	for rows.Next() {
-		rows.Scan(&id, &devid, &platformid, &isprovider, &inftype, &idLink)
-		if idLink == 0 {
-			//Not already linked device
-			node = Node{
-				ID:         id,
-				DevID:      devid,
-				PlatformID: platformid,
-				IsProvider: isprovider,
-				InfType:    inftype,
-			}
-			break
-		}
+	if srcnode.ID == 0 {
+		return nil, nil
 	}
 
-	return &node, err
-}
-
-//GetNode Retrieve node via device identifier
-func GetNode(ID int) (*Node, error) {
-	var node Node
-	db, err := sql.Open(dbDriver, dbsource)
+	links, err := s.GetLinksOfNode(srcnode.ID)
 	if err != nil {
-		return &node, err
-	}
-	defer db.Close()
-	stmt, err := db.Prepare("SELECT * FROM node WHERE id=?")
-	if err != nil {
-		return &node, err
-	}
-	defer stmt.Close()
-
-	row := stmt.QueryRow(ID)
-	var id, platformid, inftype int
-	var devid string
-	var isprovider bool
-	row.Scan(&id, &devid, &platformid, &isprovider, &inftype)
-	node = Node{
-		ID:         id,
-		DevID:      devid,
-		PlatformID: platformid,
-		IsProvider: isprovider,
-		InfType:    inftype,
-	}
-	return &node, err
-}
-
-//GetNodes Retrieves all nodes
-func GetNodes() ([]Node, error) {
-	var nodes []Node
-	db, err := sql.Open(dbDriver, dbsource)
-	if err != nil {
-		return nodes, err
-	}
-	defer db.Close()
-	stmt, err := db.Prepare("SELECT * FROM node")
-	if err != nil {
-		return nodes, err
-	}
-	defer stmt.Close()
-	rows, err := stmt.Query()
-	if err != nil {
-		return nodes, err
+		return nil, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var id, platformid, inftype int
-		var devid string
-		var isprovider bool
-		rows.Scan(&id, &devid, &platformid, &isprovider, &inftype)
-		node := Node{
-			ID:         id,
-			DevID:      devid,
-			PlatformID: platformid,
-			IsProvider: isprovider,
-			InfType:    inftype,
+	var dstnodes []Node
+	for _, link := range links {
+		dstID := link.ProvNode
+		if link.ProvNode == srcnode.ID {
+			dstID = link.ReqNode
 		}
-		nodes = append(nodes, node)
-	}
-	return nodes, err
-}
-
-//InsertLink Insert a link into the database
-func InsertLink(l *Link) error {
-	db, err := sql.Open(dbDriver, dbsource)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-	stmt, err := db.Prepare("INSERT link SET provnode=?, reqnode=?")
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	res, err := stmt.Exec(l.ProvNode, l.ReqNode)
-	if err != nil {
-		return err
-	}
-	i, err := res.LastInsertId()
-	if err != nil {
-		return err
-	}
-	l.ID = int(i)
-	return nil
-}
-
-//UpdateLink Update a link in the database
-func UpdateLink(l *Link) error {
-	db, err := sql.Open(dbDriver, dbsource)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-	stmt, err := db.Prepare("UPDATE link SET provnode=?, reqnode=? WHERE id=?")
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	res, err := stmt.Exec(l.ProvNode, l.ReqNode, l.ID)
-	if err != nil {
-		return err
-	}
-	if i, err := res.RowsAffected(); i != 1 {
+		dstnode, err := s.GetNode(dstID)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		log.Printf("RowsAffected does not equals one: %v\n", i)
-	}
-	return nil
-}
-
-//GetLinks Retrieve all links
-func GetLinks() ([]Link, error) {
-	var links []Link
-	db, err := sql.Open(dbDriver, dbsource)
-	if err != nil {
-		return links, err
-	}
-	defer db.Close()
-	stmt, err := db.Prepare("SELECT * FROM link")
-	if err != nil {
-		return links, err
-	}
-	defer stmt.Close()
-	rows, err := stmt.Query()
-	if err != nil {
-		return links, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var id, provnode, reqnode int
-		rows.Scan(&id, &provnode, &reqnode)
-		link := Link{
-			ID:       id,
-			ProvNode: provnode,
-			ReqNode:  reqnode,
-		}
-		links = append(links, link)
-	}
-	return links, err
-}
-
-//GetLink Retrieve via one of both's node ID
-func GetLink(nodeID int) (*Link, error) {
-	var link Link
-	db, err := sql.Open(dbDriver, dbsource)
-	if err != nil {
-		return &link, err
-	}
-	defer db.Close()
-	stmt, err := db.Prepare("SELECT id, provnode, reqnode FROM link WHERE provnode=? OR reqnode=?")
-	if err != nil {
-		return &link, err
-	}
-	defer stmt.Close()
-
-	row := stmt.QueryRow(nodeID, nodeID)
-	var id, provnode, reqnode int
-	row.Scan(&id, &provnode, &reqnode)
-	link = Link{
-		ID:       id,
-		ProvNode: provnode,
-		ReqNode:  reqnode,
-	}
-	return &link, err
-}
-
-//DeleteLink Delete link via id
-func DeleteLink(id int) error {
-	db, err := sql.Open(dbDriver, dbsource)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-	stmt, err := db.Prepare("DELETE FROM link WHERE id=?")
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	res, err := stmt.Exec(id)
-
-	if err != nil {
-		return err
-	}
-	if i, err := res.RowsAffected(); i != 1 {
-		if err != nil {
-			return err
+		if dstnode.ID == 0 {
+			continue
 		}
-		log.Printf("RowsAffected does not equals one: %v\n", i)
+		dstnodes = append(dstnodes, *dstnode)
 	}
-	return nil
-}
-
-//GetDestination fill message with destination and return the destination node
-func GetDestination(message *iotInterface.ComLinkMessage) (*Node, error) {
-
-	srcnode, err := FindNode(message.Origin)
-	if err != nil {
-		return nil, err
-	}
-
-	link, err := GetLink(srcnode.ID)
-	if err != nil {
-		return nil, err
-	}
-	var dstnode *Node
-	switch srcnode.ID {
-	case link.ProvNode:
-		dstnode, err = GetNode(link.ReqNode)
-	case link.ReqNode:
-		dstnode, err = GetNode(link.ProvNode)
-	}
-	if err != nil {
-		return nil, err
-	}
-
-	message.Destination = []byte(dstnode.DevID)
 
-	return dstnode, nil
+	return dstnodes, nil
 }
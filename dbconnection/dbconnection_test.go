@@ -1,50 +1,251 @@
 package dbconnection
 
 import (
-	"testing"
-
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
+	"github.com/joriwind/hecomm-fog/iotInterface"
 )
 
+//testStores Offline backends every test is run against
+func testStores(t *testing.T) (map[string]Store, func()) {
+	dir, err := ioutil.TempDir("", "hecomm-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlite, err := NewSQLiteStore(Config{Source: filepath.Join(dir, "hecomm.db"), Migrate: true})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	stores := map[string]Store{
+		DriverMemory: NewMemoryStore(),
+		DriverSQLite: sqlite,
+	}
+	return stores, func() {
+		for _, s := range stores {
+			s.Close()
+		}
+		os.RemoveAll(dir)
+	}
+}
+
 func TestPlatform(t *testing.T) {
 	type args struct {
 		pl *Platform
 	}
-	f := map[string]interface{}{
-		"Name": "Wednesday",
-		"Age":  6,
-		"Parents": []interface{}{
-			"Gomez",
-			"Morticia",
-		},
-	}
 	tests := []struct {
 		name    string
 		args    args
 		wantErr bool
 	}{
-		// TODO: Add test cases.
-		{name: "test1", args: args{&Platform{Address: "localhost/test", CIArgs: f, CIType: 1, TLSCert: "/certs/test.cert", TLSKey: "/certs/key.pem"}}, wantErr: false},
+		{name: "test1", args: args{&Platform{Address: "localhost/test", CIType: 1, TLSCert: "/certs/test.cert", TLSKey: "/certs/key.pem", Identity: "platform-a"}}, wantErr: false},
 	}
-	for _, tt := range tests {
-		if err := InsertPlatform(tt.args.pl); (err != nil) != tt.wantErr {
-			t.Errorf("%q. InsertPlatform() error = %v, wantErr %v", tt.name, err, tt.wantErr)
-			return
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for backend, store := range stores {
+		for _, tt := range tests {
+			pl := *tt.args.pl
+			if err := store.InsertPlatform(&pl); (err != nil) != tt.wantErr {
+				t.Errorf("%v: %q. InsertPlatform() error = %v, wantErr %v", backend, tt.name, err, tt.wantErr)
+				continue
+			}
+			got, err := store.GetPlatform(pl.ID)
+			if err != nil {
+				t.Errorf("%v: %q. GetPlatform() error = %v", backend, tt.name, err)
+			} else if !isPlatformEqual(got, &pl) {
+				t.Errorf("%v: %q. GetPlatform() = %v, want %v", backend, tt.name, got, pl)
+			}
+			//Every column is updated
+			updated := Platform{ID: pl.ID, Address: "localhost/updated", CIType: 0, TLSCert: "/certs/new.cert", TLSKey: "/certs/new.pem",
+				TLSCaCert: "/certs/ca.pem", TLSServerName: "platform-b", CIArgs: map[string]interface{}{"nsAddress": "localhost:8000"}, Identity: "platform-b"}
+			if err := store.UpdatePlatform(&updated); err != nil {
+				t.Errorf("%v: %q. UpdatePlatform() error = %v", backend, tt.name, err)
+			}
+			if got, _ := store.GetPlatform(pl.ID); !isPlatformEqual(got, &updated) {
+				t.Errorf("%v: %q. GetPlatform() after update = %v, want %v", backend, tt.name, got, updated)
+			}
+			if err := store.DeletePlatform(pl.ID); (err != nil) != tt.wantErr {
+				t.Errorf("%v: %q. DeletePlatform() error = %v, wantErr %v", backend, tt.name, err, tt.wantErr)
+			}
+			if got, _ := store.GetPlatform(pl.ID); got.ID != 0 {
+				t.Errorf("%v: %q. GetPlatform() after delete = %v", backend, tt.name, got)
+			}
 		}
-		defer func() { //Cleanup function!
-			if r := recover(); r != nil {
-				fmt.Println("Recovered from error in GetPlatform --> deleting platform")
+	}
+}
+
+func TestUpdateUnique(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for backend, store := range stores {
+		plA := Platform{Address: "[::1]:2000", CIType: 1, CIArgs: map[string]interface{}{"nsAddress": "ns1:8000"}}
+		plB := Platform{Address: "[::2]:2000", CIType: 1}
+		for _, pl := range []*Platform{&plA, &plB} {
+			if err := store.InsertPlatform(pl); err != nil {
+				t.Fatalf("%v: InsertPlatform() error = %v", backend, err)
+			}
+		}
+		moved := plB
+		moved.Address = plA.Address
+		if err := store.UpdatePlatform(&moved); err == nil {
+			t.Errorf("%v: UpdatePlatform() to address of other platform: expected error", backend)
+		}
+		//The stored arguments are not those of the caller
+		plA.CIArgs["nsAddress"] = "ns2:8000"
+		if got, _ := store.GetPlatform(plA.ID); got.CIArgs["nsAddress"] != "ns1:8000" {
+			t.Errorf("%v: GetPlatform() after change of inserted ciargs = %v", backend, got.CIArgs)
+		}
+
+		nA := Node{DevID: "aaaa::1", PlatformID: plA.ID, InfType: 1, CIArgs: map[string]interface{}{"fport": 10.0}}
+		nB := Node{DevID: "aaaa::2", PlatformID: plA.ID, InfType: 1}
+		for _, n := range []*Node{&nA, &nB} {
+			if err := store.InsertNode(n); err != nil {
+				t.Fatalf("%v: InsertNode() error = %v", backend, err)
 			}
-			if err := DeletePlatform(tt.args.pl.ID); (err != nil) != tt.wantErr {
-				t.Errorf("%q. DeletePlatform() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		renamed := nB
+		renamed.DevID = nA.DevID
+		if err := store.UpdateNode(&renamed); err == nil {
+			t.Errorf("%v: UpdateNode() to devid of other node: expected error", backend)
+		}
+		got, _ := store.GetNode(nA.ID)
+		got.CIArgs["fport"] = 11.0
+		if again, _ := store.GetNode(nA.ID); again.CIArgs["fport"] != 10.0 {
+			t.Errorf("%v: GetNode() after change of retrieved ciargs = %v", backend, again.CIArgs)
+		}
+		if got, _ := store.FindNode([]byte(nB.DevID)); got.ID != nB.ID {
+			t.Errorf("%v: FindNode() after rejected update = %v, want %v", backend, got, nB)
+		}
+	}
+}
+
+func TestGetDestinations(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for backend, store := range stores {
+		prov := Node{DevID: "0102030405060708", PlatformID: 1, IsProvider: true, InfType: 2, CIArgs: map[string]interface{}{"fport": 10.0}}
+		req := Node{DevID: "aaaa::1", PlatformID: 2, IsProvider: false, InfType: 2}
+		req2 := Node{DevID: "aaaa::2", PlatformID: 2, IsProvider: false, InfType: 2}
+		for _, n := range []*Node{&prov, &req, &req2} {
+			if err := store.InsertNode(n); err != nil {
+				t.Fatalf("%v: InsertNode() error = %v", backend, err)
 			}
-		}()
-		if got := GetPlatform(tt.args.pl.ID); !isPlatformEqual(got, tt.args.pl) {
-			t.Errorf("%q. GetPlatform() = %v, want %v", tt.name, got, tt.args.pl)
 		}
 
+		avail, err := store.FindAvailableProviderNode(2, req.ID)
+		if err != nil || avail.ID != prov.ID || avail.CIArgs["fport"] != 10.0 {
+			t.Errorf("%v: FindAvailableProviderNode() = %v, %v, want %v", backend, avail, err, prov)
+		}
+		//A provider asking for its own type is not offered itself
+		if avails, err := store.FindAvailableProviderNodes(2, prov.ID); err != nil || len(avails) != 0 {
+			t.Errorf("%v: FindAvailableProviderNodes() for the provider itself = %v, %v, want none", backend, avails, err)
+		}
+
+		link := Link{ProvNode: prov.ID, ReqNode: req.ID, CIArgs: map[string]interface{}{"confirmed": true}}
+		if err := store.InsertLink(&link); err != nil {
+			t.Fatalf("%v: InsertLink() error = %v", backend, err)
+		}
+		if links, err := store.GetLinksOfNode(req.ID); err != nil || len(links) != 1 || links[0].CIArgs["confirmed"] != true {
+			t.Errorf("%v: GetLinksOfNode() = %v, %v, want %v", backend, links, err, link)
+		}
+		if err := store.InsertLink(&Link{ProvNode: prov.ID, ReqNode: req.ID}); err == nil {
+			t.Errorf("%v: InsertLink() of duplicate link: expected error", backend)
+		}
+
+		avail, err = store.FindAvailableProviderNode(2, req.ID)
+		if err != nil || avail.ID != 0 {
+			t.Errorf("%v: FindAvailableProviderNode() on linked provider = %v, %v", backend, avail, err)
+		}
+		//A provider serves more than one requester
+		avail, err = store.FindAvailableProviderNode(2, req2.ID)
+		if err != nil || avail.ID != prov.ID {
+			t.Errorf("%v: FindAvailableProviderNode() for second requester = %v, %v, want %v", backend, avail, err, prov)
+		}
+		if avails, err := store.FindAvailableProviderNodes(2, req2.ID); err != nil || len(avails) != 1 || avails[0].ID != prov.ID {
+			t.Errorf("%v: FindAvailableProviderNodes() = %v, %v, want %v", backend, avails, err, prov)
+		}
+		if err := store.InsertLink(&Link{ProvNode: prov.ID, ReqNode: req2.ID}); err != nil {
+			t.Fatalf("%v: InsertLink() error = %v", backend, err)
+		}
+
+		message := iotInterface.ComLinkMessage{Origin: []byte(prov.DevID)}
+		dsts, err := GetDestinations(store, &message)
+		if err != nil {
+			t.Fatalf("%v: GetDestinations() error = %v", backend, err)
+		}
+		if len(dsts) != 2 || dsts[0].ID != req.ID || dsts[1].ID != req2.ID {
+			t.Errorf("%v: GetDestinations() = %v, want %v and %v", backend, dsts, req, req2)
+		}
+
+		message = iotInterface.ComLinkMessage{Origin: []byte(req2.DevID)}
+		if dsts, err := GetDestinations(store, &message); err != nil || len(dsts) != 1 || dsts[0].ID != prov.ID {
+			t.Errorf("%v: GetDestinations() reverse = %v, %v, want %v", backend, dsts, err, prov)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hecomm-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := Config{Source: filepath.Join(dir, "hecomm.db")}
+
+	//Without migrating nothing is created
+	store, err := NewSQLiteStore(config)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore() error = %v", err)
+	}
+	if version, err := store.(Migrator).SchemaVersion(); err != nil || version != 0 {
+		t.Errorf("SchemaVersion() = %v, %v, want 0", version, err)
+	}
+	if version, err := store.(Migrator).Migrate(); err != nil || version != LatestSchemaVersion {
+		t.Errorf("Migrate() = %v, %v, want %v", version, err, LatestSchemaVersion)
+	}
+	//Migrating twice is a no-op
+	if version, err := store.(Migrator).Migrate(); err != nil || version != LatestSchemaVersion {
+		t.Errorf("second Migrate() = %v, %v, want %v", version, err, LatestSchemaVersion)
+	}
+	pl := Platform{Address: "[::1]:2000", CIArgs: map[string]interface{}{"Name": "Wednesday"}}
+	if err := store.InsertPlatform(&pl); err != nil {
+		t.Fatalf("InsertPlatform() error = %v", err)
+	}
+	if got, err := store.GetPlatform(pl.ID); err != nil || got.CIArgs["Name"] != "Wednesday" {
+		t.Errorf("GetPlatform() = %v, %v, want ciargs %v", got, err, pl.CIArgs)
+	}
+
+	//A schema from a newer binary is refused
+	if _, err := store.(*sqlStore).db.Exec("INSERT INTO schema_migration (version, description) VALUES (?, ?)", LatestSchemaVersion+1, "future"); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	config.Migrate = true
+	if _, err := NewSQLiteStore(config); err != ErrSchemaTooNew {
+		t.Errorf("NewSQLiteStore() on newer schema error = %v, want %v", err, ErrSchemaTooNew)
+	}
+}
+
+func TestMySQLAlreadyApplied(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{err: &mysql.MySQLError{Number: mysqlDuplicateColumn, Message: "Duplicate column name 'ciargs'"}, want: true},
+		{err: fmt.Errorf("exec: %w", &mysql.MySQLError{Number: mysqlDuplicateKey}), want: true},
+		{err: &mysql.MySQLError{Number: 1146, Message: "Table 'hecomm.link' doesn't exist"}},
+		{err: errors.New("driver: bad connection")},
+	} {
+		if got := mysqlAlreadyApplied(tc.err); got != tc.want {
+			t.Errorf("mysqlAlreadyApplied(%v) = %v, want %v", tc.err, got, tc.want)
+		}
 	}
 }
 
@@ -56,18 +257,207 @@ func isPlatformEqual(pl *Platform, ref *Platform) bool {
 	if pl.CIType != ref.CIType {
 		return false
 	}
-	if pl.ID != pl.ID {
+	if pl.ID != ref.ID {
+		return false
+	}
+	if pl.TLSCert != ref.TLSCert {
+		return false
+	}
+	if pl.TLSKey != ref.TLSKey {
 		return false
 	}
-	if pl.TLSCert != pl.TLSCert {
+	if pl.TLSCaCert != ref.TLSCaCert || pl.TLSServerName != ref.TLSServerName {
 		return false
 	}
-	if pl.TLSKey != pl.TLSKey {
+	if fmt.Sprint(pl.CIArgs) != fmt.Sprint(ref.CIArgs) {
 		return false
 	}
-	if pl.CIArgs["Name"] != ref.CIArgs["Name"] {
+	if pl.Identity != ref.Identity {
 		return false
 	}
 
 	return true
 }
+
+func TestCertificates(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for backend, store := range stores {
+		notAfter := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+		first := Certificate{Serial: "0a1b", PlatformID: 1, CommonName: "platform-a", NotAfter: notAfter}
+		second := Certificate{Serial: "0c2d", PlatformID: 1, CommonName: "platform-a", NotAfter: notAfter.Add(time.Hour)}
+		other := Certificate{Serial: "0e3f", PlatformID: 2, CommonName: "platform-b", NotAfter: notAfter}
+		for _, c := range []*Certificate{&second, &other, &first} {
+			if err := store.InsertCertificate(c); err != nil {
+				t.Fatalf("%v: InsertCertificate() error = %v", backend, err)
+			}
+		}
+		if err := store.InsertCertificate(&first); err == nil {
+			t.Errorf("%v: InsertCertificate() of duplicate serial succeeded", backend)
+		}
+
+		got, err := store.GetCertificate(first.Serial)
+		if err != nil || *got != first {
+			t.Errorf("%v: GetCertificate() = %v, %v, want %v", backend, got, err, first)
+		}
+		if got, err := store.GetCertificate("ffff"); err != nil || got.Serial != "" {
+			t.Errorf("%v: GetCertificate() of unknown serial = %v, %v", backend, got, err)
+		}
+		certs, err := store.GetCertificatesOfPlatform(1)
+		if err != nil || len(certs) != 2 || certs[0].Serial != first.Serial || certs[1].Serial != second.Serial {
+			t.Errorf("%v: GetCertificatesOfPlatform() = %v, %v, want %v and %v", backend, certs, err, first, second)
+		}
+		if certs, err := store.GetCertificates(); err != nil || len(certs) != 3 {
+			t.Errorf("%v: GetCertificates() = %v, %v", backend, certs, err)
+		}
+
+		if err := store.RevokeCertificate(first.Serial); err != nil {
+			t.Errorf("%v: RevokeCertificate() error = %v", backend, err)
+		}
+		if got, _ := store.GetCertificate(first.Serial); !got.Revoked {
+			t.Errorf("%v: GetCertificate() after revoke = %v", backend, got)
+		}
+		if err := store.RevokeCertificate("ffff"); err == nil {
+			t.Errorf("%v: RevokeCertificate() of unknown serial succeeded", backend)
+		}
+	}
+}
+
+func TestMessageQueue(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for backend, store := range stores {
+		now := time.Unix(0, time.Now().UnixNano()/int64(time.Millisecond)*int64(time.Millisecond))
+		first := QueuedMessage{NodeID: 3, LinkID: 5, Origin: []byte("0102"), InterfaceType: 1, Data: []byte{1}, Metadata: []byte(`{"values":{"a":"b"}}`), Received: now, Expires: now.Add(time.Hour), NextAttempt: now}
+		second := QueuedMessage{NodeID: 3, Origin: []byte("0102"), InterfaceType: 1, Data: []byte{2}, Received: now, Expires: now.Add(time.Hour), NextAttempt: now}
+		other := QueuedMessage{NodeID: 4, Origin: []byte("0102"), InterfaceType: 1, Data: []byte{3}, Received: now, Expires: now.Add(time.Hour), NextAttempt: now}
+		for _, m := range []*QueuedMessage{&first, &second, &other} {
+			if err := store.EnqueueMessage(m); err != nil || m.ID == 0 {
+				t.Fatalf("%v: EnqueueMessage() = %v, id %v", backend, err, m.ID)
+			}
+		}
+
+		queued, err := store.GetQueuedMessages(3)
+		if err != nil || len(queued) != 2 || queued[0].ID != first.ID || queued[1].ID != second.ID {
+			t.Fatalf("%v: GetQueuedMessages() = %v, %v, want %v then %v", backend, queued, err, first.ID, second.ID)
+		}
+		if !queued[0].Received.Equal(now) || !queued[0].Expires.Equal(first.Expires) || string(queued[0].Origin) != "0102" || queued[0].Data[0] != 1 || queued[0].LinkID != 5 ||
+			string(queued[0].Metadata) != string(first.Metadata) || queued[1].Metadata != nil {
+			t.Errorf("%v: GetQueuedMessages()[0] = %+v, want %+v", backend, queued[0], first)
+		}
+		if ids, err := store.GetPendingDestinations(); err != nil || len(ids) != 2 || ids[0] != 3 || ids[1] != 4 {
+			t.Errorf("%v: GetPendingDestinations() = %v, %v, want [3 4]", backend, ids, err)
+		}
+
+		//Failed attempt, then dead-lettered
+		first.Attempts = 2
+		first.NextAttempt = now.Add(time.Minute)
+		first.LastError = "unreachable"
+		first.Dead = true
+		if err := store.UpdateQueuedMessage(&first); err != nil {
+			t.Fatalf("%v: UpdateQueuedMessage() error = %v", backend, err)
+		}
+		dead, err := store.GetDeadLetters()
+		if err != nil || len(dead) != 1 || dead[0].ID != first.ID || dead[0].Attempts != 2 || dead[0].LastError != "unreachable" || !dead[0].NextAttempt.Equal(first.NextAttempt) {
+			t.Errorf("%v: GetDeadLetters() = %+v, %v, want %+v", backend, dead, err, first)
+		}
+		if queued, _ := store.GetQueuedMessages(3); len(queued) != 1 || queued[0].ID != second.ID {
+			t.Errorf("%v: GetQueuedMessages() after dead-letter = %v, want only %v", backend, queued, second.ID)
+		}
+		//Taken by an interface
+		second.InFlight = true
+		if err := store.UpdateQueuedMessage(&second); err != nil {
+			t.Fatalf("%v: UpdateQueuedMessage() error = %v", backend, err)
+		}
+		if queued, _ := store.GetQueuedMessages(3); len(queued) != 1 || !queued[0].InFlight {
+			t.Errorf("%v: GetQueuedMessages() after in flight = %+v, want %v in flight", backend, queued, second.ID)
+		}
+
+		if err := store.DeleteQueuedMessage(other.ID); err != nil {
+			t.Errorf("%v: DeleteQueuedMessage() error = %v", backend, err)
+		}
+		if got, err := store.GetQueuedMessage(other.ID); err != nil || got.ID != 0 {
+			t.Errorf("%v: GetQueuedMessage() after delete = %v, %v", backend, got, err)
+		}
+		if got, err := store.GetQueuedMessage(second.ID); err != nil || got.ID != second.ID {
+			t.Errorf("%v: GetQueuedMessage() = %v, %v, want %v", backend, got, err, second.ID)
+		}
+	}
+}
+
+func TestDeviceKeys(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for backend, store := range stores {
+		if k, err := store.GetDeviceKeys(1); err != nil || k.NodeID != 0 {
+			t.Fatalf("%v: GetDeviceKeys() of unknown node = %+v, %v", backend, k, err)
+		}
+		keys := DeviceKeys{NodeID: 1, AppKey: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}}
+		if err := store.SetDeviceKeys(&keys); err != nil {
+			t.Fatalf("%v: SetDeviceKeys() error = %v", backend, err)
+		}
+
+		//Joined, the session replaces the previous one
+		keys.DevAddr = []byte{1, 2, 3, 4}
+		keys.NwkSKey = []byte{2}
+		keys.AppSKey = []byte{3}
+		keys.DevNonces = []uint16{1, 0xabcd}
+		keys.FCntUp = 0x80000001
+		if err := store.SetDeviceKeys(&keys); err != nil {
+			t.Fatalf("%v: SetDeviceKeys() error = %v", backend, err)
+		}
+		got, err := store.GetDeviceKeys(1)
+		if err != nil || got.NodeID != 1 || len(got.AppKey) != 16 || len(got.AppEUI) != 0 || string(got.DevAddr) != "\x01\x02\x03\x04" ||
+			len(got.DevNonces) != 2 || got.DevNonces[1] != 0xabcd || got.FCntUp != keys.FCntUp {
+			t.Errorf("%v: GetDeviceKeys() = %+v, %v, want %+v", backend, got, err, keys)
+		}
+
+		if err := store.DeleteDeviceKeys(1); err != nil {
+			t.Errorf("%v: DeleteDeviceKeys() error = %v", backend, err)
+		}
+		if k, err := store.GetDeviceKeys(1); err != nil || k.NodeID != 0 {
+			t.Errorf("%v: GetDeviceKeys() after delete = %+v, %v", backend, k, err)
+		}
+	}
+}
+
+func TestNodeErrors(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for backend, store := range stores {
+		node := Node{DevID: "0102030405060708", PlatformID: 1, InfType: 1}
+		other := Node{DevID: "0102030405060709", PlatformID: 1, InfType: 1}
+		for _, n := range []*Node{&node, &other} {
+			if err := store.InsertNode(n); err != nil {
+				t.Fatalf("%v: InsertNode() error = %v", backend, err)
+			}
+		}
+		start := time.Now().Truncate(time.Millisecond)
+		for i := 0; i < 5; i++ {
+			e := NodeError{NodeID: node.ID, PlatformID: 1, Type: "DATA_UP_MIC", Message: fmt.Sprint(i), Time: start.Add(time.Duration(i) * time.Second)}
+			if err := store.InsertNodeError(&e, 3); err != nil || e.ID == 0 {
+				t.Fatalf("%v: InsertNodeError() = %v, id %v", backend, err, e.ID)
+			}
+		}
+		if err := store.InsertNodeError(&NodeError{NodeID: other.ID, PlatformID: 1, Type: "OTAA", Time: start}, 3); err != nil {
+			t.Fatalf("%v: InsertNodeError() error = %v", backend, err)
+		}
+
+		//Only the last errors of a node are kept
+		errs, err := store.GetNodeErrors(node.ID)
+		if err != nil || len(errs) != 3 || errs[0].Message != "2" || errs[2].Message != "4" || !errs[2].Time.Equal(start.Add(4*time.Second)) {
+			t.Errorf("%v: GetNodeErrors() = %+v, %v, want errors 2 to 4", backend, errs, err)
+		}
+		if errs, err := store.GetNodeErrors(0); err != nil || len(errs) != 4 || errs[0].Type != "OTAA" {
+			t.Errorf("%v: GetNodeErrors(0) = %+v, %v, want the errors of both nodes, oldest first", backend, errs, err)
+		}
+
+		//They go with the node
+		if err := store.DeleteNode(node.ID); err != nil {
+			t.Fatalf("%v: DeleteNode() error = %v", backend, err)
+		}
+		if errs, err := store.GetNodeErrors(0); err != nil || len(errs) != 1 || errs[0].NodeID != other.ID {
+			t.Errorf("%v: GetNodeErrors(0) after DeleteNode() = %+v, %v", backend, errs, err)
+		}
+	}
+}
@@ -0,0 +1,531 @@
+package dbconnection
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+//memoryStore Store keeping everything in memory, lost on exit
+type memoryStore struct {
+	mutex     sync.Mutex
+	lastID    int
+	platforms map[int]Platform
+	nodes     map[int]Node
+	links     map[int]Link
+	certs     map[string]Certificate
+	queue     map[int]QueuedMessage
+	keys      map[int]DeviceKeys
+	errors    map[int][]NodeError
+}
+
+//NewMemoryStore Create an empty in-memory store
+func NewMemoryStore() Store {
+	return &memoryStore{
+		platforms: make(map[int]Platform),
+		nodes:     make(map[int]Node),
+		links:     make(map[int]Link),
+		certs:     make(map[string]Certificate),
+		queue:     make(map[int]QueuedMessage),
+		keys:      make(map[int]DeviceKeys),
+		errors:    make(map[int][]NodeError),
+	}
+}
+
+func (m *memoryStore) nextID() int {
+	m.lastID++
+	return m.lastID
+}
+
+//Close Nothing to release
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+//InsertPlatform Insert a new platform
+func (m *memoryStore) InsertPlatform(pl *Platform) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, p := range m.platforms {
+		if p.Address == pl.Address {
+			return fmt.Errorf("dbconnection: duplicate platform address: %v", pl.Address)
+		}
+	}
+	pl.ID = m.nextID()
+	m.platforms[pl.ID] = copyPlatform(*pl)
+	return nil
+}
+
+//UpdatePlatform Update a platform
+func (m *memoryStore) UpdatePlatform(pl *Platform) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.platforms[pl.ID]; !ok {
+		return fmt.Errorf("dbconnection: unknown platform: %v", pl.ID)
+	}
+	for id, p := range m.platforms {
+		if id != pl.ID && p.Address == pl.Address {
+			return fmt.Errorf("dbconnection: duplicate platform address: %v", pl.Address)
+		}
+	}
+	m.platforms[pl.ID] = copyPlatform(*pl)
+	return nil
+}
+
+//GetPlatform Retrieve platform via platform id, an empty platform if unknown
+func (m *memoryStore) GetPlatform(id int) (*Platform, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	pl := copyPlatform(m.platforms[id])
+	return &pl, nil
+}
+
+//GetPlatforms Retrieve all platforms
+func (m *memoryStore) GetPlatforms() ([]Platform, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var platforms []Platform
+	for id := 1; id <= m.lastID; id++ {
+		if pl, ok := m.platforms[id]; ok {
+			platforms = append(platforms, copyPlatform(pl))
+		}
+	}
+	return platforms, nil
+}
+
+//DeletePlatform Delete platform via platform id
+func (m *memoryStore) DeletePlatform(id int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.platforms, id)
+	return nil
+}
+
+//InsertNode Insert a node
+func (m *memoryStore) InsertNode(n *Node) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, node := range m.nodes {
+		if node.DevID == n.DevID {
+			return fmt.Errorf("dbconnection: duplicate node devid: %v", n.DevID)
+		}
+	}
+	n.ID = m.nextID()
+	m.nodes[n.ID] = copyNode(*n)
+	return nil
+}
+
+//UpdateNode Update a node
+func (m *memoryStore) UpdateNode(n *Node) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.nodes[n.ID]; !ok {
+		return fmt.Errorf("dbconnection: unknown node: %v", n.ID)
+	}
+	for id, node := range m.nodes {
+		if id != n.ID && node.DevID == n.DevID {
+			return fmt.Errorf("dbconnection: duplicate node devid: %v", n.DevID)
+		}
+	}
+	m.nodes[n.ID] = copyNode(*n)
+	return nil
+}
+
+//DeleteNode Delete node via id
+func (m *memoryStore) DeleteNode(id int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.nodes, id)
+	delete(m.errors, id)
+	return nil
+}
+
+//FindNode Retrieve node via device identifier, an empty node if unknown
+func (m *memoryStore) FindNode(devID []byte) (*Node, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id := 1; id <= m.lastID; id++ {
+		if node, ok := m.nodes[id]; ok && node.DevID == string(devID) {
+			node = copyNode(node)
+			return &node, nil
+		}
+	}
+	return &Node{}, nil
+}
+
+//FindAvailableProviderNode Locate a provider node of the type not yet linked with the requesting node
+func (m *memoryStore) FindAvailableProviderNode(infType int, reqNodeID int) (*Node, error) {
+	nodes, err := m.FindAvailableProviderNodes(infType, reqNodeID)
+	if err != nil || len(nodes) == 0 {
+		return &Node{}, err
+	}
+	return &nodes[0], nil
+}
+
+//FindAvailableProviderNodes Locate all provider nodes of the type not yet linked with the requesting node
+func (m *memoryStore) FindAvailableProviderNodes(infType int, reqNodeID int) ([]Node, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	linked := make(map[int]bool)
+	for _, l := range m.links {
+		if l.ReqNode == reqNodeID {
+			linked[l.ProvNode] = true
+		}
+	}
+	var nodes []Node
+	for id := 1; id <= m.lastID; id++ {
+		//A node is never linked with itself
+		if node, ok := m.nodes[id]; ok && node.IsProvider && node.InfType == infType && !linked[id] && id != reqNodeID {
+			nodes = append(nodes, copyNode(node))
+		}
+	}
+	return nodes, nil
+}
+
+//GetNode Retrieve node via node id, an empty node if unknown
+func (m *memoryStore) GetNode(id int) (*Node, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node := copyNode(m.nodes[id])
+	return &node, nil
+}
+
+//GetNodes Retrieve all nodes
+func (m *memoryStore) GetNodes() ([]Node, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var nodes []Node
+	for id := 1; id <= m.lastID; id++ {
+		if node, ok := m.nodes[id]; ok {
+			nodes = append(nodes, copyNode(node))
+		}
+	}
+	return nodes, nil
+}
+
+//InsertLink Insert a link
+func (m *memoryStore) InsertLink(l *Link) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, link := range m.links {
+		if link.ProvNode == l.ProvNode && link.ReqNode == l.ReqNode {
+			return fmt.Errorf("dbconnection: duplicate link: %v -> %v", l.ProvNode, l.ReqNode)
+		}
+	}
+	l.ID = m.nextID()
+	m.links[l.ID] = copyLink(*l)
+	return nil
+}
+
+//UpdateLink Update a link
+func (m *memoryStore) UpdateLink(l *Link) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.links[l.ID]; !ok {
+		return fmt.Errorf("dbconnection: unknown link: %v", l.ID)
+	}
+	for id, link := range m.links {
+		if id != l.ID && link.ProvNode == l.ProvNode && link.ReqNode == l.ReqNode {
+			return fmt.Errorf("dbconnection: duplicate link: %v -> %v", l.ProvNode, l.ReqNode)
+		}
+	}
+	m.links[l.ID] = copyLink(*l)
+	return nil
+}
+
+//GetLinks Retrieve all links
+func (m *memoryStore) GetLinks() ([]Link, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var links []Link
+	for id := 1; id <= m.lastID; id++ {
+		if l, ok := m.links[id]; ok {
+			links = append(links, copyLink(l))
+		}
+	}
+	return links, nil
+}
+
+//GetLinksOfNode Retrieve all links in which the node takes part, either as provider or requester
+func (m *memoryStore) GetLinksOfNode(nodeID int) ([]Link, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var links []Link
+	for id := 1; id <= m.lastID; id++ {
+		if l, ok := m.links[id]; ok && (l.ProvNode == nodeID || l.ReqNode == nodeID) {
+			links = append(links, copyLink(l))
+		}
+	}
+	return links, nil
+}
+
+//DeleteLink Delete link via id
+func (m *memoryStore) DeleteLink(id int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.links, id)
+	return nil
+}
+
+//InsertCertificate Record a certificate issued to a platform
+func (m *memoryStore) InsertCertificate(c *Certificate) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.certs[c.Serial]; ok {
+		return fmt.Errorf("dbconnection: duplicate certificate serial: %v", c.Serial)
+	}
+	m.certs[c.Serial] = *c
+	return nil
+}
+
+//GetCertificate Retrieve certificate via serial, an empty certificate if unknown
+func (m *memoryStore) GetCertificate(serial string) (*Certificate, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	c := m.certs[serial]
+	return &c, nil
+}
+
+//GetCertificates Retrieve all issued certificates
+func (m *memoryStore) GetCertificates() ([]Certificate, error) {
+	return m.findCertificates(func(c Certificate) bool { return true }), nil
+}
+
+//GetCertificatesOfPlatform Retrieve the certificates issued to a platform
+func (m *memoryStore) GetCertificatesOfPlatform(platformID int) ([]Certificate, error) {
+	return m.findCertificates(func(c Certificate) bool { return c.PlatformID == platformID }), nil
+}
+
+//findCertificates Certificates matching, by platform and expiry as the SQL backends
+func (m *memoryStore) findCertificates(match func(c Certificate) bool) []Certificate {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var certs []Certificate
+	for _, c := range m.certs {
+		if match(c) {
+			certs = append(certs, c)
+		}
+	}
+	sort.Slice(certs, func(i, j int) bool {
+		if certs[i].PlatformID != certs[j].PlatformID {
+			return certs[i].PlatformID < certs[j].PlatformID
+		}
+		return certs[i].NotAfter.Before(certs[j].NotAfter)
+	})
+	return certs
+}
+
+//RevokeCertificate Mark certificate as revoked
+func (m *memoryStore) RevokeCertificate(serial string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	c, ok := m.certs[serial]
+	if !ok {
+		return fmt.Errorf("dbconnection: unknown certificate: %v", serial)
+	}
+	c.Revoked = true
+	m.certs[serial] = c
+	return nil
+}
+
+//EnqueueMessage Persist a message for its destination
+func (m *memoryStore) EnqueueMessage(msg *QueuedMessage) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	msg.ID = m.nextID()
+	m.queue[msg.ID] = copyQueuedMessage(*msg)
+	return nil
+}
+
+//UpdateQueuedMessage Store the delivery state of a message
+func (m *memoryStore) UpdateQueuedMessage(msg *QueuedMessage) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	old, ok := m.queue[msg.ID]
+	if !ok {
+		return fmt.Errorf("dbconnection: unknown queued message: %v", msg.ID)
+	}
+	old.Expires = msg.Expires
+	old.Attempts = msg.Attempts
+	old.NextAttempt = msg.NextAttempt
+	old.LastError = msg.LastError
+	old.Dead = msg.Dead
+	old.InFlight = msg.InFlight
+	m.queue[msg.ID] = old
+	return nil
+}
+
+//DeleteQueuedMessage Remove a delivered or purged message
+func (m *memoryStore) DeleteQueuedMessage(id int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.queue, id)
+	return nil
+}
+
+//GetQueuedMessage Retrieve message via id, an empty message if unknown
+func (m *memoryStore) GetQueuedMessage(id int) (*QueuedMessage, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	msg := copyQueuedMessage(m.queue[id])
+	return &msg, nil
+}
+
+//GetQueuedMessages Pending messages of a destination, oldest first
+func (m *memoryStore) GetQueuedMessages(nodeID int) ([]QueuedMessage, error) {
+	return m.findQueuedMessages(func(msg QueuedMessage) bool { return msg.NodeID == nodeID && !msg.Dead }), nil
+}
+
+//GetPendingDestinations Destinations with pending messages
+func (m *memoryStore) GetPendingDestinations() ([]int, error) {
+	seen := make(map[int]bool)
+	var ids []int
+	for _, msg := range m.findQueuedMessages(func(msg QueuedMessage) bool { return !msg.Dead }) {
+		if !seen[msg.NodeID] {
+			seen[msg.NodeID] = true
+			ids = append(ids, msg.NodeID)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+//GetDeadLetters Retrieve the dead-lettered messages, oldest first
+func (m *memoryStore) GetDeadLetters() ([]QueuedMessage, error) {
+	return m.findQueuedMessages(func(msg QueuedMessage) bool { return msg.Dead }), nil
+}
+
+//findQueuedMessages Messages matching, in order of id
+func (m *memoryStore) findQueuedMessages(match func(msg QueuedMessage) bool) []QueuedMessage {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var messages []QueuedMessage
+	for id := 1; id <= m.lastID; id++ {
+		if msg, ok := m.queue[id]; ok && match(msg) {
+			messages = append(messages, copyQueuedMessage(msg))
+		}
+	}
+	return messages
+}
+
+//SetDeviceKeys Insert or replace the keys of a node
+func (m *memoryStore) SetDeviceKeys(k *DeviceKeys) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.keys[k.NodeID] = copyDeviceKeys(*k)
+	return nil
+}
+
+//GetDeviceKeys Retrieve the keys of a node, empty keys if it has none
+func (m *memoryStore) GetDeviceKeys(nodeID int) (*DeviceKeys, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	k := copyDeviceKeys(m.keys[nodeID])
+	return &k, nil
+}
+
+//DeleteDeviceKeys Delete the keys of a node
+func (m *memoryStore) DeleteDeviceKeys(nodeID int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.keys, nodeID)
+	return nil
+}
+
+//InsertNodeError Insert an error of a node, keeping only the last keep errors of that node
+func (m *memoryStore) InsertNodeError(e *NodeError, keep int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e.ID = m.nextID()
+	errs := append(m.errors[e.NodeID], *e)
+	if len(errs) > keep {
+		errs = append([]NodeError(nil), errs[len(errs)-keep:]...)
+	}
+	m.errors[e.NodeID] = errs
+	return nil
+}
+
+//GetNodeErrors Errors of a node, or of all nodes when 0, oldest first
+func (m *memoryStore) GetNodeErrors(nodeID int) ([]NodeError, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var errs []NodeError
+	for id, e := range m.errors {
+		if nodeID == 0 || id == nodeID {
+			errs = append(errs, e...)
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		if !errs[i].Time.Equal(errs[j].Time) {
+			return errs[i].Time.Before(errs[j].Time)
+		}
+		return errs[i].ID < errs[j].ID
+	})
+	return errs, nil
+}
+
+//copyPlatform Copy not sharing the ciargs with the caller, as the SQL backends
+func copyPlatform(pl Platform) Platform {
+	pl.CIArgs = copyCIArgs(pl.CIArgs)
+	return pl
+}
+
+//copyNode Copy not sharing the ciargs with the caller, as the SQL backends
+func copyNode(n Node) Node {
+	n.CIArgs = copyCIArgs(n.CIArgs)
+	return n
+}
+
+//copyLink Copy not sharing the ciargs with the caller, as the SQL backends
+func copyLink(l Link) Link {
+	l.CIArgs = copyCIArgs(l.CIArgs)
+	return l
+}
+
+//copyCIArgs Deep copy of decoded JSON arguments, nil stays nil
+func copyCIArgs(args map[string]interface{}) map[string]interface{} {
+	if args == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(args))
+	for k, v := range args {
+		c[k] = copyJSONValue(v)
+	}
+	return c
+}
+
+//copyJSONValue Deep copy of a decoded JSON value
+func copyJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return copyCIArgs(v)
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i := range v {
+			c[i] = copyJSONValue(v[i])
+		}
+		return c
+	}
+	return v
+}
+
+//copyDeviceKeys Copy not sharing the keys and nonces with the caller, as the SQL backends
+func copyDeviceKeys(k DeviceKeys) DeviceKeys {
+	k.AppEUI = append([]byte(nil), k.AppEUI...)
+	k.AppKey = append([]byte(nil), k.AppKey...)
+	k.DevAddr = append([]byte(nil), k.DevAddr...)
+	k.NwkSKey = append([]byte(nil), k.NwkSKey...)
+	k.AppSKey = append([]byte(nil), k.AppSKey...)
+	k.DevNonces = append([]uint16(nil), k.DevNonces...)
+	return k
+}
+
+//copyQueuedMessage Copy not sharing the byte slices with the caller, as the SQL backends
+func copyQueuedMessage(msg QueuedMessage) QueuedMessage {
+	msg.Origin = append([]byte(nil), msg.Origin...)
+	msg.Data = append([]byte(nil), msg.Data...)
+	if msg.Metadata != nil {
+		msg.Metadata = append([]byte(nil), msg.Metadata...)
+	}
+	return msg
+}
@@ -0,0 +1,371 @@
+package dbconnection
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+)
+
+//ErrSchemaTooNew The database was migrated by a newer binary, refusing to use it
+var ErrSchemaTooNew = errors.New("dbconnection: database schema is newer than supported by this binary")
+
+//Migrator Store with a versioned schema
+type Migrator interface {
+	//SchemaVersion Version of the last applied migration, 0 for an empty database
+	SchemaVersion() (int, error)
+	//Migrate Apply all pending migrations, returns the resulting version
+	Migrate() (int, error)
+}
+
+//migration Schema change per SQL dialect, applied in order of version
+type migration struct {
+	version     int
+	description string
+	mysql       []string
+	sqlite      []string
+}
+
+//LatestSchemaVersion Schema version created by Migrate
+var LatestSchemaVersion = migrations[len(migrations)-1].version
+
+//migrations All schema changes, append new versions at the end, never edit an applied one. MySQL statements must be
+//safe to rerun: CREATE ... IF NOT EXISTS, MODIFY of a column, or ADD of a column or index, which fails as already
+//applied.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "platform, node and link tables",
+		mysql: []string{
+			`CREATE TABLE IF NOT EXISTS platform (
+				id int(11) NOT NULL AUTO_INCREMENT,
+				address varchar(50) NOT NULL,
+				tlscert varchar(50) DEFAULT NULL,
+				tlskey varchar(50) DEFAULT NULL,
+				ciargs text,
+				citype int(11) NOT NULL,
+				PRIMARY KEY (id),
+				UNIQUE KEY address (address)
+			) ENGINE=InnoDB DEFAULT CHARSET=latin1`,
+			`CREATE TABLE IF NOT EXISTS node (
+				id int(11) NOT NULL AUTO_INCREMENT,
+				devid varchar(50) NOT NULL,
+				platformid int(11) NOT NULL,
+				isprovider tinyint(1) NOT NULL,
+				inftype int(11) NOT NULL,
+				PRIMARY KEY (id),
+				UNIQUE KEY devid (devid)
+			) ENGINE=InnoDB DEFAULT CHARSET=latin1`,
+			`CREATE TABLE IF NOT EXISTS link (
+				id int(11) NOT NULL AUTO_INCREMENT,
+				provnode int(11) NOT NULL,
+				reqnode int(11) NOT NULL,
+				PRIMARY KEY (id),
+				KEY provnode (provnode),
+				KEY reqnode (reqnode)
+			) ENGINE=InnoDB DEFAULT CHARSET=latin1`,
+		},
+		sqlite: []string{
+			`CREATE TABLE IF NOT EXISTS platform (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				address VARCHAR(50) NOT NULL UNIQUE,
+				tlscert VARCHAR(50) DEFAULT NULL,
+				tlskey VARCHAR(50) DEFAULT NULL,
+				ciargs TEXT,
+				citype INTEGER NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS node (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				devid VARCHAR(50) NOT NULL UNIQUE,
+				platformid INTEGER NOT NULL,
+				isprovider BOOLEAN NOT NULL,
+				inftype INTEGER NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS link (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				provnode INTEGER NOT NULL,
+				reqnode INTEGER NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS link_provnode ON link (provnode)`,
+			`CREATE INDEX IF NOT EXISTS link_reqnode ON link (reqnode)`,
+		},
+	},
+	{
+		version:     2,
+		description: "multiple links per node, unique per provider and requester pair",
+		mysql: []string{
+			`ALTER TABLE link ADD UNIQUE KEY provreq (provnode, reqnode)`,
+		},
+		sqlite: []string{
+			`CREATE UNIQUE INDEX IF NOT EXISTS link_provreq ON link (provnode, reqnode)`,
+		},
+	},
+	{
+		version:     3,
+		description: "certificate identity of a platform",
+		mysql: []string{
+			`ALTER TABLE platform ADD identity varchar(255) NOT NULL DEFAULT ''`,
+		},
+		sqlite: []string{
+			`ALTER TABLE platform ADD COLUMN identity VARCHAR(255) NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version:     4,
+		description: "per platform TLS credentials",
+		mysql: []string{
+			`ALTER TABLE platform MODIFY tlscert varchar(255) DEFAULT NULL, MODIFY tlskey varchar(255) DEFAULT NULL`,
+			`ALTER TABLE platform ADD tlscacert varchar(255) DEFAULT NULL, ADD tlsservername varchar(255) DEFAULT NULL`,
+		},
+		sqlite: []string{
+			`ALTER TABLE platform ADD COLUMN tlscacert VARCHAR(255) DEFAULT NULL`,
+			`ALTER TABLE platform ADD COLUMN tlsservername VARCHAR(255) DEFAULT NULL`,
+		},
+	},
+	{
+		version:     5,
+		description: "certificates issued to platforms by the fog CA",
+		mysql: []string{
+			`CREATE TABLE IF NOT EXISTS certificate (
+				serial varchar(64) NOT NULL,
+				platformid int(11) NOT NULL,
+				commonname varchar(255) NOT NULL,
+				notafter bigint NOT NULL,
+				revoked tinyint(1) NOT NULL DEFAULT 0,
+				PRIMARY KEY (serial),
+				KEY platformid (platformid)
+			) ENGINE=InnoDB DEFAULT CHARSET=latin1`,
+		},
+		sqlite: []string{
+			`CREATE TABLE IF NOT EXISTS certificate (
+				serial VARCHAR(64) NOT NULL PRIMARY KEY,
+				platformid INTEGER NOT NULL,
+				commonname VARCHAR(255) NOT NULL,
+				notafter INTEGER NOT NULL,
+				revoked BOOLEAN NOT NULL DEFAULT 0
+			)`,
+			`CREATE INDEX IF NOT EXISTS certificate_platformid ON certificate (platformid)`,
+		},
+	},
+	{
+		version:     6,
+		description: "downlink queue and dead letters, times in milliseconds",
+		mysql: []string{
+			`CREATE TABLE IF NOT EXISTS message_queue (
+				id int(11) NOT NULL AUTO_INCREMENT,
+				nodeid int(11) NOT NULL,
+				origin varbinary(255) NOT NULL,
+				citype int(11) NOT NULL,
+				data blob NOT NULL,
+				received bigint NOT NULL,
+				expires bigint NOT NULL,
+				attempts int(11) NOT NULL DEFAULT 0,
+				nextattempt bigint NOT NULL,
+				lasterror text,
+				dead tinyint(1) NOT NULL DEFAULT 0,
+				PRIMARY KEY (id),
+				KEY nodedead (nodeid, dead)
+			) ENGINE=InnoDB DEFAULT CHARSET=latin1`,
+		},
+		sqlite: []string{
+			`CREATE TABLE IF NOT EXISTS message_queue (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				nodeid INTEGER NOT NULL,
+				origin BLOB NOT NULL,
+				citype INTEGER NOT NULL,
+				data BLOB NOT NULL,
+				received INTEGER NOT NULL,
+				expires INTEGER NOT NULL,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				nextattempt INTEGER NOT NULL,
+				lasterror TEXT,
+				dead BOOLEAN NOT NULL DEFAULT 0
+			)`,
+			`CREATE INDEX IF NOT EXISTS message_queue_nodedead ON message_queue (nodeid, dead)`,
+		},
+	},
+	{
+		version:     7,
+		description: "ciargs of nodes and links, link of queued messages",
+		mysql: []string{
+			`ALTER TABLE node ADD ciargs text`,
+			`ALTER TABLE link ADD ciargs text`,
+			`ALTER TABLE message_queue ADD linkid int(11) NOT NULL DEFAULT 0`,
+		},
+		sqlite: []string{
+			`ALTER TABLE node ADD COLUMN ciargs TEXT`,
+			`ALTER TABLE link ADD COLUMN ciargs TEXT`,
+			`ALTER TABLE message_queue ADD COLUMN linkid INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version:     8,
+		description: "OTAA keys and sessions of LoRaWAN nodes",
+		mysql: []string{
+			`CREATE TABLE IF NOT EXISTS lorawan_device (
+				nodeid int(11) NOT NULL,
+				appeui varbinary(8) NOT NULL,
+				appkey varbinary(16) NOT NULL,
+				devaddr varbinary(4) NOT NULL,
+				nwkskey varbinary(16) NOT NULL,
+				appskey varbinary(16) NOT NULL,
+				devnonces blob NOT NULL,
+				PRIMARY KEY (nodeid)
+			) ENGINE=InnoDB DEFAULT CHARSET=latin1`,
+		},
+		sqlite: []string{
+			`CREATE TABLE IF NOT EXISTS lorawan_device (
+				nodeid INTEGER NOT NULL PRIMARY KEY,
+				appeui BLOB NOT NULL,
+				appkey BLOB NOT NULL,
+				devaddr BLOB NOT NULL,
+				nwkskey BLOB NOT NULL,
+				appskey BLOB NOT NULL,
+				devnonces BLOB NOT NULL
+			)`,
+		},
+	},
+	{
+		version:     9,
+		description: "uplink frame counter of LoRaWAN sessions",
+		mysql: []string{
+			`ALTER TABLE lorawan_device ADD fcntup int(10) unsigned NOT NULL DEFAULT 0`,
+		},
+		sqlite: []string{
+			`ALTER TABLE lorawan_device ADD COLUMN fcntup INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version:     10,
+		description: "metadata of queued messages",
+		mysql: []string{
+			`ALTER TABLE message_queue ADD metadata text`,
+		},
+		sqlite: []string{
+			`ALTER TABLE message_queue ADD COLUMN metadata TEXT`,
+		},
+	},
+	{
+		version:     11,
+		description: "queued messages in flight in an interface",
+		mysql: []string{
+			`ALTER TABLE message_queue ADD inflight tinyint(1) NOT NULL DEFAULT 0`,
+		},
+		sqlite: []string{
+			`ALTER TABLE message_queue ADD COLUMN inflight BOOLEAN NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version:     12,
+		description: "network server errors of nodes, times in milliseconds",
+		mysql: []string{
+			`CREATE TABLE IF NOT EXISTS node_error (
+				id int(11) NOT NULL AUTO_INCREMENT,
+				nodeid int(11) NOT NULL,
+				platformid int(11) NOT NULL,
+				type varchar(64) NOT NULL,
+				message text,
+				time bigint NOT NULL,
+				PRIMARY KEY (id),
+				KEY nodeid (nodeid)
+			) ENGINE=InnoDB DEFAULT CHARSET=latin1`,
+		},
+		sqlite: []string{
+			`CREATE TABLE IF NOT EXISTS node_error (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				nodeid INTEGER NOT NULL,
+				platformid INTEGER NOT NULL,
+				type VARCHAR(64) NOT NULL,
+				message TEXT,
+				time INTEGER NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS node_error_nodeid ON node_error (nodeid)`,
+		},
+	},
+}
+
+//createVersionTable Table recording the applied migrations, portable between dialects
+const createVersionTable = `CREATE TABLE IF NOT EXISTS schema_migration (
+	version INTEGER NOT NULL PRIMARY KEY,
+	description VARCHAR(255) NOT NULL,
+	applied TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+//SchemaVersion Version of the last applied migration, 0 for an empty database
+func (s *sqlStore) SchemaVersion() (int, error) {
+	if _, err := s.db.Exec(createVersionTable); err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	if err := s.db.QueryRow("SELECT MAX(version) FROM schema_migration").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+//Migrate Apply all pending migrations, returns the resulting version
+func (s *sqlStore) Migrate() (int, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return version, err
+	}
+	if version > LatestSchemaVersion {
+		return version, ErrSchemaTooNew
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		statements := m.mysql
+		if s.driver == DriverSQLite {
+			statements = m.sqlite
+		}
+
+		//Only SQLite rolls back DDL, on MySQL every statement is committed when executed. Statements of a migration
+		//that failed halfway are skipped when it is retried, all are idempotent or fail as already applied.
+		tx, err := s.db.Begin()
+		if err != nil {
+			return version, err
+		}
+		for _, query := range statements {
+			if _, err := tx.Exec(query); err != nil {
+				if s.driver == DriverMySQL && mysqlAlreadyApplied(err) {
+					log.Printf("dbconnection: migration %v: skipping applied statement: %v\n", m.version, err)
+					continue
+				}
+				tx.Rollback()
+				return version, fmt.Errorf("dbconnection: migration %v failed: %v", m.version, err)
+			}
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migration (version, description) VALUES (?, ?)", m.version, m.description); err != nil {
+			tx.Rollback()
+			return version, err
+		}
+		if err := tx.Commit(); err != nil {
+			return version, err
+		}
+		version = m.version
+		log.Printf("dbconnection: applied migration %v: %v\n", m.version, m.description)
+	}
+	return version, nil
+}
+
+//checkSchema Migrate or verify the schema when opening a store
+func (s *sqlStore) checkSchema(migrate bool) error {
+	if migrate {
+		_, err := s.Migrate()
+		return err
+	}
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > LatestSchemaVersion {
+		return ErrSchemaTooNew
+	}
+	if version < LatestSchemaVersion {
+		log.Printf("dbconnection: schema version %v is behind %v, run migrate\n", version, LatestSchemaVersion)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package dbconnection
+
+import (
+	"errors"
+
+	"github.com/go-sql-driver/mysql" //Driver mysql
+)
+
+const (
+	mysqlSource string = "hecomm:hecomm@tcp(localhost:3306)/hecomm?charset=utf8"
+
+	//mysqlDuplicateColumn, mysqlDuplicateKey The column or index being added already exists
+	mysqlDuplicateColumn = 1060
+	mysqlDuplicateKey    = 1061
+)
+
+//NewMySQLStore Store on a MySQL server, the database itself is expected to be present
+func NewMySQLStore(config Config) (Store, error) {
+	config.Driver = DriverMySQL
+	if config.Source == "" {
+		config.Source = mysqlSource
+	}
+	return openSQLStore(config)
+}
+
+//mysqlAlreadyApplied Whether err reports that a schema change was already made. MySQL commits every DDL statement
+//on its own, a migration failing halfway leaves its first statements applied and rerunning them fails with this error.
+func mysqlAlreadyApplied(err error) bool {
+	var myErr *mysql.MySQLError
+	if !errors.As(err, &myErr) {
+		return false
+	}
+	return myErr.Number == mysqlDuplicateColumn || myErr.Number == mysqlDuplicateKey
+}
@@ -0,0 +1,21 @@
+package dbconnection
+
+import (
+	_ "github.com/mattn/go-sqlite3" //Driver sqlite3, requires cgo
+)
+
+const (
+	sqliteSource string = "hecomm.db"
+)
+
+//NewSQLiteStore Store in an embedded SQLite database file, created if not present
+func NewSQLiteStore(config Config) (Store, error) {
+	config.Driver = DriverSQLite
+	if config.Source == "" {
+		config.Source = sqliteSource
+	}
+	//SQLite serializes writers, a single connection avoids "database is locked"
+	config.MaxOpenConns = 1
+	config.MaxIdleConns = 1
+	return openSQLStore(config)
+}
@@ -0,0 +1,760 @@
+package dbconnection
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+//sqlStore Store backed by a database/sql connection pool, shared by the MySQL and SQLite backends
+type sqlStore struct {
+	driver string
+	db     *sql.DB
+	mutex  sync.Mutex
+	stmts  map[string]*sql.Stmt
+}
+
+//openSQLStore Open the connection pool described by config and check its schema
+func openSQLStore(config Config) (*sqlStore, error) {
+	db, err := sql.Open(config.Driver, config.Source)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &sqlStore{driver: config.Driver, db: db, stmts: make(map[string]*sql.Stmt)}
+	if err := s.checkSchema(config.Migrate); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+//prepare Retrieve the prepared statement of query, prepared once and reused afterwards
+func (s *sqlStore) prepare(query string) (*sql.Stmt, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if stmt, ok := s.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	s.stmts[query] = stmt
+	return stmt, nil
+}
+
+//Close Release the prepared statements and the connection pool
+func (s *sqlStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for query, stmt := range s.stmts {
+		stmt.Close()
+		delete(s.stmts, query)
+	}
+	return s.db.Close()
+}
+
+//InsertPlatform Insert a new platform in the database
+func (s *sqlStore) InsertPlatform(pl *Platform) error {
+	//Prepare insert query
+	stmt, err := s.prepare("INSERT INTO platform (address, citype, tlscert, tlskey, tlscacert, tlsservername, ciargs, identity) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	ciargs, err := marshalCIArgs(pl.CIArgs)
+	if err != nil {
+		return err
+	}
+
+	//Execute insert
+	res, err := stmt.Exec(pl.Address, pl.CIType, pl.TLSCert, pl.TLSKey, pl.TLSCaCert, pl.TLSServerName, ciargs, pl.Identity)
+	if err != nil {
+		return err
+	}
+
+	//Check response for confirmation insertion
+	i, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	pl.ID = int(i)
+	log.Printf("Inserted platform: Address: %v, citype: %v, id: %v, tlscert: %v, tlskey: %v", pl.Address, pl.CIType, pl.ID, pl.TLSCert, pl.TLSKey)
+	return nil
+
+}
+
+//UpdatePlatform Update a platform row in the database
+func (s *sqlStore) UpdatePlatform(pl *Platform) error {
+	stmt, err := s.prepare("UPDATE platform SET address=?, citype=?, tlscert=?, tlskey=?, tlscacert=?, tlsservername=?, ciargs=?, identity=? WHERE id=?")
+	if err != nil {
+		return err
+	}
+	ciargs, err := marshalCIArgs(pl.CIArgs)
+	if err != nil {
+		return err
+	}
+
+	res, err := stmt.Exec(pl.Address, pl.CIType, pl.TLSCert, pl.TLSKey, pl.TLSCaCert, pl.TLSServerName, ciargs, pl.Identity, pl.ID)
+	if err != nil {
+		return err
+	}
+	return checkRowsAffected(res)
+}
+
+//GetPlatform Retrieve platform via platform id
+func (s *sqlStore) GetPlatform(id int) (*Platform, error) {
+	var platform Platform
+
+	stmt, err := s.prepare("SELECT " + platformColumns + " FROM platform WHERE id=?")
+	if err != nil {
+		return &platform, err
+	}
+
+	rows, err := stmt.Query(id)
+	if err != nil {
+		return &platform, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scanPlatform(rows, &platform); err != nil {
+			return &platform, err
+		}
+		return &platform, nil
+	}
+	return &platform, rows.Err()
+}
+
+//GetPlatforms Retrieve all platforms
+func (s *sqlStore) GetPlatforms() ([]Platform, error) {
+	var platforms []Platform
+	stmt, err := s.prepare("SELECT " + platformColumns + " FROM platform")
+	if err != nil {
+		return platforms, err
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return platforms, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var platform Platform
+		if err := scanPlatform(rows, &platform); err != nil {
+			return platforms, err
+		}
+		platforms = append(platforms, platform)
+	}
+	return platforms, rows.Err()
+}
+
+//platformColumns Selected columns of a platform, in order of scanPlatform
+const platformColumns = "id, address, COALESCE(tlscert, ''), COALESCE(tlskey, ''), COALESCE(tlscacert, ''), COALESCE(tlsservername, ''), citype, ciargs, identity"
+
+//scanPlatform Scan a row of platformColumns into pl
+func scanPlatform(rows *sql.Rows, pl *Platform) error {
+	var ciargs sql.NullString
+	if err := rows.Scan(&pl.ID, &pl.Address, &pl.TLSCert, &pl.TLSKey, &pl.TLSCaCert, &pl.TLSServerName, &pl.CIType, &ciargs, &pl.Identity); err != nil {
+		return err
+	}
+	var err error
+	pl.CIArgs, err = unmarshalCIArgs(ciargs)
+	return err
+}
+
+//marshalCIArgs JSON representation of the interface arguments stored in the ciargs column
+func marshalCIArgs(args map[string]interface{}) (sql.NullString, error) {
+	if args == nil {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(args)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+//unmarshalCIArgs Interface arguments stored in a ciargs column, nil if empty
+func unmarshalCIArgs(ciargs sql.NullString) (map[string]interface{}, error) {
+	if !ciargs.Valid || ciargs.String == "" {
+		return nil, nil
+	}
+	var args map[string]interface{}
+	err := json.Unmarshal([]byte(ciargs.String), &args)
+	return args, err
+}
+
+//DeletePlatform Delete platform via platform id
+func (s *sqlStore) DeletePlatform(id int) error {
+	return s.deleteByID("DELETE FROM platform WHERE id=?", id)
+}
+
+//InsertNode Insert a node into the database
+func (s *sqlStore) InsertNode(n *Node) error {
+	stmt, err := s.prepare("INSERT INTO node (devid, platformid, isprovider, inftype, ciargs) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	ciargs, err := marshalCIArgs(n.CIArgs)
+	if err != nil {
+		return err
+	}
+
+	res, err := stmt.Exec(n.DevID, n.PlatformID, n.IsProvider, n.InfType, ciargs)
+	if err != nil {
+		return err
+	}
+	i, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	n.ID = int(i)
+	return nil
+}
+
+//UpdateNode Update a node from the database
+func (s *sqlStore) UpdateNode(n *Node) error {
+	stmt, err := s.prepare("UPDATE node SET devid=?, platformid=?, isprovider=?, inftype=?, ciargs=? WHERE id=?")
+	if err != nil {
+		return err
+	}
+	ciargs, err := marshalCIArgs(n.CIArgs)
+	if err != nil {
+		return err
+	}
+
+	res, err := stmt.Exec(n.DevID, n.PlatformID, n.IsProvider, n.InfType, ciargs, n.ID)
+	if err != nil {
+		return err
+	}
+	return checkRowsAffected(res)
+}
+
+//DeleteNode Delete node via id
+func (s *sqlStore) DeleteNode(id int) error {
+	if err := s.deleteByID("DELETE FROM node WHERE id=?", id); err != nil {
+		return err
+	}
+	//Its errors go with the node, there may be none
+	stmt, err := s.prepare("DELETE FROM node_error WHERE nodeid=?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(id)
+	return err
+}
+
+//FindNode Retrieve node via device identifier
+func (s *sqlStore) FindNode(devID []byte) (*Node, error) {
+	return s.queryNode("SELECT "+nodeColumns+" FROM node WHERE devid=?", string(devID))
+}
+
+//availableProviderQuery Provider nodes of a type, other than the requesting node, not yet linked with it
+const availableProviderQuery = "SELECT node.id, node.devid, node.platformid, node.isprovider, node.inftype, node.ciargs FROM node LEFT JOIN link ON link.provnode = node.id AND link.reqnode = ? WHERE node.inftype=? AND link.id is null AND node.isprovider = 1 AND node.id <> ? ORDER BY node.id"
+
+//FindAvailableProviderNode Locate a provider node of the type not yet linked with the requesting node
+func (s *sqlStore) FindAvailableProviderNode(infType int, reqNodeID int) (*Node, error) {
+	return s.queryNode(availableProviderQuery, reqNodeID, infType, reqNodeID)
+}
+
+//FindAvailableProviderNodes Locate all provider nodes of the type not yet linked with the requesting node
+func (s *sqlStore) FindAvailableProviderNodes(infType int, reqNodeID int) ([]Node, error) {
+	return s.queryNodes(availableProviderQuery, reqNodeID, infType, reqNodeID)
+}
+
+//GetNode Retrieve node via node id
+func (s *sqlStore) GetNode(id int) (*Node, error) {
+	return s.queryNode("SELECT "+nodeColumns+" FROM node WHERE id=?", id)
+}
+
+//queryNode Retrieve the first node matching the query, an empty node if none matches
+func (s *sqlStore) queryNode(query string, args ...interface{}) (*Node, error) {
+	var node Node
+	stmt, err := s.prepare(query)
+	if err != nil {
+		return &node, err
+	}
+
+	var ciargs sql.NullString
+	err = stmt.QueryRow(args...).Scan(&node.ID, &node.DevID, &node.PlatformID, &node.IsProvider, &node.InfType, &ciargs)
+	if err == sql.ErrNoRows {
+		return &node, nil
+	}
+	if err != nil {
+		return &node, err
+	}
+	node.CIArgs, err = unmarshalCIArgs(ciargs)
+	return &node, err
+}
+
+//nodeColumns Selected columns of a node, in order of the scans
+const nodeColumns = "id, devid, platformid, isprovider, inftype, ciargs"
+
+//GetNodes Retrieves all nodes
+func (s *sqlStore) GetNodes() ([]Node, error) {
+	return s.queryNodes("SELECT " + nodeColumns + " FROM node")
+}
+
+//queryNodes Retrieve all nodes matching the query
+func (s *sqlStore) queryNodes(query string, args ...interface{}) ([]Node, error) {
+	var nodes []Node
+	stmt, err := s.prepare(query)
+	if err != nil {
+		return nodes, err
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nodes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var node Node
+		var ciargs sql.NullString
+		if err := rows.Scan(&node.ID, &node.DevID, &node.PlatformID, &node.IsProvider, &node.InfType, &ciargs); err != nil {
+			return nodes, err
+		}
+		var err error
+		if node.CIArgs, err = unmarshalCIArgs(ciargs); err != nil {
+			return nodes, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, rows.Err()
+}
+
+//InsertLink Insert a link into the database
+func (s *sqlStore) InsertLink(l *Link) error {
+	stmt, err := s.prepare("INSERT INTO link (provnode, reqnode, ciargs) VALUES (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	ciargs, err := marshalCIArgs(l.CIArgs)
+	if err != nil {
+		return err
+	}
+
+	res, err := stmt.Exec(l.ProvNode, l.ReqNode, ciargs)
+	if err != nil {
+		return err
+	}
+	i, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	l.ID = int(i)
+	return nil
+}
+
+//UpdateLink Update a link in the database
+func (s *sqlStore) UpdateLink(l *Link) error {
+	stmt, err := s.prepare("UPDATE link SET provnode=?, reqnode=?, ciargs=? WHERE id=?")
+	if err != nil {
+		return err
+	}
+	ciargs, err := marshalCIArgs(l.CIArgs)
+	if err != nil {
+		return err
+	}
+
+	res, err := stmt.Exec(l.ProvNode, l.ReqNode, ciargs, l.ID)
+	if err != nil {
+		return err
+	}
+	return checkRowsAffected(res)
+}
+
+//GetLinks Retrieve all links
+func (s *sqlStore) GetLinks() ([]Link, error) {
+	return s.queryLinks("SELECT id, provnode, reqnode, ciargs FROM link")
+}
+
+//GetLinksOfNode Retrieve all links in which the node takes part, either as provider or requester
+func (s *sqlStore) GetLinksOfNode(nodeID int) ([]Link, error) {
+	return s.queryLinks("SELECT id, provnode, reqnode, ciargs FROM link WHERE provnode=? OR reqnode=? ORDER BY id", nodeID, nodeID)
+}
+
+//queryLinks Retrieve all links matching the query
+func (s *sqlStore) queryLinks(query string, args ...interface{}) ([]Link, error) {
+	var links []Link
+	stmt, err := s.prepare(query)
+	if err != nil {
+		return links, err
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return links, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var link Link
+		var ciargs sql.NullString
+		if err := rows.Scan(&link.ID, &link.ProvNode, &link.ReqNode, &ciargs); err != nil {
+			return links, err
+		}
+		if link.CIArgs, err = unmarshalCIArgs(ciargs); err != nil {
+			return links, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+//DeleteLink Delete link via id
+func (s *sqlStore) DeleteLink(id int) error {
+	return s.deleteByID("DELETE FROM link WHERE id=?", id)
+}
+
+//InsertCertificate Record a certificate issued to a platform
+func (s *sqlStore) InsertCertificate(c *Certificate) error {
+	stmt, err := s.prepare("INSERT INTO certificate (serial, platformid, commonname, notafter, revoked) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(c.Serial, c.PlatformID, c.CommonName, c.NotAfter.Unix(), c.Revoked)
+	return err
+}
+
+//certificateColumns Columns scanned by queryCertificates
+const certificateColumns = "serial, platformid, commonname, notafter, revoked"
+
+//GetCertificate Retrieve certificate via serial, an empty certificate if unknown
+func (s *sqlStore) GetCertificate(serial string) (*Certificate, error) {
+	certs, err := s.queryCertificates("SELECT "+certificateColumns+" FROM certificate WHERE serial=?", serial)
+	if err != nil || len(certs) == 0 {
+		return &Certificate{}, err
+	}
+	return &certs[0], nil
+}
+
+//GetCertificates Retrieve all issued certificates
+func (s *sqlStore) GetCertificates() ([]Certificate, error) {
+	return s.queryCertificates("SELECT " + certificateColumns + " FROM certificate ORDER BY platformid, notafter")
+}
+
+//GetCertificatesOfPlatform Retrieve the certificates issued to a platform
+func (s *sqlStore) GetCertificatesOfPlatform(platformID int) ([]Certificate, error) {
+	return s.queryCertificates("SELECT "+certificateColumns+" FROM certificate WHERE platformid=? ORDER BY notafter", platformID)
+}
+
+//queryCertificates Retrieve all certificates matching the query
+func (s *sqlStore) queryCertificates(query string, args ...interface{}) ([]Certificate, error) {
+	var certs []Certificate
+	stmt, err := s.prepare(query)
+	if err != nil {
+		return certs, err
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return certs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Certificate
+		var notAfter int64
+		if err := rows.Scan(&c.Serial, &c.PlatformID, &c.CommonName, &notAfter, &c.Revoked); err != nil {
+			return certs, err
+		}
+		c.NotAfter = time.Unix(notAfter, 0)
+		certs = append(certs, c)
+	}
+	return certs, rows.Err()
+}
+
+//RevokeCertificate Mark certificate as revoked
+func (s *sqlStore) RevokeCertificate(serial string) error {
+	stmt, err := s.prepare("UPDATE certificate SET revoked=1 WHERE serial=?")
+	if err != nil {
+		return err
+	}
+
+	res, err := stmt.Exec(serial)
+	if err != nil {
+		return err
+	}
+	if i, err := res.RowsAffected(); err == nil && i == 0 {
+		return fmt.Errorf("dbconnection: unknown certificate: %v", serial)
+	}
+	return nil
+}
+
+//millis Time as stored in the message queue
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+//fromMillis Time stored in the message queue
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+//EnqueueMessage Persist a message for its destination
+func (s *sqlStore) EnqueueMessage(m *QueuedMessage) error {
+	stmt, err := s.prepare("INSERT INTO message_queue (nodeid, linkid, origin, citype, data, metadata, received, expires, attempts, nextattempt, lasterror, dead, inflight) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	metadata := sql.NullString{String: string(m.Metadata), Valid: m.Metadata != nil}
+	res, err := stmt.Exec(m.NodeID, m.LinkID, m.Origin, m.InterfaceType, m.Data, metadata, millis(m.Received), millis(m.Expires), m.Attempts, millis(m.NextAttempt), m.LastError, m.Dead, m.InFlight)
+	if err != nil {
+		return err
+	}
+	i, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	m.ID = int(i)
+	return nil
+}
+
+//UpdateQueuedMessage Store the delivery state of a message
+func (s *sqlStore) UpdateQueuedMessage(m *QueuedMessage) error {
+	stmt, err := s.prepare("UPDATE message_queue SET expires=?, attempts=?, nextattempt=?, lasterror=?, dead=?, inflight=? WHERE id=?")
+	if err != nil {
+		return err
+	}
+
+	res, err := stmt.Exec(millis(m.Expires), m.Attempts, millis(m.NextAttempt), m.LastError, m.Dead, m.InFlight, m.ID)
+	if err != nil {
+		return err
+	}
+	return checkRowsAffected(res)
+}
+
+//DeleteQueuedMessage Remove a delivered or purged message
+func (s *sqlStore) DeleteQueuedMessage(id int) error {
+	return s.deleteByID("DELETE FROM message_queue WHERE id=?", id)
+}
+
+//queuedMessageColumns Columns scanned by queryQueuedMessages
+const queuedMessageColumns = "id, nodeid, linkid, origin, citype, data, metadata, received, expires, attempts, nextattempt, COALESCE(lasterror,''), dead, inflight"
+
+//GetQueuedMessage Retrieve message via id, an empty message if unknown
+func (s *sqlStore) GetQueuedMessage(id int) (*QueuedMessage, error) {
+	messages, err := s.queryQueuedMessages("SELECT "+queuedMessageColumns+" FROM message_queue WHERE id=?", id)
+	if err != nil || len(messages) == 0 {
+		return &QueuedMessage{}, err
+	}
+	return &messages[0], nil
+}
+
+//GetQueuedMessages Pending messages of a destination, oldest first
+func (s *sqlStore) GetQueuedMessages(nodeID int) ([]QueuedMessage, error) {
+	return s.queryQueuedMessages("SELECT "+queuedMessageColumns+" FROM message_queue WHERE nodeid=? AND dead=0 ORDER BY id", nodeID)
+}
+
+//GetPendingDestinations Destinations with pending messages
+func (s *sqlStore) GetPendingDestinations() ([]int, error) {
+	var ids []int
+	stmt, err := s.prepare("SELECT DISTINCT nodeid FROM message_queue WHERE dead=0 ORDER BY nodeid")
+	if err != nil {
+		return ids, err
+	}
+	rows, err := stmt.Query()
+	if err != nil {
+		return ids, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+//GetDeadLetters Retrieve the dead-lettered messages, oldest first
+func (s *sqlStore) GetDeadLetters() ([]QueuedMessage, error) {
+	return s.queryQueuedMessages("SELECT " + queuedMessageColumns + " FROM message_queue WHERE dead=1 ORDER BY id")
+}
+
+//queryQueuedMessages Retrieve all messages matching the query
+func (s *sqlStore) queryQueuedMessages(query string, args ...interface{}) ([]QueuedMessage, error) {
+	var messages []QueuedMessage
+	stmt, err := s.prepare(query)
+	if err != nil {
+		return messages, err
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return messages, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m QueuedMessage
+		var received, expires, nextAttempt int64
+		var metadata sql.NullString
+		if err := rows.Scan(&m.ID, &m.NodeID, &m.LinkID, &m.Origin, &m.InterfaceType, &m.Data, &metadata, &received, &expires, &m.Attempts, &nextAttempt, &m.LastError, &m.Dead, &m.InFlight); err != nil {
+			return messages, err
+		}
+		if metadata.Valid {
+			m.Metadata = []byte(metadata.String)
+		}
+		m.Received = fromMillis(received)
+		m.Expires = fromMillis(expires)
+		m.NextAttempt = fromMillis(nextAttempt)
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+//SetDeviceKeys Insert or replace the keys of a node
+func (s *sqlStore) SetDeviceKeys(k *DeviceKeys) error {
+	stmt, err := s.prepare("REPLACE INTO lorawan_device (nodeid, appeui, appkey, devaddr, nwkskey, appskey, devnonces, fcntup) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(k.NodeID, nonNil(k.AppEUI), nonNil(k.AppKey), nonNil(k.DevAddr), nonNil(k.NwkSKey), nonNil(k.AppSKey), encodeNonces(k.DevNonces), k.FCntUp)
+	return err
+}
+
+//GetDeviceKeys Retrieve the keys of a node, empty keys if it has none
+func (s *sqlStore) GetDeviceKeys(nodeID int) (*DeviceKeys, error) {
+	var k DeviceKeys
+	stmt, err := s.prepare("SELECT nodeid, appeui, appkey, devaddr, nwkskey, appskey, devnonces, fcntup FROM lorawan_device WHERE nodeid=?")
+	if err != nil {
+		return &k, err
+	}
+
+	var nonces []byte
+	err = stmt.QueryRow(nodeID).Scan(&k.NodeID, &k.AppEUI, &k.AppKey, &k.DevAddr, &k.NwkSKey, &k.AppSKey, &nonces, &k.FCntUp)
+	if err == sql.ErrNoRows {
+		return &k, nil
+	}
+	k.DevNonces = decodeNonces(nonces)
+	return &k, err
+}
+
+//DeleteDeviceKeys Delete the keys of a node
+func (s *sqlStore) DeleteDeviceKeys(nodeID int) error {
+	return s.deleteByID("DELETE FROM lorawan_device WHERE nodeid=?", nodeID)
+}
+
+//InsertNodeError Insert an error of a node, keeping only the last keep errors of that node
+func (s *sqlStore) InsertNodeError(e *NodeError, keep int) error {
+	stmt, err := s.prepare("INSERT INTO node_error (nodeid, platformid, type, message, time) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	res, err := stmt.Exec(e.NodeID, e.PlatformID, e.Type, e.Message, millis(e.Time))
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	e.ID = int(id)
+
+	//MySQL only reads the table it deletes from through a derived table
+	stmt, err = s.prepare("DELETE FROM node_error WHERE nodeid=? AND id <= (SELECT id FROM (SELECT id FROM node_error WHERE nodeid=? ORDER BY id DESC LIMIT 1 OFFSET ?) AS oldest)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(e.NodeID, e.NodeID, keep)
+	return err
+}
+
+//GetNodeErrors Errors of a node, or of all nodes when 0, oldest first
+func (s *sqlStore) GetNodeErrors(nodeID int) ([]NodeError, error) {
+	query := "SELECT id, nodeid, platformid, type, message, time FROM node_error"
+	var args []interface{}
+	if nodeID != 0 {
+		query += " WHERE nodeid=?"
+		args = append(args, nodeID)
+	}
+	var errs []NodeError
+	stmt, err := s.prepare(query + " ORDER BY time, id")
+	if err != nil {
+		return errs, err
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return errs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e NodeError
+		var message sql.NullString
+		var t int64
+		if err := rows.Scan(&e.ID, &e.NodeID, &e.PlatformID, &e.Type, &message, &t); err != nil {
+			return errs, err
+		}
+		e.Message = message.String
+		e.Time = fromMillis(t)
+		errs = append(errs, e)
+	}
+	return errs, rows.Err()
+}
+
+//nonNil Empty instead of NULL for the NOT NULL binary columns
+func nonNil(b []byte) []byte {
+	if b == nil {
+		return []byte{}
+	}
+	return b
+}
+
+//encodeNonces Nonces as stored in the devnonces column, 2 bytes each, big endian
+func encodeNonces(nonces []uint16) []byte {
+	b := make([]byte, 2*len(nonces))
+	for i, n := range nonces {
+		binary.BigEndian.PutUint16(b[2*i:], n)
+	}
+	return b
+}
+
+//decodeNonces Nonces of the devnonces column
+func decodeNonces(b []byte) []uint16 {
+	var nonces []uint16
+	for i := 0; i+1 < len(b); i += 2 {
+		nonces = append(nonces, binary.BigEndian.Uint16(b[i:]))
+	}
+	return nonces
+}
+
+//deleteByID Execute a delete statement on a single row id
+func (s *sqlStore) deleteByID(query string, id int) error {
+	stmt, err := s.prepare(query)
+	if err != nil {
+		return err
+	}
+
+	res, err := stmt.Exec(id)
+	if err != nil {
+		return err
+	}
+	return checkRowsAffected(res)
+}
+
+//checkRowsAffected Log when a statement did not touch exactly one row
+func checkRowsAffected(res sql.Result) error {
+	if i, err := res.RowsAffected(); i != 1 {
+		if err != nil {
+			return err
+		}
+		log.Printf("RowsAffected does not equals one: %v\n", i)
+	}
+	return nil
+}
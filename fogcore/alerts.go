@@ -0,0 +1,205 @@
+package fogcore
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/iotInterface/cilorawan"
+)
+
+//Kinds of alerts
+const (
+	AlertNodeError      = "node-error"
+	AlertGatewayOffline = "gateway-offline"
+	AlertGatewayOnline  = "gateway-online"
+)
+
+//Alert Condition reported to the alert hooks
+type Alert struct {
+	Kind       string    `json:"kind"`
+	PlatformID int       `json:"platformId"`
+	NodeID     int       `json:"nodeId,omitempty"` //0 when the node is unknown to the fog
+	Subject    string    `json:"subject"`          //DevID of the node or MAC of the gateway
+	Message    string    `json:"message"`
+	Time       time.Time `json:"time"`
+}
+
+//AlertHook Notified of every alert, hooks must not block
+type AlertHook func(a Alert)
+
+//metricNodeErrors Network server errors per type, published by expvar
+var metricNodeErrors = expvar.NewMap("fogcore_node_errors")
+
+//alerts Registered alert hooks
+type alerts struct {
+	mutex sync.RWMutex
+	hooks []AlertHook
+}
+
+func (a *alerts) add(h AlertHook) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.hooks = append(a.hooks, h)
+}
+
+func (a *alerts) raise(alert Alert) {
+	log.Printf("fogcore: alert %v of %v: %v\n", alert.Kind, alert.Subject, alert.Message)
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	for _, h := range a.hooks {
+		h(alert)
+	}
+}
+
+//WebhookAlertHook Post every alert as JSON to url, in the background
+func WebhookAlertHook(url string) AlertHook {
+	client := &http.Client{Timeout: ConfAlertTimeout}
+	return func(a Alert) {
+		go func() {
+			body, err := json.Marshal(a)
+			if err != nil {
+				log.Printf("fogcore: unable to encode alert: %v\n", err)
+				return
+			}
+			resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				log.Printf("fogcore: unable to post alert to %v: %v\n", url, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Printf("fogcore: alert webhook %v answered %v\n", url, resp.Status)
+			}
+		}()
+	}
+}
+
+//NodeError Error a network server reported for a node
+type NodeError struct {
+	PlatformID int
+	NodeID     int //0 when the node is unknown to the fog
+	DevID      string
+	Type       string
+	Message    string
+	Time       time.Time
+}
+
+//maxUnknownNodes Nodes unknown to the fog whose errors are kept
+const maxUnknownNodes = 256
+
+//nodeErrors Last ConfNodeErrorHistory errors per node, stored against the node. Errors of nodes unknown to the fog
+//are kept in memory, for at most maxUnknownNodes of them
+type nodeErrors struct {
+	store   dbconnection.Store
+	mutex   sync.Mutex
+	unknown map[string][]NodeError
+}
+
+func newNodeErrors(store dbconnection.Store) *nodeErrors {
+	return &nodeErrors{store: store, unknown: make(map[string][]NodeError)}
+}
+
+func (n *nodeErrors) add(e NodeError) error {
+	if e.NodeID != 0 {
+		return n.store.InsertNodeError(&dbconnection.NodeError{
+			NodeID:     e.NodeID,
+			PlatformID: e.PlatformID,
+			Type:       e.Type,
+			Message:    e.Message,
+			Time:       e.Time,
+		}, ConfNodeErrorHistory)
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	errs, ok := n.unknown[e.DevID]
+	//Any DevEUI can be reported, forget an arbitrary node when full
+	if !ok && len(n.unknown) >= maxUnknownNodes {
+		for devID := range n.unknown {
+			delete(n.unknown, devID)
+			break
+		}
+	}
+	errs = append(errs, e)
+	if len(errs) > ConfNodeErrorHistory {
+		errs = errs[len(errs)-ConfNodeErrorHistory:]
+	}
+	n.unknown[e.DevID] = errs
+	return nil
+}
+
+//get Errors of the node with id nodeID, or of all nodes when 0, oldest first
+func (n *nodeErrors) get(nodeID int) ([]NodeError, error) {
+	stored, err := n.store.GetNodeErrors(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	devIDs := make(map[int]string)
+	var errs []NodeError
+	for _, e := range stored {
+		devID, ok := devIDs[e.NodeID]
+		if !ok {
+			node, err := n.store.GetNode(e.NodeID)
+			if err != nil {
+				return nil, err
+			}
+			devID = node.DevID
+			devIDs[e.NodeID] = devID
+		}
+		errs = append(errs, NodeError{PlatformID: e.PlatformID, NodeID: e.NodeID, DevID: devID, Type: e.Type, Message: e.Message, Time: e.Time})
+	}
+	if nodeID == 0 {
+		n.mutex.Lock()
+		for _, e := range n.unknown {
+			errs = append(errs, e...)
+		}
+		n.mutex.Unlock()
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Time.Before(errs[j].Time) })
+	return errs, nil
+}
+
+//AddAlertHook Notify h of every alert: network server errors of nodes and gateways going offline or online
+func (f *Fogcore) AddAlertHook(h AlertHook) {
+	f.alerts.add(h)
+}
+
+//NodeErrors Errors the network servers reported for the node with id nodeID, or for all nodes when 0
+func (f *Fogcore) NodeErrors(nodeID int) ([]NodeError, error) {
+	return f.nodeErrors.get(nodeID)
+}
+
+//lorawanErrors Handler recording the network server errors of platform against their nodes
+func (f *Fogcore) lorawanErrors(platform dbconnection.Platform) cilorawan.ErrorHandler {
+	return func(e cilorawan.NodeError) {
+		//The DevID of a LoRaWAN node is its binary DevEUI
+		ne := NodeError{PlatformID: platform.ID, DevID: string(e.DevEUI), Type: e.Type, Message: e.Error, Time: e.Time}
+		subject := fmt.Sprintf("%x", e.DevEUI)
+		node, err := f.store.FindNode(e.DevEUI)
+		if err != nil {
+			log.Printf("fogcore: unable to find node %v of network server error: %v\n", subject, err)
+		} else {
+			ne.NodeID = node.ID
+		}
+		metricNodeErrors.Add(e.Type, 1)
+		if err := f.nodeErrors.add(ne); err != nil {
+			log.Printf("fogcore: unable to store network server error of node %v: %v\n", subject, err)
+		}
+		f.alerts.raise(Alert{
+			Kind:       AlertNodeError,
+			PlatformID: platform.ID,
+			NodeID:     ne.NodeID,
+			Subject:    subject,
+			Message:    fmt.Sprintf("%v: %v", e.Type, e.Error),
+			Time:       e.Time,
+		})
+	}
+}
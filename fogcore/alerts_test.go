@@ -0,0 +1,86 @@
+package fogcore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/iotInterface/cilorawan"
+)
+
+func TestLorawanErrors(t *testing.T) {
+	store := dbconnection.NewMemoryStore()
+	node := dbconnection.Node{DevID: string([]byte{1, 2, 3, 4, 5, 6, 7, 8}), PlatformID: 1}
+	if err := store.InsertNode(&node); err != nil {
+		t.Fatal(err)
+	}
+	f := &Fogcore{store: store, alerts: &alerts{}, nodeErrors: newNodeErrors(store)}
+	var raised []Alert
+	f.AddAlertHook(func(a Alert) { raised = append(raised, a) })
+
+	handle := f.lorawanErrors(dbconnection.Platform{ID: 1})
+	handle(cilorawan.NodeError{DevEUI: []byte(node.DevID), Type: "DATA_UP_MIC", Error: "invalid MIC", Time: time.Now()})
+	handle(cilorawan.NodeError{DevEUI: []byte{9}, Type: "OTAA", Error: "unknown device", Time: time.Now()})
+
+	if errs, err := f.NodeErrors(node.ID); err != nil || len(errs) != 1 || errs[0].Type != "DATA_UP_MIC" || errs[0].PlatformID != 1 || errs[0].DevID != node.DevID {
+		t.Errorf("NodeErrors(%v) = %+v, %v, want the MIC error", node.ID, errs, err)
+	}
+	if errs, err := f.NodeErrors(0); err != nil || len(errs) != 2 || errs[1].NodeID != 0 {
+		t.Errorf("NodeErrors(0) = %+v, %v, want both errors", errs, err)
+	}
+	//Stored against the node
+	if stored, err := store.GetNodeErrors(node.ID); err != nil || len(stored) != 1 {
+		t.Errorf("GetNodeErrors(%v) = %+v, %v, want the MIC error", node.ID, stored, err)
+	}
+	if len(raised) != 2 || raised[0].Kind != AlertNodeError || raised[0].NodeID != node.ID || raised[0].Subject != "0102030405060708" {
+		t.Errorf("alerts = %+v, want an alert per error", raised)
+	}
+}
+
+func TestNodeErrorHistory(t *testing.T) {
+	n := newNodeErrors(dbconnection.NewMemoryStore())
+	for i := 0; i < ConfNodeErrorHistory+5; i++ {
+		if err := n.add(NodeError{NodeID: 1, DevID: "a", Time: time.Unix(int64(i), 0)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if errs, err := n.get(1); err != nil || len(errs) != ConfNodeErrorHistory || errs[0].Time.Unix() != 5 {
+		t.Fatalf("get() = %v errors, %v, want the last %v", len(errs), err, ConfNodeErrorHistory)
+	}
+
+	//A bounded number of unknown nodes is remembered
+	for i := 0; i < maxUnknownNodes+10; i++ {
+		if err := n.add(NodeError{DevID: fmt.Sprint(i), Time: time.Unix(int64(i), 0)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if errs, err := n.get(0); err != nil || len(errs) != ConfNodeErrorHistory+maxUnknownNodes {
+		t.Errorf("get(0) = %v errors, %v, want %v", len(errs), err, ConfNodeErrorHistory+maxUnknownNodes)
+	}
+}
+
+func TestWebhookAlertHook(t *testing.T) {
+	received := make(chan Alert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a Alert
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Errorf("alert body: %v", err)
+		}
+		received <- a
+	}))
+	defer server.Close()
+
+	WebhookAlertHook(server.URL)(Alert{Kind: AlertGatewayOffline, Subject: "0102", Time: time.Now()})
+	select {
+	case a := <-received:
+		if a.Kind != AlertGatewayOffline || a.Subject != "0102" {
+			t.Errorf("posted alert = %+v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("alert not posted")
+	}
+}
@@ -0,0 +1,152 @@
+package fogcore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+)
+
+//ConfAdminIdentities Certificate names allowed to manage every platform, comma separated
+var ConfAdminIdentities = ""
+
+//ConfAuditLog File the audit trail of management commands is appended to, empty for the standard log
+var ConfAuditLog = ""
+
+//peerIdentity Names proven by the verified client certificate of a connection
+type peerIdentity struct {
+	//CommonName Subject CN of the certificate
+	CommonName string
+	//Names CN and all DNS, IP and URI SANs
+	Names  []string
+	Remote string
+}
+
+//newPeerIdentity Identity of the verified leaf certificate, empty if the peer did not present one
+func newPeerIdentity(state tls.ConnectionState, remote net.Addr) peerIdentity {
+	id := peerIdentity{Remote: remote.String()}
+	if len(state.PeerCertificates) == 0 {
+		return id
+	}
+	id.CommonName, id.Names = certificateNames(state.PeerCertificates[0])
+	return id
+}
+
+//certificateNames Subject CN and all names of cert, the CN first
+func certificateNames(cert *x509.Certificate) (string, []string) {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return cert.Subject.CommonName, names
+}
+
+//String Name used in logs and stored as identity of new platforms
+func (id peerIdentity) String() string {
+	if id.CommonName != "" {
+		return id.CommonName
+	}
+	if len(id.Names) > 0 {
+		return id.Names[0]
+	}
+	return "anonymous"
+}
+
+//Has The certificate carries name
+func (id peerIdentity) Has(name string) bool {
+	for _, n := range id.Names {
+		if name != "" && strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+//IsAdmin The identity is one of ConfAdminIdentities
+func (id peerIdentity) IsAdmin() bool {
+	for _, admin := range strings.Split(ConfAdminIdentities, ",") {
+		if id.Has(strings.TrimSpace(admin)) {
+			return true
+		}
+	}
+	return false
+}
+
+//Owns The identity is bound to platform, by its Identity or else by the host of its address. A host binds a
+//platform without Identity only while no other of the registered platforms is on that host
+func (id peerIdentity) Owns(platform dbconnection.Platform, platforms []dbconnection.Platform) bool {
+	if platform.Identity != "" {
+		return id.Has(platform.Identity)
+	}
+	host := platformHost(platform.Address)
+	for _, pl := range platforms {
+		if pl.Address != platform.Address && strings.EqualFold(platformHost(pl.Address), host) {
+			return false
+		}
+	}
+	return id.Has(host)
+}
+
+//authorize Check whether id may manage platform, ErrUnauthorized if not
+func (id peerIdentity) authorize(store dbconnection.Store, platform dbconnection.Platform) error {
+	if id.IsAdmin() {
+		return nil
+	}
+	platforms, err := store.GetPlatforms()
+	if err != nil {
+		return err
+	}
+	if id.Owns(platform, platforms) {
+		return nil
+	}
+	return fmt.Errorf("%w: %v is not bound to platform %v", ErrUnauthorized, id, platform.Address)
+}
+
+//platformHost Host of the address of a platform
+func platformHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+var (
+	auditMutex  sync.Mutex
+	auditLogger *log.Logger
+)
+
+//audit Record the decision on a management command
+func audit(id peerIdentity, action string, subject string, err error) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	if auditLogger == nil {
+		auditLogger = log.New(os.Stderr, "audit: ", log.LstdFlags)
+		if ConfAuditLog != "" {
+			file, ferr := os.OpenFile(ConfAuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+			if ferr != nil {
+				log.Printf("fogcore: unable to open audit log %v, using standard log: %v\n", ConfAuditLog, ferr)
+			} else {
+				auditLogger = log.New(file, "", log.LstdFlags)
+			}
+		}
+	}
+	decision := "accepted"
+	if err != nil {
+		decision = fmt.Sprintf("rejected: %v", err)
+	}
+	auditLogger.Printf("identity=%q remote=%v action=%v subject=%q %v\n", id.String(), id.Remote, action, subject, decision)
+}
@@ -0,0 +1,129 @@
+package fogcore
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/joriwind/hecomm-api/hecomm"
+	"github.com/joriwind/hecomm-fog/dbconnection"
+)
+
+func TestCertificateNames(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "platform-a"},
+		DNSNames:    []string{"a.example.org"},
+		IPAddresses: []net.IP{net.ParseIP("192.168.2.107")},
+	}
+	cn, names := certificateNames(cert)
+	id := peerIdentity{CommonName: cn, Names: names}
+	if id.String() != "platform-a" {
+		t.Errorf("String() = %v, want platform-a", id)
+	}
+	for _, name := range []string{"platform-a", "A.example.org", "192.168.2.107"} {
+		if !id.Has(name) {
+			t.Errorf("Has(%v) = false", name)
+		}
+	}
+	pl := dbconnection.Platform{Address: "192.168.2.107:2000"}
+	if !id.Owns(pl, []dbconnection.Platform{pl}) {
+		t.Errorf("Owns() by address host = false")
+	}
+	//The host is shared, it does not tell which platform the certificate is for
+	other := dbconnection.Platform{Address: "192.168.2.107:2001", Identity: "platform-c"}
+	if id.Owns(pl, []dbconnection.Platform{pl, other}) {
+		t.Errorf("Owns() by host of several platforms = true")
+	}
+	if id.Owns(dbconnection.Platform{Address: "192.168.2.107:2000", Identity: "platform-b"}, nil) {
+		t.Errorf("Owns() of platform bound to other identity = true")
+	}
+}
+
+//nodeCommand Command to insert or delete devEUI on the platform at address
+func nodeCommand(t *testing.T, insert bool, devEUI string, address string) *hecomm.DBCommand {
+	data, err := json.Marshal(hecomm.DBCNode{DevEUI: []byte(devEUI), PlAddress: address, PlType: 99, InfType: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &hecomm.DBCommand{Insert: insert, EType: hecomm.ETypeNode, Data: data}
+}
+
+func TestExecuteCommandAuthorization(t *testing.T) {
+	f, err := NewFogcore(context.Background(), dbconnection.Config{Driver: dbconnection.DriverMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plA := dbconnection.Platform{Address: "[::1]:2000", CIType: 99, Identity: "platform-a"}
+	plB := dbconnection.Platform{Address: "[::2]:2000", CIType: 99, Identity: "platform-b"}
+	for _, pl := range []*dbconnection.Platform{&plA, &plB} {
+		if err := f.store.InsertPlatform(pl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idA := peerIdentity{CommonName: "platform-a", Names: []string{"platform-a"}}
+	idB := peerIdentity{CommonName: "platform-b", Names: []string{"platform-b"}}
+	defer func(admins string) { ConfAdminIdentities = admins }(ConfAdminIdentities)
+	ConfAdminIdentities = "operator"
+	admin := peerIdentity{CommonName: "operator", Names: []string{"operator"}}
+
+	tests := []struct {
+		name    string
+		command *hecomm.DBCommand
+		id      peerIdentity
+		want    error
+	}{
+		{name: "insert on own platform", command: nodeCommand(t, true, "0102030405060708", plA.Address), id: idA},
+		{name: "insert on other platform", command: nodeCommand(t, true, "0102030405060709", plA.Address), id: idB, want: ErrUnauthorized},
+		{name: "delete from other platform", command: nodeCommand(t, false, "0102030405060708", plA.Address), id: idB, want: ErrUnauthorized},
+		{name: "delete via own platform of node of other", command: nodeCommand(t, false, "0102030405060708", plB.Address), id: idB, want: ErrUnauthorized},
+		{name: "delete unknown node", command: nodeCommand(t, false, "ffffffffffffffff", plA.Address), id: idA, want: ErrUnknownNode},
+		{name: "delete from own platform", command: nodeCommand(t, false, "0102030405060708", plA.Address), id: idA},
+		{name: "admin inserts anywhere", command: nodeCommand(t, true, "0102030405060709", plB.Address), id: admin},
+		{name: "anonymous", command: nodeCommand(t, true, "010203040506070a", plB.Address), id: peerIdentity{}, want: ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		err := f.executeCommand(tt.command, tt.id)
+		if (tt.want == nil && err != nil) || (tt.want != nil && !errors.Is(err, tt.want)) {
+			t.Errorf("%q. executeCommand() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	if node, _ := f.store.FindNode([]byte("0102030405060708")); node.ID != 0 {
+		t.Errorf("FindNode() after delete = %v", node)
+	}
+	if node, _ := f.store.FindNode([]byte("0102030405060709")); node.PlatformID != plB.ID {
+		t.Errorf("FindNode() of admin insert = %v, want on platform %v", node, plB.ID)
+	}
+
+	//Platforms can only be deleted by their owner
+	data, err := json.Marshal(hecomm.DBCPlatform{Address: plA.Address, CI: 99})
+	if err != nil {
+		t.Fatal(err)
+	}
+	command := &hecomm.DBCommand{Insert: false, EType: hecomm.ETypePlatform, Data: data}
+	if err := f.executeCommand(command, idB); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("executeCommand() delete platform of other = %v, want %v", err, ErrUnauthorized)
+	}
+	if err := f.executeCommand(command, idA); err != nil {
+		t.Errorf("executeCommand() delete own platform = %v", err)
+	}
+	if pl, _ := f.store.GetPlatform(plA.ID); pl.ID != 0 {
+		t.Errorf("GetPlatform() after delete = %v", pl)
+	}
+
+	//Only admins register new platforms, starting their interface
+	data, err = json.Marshal(hecomm.DBCPlatform{Address: "[::3]:2000", CI: 99})
+	if err != nil {
+		t.Fatal(err)
+	}
+	command = &hecomm.DBCommand{Insert: true, EType: hecomm.ETypePlatform, Data: data}
+	if err := f.executeCommand(command, idB); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("executeCommand() new platform by non-admin = %v, want %v", err, ErrUnauthorized)
+	}
+	if err := f.executeCommand(command, admin); !errors.Is(err, ErrUnknownInterface) {
+		t.Errorf("executeCommand() new platform by admin = %v, want the interface started", err)
+	}
+}
@@ -0,0 +1,79 @@
+package fogcore
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/pki"
+)
+
+//ConfCACert Root certificate of the built-in CA, has to be part of ConfFogcoreCaCert for issued certificates to be accepted
+var ConfCACert = "certs/hecomm-ca.cert.pem"
+
+//ConfCAKey Key of the built-in CA
+var ConfCAKey = "private/hecomm-ca.key.pem"
+
+//ConfCertValidity Validity of the certificates issued to platforms
+var ConfCertValidity = 365 * 24 * time.Hour
+
+//storeRevocations Revocation checker on the certificates issued to platforms, unknown certificates are not revoked
+type storeRevocations struct {
+	store dbconnection.Store
+}
+
+func (r storeRevocations) IsRevoked(cert *x509.Certificate) (bool, error) {
+	issued, err := r.store.GetCertificate(pki.SerialString(cert.SerialNumber))
+	if err != nil {
+		return false, err
+	}
+	return issued.Revoked, nil
+}
+
+//IssuePlatformCertificate Issue a certificate binding to the platform and record its serial.
+//The common name is the identity of the platform, or the host of its address; names are added as SANs next to the host
+func IssuePlatformCertificate(store dbconnection.Store, ca *pki.CA, platformID int, names []string) (*pki.IssuedCertificate, error) {
+	platform, err := store.GetPlatform(platformID)
+	if err != nil {
+		return nil, err
+	}
+	if platform.ID == 0 {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownPlatform, platformID)
+	}
+	host := platformHost(platform.Address)
+	commonName := platform.Identity
+	if commonName == "" {
+		commonName = host
+	}
+	issued, err := ca.Issue(pki.CertificateRequest{
+		CommonName: commonName,
+		Names:      append([]string{host}, names...),
+		Validity:   ConfCertValidity,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = store.InsertCertificate(&dbconnection.Certificate{
+		Serial:     pki.SerialString(issued.Cert.SerialNumber),
+		PlatformID: platform.ID,
+		CommonName: commonName,
+		NotAfter:   issued.Cert.NotAfter,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return issued, nil
+}
+
+//RevokePlatformCertificate Revoke an issued certificate, refused on the next handshake of its platform
+func RevokePlatformCertificate(store dbconnection.Store, serial string) error {
+	issued, err := store.GetCertificate(serial)
+	if err != nil {
+		return err
+	}
+	if issued.Serial == "" {
+		return fmt.Errorf("fogcore: unknown certificate: %v", serial)
+	}
+	return store.RevokeCertificate(serial)
+}
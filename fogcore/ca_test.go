@@ -0,0 +1,63 @@
+package fogcore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/pki"
+)
+
+func TestIssuePlatformCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fogcore-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, err := pki.InitCA(filepath.Join(dir, "ca.cert.pem"), filepath.Join(dir, "ca.key.pem"), "test CA", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := dbconnection.NewMemoryStore()
+	pl := dbconnection.Platform{Address: "192.168.2.107:2000", CIType: 1}
+	if err := store.InsertPlatform(&pl); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := IssuePlatformCertificate(store, ca, pl.ID+1, nil); !errors.Is(err, ErrUnknownPlatform) {
+		t.Errorf("IssuePlatformCertificate() of unknown platform = %v, want %v", err, ErrUnknownPlatform)
+	}
+	issued, err := IssuePlatformCertificate(store, ca, pl.ID, []string{"platform-a.local"})
+	if err != nil {
+		t.Fatalf("IssuePlatformCertificate() error = %v", err)
+	}
+	//Binds to the platform by the host of its address
+	id := peerIdentity{}
+	id.CommonName, id.Names = certificateNames(issued.Cert)
+	if !id.Owns(pl, []dbconnection.Platform{pl}) || !id.Has("platform-a.local") {
+		t.Errorf("issued certificate names %v do not bind to %v", id.Names, pl.Address)
+	}
+
+	serial := pki.SerialString(issued.Cert.SerialNumber)
+	certs, err := store.GetCertificatesOfPlatform(pl.ID)
+	if err != nil || len(certs) != 1 || certs[0].Serial != serial {
+		t.Fatalf("GetCertificatesOfPlatform() = %v, %v, want serial %v", certs, err, serial)
+	}
+	revocations := storeRevocations{store: store}
+	if revoked, err := revocations.IsRevoked(issued.Cert); err != nil || revoked {
+		t.Errorf("IsRevoked() before revoke = %v, %v", revoked, err)
+	}
+	if err := RevokePlatformCertificate(store, serial); err != nil {
+		t.Fatalf("RevokePlatformCertificate() error = %v", err)
+	}
+	if revoked, err := revocations.IsRevoked(issued.Cert); err != nil || !revoked {
+		t.Errorf("IsRevoked() after revoke = %v, %v", revoked, err)
+	}
+	if err := RevokePlatformCertificate(store, "ffff"); err == nil {
+		t.Error("RevokePlatformCertificate() of unknown serial succeeded")
+	}
+}
@@ -1,6 +1,8 @@
 package fogcore
 
 import (
+	"time"
+
 	"github.com/joriwind/hecomm-interface-6lowpan"
 )
 
@@ -16,6 +18,67 @@ var ConfFogcoreCaCert = "certs/ca-chain.cert.pem"
 //ConfFogcoreKey ...
 var ConfFogcoreKey = "private/fogcore.key.pem"
 
+//ConfProviderDialTimeout Maximum time to reach a provider platform before trying the next candidate
+var ConfProviderDialTimeout = 10 * time.Second
+
+//ConfLinkTimeout Maximum duration of a link session
+var ConfLinkTimeout = 5 * time.Minute
+
+//ConfMaxMessageSize Largest accepted hecomm message in bytes
+var ConfMaxMessageSize = 64 * 1024
+
+//ConfPoolMaxIdle Maximum idle connections kept per platform
+var ConfPoolMaxIdle = 2
+
+//ConfPoolMinIdle Idle connections kept open to every platform in use, reconnected in the background
+var ConfPoolMinIdle = 0
+
+//ConfPoolIdleTimeout Idle connections and network server clients unused for this long are closed
+var ConfPoolIdleTimeout = 5 * time.Minute
+
+//ConfPoolHealthInterval Interval between health checks of the idle connections
+var ConfPoolHealthInterval = 30 * time.Second
+
+//ConfReconnectMin First delay before dialing a platform again after a failure, doubled on every next failure
+var ConfReconnectMin = time.Second
+
+//ConfReconnectMax Maximum delay before dialing a platform again
+var ConfReconnectMax = time.Minute
+
+//ConfQueueTTL Queued downlinks not delivered within this period are dead-lettered
+var ConfQueueTTL = time.Hour
+
+//ConfQueueMaxAttempts Failed attempts after which a downlink is dead-lettered, 0 to retry until ConfQueueTTL
+var ConfQueueMaxAttempts = 0
+
+//ConfQueueRetryMin First delay before retrying a failed downlink, doubled on every next failure
+var ConfQueueRetryMin = time.Second
+
+//ConfQueueRetryMax Maximum delay before retrying a failed downlink
+var ConfQueueRetryMax = 5 * time.Minute
+
+//ConfQueueRetryInterval Interval between checks of the delivery queues
+var ConfQueueRetryInterval = time.Second
+
+//ConfNodeErrorHistory Network server errors kept per node
+var ConfNodeErrorHistory = 20
+
+//ConfGatewayPollInterval Interval between polls of the LoRaWAN gateways, 0 to disable
+var ConfGatewayPollInterval = time.Minute
+
+//ConfGatewayStatsWindow Period the packet counters of a gateway are summed over
+var ConfGatewayStatsWindow = time.Hour
+
+//ConfGatewayOffline A gateway not seen for this long is reported offline
+var ConfGatewayOffline = 10 * time.Minute
+
+//ConfAlertTimeout Maximum time to deliver an alert to a webhook
+var ConfAlertTimeout = 10 * time.Second
+
+//ConfFraming Framing of connections to platforms without a "framing" ciarg, replies follow the peer. Legacy JSON,
+//the only framing existing platforms understand, until a platform is known to support length prefixes.
+var ConfFraming = FramingJSON
+
 //SixlowpanPort Used serial connection to communicate with 6LoWPAN
 var SixlowpanPort = SixlowpanPortConst
 
@@ -0,0 +1,342 @@
+package fogcore
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/iotInterface/cilorawan"
+	"github.com/joriwind/hecomm-fog/pki"
+)
+
+//idleConn Connection to a platform waiting for its next session
+type idleConn struct {
+	conn  *frameConn
+	since time.Time
+}
+
+//platformConns Pooled connections and reconnect state of a platform
+type platformConns struct {
+	platform dbconnection.Platform
+	idle     []idleConn
+	//dialing Background reconnect in progress
+	dialing  bool
+	failures int
+	retryAt  time.Time
+	lastErr  error
+	//lastUsed Last session asked for, spare connections are only kept to platforms in use
+	lastUsed time.Time
+}
+
+//nsClient Network server client shared by all downlinks towards it
+type nsClient struct {
+	client   *cilorawan.NetworkClient
+	lastUsed time.Time
+}
+
+//PoolStats Connection state of a platform, as shown on the command line
+type PoolStats struct {
+	PlatformID int
+	Address    string
+	Idle       int
+	Failures   int
+	RetryAt    time.Time
+	LastError  error
+}
+
+/*
+ * connManager Long-lived connections to the platforms, shared by link sessions and downlink delivery.
+ * Provider platforms: a connection serves one link session at a time and returns to the idle pool when the
+ * session ends cleanly. Idle connections are health checked every ConfPoolHealthInterval, and closed after
+ * ConfPoolIdleTimeout. Platforms used within ConfPoolIdleTimeout keep ConfPoolMinIdle connections, reconnecting
+ * in the background. Failed dials back off exponentially, from ConfReconnectMin up to ConfReconnectMax, and the
+ * platform is reported unreachable in between.
+ * Network servers: one gRPC client per address and credentials, gRPC itself reconnects with backoff.
+ */
+type connManager struct {
+	ctx       context.Context
+	dial      providerDialer
+	latencies *latencyTracker
+	mutex     sync.Mutex
+	platforms map[int]*platformConns
+	ns        map[string]*nsClient
+}
+
+//newConnManager Connection manager dialing platforms with dial, latencies of new connections are recorded if not nil
+func newConnManager(ctx context.Context, dial providerDialer, latencies *latencyTracker) *connManager {
+	return &connManager{
+		ctx:       ctx,
+		dial:      dial,
+		latencies: latencies,
+		platforms: make(map[int]*platformConns),
+		ns:        make(map[string]*nsClient),
+	}
+}
+
+//entry State of platform, created on first use; the caller holds the mutex
+func (m *connManager) entry(platform dbconnection.Platform) *platformConns {
+	pc, ok := m.platforms[platform.ID]
+	if !ok {
+		pc = &platformConns{}
+		m.platforms[platform.ID] = pc
+	}
+	if pc.platform.Address != "" && pc.platform.Address != platform.Address {
+		//Platform moved, its connections lead to the old address
+		for _, ic := range pc.idle {
+			ic.conn.Close()
+		}
+		pc.idle = nil
+	}
+	pc.platform = platform
+	return pc
+}
+
+//Get Connection to platform for a session: an idle one if still alive, else a new one unless backing off
+func (m *connManager) Get(platform dbconnection.Platform) (*frameConn, error) {
+	var pc *platformConns
+	for {
+		m.mutex.Lock()
+		pc = m.entry(platform)
+		pc.lastUsed = time.Now()
+		if len(pc.idle) == 0 {
+			break
+		}
+		ic := pc.idle[len(pc.idle)-1]
+		pc.idle = pc.idle[:len(pc.idle)-1]
+		m.mutex.Unlock()
+		//Probed outside the lock, it is no longer in the pool
+		if ic.conn.alive() {
+			return ic.conn, nil
+		}
+		ic.conn.Close()
+	}
+	if wait := time.Until(pc.retryAt); wait > 0 {
+		err := fmt.Errorf("%w: %v backing off for %v after %v failures: %v", ErrPlatformUnreachable, platform.Address, wait.Round(time.Millisecond), pc.failures, pc.lastErr)
+		m.mutex.Unlock()
+		return nil, err
+	}
+	m.mutex.Unlock()
+	return m.connect(platform)
+}
+
+//connect Dial platform, recording the outcome for its backoff
+func (m *connManager) connect(platform dbconnection.Platform) (*frameConn, error) {
+	start := time.Now()
+	dialed, err := m.dial(platform)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	pc := m.entry(platform)
+	if err != nil {
+		pc.failures++
+		pc.lastErr = err
+		pc.retryAt = time.Now().Add(reconnectDelay(pc.failures))
+		return nil, fmt.Errorf("%w: %v: %v", ErrPlatformUnreachable, platform.Address, err)
+	}
+	pc.failures = 0
+	pc.lastErr = nil
+	pc.retryAt = time.Time{}
+	if m.latencies != nil {
+		m.latencies.Record(platform.ID, time.Since(start))
+	}
+	return newFrameConn(dialed, platformFraming(platform)), nil
+}
+
+//reconnectDelay Backoff after the given number of consecutive failed dials
+func reconnectDelay(failures int) time.Duration {
+	return backoff(failures, ConfReconnectMin, ConfReconnectMax)
+}
+
+//Put Return conn after a session with platform, it is pooled if reusable and the pool is not full
+func (m *connManager) Put(platform dbconnection.Platform, conn *frameConn, reusable bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	pc := m.entry(platform)
+	if !reusable || len(pc.idle) >= ConfPoolMaxIdle || m.ctx.Err() != nil {
+		conn.Close()
+		return
+	}
+	pc.idle = append(pc.idle, idleConn{conn: conn, since: time.Now()})
+}
+
+//Forget Close the connections of a removed or changed platform
+func (m *connManager) Forget(platformID int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if pc, ok := m.platforms[platformID]; ok {
+		for _, ic := range pc.idle {
+			ic.conn.Close()
+		}
+		delete(m.platforms, platformID)
+	}
+}
+
+//NetworkClient Shared client of the network server at host, created on first use
+func (m *connManager) NetworkClient(host string, creds pki.Credentials) (*cilorawan.NetworkClient, error) {
+	key := fmt.Sprintf("%v|%v", host, creds)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if c, ok := m.ns[key]; ok {
+		if !c.client.Closed() {
+			c.lastUsed = time.Now()
+			return c.client, nil
+		}
+		delete(m.ns, key)
+	}
+	client, err := cilorawan.NewNetworkClient(m.ctx, host, creds)
+	if err != nil {
+		return nil, err
+	}
+	m.ns[key] = &nsClient{client: client, lastUsed: time.Now()}
+	return client, nil
+}
+
+//Stats Connection state of every platform used
+func (m *connManager) Stats() []PoolStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var stats []PoolStats
+	for id, pc := range m.platforms {
+		stats = append(stats, PoolStats{
+			PlatformID: id,
+			Address:    pc.platform.Address,
+			Idle:       len(pc.idle),
+			Failures:   pc.failures,
+			RetryAt:    pc.retryAt,
+			LastError:  pc.lastErr,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].PlatformID < stats[j].PlatformID })
+	return stats
+}
+
+//run Health check the pools every ConfPoolHealthInterval, until the context is done
+func (m *connManager) run() {
+	ticker := time.NewTicker(ConfPoolHealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			m.closeAll()
+			return
+		case <-ticker.C:
+			m.checkHealth()
+		}
+	}
+}
+
+//probe Idle connections of a platform taken out of its pool for a health check
+type probe struct {
+	pc      *platformConns
+	address string
+	idle    []idleConn
+}
+
+//checkHealth Drop dead and expired idle connections, reconnect platforms in use below ConfPoolMinIdle.
+//The idle connections are probed outside the lock, out of their pool meanwhile
+func (m *connManager) checkHealth() {
+	now := time.Now()
+	var probes []probe
+	m.mutex.Lock()
+	for _, pc := range m.platforms {
+		p := probe{pc: pc, address: pc.platform.Address}
+		for _, ic := range pc.idle {
+			if now.Sub(ic.since) > ConfPoolIdleTimeout {
+				ic.conn.Close()
+				continue
+			}
+			p.idle = append(p.idle, ic)
+		}
+		pc.idle = nil
+		probes = append(probes, p)
+	}
+	for key, c := range m.ns {
+		if now.Sub(c.lastUsed) > ConfPoolIdleTimeout || c.client.Closed() {
+			c.client.Close()
+			delete(m.ns, key)
+		}
+	}
+	m.mutex.Unlock()
+
+	for i, p := range probes {
+		var alive []idleConn
+		for _, ic := range p.idle {
+			if !ic.conn.alive() {
+				ic.conn.Close()
+				continue
+			}
+			alive = append(alive, ic)
+		}
+		probes[i].idle = alive
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, p := range probes {
+		pc := p.pc
+		//Forgotten or moved during the probe
+		if m.platforms[pc.platform.ID] != pc || pc.platform.Address != p.address {
+			for _, ic := range p.idle {
+				ic.conn.Close()
+			}
+			continue
+		}
+		//Older than the connections put back meanwhile, the oldest go when full
+		idle := append(p.idle, pc.idle...)
+		for len(idle) > ConfPoolMaxIdle {
+			idle[0].conn.Close()
+			idle = idle[1:]
+		}
+		pc.idle = idle
+		if len(pc.idle) < ConfPoolMinIdle && now.Sub(pc.lastUsed) <= ConfPoolIdleTimeout && !pc.dialing && !now.Before(pc.retryAt) {
+			pc.dialing = true
+			go m.reconnect(pc.platform)
+		}
+	}
+}
+
+//reconnect Dial a spare connection to platform in the background
+func (m *connManager) reconnect(platform dbconnection.Platform) {
+	conn, err := m.connect(platform)
+	m.mutex.Lock()
+	if pc, ok := m.platforms[platform.ID]; ok {
+		pc.dialing = false
+	}
+	m.mutex.Unlock()
+	if err != nil {
+		log.Printf("fogcore: reconnect to platform %v failed: %v\n", platform.Address, err)
+		return
+	}
+	m.Put(platform, conn, true)
+}
+
+//closeAll Close every pooled connection and client
+func (m *connManager) closeAll() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id, pc := range m.platforms {
+		for _, ic := range pc.idle {
+			ic.conn.Close()
+		}
+		delete(m.platforms, id)
+	}
+	for key, c := range m.ns {
+		c.client.Close()
+		delete(m.ns, key)
+	}
+}
+
+//alive Whether an idle connection is still open and silent, without consuming anything
+func (c *frameConn) alive() bool {
+	c.Conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := c.reader.Peek(1)
+	c.Conn.SetReadDeadline(time.Time{})
+	//Only a timeout means open and silent, unsolicited data leaves the connection out of sync
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,127 @@
+package fogcore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+)
+
+//countingDialer Dialer of in-memory connections, failing while down
+type countingDialer struct {
+	mutex sync.Mutex
+	dials int
+	down  bool
+	peers []net.Conn
+}
+
+func (d *countingDialer) dial(platform dbconnection.Platform) (net.Conn, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.dials++
+	if d.down {
+		return nil, errors.New("connection refused")
+	}
+	fog, peer := net.Pipe()
+	d.peers = append(d.peers, peer)
+	return fog, nil
+}
+
+func (d *countingDialer) count() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.dials
+}
+
+func TestConnManagerReuse(t *testing.T) {
+	d := &countingDialer{}
+	m := newConnManager(context.Background(), d.dial, newLatencyTracker())
+	pl := dbconnection.Platform{ID: 1, Address: "[::1]:2000"}
+
+	conn, err := m.Get(pl)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	m.Put(pl, conn, true)
+	if again, err := m.Get(pl); err != nil || again != conn || d.count() != 1 {
+		t.Fatalf("Get() after Put() = %p, %v with %v dials, want pooled %p", again, err, d.count(), conn)
+	}
+	if _, ok := m.latencies.Get(pl.ID); !ok {
+		t.Error("latency of new connection not recorded")
+	}
+
+	//A connection closed by the platform is not handed out
+	m.Put(pl, conn, true)
+	d.peers[0].Close()
+	fresh, err := m.Get(pl)
+	if err != nil || fresh == conn || d.count() != 2 {
+		t.Errorf("Get() with dead idle connection = %p, %v with %v dials, want new connection", fresh, err, d.count())
+	}
+
+	//Not reusable or beyond ConfPoolMaxIdle is closed
+	m.Put(pl, fresh, false)
+	if stats := m.Stats(); len(stats) != 1 || stats[0].Idle != 0 {
+		t.Errorf("Stats() after Put() of unusable connection = %+v", stats)
+	}
+}
+
+func TestConnManagerBackoff(t *testing.T) {
+	min, max, minIdle := ConfReconnectMin, ConfReconnectMax, ConfPoolMinIdle
+	ConfReconnectMin, ConfReconnectMax, ConfPoolMinIdle = 50*time.Millisecond, 100*time.Millisecond, 1
+	defer func() { ConfReconnectMin, ConfReconnectMax, ConfPoolMinIdle = min, max, minIdle }()
+	if reconnectDelay(1) != 50*time.Millisecond || reconnectDelay(2) != 100*time.Millisecond || reconnectDelay(5) != 100*time.Millisecond {
+		t.Errorf("reconnectDelay() = %v, %v, %v", reconnectDelay(1), reconnectDelay(2), reconnectDelay(5))
+	}
+
+	d := &countingDialer{down: true}
+	m := newConnManager(context.Background(), d.dial, nil)
+	pl := dbconnection.Platform{ID: 1, Address: "[::1]:2000"}
+	if _, err := m.Get(pl); !errors.Is(err, ErrPlatformUnreachable) {
+		t.Fatalf("Get() of unreachable platform = %v, want %v", err, ErrPlatformUnreachable)
+	}
+	//Backing off, not dialed again
+	if _, err := m.Get(pl); !errors.Is(err, ErrPlatformUnreachable) || d.count() != 1 {
+		t.Errorf("Get() while backing off = %v with %v dials, want %v without dial", err, d.count(), ErrPlatformUnreachable)
+	}
+
+	//Reconnected in the background once the platform is back
+	d.mutex.Lock()
+	d.down = false
+	d.mutex.Unlock()
+	time.Sleep(ConfReconnectMin)
+	m.checkHealth()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if stats := m.Stats(); stats[0].Idle == 1 && stats[0].Failures == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Stats() = %+v, want reconnected idle connection", m.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, err := m.Get(pl)
+	if err != nil || d.count() != 2 {
+		t.Errorf("Get() after reconnect = %v with %v dials, want the spare connection", err, d.count())
+	}
+
+	//Healthy idle connections stay pooled, platforms no longer in use are not reconnected
+	m.Put(pl, conn, true)
+	m.mutex.Lock()
+	m.platforms[pl.ID].lastUsed = time.Now().Add(-ConfPoolIdleTimeout - time.Second)
+	m.mutex.Unlock()
+	m.checkHealth()
+	if stats := m.Stats(); stats[0].Idle != 1 {
+		t.Errorf("Stats() after health check = %+v, want the idle connection kept", stats)
+	}
+	d.peers[0].Close()
+	m.checkHealth()
+	time.Sleep(50 * time.Millisecond)
+	if stats := m.Stats(); stats[0].Idle != 0 || d.count() != 2 {
+		t.Errorf("Stats() of unused platform = %+v with %v dials, want no reconnect", stats, d.count())
+	}
+}
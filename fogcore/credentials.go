@@ -0,0 +1,36 @@
+package fogcore
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/pki"
+)
+
+//fogcoreCredentials Credentials of the fogcore, used for platforms without their own
+func fogcoreCredentials() pki.Credentials {
+	return pki.Credentials{Cert: ConfFogcoreCert, Key: ConfFogcoreKey, CaCert: ConfFogcoreCaCert}
+}
+
+//platformCredentials Credentials stored with platform, empty fields fall back to the defaults of the dialer
+func platformCredentials(platform dbconnection.Platform) pki.Credentials {
+	return pki.Credentials{
+		Cert:       platform.TLSCert,
+		Key:        platform.TLSKey,
+		CaCert:     platform.TLSCaCert,
+		ServerName: platform.TLSServerName,
+	}
+}
+
+//platformDialer Dial provider platforms over TLS with their own credentials
+func (f *Fogcore) platformDialer() providerDialer {
+	return func(platform dbconnection.Platform) (net.Conn, error) {
+		config, err := f.credentials.ClientConfig(platformCredentials(platform).Or(fogcoreCredentials()))
+		if err != nil {
+			return nil, fmt.Errorf("fogcore: credentials of platform %v: %v", platform.Address, err)
+		}
+		return tls.DialWithDialer(&net.Dialer{Timeout: ConfProviderDialTimeout}, "tcp", platform.Address, config)
+	}
+}
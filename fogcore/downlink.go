@@ -0,0 +1,88 @@
+package fogcore
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/joriwind/hecomm-fog/iotInterface"
+	"github.com/joriwind/hecomm-fog/iotInterface/cilorawan"
+	"github.com/joriwind/hecomm-fog/iotInterface/cisixlowpan"
+)
+
+//ciArg Argument of the messages over rt: from the ciargs of its link, else of its destination node
+func ciArg(rt route, name string) (interface{}, bool) {
+	if v, ok := rt.Link.CIArgs[name]; ok {
+		return v, true
+	}
+	v, ok := rt.Node.CIArgs[name]
+	return v, ok
+}
+
+//ciArgInt Numeric argument of the messages over rt, JSON numbers are stored as float64
+func ciArgInt(rt route, name string) (int, bool) {
+	v, ok := ciArg(rt, name)
+	if !ok {
+		return 0, false
+	}
+	f, ok := v.(float64)
+	if !ok || f != float64(int(f)) {
+		return 0, false
+	}
+	return int(f), true
+}
+
+//lorawanDownlink Downlink of clm to the LoRaWAN node of rt, the ciargs "fport", "confirmed" and "priority" override
+//the cilorawan defaults
+func lorawanDownlink(clm iotInterface.ComLinkMessage, rt route) *cilorawan.Downlink {
+	d := &cilorawan.Downlink{
+		Data:      clm.Data,
+		FPort:     cilorawan.ConfDownlinkFPort,
+		Confirmed: cilorawan.ConfDownlinkConfirmed,
+	}
+	//FPort 0 carries MAC commands, 224 and up are reserved
+	if fport, ok := ciArgInt(rt, "fport"); ok && fport > 0 && fport < 224 {
+		d.FPort = uint32(fport)
+	}
+	if confirmed, ok := ciArg(rt, "confirmed"); ok {
+		if b, ok := confirmed.(bool); ok {
+			d.Confirmed = b
+		}
+	}
+	if priority, ok := ciArgInt(rt, "priority"); ok {
+		d.Priority = priority
+	}
+	return d
+}
+
+//sixlowpanDatagram Datagram of clm to the 6LoWPAN node of rt. The port of the application is the one of the DevID
+//("[aaaa::2]:5684"), else the "port" ciarg, else cisixlowpan.ConfPort; the "hopLimit" ciarg overrides
+//cisixlowpan.ConfHopLimit
+func sixlowpanDatagram(clm iotInterface.ComLinkMessage, rt route) (cisixlowpan.Datagram, error) {
+	dst, port, err := cisixlowpan.ParseAddress(rt.Node.DevID)
+	if err != nil {
+		return cisixlowpan.Datagram{}, fmt.Errorf("%w: %v", ErrUndeliverable, err)
+	}
+	d := cisixlowpan.Datagram{Destination: dst, Port: port, Data: clm.Data}
+	if p, ok := ciArgInt(rt, "port"); ok && d.Port == 0 && p > 0 && p <= 0xFFFF {
+		d.Port = uint16(p)
+	}
+	if hopLimit, ok := ciArgInt(rt, "hopLimit"); ok && hopLimit > 0 && hopLimit <= 0xFF {
+		d.HopLimit = hopLimit
+	}
+	return d, nil
+}
+
+//sixlowpanOrigin Origin of an uplink from a 6LoWPAN node: the application on its source port ("[aaaa::2]:5684") when
+//registered as a node of its own, else the node
+func (f *Fogcore) sixlowpanOrigin(clm iotInterface.ComLinkMessage) []byte {
+	s := clm.Metadata.Sixlowpan
+	if s == nil {
+		return clm.Origin
+	}
+	application := net.JoinHostPort(s.Source, strconv.Itoa(int(s.SourcePort)))
+	if f.routes.known(application) {
+		return []byte(application)
+	}
+	return clm.Origin
+}
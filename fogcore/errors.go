@@ -0,0 +1,29 @@
+package fogcore
+
+import (
+	"errors"
+)
+
+//Errors returned while handling hecomm sessions and interface messages
+var (
+	//ErrUnknownNode The node is not present in the database
+	ErrUnknownNode = errors.New("fogcore: unknown node")
+	//ErrUnknownPlatform The platform is not present in the database
+	ErrUnknownPlatform = errors.New("fogcore: unknown platform")
+	//ErrNoRoute The node has no link to a destination
+	ErrNoRoute = errors.New("fogcore: no route for node")
+	//ErrNoProvider No provider node is available for the requested information type
+	ErrNoProvider = errors.New("fogcore: no available provider node")
+	//ErrPlatformUnreachable The platform could not be contacted or refused the message
+	ErrPlatformUnreachable = errors.New("fogcore: platform unreachable")
+	//ErrProtocolViolation The peer sent a message that is not valid at this point of the hecomm protocol
+	ErrProtocolViolation = errors.New("fogcore: hecomm protocol violation")
+	//ErrUnknownInterface The communication interface type is not supported
+	ErrUnknownInterface = errors.New("fogcore: unknown communication interface")
+	//ErrMessageTooLarge A hecomm message exceeds ConfMaxMessageSize or has an invalid length
+	ErrMessageTooLarge = errors.New("fogcore: hecomm message too large")
+	//ErrUndeliverable The interface refuses the message as it is, a retry will not help
+	ErrUndeliverable = errors.New("fogcore: undeliverable message")
+	//ErrUnauthorized The identity of the peer does not own the platform it wants to manage
+	ErrUnauthorized = errors.New("fogcore: unauthorized")
+)
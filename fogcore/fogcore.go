@@ -4,28 +4,20 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/tls"
-	"crypto/x509"
+	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"log"
 	"net"
-
-	"github.com/joriwind/hecomm-interface-6lowpan"
-
-	"time"
-
-	"encoding/json"
-
-	"io"
-
-	"fmt"
+	"strings"
 
 	"github.com/joriwind/hecomm-api/hecomm"
 	"github.com/joriwind/hecomm-fog/dbconnection"
 	"github.com/joriwind/hecomm-fog/iotInterface"
 	"github.com/joriwind/hecomm-fog/iotInterface/cilorawan"
 	"github.com/joriwind/hecomm-fog/iotInterface/cisixlowpan"
-	"github.com/joriwind/hecomm-fog/mapping"
+	"github.com/joriwind/hecomm-fog/pki"
 )
 
 //Fogcore Struct
@@ -35,6 +27,18 @@ type Fogcore struct {
 	ciCommonCH   chan iotInterface.ComLinkMessage
 	ciCollection []ci
 	tlsConfig    *tls.Config
+	store        dbconnection.Store
+	routes       *routingTable
+	policy       ProviderPolicy
+	latencies    *latencyTracker
+	credentials  *pki.Cache
+	conns        *connManager
+	queue        *deliveryQueue
+	alerts       *alerts
+	nodeErrors   *nodeErrors
+	gateways     *gatewayPoller
+	lorawan      *lorawanServers
+	sixlowpan    *sixlowpanLinks
 }
 
 type ci struct {
@@ -46,27 +50,87 @@ type ci struct {
 
 type controlCHMessage struct {
 	Message    hecomm.DBCommand
+	Identity   peerIdentity
 	ResponseCH chan bool
 }
 
-/*
- *	State of hecomm protocol
- * Linked: state of hecomm protocol: 0 if not found partner, 1 if found partner
- */
-type linkState struct {
-	LC       hecomm.LinkContract
-	ReqConn  net.Conn
-	ProvConn net.Conn
-	BufReq   []byte
-	BufProv  []byte
-	Ctx      context.Context
+//NewFogcore Create new fogcore module, opening the connection pool of the storage backend
+func NewFogcore(ctx context.Context, dbConfig dbconnection.Config) (*Fogcore, error) {
+	store, err := dbconnection.Open(dbConfig)
+	if err != nil {
+		return nil, err
+	}
+	//All access passes through the routing table to keep it coherent
+	routes, err := newRoutingTable(store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	latencies := newLatencyTracker()
+	policy, err := NewProviderPolicy(ConfProviderPolicy, latencies)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	fogcore := Fogcore{ctx: ctx, store: routes, routes: routes, policy: policy, latencies: latencies, credentials: pki.NewCache()}
+	pki.DefaultWatcher.AddCache(fogcore.credentials)
+	fogcore.conns = newConnManager(ctx, fogcore.platformDialer(), latencies)
+	fogcore.queue = newDeliveryQueue(fogcore.store, fogcore.deliver)
+	fogcore.lorawan = newLorawanServers()
+	fogcore.sixlowpan = newSixlowpanLinks()
+	fogcore.alerts = &alerts{}
+	fogcore.nodeErrors = newNodeErrors(fogcore.store)
+	fogcore.gateways = newGatewayPoller(fogcore.networkGateways, fogcore.alerts.raise)
+	pki.SetRevocationChecker(storeRevocations{store: fogcore.store})
+
+	return &fogcore, nil
 }
 
-//NewFogcore Create new fogcore module
-func NewFogcore(ctx context.Context) *Fogcore {
-	fogcore := Fogcore{ctx: ctx}
+//Store The storage backend owned by the fogcore
+func (f *Fogcore) Store() dbconnection.Store {
+	return f.store
+}
 
-	return &fogcore
+//RoutingStats Statistics of the uplink routing table
+func (f *Fogcore) RoutingStats() RoutingStats {
+	return f.routes.Stats()
+}
+
+//PendingMessages Downlinks waiting in the queues of their destinations
+func (f *Fogcore) PendingMessages() ([]dbconnection.QueuedMessage, error) {
+	nodes, err := f.store.GetPendingDestinations()
+	if err != nil {
+		return nil, err
+	}
+	var pending []dbconnection.QueuedMessage
+	for _, nodeID := range nodes {
+		messages, err := f.store.GetQueuedMessages(nodeID)
+		if err != nil {
+			return pending, err
+		}
+		pending = append(pending, messages...)
+	}
+	return pending, nil
+}
+
+//DeadLetters Downlinks that were given up on
+func (f *Fogcore) DeadLetters() ([]dbconnection.QueuedMessage, error) {
+	return f.store.GetDeadLetters()
+}
+
+//ReplayDeadLetter Queue a dead-lettered downlink again
+func (f *Fogcore) ReplayDeadLetter(id int) error {
+	return f.queue.Replay(id)
+}
+
+//PurgeDeadLetter Drop a dead-lettered downlink
+func (f *Fogcore) PurgeDeadLetter(id int) error {
+	return f.queue.Purge(id)
+}
+
+//PoolStats Connection state of every platform the fog connected to
+func (f *Fogcore) PoolStats() []PoolStats {
+	return f.conns.Stats()
 }
 
 //Start Start the fogcore module
@@ -74,9 +138,16 @@ func (f *Fogcore) Start() error {
 	//Start management interface
 	f.controlCH = make(chan controlCHMessage, 20)
 	go f.listenOnTLS()
+	go f.conns.run()
+	//Retry the downlinks left queued by a previous run as well
+	if err := f.queue.requeueInFlight(); err != nil {
+		log.Printf("fogcore: unable to recover the messages in flight: %v\n", err)
+	}
+	go f.queue.run(f.ctx)
+	go f.gateways.run(f.ctx, f.store)
 
 	//Startup already known platforms
-	platforms, err := dbconnection.GetPlatforms()
+	platforms, err := f.store.GetPlatforms()
 	if err != nil {
 		log.Fatalf("fogcore: something went wrong in retrieving interfaces: %v", err)
 	}
@@ -92,47 +163,49 @@ func (f *Fogcore) Start() error {
 		platform := pl //Map variable, else last value used!
 		face := ci{Platform: &platform, Channel: channel, Ctx: ctx, Cancel: cancel}
 		f.ciCollection = append(f.ciCollection, face)
-		f.startInterface(&f.ciCollection[len(f.ciCollection)-1])
+		if err := f.startInterface(&f.ciCollection[len(f.ciCollection)-1]); err != nil {
+			log.Printf("fogcore: unable to start interface of platform: %v, error: %v\n", platform, err)
+		}
 	}
 
 	for {
 		select {
 		case cm := <-f.controlCH:
-			if err := f.executeCommand(&cm.Message); err != nil {
+			err := f.executeCommand(&cm.Message, cm.Identity)
+			action, subject := describeCommand(&cm.Message)
+			audit(cm.Identity, action, subject, err)
+			if err != nil {
 				log.Printf("Error in executeCommand! controlMessage: %v\n", err)
 				cm.ResponseCH <- false
-				//return nil
+			} else {
+				cm.ResponseCH <- true
 			}
-			cm.ResponseCH <- true
 		case clm := <-f.ciCommonCH:
 			if err := f.handleCIMessage(clm); err != nil {
-				log.Printf("Error in handleCIMessage! message: %v\n", clm)
+				log.Printf("Error in handleCIMessage! message: %v, error: %v\n", clm, err)
 			}
 		case <-f.ctx.Done():
-			return nil
+			return f.store.Close()
 		}
 	}
 }
 
 func (f *Fogcore) listenOnTLS() error {
-	cert, err := tls.LoadX509KeyPair(ConfFogcoreCert, ConfFogcoreKey)
+	keyPair, err := pki.LoadKeyPair(ConfFogcoreCert, ConfFogcoreKey)
 	if err != nil {
 		log.Fatalf("fogcore: tls error: loadkeys: %s", err)
 		return err
 	}
-
-	caCert, err := ioutil.ReadFile(ConfFogcoreCaCert)
+	caPool, err := pki.LoadCAPool(ConfFogcoreCaCert)
 	if err != nil {
 		log.Fatalf("cacert error: %v\n", err)
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+	//Rotated certificates are picked up by the next handshake
+	pki.DefaultWatcher.AddKeyPair(keyPair)
+	pki.DefaultWatcher.AddCAPool(caPool)
 
-	config := &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		RootCAs:            caCertPool,
-		InsecureSkipVerify: false,
-	}
+	//Platforms have to authenticate with a certificate of the CA, it binds them to their platform record
+	config := pki.ServerConfig(keyPair, caPool)
 	config.Rand = rand.Reader
 	f.tlsConfig = config
 	listener, err := tls.Listen("tcp", ConfFogcoreAddress, f.tlsConfig)
@@ -167,15 +240,7 @@ func (f *Fogcore) listenOnTLS() error {
 			}
 
 			log.Printf("fogcore: accepted TLS connection from %s", conn.RemoteAddr())
-			tlscon, ok := conn.(*tls.Conn)
-			if ok {
-				state := tlscon.ConnectionState()
-				for _, v := range state.PeerCertificates {
-					log.Print(x509.MarshalPKIXPublicKey(v.PublicKey))
-				}
-				log.Printf("New connection from: %v\n", conn.RemoteAddr())
-				go f.handleTLSConn(conn)
-			}
+			go f.handleTLSConn(conn)
 		case <-f.ctx.Done():
 			return nil
 		}
@@ -183,12 +248,29 @@ func (f *Fogcore) listenOnTLS() error {
 
 }
 
-func (f *Fogcore) handleTLSConn(conn net.Conn) {
-	buf := make([]byte, 10000)
+func (f *Fogcore) handleTLSConn(c net.Conn) {
+	//Replies follow the framing of the requester
+	conn := newFrameConn(c, ConfFraming)
 	defer conn.Close()
+	//Verify the client certificate before anything is read
+	id := peerIdentity{Remote: c.RemoteAddr().String()}
+	if tlscon, ok := c.(*tls.Conn); ok {
+		if err := tlscon.Handshake(); err != nil {
+			log.Printf("fogcore: handleTLSConn: handshake with %v failed: %v\n", c.RemoteAddr(), err)
+			return
+		}
+		id = newPeerIdentity(tlscon.ConnectionState(), c.RemoteAddr())
+	}
+	log.Printf("New connection from: %v, identity: %v\n", c.RemoteAddr(), id)
+	//A failing session should never take down the fog
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("fogcore: handleTLSConn: recovered from panic: %v, remote: %v\n", r, conn.RemoteAddr())
+		}
+	}()
 	for {
 		//Read
-		n, err := conn.Read(buf)
+		buf, err := conn.ReadMessage()
 		if err != nil {
 			if err == io.EOF { //Check if connection was closed by remote
 				log.Printf("Connection closed by remote: %v\n", conn.RemoteAddr())
@@ -197,356 +279,123 @@ func (f *Fogcore) handleTLSConn(conn net.Conn) {
 			log.Printf("fogcore: handleTLSConn: error: %v\n", err)
 			return
 		}
-		//var m tlsMessage
-		//err = json.Unmarshal(buf[0:n], m)
-		m, err := hecomm.GetMessage(buf[:n])
+		m, err := hecomm.GetMessage(buf)
 		if err != nil {
 			log.Printf("fogcore: handleTLSConn: NewMessage: error: %v\n", err)
+			sendResponse(conn, false)
 			return
 		}
 		log.Printf("Hecomm message received: FPort: %v, remote: %v\n", m.FPort, conn.RemoteAddr())
 
 		//Detect control message, is boolean 'Link' true or false?
 		switch m.FPort {
-		case 10:
-			bufProv := make([]byte, 10000)
-			ctx, cancel := context.WithTimeout(f.ctx, time.Minute*5)
-			defer cancel()
-			ls := linkState{
-				ReqConn: conn,
-				BufReq:  buf,
-				BufProv: bufProv,
-				Ctx:     ctx,
-			}
-			ls.handleLinkProtocol(m, f.tlsConfig)
+		case hecomm.FPortLinkReq:
+			ctx, cancel := context.WithTimeout(f.ctx, ConfLinkTimeout)
+			ls := newLinkState(ctx, conn, id, f.store, f.policy, f.conns)
+			//The requester was already notified of a failure by the protocol
+			if err := ls.handleLinkProtocol(m); err != nil {
+				log.Printf("fogcore: handleTLSConn: link session failed in %v: %v, remote: %v\n", ls.Phase, err, conn.RemoteAddr())
+			}
+			cancel()
+			//The session owned the connection, it ends with the session
+			return
 
 		case 0:
 			//Unmarshal the data part of hecomm message as command
 			cm, err := m.GetCommand()
 			if err != nil {
 				log.Printf("fogcore: handleTLSConn: GetCommand error: %v\n", err)
+				sendResponse(conn, false)
 				return
 			}
 			resp := make(chan bool, 1)
 			cchm := controlCHMessage{
 				Message:    *cm,
+				Identity:   id,
 				ResponseCH: resp,
 			}
 			//Sending command to main routine, waiting for answer, also getting ready to close connection
 			f.controlCH <- cchm
 			response := <-resp
 			log.Printf("DBcommand resulted in: %v\n", response)
-			rsp, err := hecomm.NewResponse(response)
-			if err != nil {
-				log.Printf("fogcore: handleTLSConn: getbytes of response, error: %v\n", err)
-				return
-			}
 			//Writing answer to client
-			conn.Write(rsp)
+			sendResponse(conn, response)
 			//Stop connection
 			break
 		default:
 			log.Printf("Unexpected FPort: %v\n", m.FPort)
+			sendResponse(conn, false)
 		}
 
 	}
 }
 
-func (ls *linkState) handleLinkProtocol(sP *hecomm.Message, tlsConfig *tls.Config) {
-	//Buffers
-	var message *hecomm.Message
-	var err error
-	var rcv []byte
-	//rcv = make([]byte, 10000)
-	rcvOrigFromReq := true
-
-	//Init
-	message = sP
-	chReq := make(chan []byte, 1)
-	chProv := make(chan []byte, 1)
-	chError := make(chan error)
-
-	//Tunnel data from requester to channel requester
-	go func(ch chan []byte, chError chan error) {
-
-		buf := make([]byte, 4048)
-		s := 0
-		n := 0
-		var err error
-		for {
-
-			for {
-				n, err = ls.ReqConn.Read(buf)
-				if err != nil {
-					//log.Fatalf("Could not read from connection: %v\n", err)
-					chError <- err
-					return
-				}
-				fmt.Printf("Received %v bytes from requester\n", n)
-
-				if buf[0] != 123 {
-					chError <- fmt.Errorf("First character != 123: %v", buf[0])
-					return
-				}
-
-				if buf[n+s-1] == 125 {
-					break
-				} else {
-					s = s + n
-				}
-			}
-			ch <- buf[:n+s]
-			s = 0
-			n = 0
-		}
-	}(chReq, chError)
-
-	//Keep running while protocol is active
-	for {
-		fmt.Printf("Received message, FPort: %v, originReq: %v\n", message.FPort, rcvOrigFromReq)
-		//Do action depending on type of message
-		switch message.FPort {
-
-		case hecomm.FPortLinkReq:
-			//TODO: check requesting node and platform, in db?
-			lc, err := message.GetLinkContract()
-			if err != nil {
-				log.Printf("Unable to formulate LinkContract from message: %v, error: %v\n", string(message.Data), err)
-				break
-			}
-
-			//Check if requester node is in the db
-			reqNode, err := dbconnection.FindNode(lc.ReqDevEUI)
-			if err != nil {
-				log.Fatalf("fogcore: handleLinkProtocol: error in locating requesting node: %v, error %v\n", lc, err)
-			}
-			//If not valid id
-			if reqNode.ID == 0 {
-				log.Printf("fogcore: handleLinkProtocol: dit not find requesting node in db: %v\n", message)
-				bytes, err := hecomm.NewResponse(false)
-				if err != nil {
-					log.Fatalf("Failed to formulate %v response, error: %v\n", false, err)
-				}
-				ls.ReqConn.Write(bytes)
-				return
-			}
-
-			//Ready to find partner
-			ls.LC = *lc
-
-			//Locating a possible provider node
-			tmpProvnode, err := dbconnection.FindAvailableProviderNode(lc.InfType)
-			if err != nil {
-				log.Fatalf("Error in finding provider node in DB: InfType: %v, error: %v\n", lc.InfType, err)
-			}
-			if tmpProvnode.ID == 0 {
-				log.Printf("fogcore: handleLinkProtocol: Dit not find suitable provider node! link request: %v\n", string(sP.Data))
-				//Sending failed response
-				bytes, err := hecomm.NewResponse(false)
-				if err != nil {
-					log.Fatalf("Failed to formulate false response, error: %v\n", err)
-				}
-				ls.ReqConn.Write(bytes)
-				return
-			}
-
-			platform, err := dbconnection.GetPlatform(tmpProvnode.PlatformID)
-			if err != nil {
-				log.Fatalf("Failed to retrieve platform from DB, platform ID: %v, error: %v\n", tmpProvnode.ID, err)
-			}
-
-			//Setup tls connection to provider platform
-			ls.ProvConn, err = tls.Dial("tcp", platform.Address, tlsConfig)
-			if err != nil {
-				log.Printf("Could not reach provider platform: %v\n", err)
-				//TODO: connection not available
-				bytes, err := hecomm.NewResponse(false)
-				if err != nil {
-					log.Fatalf("Failed to formuate false response, error: %v\n", err)
-				}
-				ls.ReqConn.Write(bytes)
-				return
-			}
-			defer ls.ProvConn.Close()
-
-			//Send contract for node to provider platform
-			ls.LC.ProvDevEUI = []byte(tmpProvnode.DevID)
-			bytes, err := ls.LC.GetBytes()
-			if err != nil {
-				log.Fatalf("Failed to compile linkcontract into bytes, linkcontract: %v, error: %v\n", ls.LC, err)
-				return
-			}
-			bytes, err = hecomm.NewMessage(hecomm.FPortLinkReq, bytes)
-			if err != nil {
-				log.Fatalf("Failed to compile message into bytes, FPort: %v, error: %v\n", hecomm.FPortLinkReq, err)
-				return
-			}
-			ls.ProvConn.Write(bytes)
-
-			//Tunnel data from provider to channel provider
-			go func(ch chan []byte, chError chan error) {
-
-				buf := make([]byte, 4048)
-				s := 0
-				n := 0
-				var err error
-
-				for {
-					for {
-						n, err = ls.ProvConn.Read(buf[s:])
-						if err != nil {
-							//log.Fatalf("Could not read from connection: %v\n", err)
-							chError <- err
-							return
-						}
-						fmt.Printf("Received %v bytes from provider\n", n)
-
-						if buf[0] != 123 {
-							chError <- fmt.Errorf("First character != 123: %v", buf[0])
-							return
-						}
-
-						if buf[n+s-1] == 125 {
-							break
-						} else {
-							s = s + n
-						}
-					}
-					ch <- buf[:n+s]
-					s = 0
-					n = 0
-				}
-			}(chProv, chError)
-
-		case hecomm.FPortLinkState:
-			//Depending on origin of data send to the other
-			/* bytes, err := message.GetBytes()
-			if err != nil {
-				log.Fatalf("Unable to compile message to bytes: %v\n", err)
-			} */
-			if rcvOrigFromReq {
-				ls.ProvConn.Write(rcv)
-			} else {
-				ls.ReqConn.Write(rcv)
-			}
-
-		case hecomm.FPortLinkSet:
-			//TODO:Check if memorised LC is similar to received Linkcontract
-			lc, err := message.GetLinkContract()
-			if err != nil {
-				log.Fatalf("fogcore: handleLinkProtocol: unvalid data set packet: %v, error: %v\n", string(message.Data), err)
-				return
-			}
-			//If status linked and received from requester --> send contract to provider
-			if lc.Linked == true && rcvOrigFromReq {
-				//Send contract to provider
-				ls.LC.Linked = true
-				bytes, err := ls.LC.GetBytes()
-				if err != nil {
-					log.Fatalf("fogcore: handleLinkProtocol: linkcontract to bytes, error: %v\n", err)
-					return
-
-				}
-				bytes, err = hecomm.NewMessage(hecomm.FPortLinkSet, bytes)
-				if err != nil {
-					log.Fatalf("Failed to compile message into bytes, FPort: %v, error: %v\n", hecomm.FPortLinkSet, err)
-					return
-				}
-				ls.ProvConn.Write(bytes)
-			}
-
-		case hecomm.FPortResponse:
-			rsp, err := message.GetResponse()
-			if err != nil {
-				log.Fatalf("fogcore: handleLinkProtocol: invalid response message: %v, error %v\n", message, err)
-			}
-			switch ls.LC.Linked {
-			case false:
-				//Found valid partner or not!
-				if rsp.OK && !rcvOrigFromReq { //Response to request for prov node
-
-					//Sending linkcontract to requester
-					bytes, err := ls.LC.GetBytes()
-					if err != nil {
-						log.Fatalf("fogcore: handleLinkProtocol: ok tslResponse, error: %v\n", err)
-						return
-					}
-					bytes, err = hecomm.NewMessage(hecomm.FPortLinkReq, bytes)
-					if err != nil {
-						log.Fatalf("Failed to compile message into bytes, FPort: %v, error: %v\n", hecomm.FPortLinkSet, err)
-						return
-					}
-					ls.ReqConn.Write(bytes)
-
-				} else {
-					//TODO: in case of not valid response, search for other provider!!
-					log.Printf("fogcore: handleLinkProtocol: NOT OK response, what to do? State: %v\n", ls.LC)
-					bytes, err := hecomm.NewResponse(false)
-					if err != nil {
-						log.Fatalf("Unable to compile response into bytes: %v\n", err)
-					}
-					ls.ReqConn.Write(bytes)
-					return
-				}
-			case true:
-				//Connection is set and key was generated!
-				if rsp.OK && !rcvOrigFromReq {
-
-					//Sending OK response to requester
-					bytes, err := hecomm.NewResponse(true)
-					if err != nil {
-						log.Fatalf("fogcore: handleLinkProtocol: ok tslResponse, error: %v\n", err)
-						return
-					}
-					ls.ReqConn.Write(bytes)
-					link, err := mapping.ConvertToLink(ls.LC)
-					if err != nil {
-						log.Fatalf("fogcore: handleLinkProtocol: could not convert contract to link: contract: %v, error: %v\n", ls.LC, err)
-					}
-					err = dbconnection.InsertLink(link)
-					if err != nil {
-						log.Fatalf("fogcore: handleLinkProtocol: could not insert link: contract: %v, error: %v\n", link, err)
-					}
-					//Link is set!
-					return
-				}
-				//TODO: in case of not valid response, search for other provider
-				log.Fatalf("fogcore: handleLinkProtocol: NOT OK response, what to do? State: %v\n", ls)
-
-			}
+//sendResponse Send a hecomm response to the peer, failures are only logged as the session is ending anyway
+func sendResponse(conn *frameConn, ok bool) {
+	bytes, err := hecomm.NewResponse(ok)
+	if err != nil {
+		log.Printf("fogcore: unable to compile %v response: %v\n", ok, err)
+		return
+	}
+	if err := conn.WriteMessage(bytes); err != nil {
+		log.Printf("fogcore: unable to send %v response to %v: %v\n", ok, conn.RemoteAddr(), err)
+	}
+}
 
-		default:
-			log.Fatalf("fogcore: handleLinkProtocol: unexpected FPort: %v\n", message.FPort)
+//sendMessage Compile data into a hecomm message and send it over conn
+func sendMessage(conn *frameConn, fport int, data []byte) error {
+	bytes, err := hecomm.NewMessage(fport, data)
+	if err != nil {
+		return fmt.Errorf("fogcore: failed to compile message into bytes, FPort: %v, error: %v", fport, err)
+	}
+	return conn.WriteMessage(bytes)
+}
 
+//findPlatformByAddress Platform with address, an empty platform if unknown
+func (f *Fogcore) findPlatformByAddress(address string) (dbconnection.Platform, error) {
+	pls, err := f.store.GetPlatforms()
+	if err != nil {
+		return dbconnection.Platform{}, err
+	}
+	for _, pl := range pls {
+		if pl.Address == address {
+			return pl, nil
 		}
+	}
+	return dbconnection.Platform{}, nil
+}
 
-		//Wait for either packet from requester or data provider
-		select {
-		case rcv = <-chReq:
-			rcvOrigFromReq = true
-
-		case rcv = <-chProv:
-			rcvOrigFromReq = false
-
-		case err := <-chError:
-			log.Printf("fogcore: handleLinkProtocol: received error from a channel: %v\n", err)
-			return
-
-		case <-ls.Ctx.Done():
-			log.Printf("fogcore: handleLinkProtocol: context ended linkState: %v\n", ls)
-			return
-		}
+//findPlatform Platform with address and interface type, an empty platform if unknown
+func (f *Fogcore) findPlatform(address string, ciType int) (dbconnection.Platform, error) {
+	pl, err := f.findPlatformByAddress(address)
+	if err != nil || pl.CIType != ciType {
+		return dbconnection.Platform{}, err
+	}
+	return pl, nil
+}
 
-		//Translate packet
-		message, err = hecomm.GetMessage(rcv)
-		if err != nil {
-			log.Fatalf("fogcore: handleLinkProtocol: unable to unmarshal linkmessage: %v\n", err)
-		}
+//describeCommand Action and subject of a command, for the audit trail
+func describeCommand(command *hecomm.DBCommand) (string, string) {
+	action := "delete"
+	if command.Insert {
+		action = "insert"
+	}
+	switch command.EType {
+	case hecomm.ETypePlatform:
+		var element hecomm.DBCPlatform
+		json.Unmarshal(command.Data, &element)
+		return action + " platform", element.Address
+	case hecomm.ETypeNode:
+		var element hecomm.DBCNode
+		json.Unmarshal(command.Data, &element)
+		return action + " node", fmt.Sprintf("%s@%v", element.DevEUI, element.PlAddress)
+	default:
+		return fmt.Sprintf("%v etype %v", action, command.EType), ""
 	}
 }
 
-//executeCommand Handle the control messages
-func (f *Fogcore) executeCommand(command *hecomm.DBCommand) error {
+//executeCommand Handle the control messages of peer id, which may only manage its own platforms
+func (f *Fogcore) executeCommand(command *hecomm.DBCommand, id peerIdentity) error {
 	log.Printf("Executing DBCommand: EType: %v, Insert: %v\n", command.EType, command.Insert)
 	switch command.EType {
 	case hecomm.ETypePlatform: //Start new platform
@@ -563,12 +412,30 @@ func (f *Fogcore) executeCommand(command *hecomm.DBCommand) error {
 			CIType:  int(element.CI),
 		}
 
+		//Only the owner of a registered platform may change it
+		existing, err := f.findPlatformByAddress(platform.Address)
+		if err != nil {
+			return err
+		}
+		if existing.ID != 0 {
+			if err := id.authorize(f.store, existing); err != nil {
+				return err
+			}
+			platform.Identity = existing.Identity
+			//Not part of the hecomm registration: network server, listen address and credentials stay
+			platform.CIArgs = existing.CIArgs
+			platform.TLSCert, platform.TLSKey, platform.TLSCaCert, platform.TLSServerName = existing.TLSCert, existing.TLSKey, existing.TLSCaCert, existing.TLSServerName
+		} else if command.Insert && !id.IsAdmin() {
+			//Starting an interface opens devices and servers of the fog, only admins add platforms
+			return fmt.Errorf("%w: only admins may register new platform %v", ErrUnauthorized, platform.Address)
+		}
+
 		//Depending on insert bool, insert or delete
 		switch command.Insert {
 		case true:
 			//Check if interface already exists?
-			for index, ci := range f.ciCollection {
-
+			for index := range f.ciCollection {
+				ci := &f.ciCollection[index]
 				if ci.Platform.Address == platform.Address {
 					log.Printf("Execute command: Communication interface already present")
 					var newPlatform dbconnection.Platform
@@ -576,10 +443,12 @@ func (f *Fogcore) executeCommand(command *hecomm.DBCommand) error {
 					//Only need the ID for db
 					newPlatform.ID = ci.Platform.ID
 					log.Printf("Updating platform with new information: %+v\n", newPlatform)
-					err := dbconnection.UpdatePlatform(&newPlatform)
+					err := f.store.UpdatePlatform(&newPlatform)
 					if err != nil {
 						return err
 					}
+					//Pooled connections may use the old credentials
+					f.conns.Forget(newPlatform.ID)
 					//Stop old platform interface
 					ci.Cancel()
 
@@ -590,39 +459,50 @@ func (f *Fogcore) executeCommand(command *hecomm.DBCommand) error {
 					ci.Platform = &newPlatform
 					//Channel is reused
 
-					f.startInterface(&f.ciCollection[index])
-					return nil
+					return f.startInterface(ci)
 				}
 
 			}
+			if existing.ID != 0 {
+				return fmt.Errorf("fogcore: platform %v is registered without running interface", platform.Address)
+			}
 
 			channel := make(chan iotInterface.ComLinkMessage, 5)
 			ctx, cancel := context.WithCancel(f.ctx)
 			//Add new interface to end of collection
 			f.ciCollection = append(f.ciCollection, ci{Platform: &platform, Channel: channel, Ctx: ctx, Cancel: cancel})
 			//Startup last added interface
-			f.startInterface(&f.ciCollection[len(f.ciCollection)-1])
+			if err := f.startInterface(&f.ciCollection[len(f.ciCollection)-1]); err != nil {
+				cancel()
+				f.ciCollection = f.ciCollection[:len(f.ciCollection)-1]
+				return err
+			}
 
 			//Add to db
-			err := dbconnection.InsertPlatform(&platform)
+			err := f.store.InsertPlatform(&platform)
 			if err != nil {
 				return err
 			}
 			log.Printf("New platform inserted: %v\n", platform)
 
 		case false: //Stop a platform
+			if existing.ID == 0 || existing.CIType != platform.CIType {
+				return fmt.Errorf("fogcore: unknown platform: %v, type: %v", platform.Address, platform.CIType)
+			}
+			//Remove from db
+			if err := f.store.DeletePlatform(existing.ID); err != nil {
+				return err
+			}
+			f.conns.Forget(existing.ID)
+			f.lorawan.remove(existing)
+			f.sixlowpan.remove(existing)
 			for index, intface := range f.ciCollection {
-				if intface.Platform.Address == platform.Address && intface.Platform.CIType == platform.CIType {
-					//Remove from db
-					err = dbconnection.DeletePlatform(intface.Platform.ID)
-					if err != nil {
-						return err
-					}
-
+				if intface.Platform.ID == existing.ID {
+					intface.Cancel()
 					//Delete while preserving order
 					//append the slice part before the element with all the elements after the specific element
 					f.ciCollection = append(f.ciCollection[:index], f.ciCollection[index+1:]...)
-
+					break
 				}
 			}
 			log.Printf("Platform Deleted: %v\n", platform)
@@ -637,21 +517,18 @@ func (f *Fogcore) executeCommand(command *hecomm.DBCommand) error {
 		if err != nil {
 			return err
 		}
-		pls, err := dbconnection.GetPlatforms()
+		platform, err := f.findPlatform(element.PlAddress, int(element.PlType))
 		if err != nil {
 			return err
 		}
-		for _, pl := range pls {
-			if pl.Address == element.PlAddress {
-				if pl.CIType == int(element.PlType) {
-					platformID = pl.ID
-					break
-				}
-			}
-		}
+		platformID = platform.ID
 		if platformID == 0 {
 			return fmt.Errorf("Could not find platform for node, origin: %v, type: %v", element.PlAddress, element.PlType)
 		}
+		//Nodes are managed by their own platform only
+		if err := id.authorize(f.store, platform); err != nil {
+			return err
+		}
 
 		node = dbconnection.Node{
 			DevID:      string(element.DevEUI),
@@ -663,18 +540,28 @@ func (f *Fogcore) executeCommand(command *hecomm.DBCommand) error {
 		//Depending on insert bool, insert or delete
 		switch command.Insert {
 		case true:
-			err := dbconnection.InsertNode(&node)
+			err := f.store.InsertNode(&node)
 			if err != nil {
 				return err
 			}
+			log.Printf("New node inserted %v\n", node)
 
 		case false:
-			err := dbconnection.DeleteNode(node.ID)
+			existing, err := f.store.FindNode([]byte(node.DevID))
 			if err != nil {
 				return err
 			}
+			if existing.ID == 0 {
+				return fmt.Errorf("%w: %v", ErrUnknownNode, node.DevID)
+			}
+			if existing.PlatformID != platformID {
+				return fmt.Errorf("%w: node %v belongs to another platform", ErrUnauthorized, node.DevID)
+			}
+			if err := f.store.DeleteNode(existing.ID); err != nil {
+				return err
+			}
+			log.Printf("Node deleted %v\n", existing)
 		}
-		log.Printf("New node inserted %v\n", node)
 
 	default:
 		return fmt.Errorf("fogcore: executeCommand: unexpected EType: %v", command.EType)
@@ -693,7 +580,23 @@ func (f *Fogcore) startInterface(iot *ci) error {
 	case int(hecomm.CILorawan):
 
 		//args := (grpc.ServerOption)pl.CIArgs
-		lorawanapi := cilorawan.NewApplicationServerAPI(iot.Ctx, iot.Channel)
+		//Every platform has its own application server, network server and credentials
+		lorawanapi, err := cilorawan.NewApplicationServerAPI(iot.Ctx, iot.Channel, lorawanASAddress(*iot.Platform), platformCredentials(*iot.Platform))
+		if err != nil {
+			return fmt.Errorf("%w: cilorawan: %v", ErrPlatformUnreachable, err)
+		}
+		//Downlinks are only accepted once the network server can fetch them
+		err = f.lorawan.start(*iot.Platform, lorawanASAddress(*iot.Platform), func() (lorawanServer, error) {
+			if err := lorawanapi.Listen(); err != nil {
+				return lorawanServer{}, fmt.Errorf("%w: cilorawan: %v", ErrPlatformUnreachable, err)
+			}
+			return lorawanServer{downlinks: lorawanapi.Downlinks(), stop: lorawanapi.Stop}, nil
+		})
+		if err != nil {
+			return err
+		}
+		lorawanapi.SetKeyStore(storeKeys{f.store}, networkSessions{f.conns, *iot.Platform})
+		lorawanapi.SetErrorHandler(f.lorawanErrors(*iot.Platform))
 		log.Println("Starting LoRaWAN interface!")
 		//Start the cilorawan
 		go func() {
@@ -711,11 +614,12 @@ func (f *Fogcore) startInterface(iot *ci) error {
 	case int(hecomm.CISixlowpan):
 		//Create the communication to the iot interface thread
 
-		config := sixlowpan.Config{
-			DebugLevel: SixlowpanDebugLevel,
-			PortName:   SixlowpanPort,
+		//Every platform has its own border router, receive and transmit share the line to it
+		link, err := f.sixlowpan.open(*iot.Platform)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrPlatformUnreachable, err)
 		}
-		sixlowpanServer := cisixlowpan.NewServer(iot.Ctx, iot.Channel, config)
+		sixlowpanServer := cisixlowpan.NewServer(iot.Ctx, iot.Channel, link)
 		log.Println("Starting 6LoWPAN interface!")
 		//Start the cilorawan
 		go func() {
@@ -731,65 +635,166 @@ func (f *Fogcore) startInterface(iot *ci) error {
 		}()
 
 	default:
-		return fmt.Errorf("Unkown interface requested! %v", iot)
+		return fmt.Errorf("%w: %v", ErrUnknownInterface, iot.Platform.CIType)
 	}
 
 	return nil
 }
 
+//DeliveryResult Outcome of forwarding a message to one of its destinations
+type DeliveryResult struct {
+	Destination dbconnection.Node
+	Platform    dbconnection.Platform
+	Err         error
+	//Queued Not delivered yet, the message is retried from the queue of the destination
+	Queued bool
+}
+
+//DeliveryError Forwarding a message failed for one or more destinations
+type DeliveryError struct {
+	Results []DeliveryResult
+}
+
+func (e *DeliveryError) Error() string {
+	var failed []string
+	for _, r := range e.Results {
+		if r.Err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", r.Destination.DevID, r.Err))
+		}
+	}
+	return fmt.Sprintf("fogcore: delivery failed for %v of %v destinations: %v", len(failed), len(e.Results), strings.Join(failed, "; "))
+}
+
+//Unwrap The errors of the failed destinations
+func (e *DeliveryError) Unwrap() []error {
+	var errs []error
+	for _, r := range e.Results {
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+		}
+	}
+	return errs
+}
+
+//handleCIMessage Queue an uplink for all its destinations and try to deliver it right away, failures only affect this message
 func (f *Fogcore) handleCIMessage(clm iotInterface.ComLinkMessage) error {
-	//Find destination node
-	dstnode, err := dbconnection.GetDestination(&clm)
-	if err != nil {
-		log.Fatalf("fogcore: Error in searching for destination node, message: %v", clm)
-		return err
+	recordUplink(clm)
+	if clm.InterfaceType == hecomm.CISixlowpan {
+		clm.Origin = f.sixlowpanOrigin(clm)
 	}
-	platform, err := dbconnection.GetPlatform(dstnode.PlatformID)
+	//Find destination nodes and their platforms
+	all, err := f.routes.Lookup(&clm)
 	if err != nil {
-		log.Fatalf("fogcore: Error in searching for platform of destination node, dstnode: %v", dstnode)
 		return err
+	}
+	//Only the destinations whose metadata rules the message passes
+	var routes []route
+	for _, rt := range all {
+		match, err := matchesMetadata(&clm, rt)
+		if err != nil {
+			log.Printf("%v\n", err)
+		}
+		if !match {
+			metricFiltered.Add(1)
+			log.Printf("Delivery: from %v, to %v filtered on metadata: %v\n", string(clm.Origin), rt.Node.DevID, clm.Metadata)
+			continue
+		}
+		routes = append(routes, rt)
+	}
 
+	results := make([]DeliveryResult, len(routes))
+	failed := false
+	for i, rt := range routes {
+		results[i] = f.enqueue(clm, rt)
+		if results[i].Err != nil {
+			failed = true
+		}
+		log.Printf("Delivery: from %v, to %v, platform: %v, queued: %v, error: %v, metadata: %v\n", string(clm.Origin), rt.Node.DevID, rt.Platform.Address, results[i].Queued, results[i].Err, clm.Metadata)
+	}
+	if failed {
+		return &DeliveryError{Results: results}
+	}
+	return nil
+}
+
+//enqueue Persist the message for the destination of rt, then deliver the queue of the destination up to it
+func (f *Fogcore) enqueue(clm iotInterface.ComLinkMessage, rt route) DeliveryResult {
+	result := DeliveryResult{Destination: rt.Node, Platform: rt.Platform}
+	queued, err := f.queue.Enqueue(clm, rt)
+	if err != nil {
+		result.Err = err
+		return result
 	}
+	attempts, err := f.queue.Flush(rt.Node.ID)
+	if err != nil {
+		result.Err = err
+		result.Queued = true
+		return result
+	}
+	err, attempted := attempts[queued.ID]
+	result.Err = err
+	//Waiting behind an earlier message, or failed and retried later
+	result.Queued = !attempted || (err != nil && retryable(err))
+	return result
+}
+
+//deliver Send message to a single destination node over the interface of its platform
+func (f *Fogcore) deliver(clm iotInterface.ComLinkMessage, rt route, m *dbconnection.QueuedMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("fogcore: recovered from panic in deliver: %v", r)
+		}
+	}()
 	log.Printf("Redirecting message: from %v, to %v, data: %x\n", string(clm.Origin), string(clm.Destination), clm.Data)
 
 	//Send to destination node
+	dstnode, platform := rt.Node, rt.Platform
 	switch platform.CIType {
 	case int(hecomm.CILorawan):
 
-		//Create client, to send the message
-		client, err := cilorawan.NewNetworkClient(context.Background(), cilorawan.ConfNSAddress)
-		if err != nil {
-			log.Fatalf("fogcore: cilorawan: creation of newnetworkclient failed! address: %v\n", "")
-			return err
+		//Served in the next receive window of the class-A node, the message stays queued until then
+		downlink := lorawanDownlink(clm, rt)
+		downlink.Expires = m.Expires
+		nodeID, id := m.NodeID, m.ID
+		downlink.Done = func(err error) {
+			if errors.Is(err, cilorawan.ErrQueueClosed) {
+				err = fmt.Errorf("%w: %v", ErrPlatformUnreachable, err)
+			}
+			//Called by the queue of the application server, which may be pushing on behalf of a flush of this node
+			go f.queue.Settle(nodeID, id, err)
 		}
-		defer client.Close()
-		//Send data with created client
-		err = client.SendData(clm)
+		//Fetched by the network server of the platform of the node
+		downlinks, err := f.lorawan.downlinks(platform)
 		if err != nil {
-			log.Fatalf("fogcore: cilorawan: unable to send message: %v", err)
 			return err
 		}
+		if err := downlinks.Push(clm.Destination, downlink); err != nil {
+			if errors.Is(err, cilorawan.ErrQueueClosed) {
+				return fmt.Errorf("%w: %v", ErrPlatformUnreachable, err)
+			}
+			return fmt.Errorf("%w: %v", ErrUndeliverable, err)
+		}
+		return errInFlight
 
 	case int(hecomm.CISixlowpan):
-		config := sixlowpan.Config{
-			DebugLevel: SixlowpanDebugLevel,
-			PortName:   SixlowpanPort,
-		}
-		client, err := cisixlowpan.NewClient(config)
+		//Sent over the line the server of the platform of the node receives on
+		link, err := f.sixlowpan.link(platform)
 		if err != nil {
-			log.Fatalf("fogcore: cisixlowpan: unable to create client, destination: %v\n", dstnode.DevID)
 			return err
 		}
-		defer client.Close()
-
-		err = client.SendData(clm)
+		datagram, err := sixlowpanDatagram(clm, rt)
 		if err != nil {
-			log.Fatalf("fogcore: cisixlowpan: unable to send message: %v, error: %v\n", clm, err)
 			return err
 		}
+		if err := link.Send(datagram); err != nil {
+			if errors.Is(err, cisixlowpan.ErrOutsidePrefix) {
+				return fmt.Errorf("%w: %v", ErrUndeliverable, err)
+			}
+			return fmt.Errorf("%w: %v", ErrPlatformUnreachable, err)
+		}
 
 	default:
-		log.Fatalln("fogcore: Unkown interface of destination node")
+		return fmt.Errorf("%w: destination node %v, citype: %v", ErrUnknownInterface, dstnode.DevID, platform.CIType)
 	}
 	return nil
 }
@@ -0,0 +1,87 @@
+package fogcore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/iotInterface"
+)
+
+func TestHandleCIMessageErrors(t *testing.T) {
+	f, err := NewFogcore(context.Background(), dbconnection.Config{Driver: dbconnection.DriverMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := dbconnection.Platform{Address: "[::1]:2000", CIType: 99}
+	if err := f.store.InsertPlatform(&pl); err != nil {
+		t.Fatal(err)
+	}
+	prov := dbconnection.Node{DevID: "0102030405060708", PlatformID: pl.ID, IsProvider: true, InfType: 1}
+	req := dbconnection.Node{DevID: "aaaa::1", PlatformID: pl.ID, InfType: 1}
+	req2 := dbconnection.Node{DevID: "aaaa::2", PlatformID: pl.ID, InfType: 1}
+	for _, n := range []*dbconnection.Node{&prov, &req, &req2} {
+		if err := f.store.InsertNode(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		origin string
+		link   bool
+		want   error
+	}{
+		{name: "unknown node", origin: "ffffffffffffffff", want: ErrUnknownNode},
+		{name: "no link", origin: prov.DevID, want: ErrNoRoute},
+		{name: "unknown interface", origin: prov.DevID, link: true, want: ErrUnknownInterface},
+	}
+	for _, tt := range tests {
+		if tt.link {
+			if err := f.store.InsertLink(&dbconnection.Link{ProvNode: prov.ID, ReqNode: req.ID}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := f.handleCIMessage(iotInterface.ComLinkMessage{Origin: []byte(tt.origin), Data: []byte{1}})
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%q. handleCIMessage() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestHandleCIMessageFanOut(t *testing.T) {
+	f, err := NewFogcore(context.Background(), dbconnection.Config{Driver: dbconnection.DriverMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := dbconnection.Platform{Address: "[::1]:2000", CIType: 99}
+	if err := f.store.InsertPlatform(&pl); err != nil {
+		t.Fatal(err)
+	}
+	prov := dbconnection.Node{DevID: "0102030405060708", PlatformID: pl.ID, IsProvider: true, InfType: 1}
+	req := dbconnection.Node{DevID: "aaaa::1", PlatformID: pl.ID, InfType: 1}
+	req2 := dbconnection.Node{DevID: "aaaa::2", PlatformID: pl.ID, InfType: 1}
+	for _, n := range []*dbconnection.Node{&prov, &req, &req2} {
+		if err := f.store.InsertNode(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range []dbconnection.Node{req, req2} {
+		if err := f.store.InsertLink(&dbconnection.Link{ProvNode: prov.ID, ReqNode: n.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = f.handleCIMessage(iotInterface.ComLinkMessage{Origin: []byte(prov.DevID), Data: []byte{1}})
+	var derr *DeliveryError
+	if !errors.As(err, &derr) {
+		t.Fatalf("handleCIMessage() error = %v, want DeliveryError", err)
+	}
+	if len(derr.Results) != 2 || derr.Results[0].Destination.ID != req.ID || derr.Results[1].Destination.ID != req2.ID {
+		t.Errorf("DeliveryError.Results = %+v, want %v and %v", derr.Results, req, req2)
+	}
+	if !errors.Is(err, ErrUnknownInterface) {
+		t.Errorf("handleCIMessage() error = %v, want %v", err, ErrUnknownInterface)
+	}
+}
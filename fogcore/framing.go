@@ -0,0 +1,190 @@
+package fogcore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+)
+
+//Framing Delimitation of hecomm messages on a stream
+type Framing int
+
+const (
+	//FramingLengthPrefixed Every message is preceded by its length, 4 bytes big endian
+	FramingLengthPrefixed Framing = iota
+	//FramingJSON Messages are bare consecutive JSON objects, as sent by legacy peers
+	FramingJSON
+)
+
+func (f Framing) String() string {
+	switch f {
+	case FramingLengthPrefixed:
+		return "length"
+	case FramingJSON:
+		return "json"
+	default:
+		return fmt.Sprintf("Framing(%d)", int(f))
+	}
+}
+
+//ParseFraming Framing by name, as in the ciargs of a platform
+func ParseFraming(name string) (Framing, error) {
+	switch name {
+	case "length", "":
+		return FramingLengthPrefixed, nil
+	case "json":
+		return FramingJSON, nil
+	default:
+		return FramingLengthPrefixed, fmt.Errorf("fogcore: unknown framing: %v", name)
+	}
+}
+
+//platformFraming Framing to use towards platform, its ciargs "framing" or ConfFraming
+func platformFraming(platform dbconnection.Platform) Framing {
+	name, ok := platform.CIArgs["framing"].(string)
+	if !ok {
+		return ConfFraming
+	}
+	framing, err := ParseFraming(name)
+	if err != nil {
+		return ConfFraming
+	}
+	return framing
+}
+
+/*
+ * frameConn Connection carrying framed hecomm messages.
+ * The framing of every received message is detected on its first byte: a JSON message starts with '{',
+ * a length prefix of a message within ConfMaxMessageSize never does. Written messages use the framing
+ * of the last received message, so legacy peers are answered the way they talk.
+ */
+type frameConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	maxSize int
+	mutex   sync.Mutex
+	framing Framing
+}
+
+//newFrameConn Frame messages on conn, framing is used until the peer sends a message
+func newFrameConn(conn net.Conn, framing Framing) *frameConn {
+	return &frameConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		maxSize: ConfMaxMessageSize,
+		framing: framing,
+	}
+}
+
+//Framing Framing used for the next written message
+func (c *frameConn) Framing() Framing {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.framing
+}
+
+//ReadMessage Read the next complete message, messages sharing a read are returned one by one
+func (c *frameConn) ReadMessage() ([]byte, error) {
+	//Legacy peers may separate their JSON messages by whitespace, never the first byte of a length
+	first, err := c.reader.Peek(1)
+	for err == nil && (first[0] == ' ' || first[0] == '\n' || first[0] == '\r' || first[0] == '\t') {
+		c.reader.ReadByte()
+		first, err = c.reader.Peek(1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	framing := FramingLengthPrefixed
+	if first[0] == '{' {
+		framing = FramingJSON
+	}
+
+	var message []byte
+	if framing == FramingJSON {
+		message, err = c.readJSON()
+	} else {
+		message, err = c.readLengthPrefixed()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	c.framing = framing
+	c.mutex.Unlock()
+	return message, nil
+}
+
+//readLengthPrefixed Read a message preceded by its length
+func (c *frameConn) readLengthPrefixed() ([]byte, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(c.reader, prefix[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	if length == 0 || int64(length) > int64(c.maxSize) {
+		return nil, fmt.Errorf("%w: length %v, maximum %v", ErrMessageTooLarge, length, c.maxSize)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+//readJSON Read a single JSON object, tracking nesting and strings to find its end
+func (c *frameConn) readJSON() ([]byte, error) {
+	var message []byte
+	depth := 0
+	inString := false
+	escaped := false
+	for {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		message = append(message, b)
+		if len(message) > c.maxSize {
+			return nil, fmt.Errorf("%w: JSON message exceeds maximum %v", ErrMessageTooLarge, c.maxSize)
+		}
+		switch {
+		case escaped:
+			escaped = false
+		case inString && b == '\\':
+			escaped = true
+		case b == '"':
+			inString = !inString
+		case inString:
+		case b == '{' || b == '[':
+			depth++
+		case b == '}' || b == ']':
+			depth--
+			if depth == 0 {
+				return message, nil
+			}
+		}
+	}
+}
+
+//WriteMessage Write message in the framing of the connection
+func (c *frameConn) WriteMessage(message []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(message) > c.maxSize {
+		return fmt.Errorf("%w: length %v, maximum %v", ErrMessageTooLarge, len(message), c.maxSize)
+	}
+	if c.framing == FramingJSON {
+		_, err := c.Conn.Write(message)
+		return err
+	}
+	buf := make([]byte, 4+len(message))
+	binary.BigEndian.PutUint32(buf, uint32(len(message)))
+	copy(buf[4:], message)
+	_, err := c.Conn.Write(buf)
+	return err
+}
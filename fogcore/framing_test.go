@@ -0,0 +1,134 @@
+package fogcore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+)
+
+func TestFrameConn(t *testing.T) {
+	long := bytes.Repeat([]byte("a"), 3000)
+	tests := []struct {
+		name    string
+		written [][]byte
+		want    []string
+		framing Framing
+	}{
+		{
+			name:    "length prefixed, coalesced in one write",
+			written: [][]byte{{0, 0, 0, 2, 'h', 'i', 0, 0, 0, 3, 'f', 'o', 'g'}},
+			want:    []string{"hi", "fog"},
+			framing: FramingLengthPrefixed,
+		},
+		{
+			name:    "length prefixed, split over writes",
+			written: [][]byte{{0, 0}, {0, 5, 'h', 'e'}, {'c', 'o', 'm'}},
+			want:    []string{"hecom"},
+			framing: FramingLengthPrefixed,
+		},
+		{
+			name:    "json, coalesced with whitespace",
+			written: [][]byte{[]byte(`{"FPort":10,"Data":"e30="}` + "\n" + `{"a":{"b":[1,2]}}`)},
+			want:    []string{`{"FPort":10,"Data":"e30="}`, `{"a":{"b":[1,2]}}`},
+			framing: FramingJSON,
+		},
+		{
+			name:    "json, braces in strings and split writes",
+			written: [][]byte{[]byte(`{"s":"}\"{`), []byte(`"}{"t":1}`)},
+			want:    []string{`{"s":"}\"{"}`, `{"t":1}`},
+			framing: FramingJSON,
+		},
+		{
+			name:    "json, larger than a single read",
+			written: [][]byte{append(append([]byte(`{"s":"`), long...), '"', '}')},
+			want:    []string{`{"s":"` + string(long) + `"}`},
+			framing: FramingJSON,
+		},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			for _, w := range tt.written {
+				client.Write(w)
+			}
+			client.Close()
+		}()
+		conn := newFrameConn(server, FramingLengthPrefixed)
+		server.SetDeadline(time.Now().Add(5 * time.Second))
+		for _, want := range tt.want {
+			got, err := conn.ReadMessage()
+			if err != nil || string(got) != want {
+				t.Errorf("%q. ReadMessage() = %.40q, %v, want %.40q", tt.name, got, err, want)
+			}
+		}
+		if _, err := conn.ReadMessage(); err != io.EOF {
+			t.Errorf("%q. ReadMessage() at end = %v, want EOF", tt.name, err)
+		}
+		if conn.Framing() != tt.framing {
+			t.Errorf("%q. Framing() = %v, want %v", tt.name, conn.Framing(), tt.framing)
+		}
+		server.Close()
+	}
+}
+
+func TestFrameConnWrite(t *testing.T) {
+	for _, framing := range []Framing{FramingLengthPrefixed, FramingJSON} {
+		client, server := net.Pipe()
+		conn := newFrameConn(server, framing)
+		peer := newFrameConn(client, framing)
+		go func() {
+			conn.WriteMessage([]byte(`{"FPort":13}`))
+			conn.WriteMessage([]byte(`{"FPort":10}`))
+		}()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		for _, want := range []string{`{"FPort":13}`, `{"FPort":10}`} {
+			if got, err := peer.ReadMessage(); err != nil || string(got) != want {
+				t.Errorf("%v. ReadMessage() = %s, %v, want %s", framing, got, err, want)
+			}
+		}
+		if peer.Framing() != framing {
+			t.Errorf("%v. peer Framing() = %v", framing, peer.Framing())
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestFrameConnMaxSize(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := newFrameConn(server, FramingLengthPrefixed)
+	conn.maxSize = 16
+	go client.Write([]byte{0, 1, 0, 0})
+	if _, err := conn.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("ReadMessage() of oversized length = %v, want %v", err, ErrMessageTooLarge)
+	}
+	if err := conn.WriteMessage(make([]byte, 17)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("WriteMessage() of oversized message = %v, want %v", err, ErrMessageTooLarge)
+	}
+
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	conn = newFrameConn(server2, FramingJSON)
+	conn.maxSize = 16
+	go client2.Write([]byte(`{"s":"0123456789abcdef"}`))
+	if _, err := conn.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("ReadMessage() of oversized JSON = %v, want %v", err, ErrMessageTooLarge)
+	}
+}
+
+func TestPlatformFraming(t *testing.T) {
+	//Legacy providers without a "framing" ciarg keep receiving bare JSON
+	if framing := platformFraming(dbconnection.Platform{}); framing != FramingJSON {
+		t.Errorf("platformFraming() without ciarg = %v, want %v", framing, FramingJSON)
+	}
+	pl := dbconnection.Platform{CIArgs: map[string]interface{}{"framing": "length"}}
+	if framing := platformFraming(pl); framing != FramingLengthPrefixed {
+		t.Errorf("platformFraming() = %v, want %v", framing, FramingLengthPrefixed)
+	}
+}
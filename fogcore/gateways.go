@@ -0,0 +1,200 @@
+package fogcore
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/joriwind/hecomm-api/hecomm"
+	ns "github.com/joriwind/hecomm-fog/api/ns"
+	"github.com/joriwind/hecomm-fog/dbconnection"
+)
+
+//Metrics of the gateways per MAC, published by expvar
+var (
+	metricGatewayRx        = expvar.NewMap("fogcore_gateway_rx_packets")
+	metricGatewayRxOK      = expvar.NewMap("fogcore_gateway_rx_packets_ok")
+	metricGatewayTx        = expvar.NewMap("fogcore_gateway_tx_packets")
+	metricGatewayTxEmitted = expvar.NewMap("fogcore_gateway_tx_emitted")
+	metricGatewayLastSeen  = expvar.NewMap("fogcore_gateway_last_seen_seconds")
+)
+
+//GatewayStatus Inventory and traffic of a LoRaWAN gateway, as last polled
+type GatewayStatus struct {
+	PlatformID int
+	MAC        []byte
+	Name       string
+	Latitude   float64
+	Longitude  float64
+	Altitude   float64
+	LastSeen   time.Time
+	Online     bool
+	//Packet counters over the last ConfGatewayStatsWindow
+	RxReceived   int
+	RxReceivedOK int
+	TxReceived   int
+	TxEmitted    int
+	Polled       time.Time
+	//StatsError Error of the last statistics request, the counters are older
+	StatsError error
+}
+
+//gatewaySource Network server of a platform as polled for its gateways
+type gatewaySource interface {
+	ListGateways(ctx context.Context) ([]*ns.GetGatewayResponse, error)
+	GatewayStats(ctx context.Context, mac []byte, start time.Time, end time.Time) ([]*ns.GatewayStats, error)
+}
+
+/*
+ * gatewayPoller Polls the network servers of the LoRaWAN platforms every ConfGatewayPollInterval for their gateways
+ * and the packet counters of each. A gateway not seen for ConfGatewayOffline is reported offline, and online again
+ * once it is seen.
+ */
+type gatewayPoller struct {
+	source   func(platform dbconnection.Platform) (gatewaySource, error)
+	alert    func(a Alert)
+	mutex    sync.Mutex
+	gateways map[string]*GatewayStatus
+}
+
+func newGatewayPoller(source func(platform dbconnection.Platform) (gatewaySource, error), alert func(a Alert)) *gatewayPoller {
+	return &gatewayPoller{source: source, alert: alert, gateways: make(map[string]*GatewayStatus)}
+}
+
+//run Poll the LoRaWAN platforms of store until ctx is done
+func (p *gatewayPoller) run(ctx context.Context, store dbconnection.Store) {
+	if ConfGatewayPollInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(ConfGatewayPollInterval)
+	defer ticker.Stop()
+	for {
+		platforms, err := store.GetPlatforms()
+		if err != nil {
+			log.Printf("fogcore: unable to retrieve platforms for the gateway poll: %v\n", err)
+		}
+		for _, platform := range platforms {
+			if platform.CIType != int(hecomm.CILorawan) {
+				continue
+			}
+			if err := p.poll(ctx, platform, time.Now()); err != nil {
+				log.Printf("fogcore: unable to poll the gateways of platform %v: %v\n", platform.ID, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//poll Update the gateways of platform
+func (p *gatewayPoller) poll(ctx context.Context, platform dbconnection.Platform, now time.Time) error {
+	source, err := p.source(platform)
+	if err != nil {
+		return err
+	}
+	gateways, err := source.ListGateways(ctx)
+	if err != nil {
+		return err
+	}
+	for _, gw := range gateways {
+		status := GatewayStatus{
+			PlatformID: platform.ID,
+			MAC:        gw.Mac,
+			Name:       gw.Name,
+			Latitude:   gw.Latitude,
+			Longitude:  gw.Longitude,
+			Altitude:   gw.Altitude,
+			Polled:     now,
+		}
+		if gw.LastSeenAt != "" {
+			if t, err := time.Parse(time.RFC3339Nano, gw.LastSeenAt); err == nil {
+				status.LastSeen = t
+			}
+		}
+		status.Online = !status.LastSeen.IsZero() && now.Sub(status.LastSeen) < ConfGatewayOffline
+
+		stats, err := source.GatewayStats(ctx, gw.Mac, now.Add(-ConfGatewayStatsWindow), now)
+		status.StatsError = err
+		for _, s := range stats {
+			status.RxReceived += int(s.RxPacketsReceived)
+			status.RxReceivedOK += int(s.RxPacketsReceivedOK)
+			status.TxReceived += int(s.TxPacketsReceived)
+			status.TxEmitted += int(s.TxPacketsEmitted)
+		}
+		p.update(status, now)
+	}
+	return nil
+}
+
+//update Store the polled status of a gateway, alerting when it went offline or came back
+func (p *gatewayPoller) update(status GatewayStatus, now time.Time) {
+	mac := fmt.Sprintf("%x", status.MAC)
+	key := fmt.Sprintf("%v/%v", status.PlatformID, mac)
+	p.mutex.Lock()
+	old, known := p.gateways[key]
+	if known && status.StatsError != nil {
+		//Keep the last known counters
+		status.RxReceived, status.RxReceivedOK, status.TxReceived, status.TxEmitted = old.RxReceived, old.RxReceivedOK, old.TxReceived, old.TxEmitted
+	}
+	p.gateways[key] = &status
+	p.mutex.Unlock()
+
+	metricGatewayRx.Set(mac, gaugeInt(status.RxReceived))
+	metricGatewayRxOK.Set(mac, gaugeInt(status.RxReceivedOK))
+	metricGatewayTx.Set(mac, gaugeInt(status.TxReceived))
+	metricGatewayTxEmitted.Set(mac, gaugeInt(status.TxEmitted))
+	if !status.LastSeen.IsZero() {
+		metricGatewayLastSeen.Set(mac, gauge(now.Sub(status.LastSeen).Seconds()))
+	}
+
+	alert := Alert{PlatformID: status.PlatformID, Subject: mac, Time: now}
+	switch {
+	case status.Online && known && !old.Online:
+		alert.Kind, alert.Message = AlertGatewayOnline, fmt.Sprintf("gateway %v seen at %v", status.Name, status.LastSeen.Format(time.RFC3339))
+	case !status.Online && (!known || old.Online):
+		alert.Kind, alert.Message = AlertGatewayOffline, fmt.Sprintf("gateway %v not seen since %v", status.Name, status.LastSeen.Format(time.RFC3339))
+	default:
+		return
+	}
+	p.alert(alert)
+}
+
+//Gateways Last polled status of every gateway, by platform and MAC
+func (p *gatewayPoller) Gateways() []GatewayStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	gateways := make([]GatewayStatus, 0, len(p.gateways))
+	for _, g := range p.gateways {
+		gateways = append(gateways, *g)
+	}
+	sort.Slice(gateways, func(i, j int) bool {
+		if gateways[i].PlatformID != gateways[j].PlatformID {
+			return gateways[i].PlatformID < gateways[j].PlatformID
+		}
+		return string(gateways[i].MAC) < string(gateways[j].MAC)
+	})
+	return gateways
+}
+
+func gaugeInt(v int) *expvar.Int {
+	i := new(expvar.Int)
+	i.Set(int64(v))
+	return i
+}
+
+//networkGateways Network server of a LoRaWAN platform, over the shared client
+func (f *Fogcore) networkGateways(platform dbconnection.Platform) (gatewaySource, error) {
+	return f.conns.NetworkClient(lorawanNSAddress(platform), platformCredentials(platform))
+}
+
+//Gateways Inventory and statistics of the gateways of the LoRaWAN platforms, as last polled
+func (f *Fogcore) Gateways() []GatewayStatus {
+	return f.gateways.Gateways()
+}
@@ -0,0 +1,73 @@
+package fogcore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ns "github.com/joriwind/hecomm-fog/api/ns"
+	"github.com/joriwind/hecomm-fog/dbconnection"
+)
+
+//stubGateways Network server with a fixed set of gateways
+type stubGateways struct {
+	gateways []*ns.GetGatewayResponse
+	stats    []*ns.GatewayStats
+	statsErr error
+}
+
+func (s *stubGateways) ListGateways(ctx context.Context) ([]*ns.GetGatewayResponse, error) {
+	return s.gateways, nil
+}
+
+func (s *stubGateways) GatewayStats(ctx context.Context, mac []byte, start time.Time, end time.Time) ([]*ns.GatewayStats, error) {
+	return s.stats, s.statsErr
+}
+
+func TestGatewayPoller(t *testing.T) {
+	now := time.Now()
+	source := &stubGateways{
+		gateways: []*ns.GetGatewayResponse{{Mac: []byte{1, 2}, Name: "roof", LastSeenAt: now.Add(-time.Minute).Format(time.RFC3339Nano)}},
+		stats: []*ns.GatewayStats{
+			{RxPacketsReceived: 10, RxPacketsReceivedOK: 8, TxPacketsReceived: 2, TxPacketsEmitted: 2},
+			{RxPacketsReceived: 5, RxPacketsReceivedOK: 5, TxPacketsReceived: 1},
+		},
+	}
+	var alerts []Alert
+	p := newGatewayPoller(func(platform dbconnection.Platform) (gatewaySource, error) { return source, nil }, func(a Alert) { alerts = append(alerts, a) })
+	platform := dbconnection.Platform{ID: 3}
+
+	if err := p.poll(context.Background(), platform, now); err != nil {
+		t.Fatal(err)
+	}
+	gws := p.Gateways()
+	if len(gws) != 1 || !gws[0].Online || gws[0].PlatformID != 3 || gws[0].RxReceived != 15 || gws[0].RxReceivedOK != 13 || gws[0].TxReceived != 3 || gws[0].TxEmitted != 2 {
+		t.Fatalf("Gateways() = %+v, want online gateway with summed counters", gws)
+	}
+	if len(alerts) != 0 {
+		t.Errorf("alerts = %v for a gateway online from the start", alerts)
+	}
+
+	//Silent and its statistics unavailable: offline, the last counters are kept
+	source.statsErr = errors.New("unavailable")
+	if err := p.poll(context.Background(), platform, now.Add(ConfGatewayOffline)); err != nil {
+		t.Fatal(err)
+	}
+	gws = p.Gateways()
+	if gws[0].Online || gws[0].RxReceived != 15 || gws[0].StatsError == nil {
+		t.Errorf("Gateways() = %+v, want offline with the last counters", gws)
+	}
+	if len(alerts) != 1 || alerts[0].Kind != AlertGatewayOffline || alerts[0].Subject != "0102" {
+		t.Errorf("alerts = %+v, want gateway 0102 offline", alerts)
+	}
+
+	//Seen again
+	source.gateways[0].LastSeenAt = now.Add(ConfGatewayOffline).Format(time.RFC3339Nano)
+	if err := p.poll(context.Background(), platform, now.Add(ConfGatewayOffline)); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 2 || alerts[1].Kind != AlertGatewayOnline {
+		t.Errorf("alerts = %+v, want gateway online again", alerts)
+	}
+}
@@ -0,0 +1,438 @@
+package fogcore
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/joriwind/hecomm-api/hecomm"
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/mapping"
+)
+
+//LinkPhase Phase of a link session
+type LinkPhase int
+
+//Phases of a link session, a session ends in LinkLinked or LinkFailed
+const (
+	//LinkIdle Waiting for the link request of the requester
+	LinkIdle LinkPhase = iota
+	//LinkProviderContacted Contract offered to a provider platform, waiting for its response
+	LinkProviderContacted
+	//LinkContractAccepted Provider accepted, contract forwarded to the requester
+	LinkContractAccepted
+	//LinkKeyExchange Link state is tunneled between requester and provider
+	LinkKeyExchange
+	//LinkLinked Link stored, session done
+	LinkLinked
+	//LinkFailed Session aborted, both parties got a negative response
+	LinkFailed
+)
+
+func (p LinkPhase) String() string {
+	switch p {
+	case LinkIdle:
+		return "Idle"
+	case LinkProviderContacted:
+		return "ProviderContacted"
+	case LinkContractAccepted:
+		return "ContractAccepted"
+	case LinkKeyExchange:
+		return "KeyExchange"
+	case LinkLinked:
+		return "Linked"
+	case LinkFailed:
+		return "Failed"
+	default:
+		return fmt.Sprintf("LinkPhase(%d)", int(p))
+	}
+}
+
+//linkParty Sender of a message in a link session
+type linkParty int
+
+const (
+	fromRequester linkParty = iota
+	fromProvider
+)
+
+func (p linkParty) String() string {
+	if p == fromRequester {
+		return "requester"
+	}
+	return "provider"
+}
+
+//linkEvent Arrival of a message of type fport from origin during phase
+type linkEvent struct {
+	Phase  LinkPhase
+	Origin linkParty
+	FPort  int
+}
+
+//linkTransition Handle a message, returns the next phase
+type linkTransition func(ls *linkState, origin linkParty, message *hecomm.Message, raw []byte) (LinkPhase, error)
+
+//linkTransitions All legal transitions of the link protocol, every other event fails the session
+var linkTransitions = map[linkEvent]linkTransition{
+	{LinkIdle, fromRequester, hecomm.FPortLinkReq}:               (*linkState).onLinkRequest,
+	{LinkProviderContacted, fromProvider, hecomm.FPortResponse}:  (*linkState).onProviderResponse,
+	{LinkContractAccepted, fromRequester, hecomm.FPortLinkState}: (*linkState).onLinkState,
+	{LinkContractAccepted, fromProvider, hecomm.FPortLinkState}:  (*linkState).onLinkState,
+	{LinkContractAccepted, fromRequester, hecomm.FPortLinkSet}:   (*linkState).onLinkSet,
+	{LinkKeyExchange, fromRequester, hecomm.FPortLinkState}:      (*linkState).onLinkState,
+	{LinkKeyExchange, fromProvider, hecomm.FPortLinkState}:       (*linkState).onLinkState,
+	{LinkKeyExchange, fromRequester, hecomm.FPortLinkSet}:        (*linkState).onLinkSet,
+	{LinkKeyExchange, fromProvider, hecomm.FPortResponse}:        (*linkState).onProviderConfirm,
+}
+
+//providerDialer Open a connection to the platform of a provider
+type providerDialer func(platform dbconnection.Platform) (net.Conn, error)
+
+/*
+ * linkState State of a hecomm link session between a requester and a provider platform
+ * Phase: position in the link protocol, only changed by the transitions in linkTransitions
+ * Candidates: providers not yet contacted, in order of the selection policy
+ */
+type linkState struct {
+	Phase   LinkPhase
+	LC      hecomm.LinkContract
+	ReqConn *frameConn
+	//ReqID Identity of the requester, it has to own the requesting node
+	ReqID      peerIdentity
+	ProvConn   *frameConn
+	Ctx        context.Context
+	Store      dbconnection.Store
+	Policy     ProviderPolicy
+	Conns      *connManager
+	Candidates []candidate
+	//ProvPlatform Platform of ProvConn, the connection returns to its pool after the session
+	ProvPlatform dbconnection.Platform
+	Attempts     int
+	chProv       chan []byte
+	chProvError  chan error
+}
+
+//newLinkState Link session for the requester on conn
+func newLinkState(ctx context.Context, conn *frameConn, id peerIdentity, store dbconnection.Store, policy ProviderPolicy, conns *connManager) *linkState {
+	if policy == nil {
+		policy = firstFit{}
+	}
+	return &linkState{
+		Phase:   LinkIdle,
+		ReqConn: conn,
+		ReqID:   id,
+		Ctx:     ctx,
+		Store:   store,
+		Policy:  policy,
+		Conns:   conns,
+	}
+}
+
+//handleLinkProtocol Run a link session for the requester, starting with its link request sP, returns why the link was not made
+func (ls *linkState) handleLinkProtocol(sP *hecomm.Message) error {
+	chReq := make(chan []byte, 1)
+	chError := make(chan error, 1)
+	defer func() {
+		ls.releaseProvider(ls.Phase == LinkLinked)
+	}()
+
+	//Tunnel data from requester to channel requester
+	go ls.readMessages(ls.ReqConn, chReq, chError)
+
+	message := sP
+	origin := fromRequester
+	var raw []byte
+	for {
+		if err := ls.step(origin, message, raw); err != nil {
+			return ls.fail(err)
+		}
+		if ls.Phase == LinkLinked {
+			return nil
+		}
+
+		//Wait for either packet from requester or data provider
+	wait:
+		for {
+			select {
+			case raw = <-chReq:
+				origin = fromRequester
+				break wait
+
+			case raw = <-ls.chProv:
+				origin = fromProvider
+				break wait
+
+			case err := <-chError:
+				return ls.fail(fmt.Errorf("fogcore: requester connection failed: %w", err))
+
+			case err := <-ls.chProvError:
+				//Provider platform dropped out, try the next candidate if still possible
+				if ls.Phase != LinkProviderContacted {
+					return ls.fail(fmt.Errorf("%w: provider connection failed in %v: %v", ErrPlatformUnreachable, ls.Phase, err))
+				}
+				if err := ls.failover(err); err != nil {
+					return ls.fail(err)
+				}
+
+			case <-ls.Ctx.Done():
+				return ls.fail(fmt.Errorf("fogcore: link session ended: %v", ls.Ctx.Err()))
+			}
+		}
+
+		//Translate packet
+		var err error
+		message, err = hecomm.GetMessage(raw)
+		if err != nil {
+			return ls.fail(fmt.Errorf("%w: unable to unmarshal linkmessage: %v", ErrProtocolViolation, err))
+		}
+	}
+}
+
+//step Apply the transition of message from origin in the current phase
+func (ls *linkState) step(origin linkParty, message *hecomm.Message, raw []byte) error {
+	log.Printf("fogcore: link session: %v: FPort %v from %v\n", ls.Phase, message.FPort, origin)
+	transition, ok := linkTransitions[linkEvent{Phase: ls.Phase, Origin: origin, FPort: message.FPort}]
+	if !ok {
+		return fmt.Errorf("%w: illegal FPort %v from %v in phase %v", ErrProtocolViolation, message.FPort, origin, ls.Phase)
+	}
+	next, err := transition(ls, origin, message, raw)
+	if err != nil {
+		return err
+	}
+	if next != ls.Phase {
+		log.Printf("fogcore: link session: %v -> %v\n", ls.Phase, next)
+	}
+	ls.Phase = next
+	return nil
+}
+
+//fail End the session in LinkFailed, notifying requester and provider
+func (ls *linkState) fail(err error) error {
+	ls.Phase = LinkFailed
+	sendResponse(ls.ReqConn, false)
+	if ls.ProvConn != nil {
+		sendResponse(ls.ProvConn, false)
+	}
+	return err
+}
+
+//onLinkRequest Find the candidate providers and offer the contract to the first
+func (ls *linkState) onLinkRequest(origin linkParty, message *hecomm.Message, raw []byte) (LinkPhase, error) {
+	lc, err := message.GetLinkContract()
+	if err != nil {
+		return LinkFailed, fmt.Errorf("%w: invalid link contract: %v, error: %v", ErrProtocolViolation, string(message.Data), err)
+	}
+
+	//Check if requester node is in the db
+	reqNode, err := ls.Store.FindNode(lc.ReqDevEUI)
+	if err != nil {
+		return LinkFailed, fmt.Errorf("fogcore: error in locating requesting node: %v, error %v", lc, err)
+	}
+	if reqNode.ID == 0 {
+		return LinkFailed, fmt.Errorf("%w: requesting node: %s", ErrUnknownNode, lc.ReqDevEUI)
+	}
+	//Only the platform of the requesting node may ask links for it
+	reqPlatform, err := ls.Store.GetPlatform(reqNode.PlatformID)
+	if err != nil {
+		return LinkFailed, fmt.Errorf("fogcore: error in locating platform of requesting node: %v, error %v", lc, err)
+	}
+	if err := ls.ReqID.authorize(ls.Store, *reqPlatform); err != nil {
+		return LinkFailed, fmt.Errorf("%w, requesting node: %s", err, lc.ReqDevEUI)
+	}
+
+	//Ready to find partner
+	ls.LC = *lc
+	ls.LC.Linked = false
+
+	//Locating the possible provider nodes, ordered by the selection policy
+	ls.Candidates, err = findCandidates(ls.Store, ls.Policy, *reqNode, lc.InfType)
+	if err != nil {
+		return LinkFailed, fmt.Errorf("fogcore: error in finding provider node in DB: InfType: %v, error: %v", lc.InfType, err)
+	}
+	if len(ls.Candidates) == 0 {
+		return LinkFailed, fmt.Errorf("%w: InfType: %v", ErrNoProvider, lc.InfType)
+	}
+	log.Printf("fogcore: %v candidate providers for %s, policy: %v\n", len(ls.Candidates), lc.ReqDevEUI, ls.Policy.Name())
+
+	if err := ls.contactProvider(); err != nil {
+		return LinkFailed, err
+	}
+	return LinkProviderContacted, nil
+}
+
+//onProviderResponse Forward the accepted contract to the requester, or fail over on a refusal
+func (ls *linkState) onProviderResponse(origin linkParty, message *hecomm.Message, raw []byte) (LinkPhase, error) {
+	rsp, err := message.GetResponse()
+	if err != nil {
+		return LinkFailed, fmt.Errorf("%w: invalid response message: %v, error %v", ErrProtocolViolation, string(message.Data), err)
+	}
+	if !rsp.OK {
+		//Provider refused, offer the contract to the next candidate
+		if err := ls.failover(fmt.Errorf("provider refused link, state: %v", ls.LC)); err != nil {
+			return LinkFailed, err
+		}
+		return LinkProviderContacted, nil
+	}
+
+	//Found valid partner, sending linkcontract to requester
+	bytes, err := ls.LC.GetBytes()
+	if err != nil {
+		return LinkFailed, fmt.Errorf("fogcore: linkcontract to bytes, error: %v", err)
+	}
+	if err := sendMessage(ls.ReqConn, hecomm.FPortLinkReq, bytes); err != nil {
+		return LinkFailed, err
+	}
+	return LinkContractAccepted, nil
+}
+
+//onLinkState Tunnel key material to the other party
+func (ls *linkState) onLinkState(origin linkParty, message *hecomm.Message, raw []byte) (LinkPhase, error) {
+	if ls.LC.Linked {
+		return LinkFailed, fmt.Errorf("%w: link state after link set", ErrProtocolViolation)
+	}
+	dst := ls.ProvConn
+	if origin == fromProvider {
+		dst = ls.ReqConn
+	}
+	if err := dst.WriteMessage(raw); err != nil {
+		return LinkFailed, fmt.Errorf("%w: unable to tunnel link state: %v", ErrPlatformUnreachable, err)
+	}
+	return LinkKeyExchange, nil
+}
+
+//onLinkSet Requester has its key, confirm the contract to the provider
+func (ls *linkState) onLinkSet(origin linkParty, message *hecomm.Message, raw []byte) (LinkPhase, error) {
+	//TODO:Check if memorised LC is similar to received Linkcontract
+	lc, err := message.GetLinkContract()
+	if err != nil {
+		return LinkFailed, fmt.Errorf("%w: invalid link set packet: %v, error: %v", ErrProtocolViolation, string(message.Data), err)
+	}
+	if !lc.Linked {
+		return LinkFailed, fmt.Errorf("%w: link set without linked contract", ErrProtocolViolation)
+	}
+	ls.LC.Linked = true
+	bytes, err := ls.LC.GetBytes()
+	if err != nil {
+		return LinkFailed, fmt.Errorf("fogcore: linkcontract to bytes, error: %v", err)
+	}
+	if err := sendMessage(ls.ProvConn, hecomm.FPortLinkSet, bytes); err != nil {
+		return LinkFailed, fmt.Errorf("%w: %v", ErrPlatformUnreachable, err)
+	}
+	return LinkKeyExchange, nil
+}
+
+//onProviderConfirm Provider has its key, store the link
+func (ls *linkState) onProviderConfirm(origin linkParty, message *hecomm.Message, raw []byte) (LinkPhase, error) {
+	rsp, err := message.GetResponse()
+	if err != nil {
+		return LinkFailed, fmt.Errorf("%w: invalid response message: %v, error %v", ErrProtocolViolation, string(message.Data), err)
+	}
+	if !ls.LC.Linked {
+		return LinkFailed, fmt.Errorf("%w: provider response before link set", ErrProtocolViolation)
+	}
+	if !rsp.OK {
+		return LinkFailed, fmt.Errorf("%w: provider refused link set, state: %v", ErrPlatformUnreachable, ls.LC)
+	}
+
+	//Connection is set and key was generated!
+	link, err := mapping.ConvertToLink(ls.Store, ls.LC)
+	if err != nil {
+		return LinkFailed, fmt.Errorf("fogcore: could not convert contract to link: contract: %v, error: %v", ls.LC, err)
+	}
+	if err := ls.Store.InsertLink(link); err != nil {
+		return LinkFailed, fmt.Errorf("fogcore: could not insert link: contract: %v, error: %v", link, err)
+	}
+	//Sending OK response to requester, link is set!
+	sendResponse(ls.ReqConn, true)
+	return LinkLinked, nil
+}
+
+//readMessages Pass every message read from conn to ch, until conn fails
+func (ls *linkState) readMessages(conn *frameConn, ch chan []byte, chError chan error) {
+	for {
+		message, err := conn.ReadMessage()
+		if err != nil {
+			chError <- err
+			return
+		}
+		select {
+		case ch <- message:
+		case <-ls.Ctx.Done():
+			return
+		}
+	}
+}
+
+//contactProvider Offer the link contract to the next candidate, until a provider platform takes it or all are exhausted
+func (ls *linkState) contactProvider() error {
+	ls.releaseProvider(false)
+	for len(ls.Candidates) > 0 {
+		c := ls.Candidates[0]
+		ls.Candidates = ls.Candidates[1:]
+		ls.Attempts++
+
+		//Connection to provider platform, pooled or new
+		conn, err := ls.Conns.Get(c.Platform)
+		if err != nil {
+			log.Printf("fogcore: provider platform %v unreachable, trying next candidate: %v\n", c.Platform.Address, err)
+			continue
+		}
+
+		//Send contract for node to provider platform
+		ls.LC.ProvDevEUI = []byte(c.Node.DevID)
+		bytes, err := ls.LC.GetBytes()
+		if err != nil {
+			ls.Conns.Put(c.Platform, conn, true)
+			return fmt.Errorf("fogcore: failed to compile linkcontract into bytes, linkcontract: %v, error: %v", ls.LC, err)
+		}
+		if err := sendMessage(conn, hecomm.FPortLinkReq, bytes); err != nil {
+			ls.Conns.Put(c.Platform, conn, false)
+			log.Printf("fogcore: unable to send contract to provider platform %v, trying next candidate: %v\n", c.Platform.Address, err)
+			continue
+		}
+		log.Printf("fogcore: offered contract to provider %v on %v, attempt %v\n", c.Node.DevID, c.Platform.Address, ls.Attempts)
+
+		//Tunnel data from provider to its own channels, a replaced provider can not interfere
+		ls.ProvConn = conn
+		ls.ProvPlatform = c.Platform
+		ls.chProv = make(chan []byte, 1)
+		ls.chProvError = make(chan error, 1)
+		go ls.readMessages(conn, ls.chProv, ls.chProvError)
+		return nil
+	}
+	return fmt.Errorf("%w: InfType: %v, all %v candidates exhausted", ErrNoProvider, ls.LC.InfType, ls.Attempts)
+}
+
+//releaseProvider Stop reading the provider connection and hand it back to the pool, reused only after a clean session
+func (ls *linkState) releaseProvider(reusable bool) {
+	conn := ls.ProvConn
+	if conn == nil {
+		return
+	}
+	ls.ProvConn = nil
+	if reusable {
+		//Unblock the reader, only a timeout leaves the connection between two messages
+		conn.SetReadDeadline(time.Now())
+		select {
+		case err := <-ls.chProvError:
+			ne, ok := err.(net.Error)
+			reusable = ok && ne.Timeout()
+		case <-ls.chProv:
+			//Unsolicited message after the session
+			reusable = false
+		case <-time.After(time.Second):
+			reusable = false
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
+	ls.Conns.Put(ls.ProvPlatform, conn, reusable)
+}
+
+//failover Replace the current provider after it refused or failed, only while no contract reached the requester
+func (ls *linkState) failover(cause error) error {
+	log.Printf("fogcore: provider %s failed: %v, %v candidates left\n", ls.LC.ProvDevEUI, cause, len(ls.Candidates))
+	return ls.contactProvider()
+}
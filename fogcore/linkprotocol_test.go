@@ -0,0 +1,289 @@
+package fogcore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/joriwind/hecomm-api/hecomm"
+	"github.com/joriwind/hecomm-fog/dbconnection"
+)
+
+//fakePeer Test side of a requester or provider connection
+type fakePeer struct {
+	t    *testing.T
+	name string
+	conn *frameConn
+}
+
+func newFakePeer(t *testing.T, name string, conn net.Conn, framing Framing) *fakePeer {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &fakePeer{t: t, name: name, conn: newFrameConn(conn, framing)}
+}
+
+func (p *fakePeer) send(fport int, data []byte) {
+	bytes, err := hecomm.NewMessage(fport, data)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if err := p.conn.WriteMessage(bytes); err != nil {
+		p.t.Fatalf("%v: send FPort %v: %v", p.name, fport, err)
+	}
+}
+
+func (p *fakePeer) sendContract(fport int, lc hecomm.LinkContract) {
+	bytes, err := lc.GetBytes()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.send(fport, bytes)
+}
+
+func (p *fakePeer) sendResponse(ok bool) {
+	bytes, err := hecomm.NewResponse(ok)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if err := p.conn.WriteMessage(bytes); err != nil {
+		p.t.Fatalf("%v: send response: %v", p.name, err)
+	}
+}
+
+//expect Read the next message, which has to be of type fport
+func (p *fakePeer) expect(fport int) *hecomm.Message {
+	buf, err := p.conn.ReadMessage()
+	if err != nil {
+		p.t.Fatalf("%v: expected FPort %v: %v", p.name, fport, err)
+	}
+	m, err := hecomm.GetMessage(buf)
+	if err != nil {
+		p.t.Fatalf("%v: invalid message %s: %v", p.name, buf, err)
+	}
+	if m.FPort != fport {
+		p.t.Fatalf("%v: got FPort %v, want %v", p.name, m.FPort, fport)
+	}
+	return m
+}
+
+//expectResponse Read the next message, which has to be a response ok
+func (p *fakePeer) expectResponse(ok bool) {
+	rsp, err := p.expect(hecomm.FPortResponse).GetResponse()
+	if err != nil || rsp.OK != ok {
+		p.t.Fatalf("%v: got response %v, %v, want %v", p.name, rsp, err, ok)
+	}
+}
+
+//linkFixture Link session with a requester and fake provider platforms
+type linkFixture struct {
+	store     dbconnection.Store
+	req       dbconnection.Node
+	provs     []dbconnection.Node
+	requester *fakePeer
+	providers chan *fakePeer
+	ls        *linkState
+	result    chan error
+}
+
+//newLinkFixture Store with a requester and a provider on each platform, dials fail for the platforms in unreachable
+func newLinkFixture(t *testing.T, platforms int, unreachable map[int]bool) *linkFixture {
+	f := linkFixture{store: dbconnection.NewMemoryStore(), providers: make(chan *fakePeer, platforms), result: make(chan error, 1)}
+	for i := 0; i < platforms; i++ {
+		pl := dbconnection.Platform{Address: "[::1]:" + string(rune('0'+i)), CIType: 1, Identity: "platform-" + string(rune('0'+i))}
+		if err := f.store.InsertPlatform(&pl); err != nil {
+			t.Fatal(err)
+		}
+		prov := dbconnection.Node{DevID: "010203040506070" + string(rune('0'+i)), PlatformID: pl.ID, IsProvider: true, InfType: 1}
+		if err := f.store.InsertNode(&prov); err != nil {
+			t.Fatal(err)
+		}
+		f.provs = append(f.provs, prov)
+	}
+	f.req = dbconnection.Node{DevID: "aaaa::1", PlatformID: 1, InfType: 1}
+	if err := f.store.InsertNode(&f.req); err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func(platform dbconnection.Platform) (net.Conn, error) {
+		if unreachable[platform.ID] {
+			return nil, errors.New("connection refused")
+		}
+		fog, peer := net.Pipe()
+		f.providers <- newFakePeer(t, "provider "+platform.Address, peer, platformFraming(platform))
+		return fog, nil
+	}
+	fog, peer := net.Pipe()
+	//Legacy requester, its link request was read as bare JSON
+	f.requester = newFakePeer(t, "requester", peer, FramingJSON)
+	//Bound to the platform of the requester, the platforms share a host
+	id := peerIdentity{CommonName: "platform-0", Names: []string{"platform-0"}}
+	f.ls = newLinkState(context.Background(), newFrameConn(fog, FramingJSON), id, f.store, nil, newConnManager(context.Background(), dial, nil))
+	return &f
+}
+
+//start Run the session from its first message
+func (f *linkFixture) start(t *testing.T, fport int, lc hecomm.LinkContract) {
+	data, err := lc.GetBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		f.result <- f.ls.handleLinkProtocol(&hecomm.Message{FPort: fport, Data: data})
+	}()
+}
+
+//provider Next dialed provider platform
+func (f *linkFixture) provider(t *testing.T) *fakePeer {
+	select {
+	case p := <-f.providers:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("no provider platform dialed")
+		return nil
+	}
+}
+
+func (f *linkFixture) wait(t *testing.T) error {
+	select {
+	case err := <-f.result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("link session did not end")
+		return nil
+	}
+}
+
+func TestLinkProtocol(t *testing.T) {
+	f := newLinkFixture(t, 1, nil)
+	lc := hecomm.LinkContract{InfType: 1, ReqDevEUI: []byte(f.req.DevID)}
+	f.start(t, hecomm.FPortLinkReq, lc)
+
+	//Contract is offered to the provider
+	prov := f.provider(t)
+	offered, err := prov.expect(hecomm.FPortLinkReq).GetLinkContract()
+	if err != nil || string(offered.ProvDevEUI) != f.provs[0].DevID {
+		t.Fatalf("offered contract = %v, %v, want provider %v", offered, err, f.provs[0].DevID)
+	}
+	prov.sendResponse(true)
+	accepted, err := f.requester.expect(hecomm.FPortLinkReq).GetLinkContract()
+	if err != nil || string(accepted.ProvDevEUI) != f.provs[0].DevID {
+		t.Fatalf("accepted contract = %v, %v", accepted, err)
+	}
+
+	//Key exchange is tunneled both ways
+	f.requester.send(hecomm.FPortLinkState, []byte("req-key"))
+	if m := prov.expect(hecomm.FPortLinkState); string(m.Data) != "req-key" {
+		t.Errorf("tunneled to provider = %s", m.Data)
+	}
+	prov.send(hecomm.FPortLinkState, []byte("prov-key"))
+	if m := f.requester.expect(hecomm.FPortLinkState); string(m.Data) != "prov-key" {
+		t.Errorf("tunneled to requester = %s", m.Data)
+	}
+
+	lc.Linked = true
+	f.requester.sendContract(hecomm.FPortLinkSet, lc)
+	if set, err := prov.expect(hecomm.FPortLinkSet).GetLinkContract(); err != nil || !set.Linked {
+		t.Fatalf("link set = %v, %v", set, err)
+	}
+	prov.sendResponse(true)
+	f.requester.expectResponse(true)
+
+	if err := f.wait(t); err != nil || f.ls.Phase != LinkLinked {
+		t.Fatalf("handleLinkProtocol() = %v in %v, want nil in %v", err, f.ls.Phase, LinkLinked)
+	}
+	links, err := f.store.GetLinksOfNode(f.req.ID)
+	if err != nil || len(links) != 1 || links[0].ProvNode != f.provs[0].ID {
+		t.Errorf("GetLinksOfNode() = %v, %v, want link with %v", links, err, f.provs[0])
+	}
+	//The provider connection is kept for the next session
+	if stats := f.ls.Conns.Stats(); len(stats) != 1 || stats[0].Idle != 1 {
+		t.Errorf("Stats() after link = %+v, want pooled provider connection", stats)
+	}
+}
+
+func TestLinkProtocolFailover(t *testing.T) {
+	//First platform unreachable, second refuses, third accepts
+	f := newLinkFixture(t, 3, map[int]bool{1: true})
+	f.start(t, hecomm.FPortLinkReq, hecomm.LinkContract{InfType: 1, ReqDevEUI: []byte(f.req.DevID)})
+
+	refusing := f.provider(t)
+	refusing.expect(hecomm.FPortLinkReq)
+	refusing.sendResponse(false)
+
+	accepting := f.provider(t)
+	if offered, err := accepting.expect(hecomm.FPortLinkReq).GetLinkContract(); err != nil || string(offered.ProvDevEUI) != f.provs[2].DevID {
+		t.Fatalf("offered contract = %v, %v, want provider %v", offered, err, f.provs[2].DevID)
+	}
+	accepting.sendResponse(true)
+	if accepted, err := f.requester.expect(hecomm.FPortLinkReq).GetLinkContract(); err != nil || string(accepted.ProvDevEUI) != f.provs[2].DevID {
+		t.Fatalf("accepted contract = %v, %v", accepted, err)
+	}
+	if f.ls.Attempts != 3 {
+		t.Errorf("Attempts = %v, want 3", f.ls.Attempts)
+	}
+
+	//Once accepted, losing the provider fails the session
+	accepting.conn.Close()
+	f.requester.expectResponse(false)
+	if err := f.wait(t); !errors.Is(err, ErrPlatformUnreachable) {
+		t.Errorf("handleLinkProtocol() = %v, want %v", err, ErrPlatformUnreachable)
+	}
+}
+
+func TestLinkProtocolExhausted(t *testing.T) {
+	f := newLinkFixture(t, 2, map[int]bool{1: true})
+	f.start(t, hecomm.FPortLinkReq, hecomm.LinkContract{InfType: 1, ReqDevEUI: []byte(f.req.DevID)})
+
+	prov := f.provider(t)
+	prov.expect(hecomm.FPortLinkReq)
+	prov.sendResponse(false)
+
+	f.requester.expectResponse(false)
+	if err := f.wait(t); !errors.Is(err, ErrNoProvider) || f.ls.Phase != LinkFailed {
+		t.Errorf("handleLinkProtocol() = %v in %v, want %v in %v", err, f.ls.Phase, ErrNoProvider, LinkFailed)
+	}
+}
+
+func TestLinkProtocolUnauthorized(t *testing.T) {
+	//A platform can not request links for the nodes of others
+	f := newLinkFixture(t, 1, nil)
+	f.ls.ReqID = peerIdentity{CommonName: "platform-b", Names: []string{"platform-b"}}
+	f.start(t, hecomm.FPortLinkReq, hecomm.LinkContract{InfType: 1, ReqDevEUI: []byte(f.req.DevID)})
+	f.requester.expectResponse(false)
+	if err := f.wait(t); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("handleLinkProtocol() = %v, want %v", err, ErrUnauthorized)
+	}
+	select {
+	case <-f.providers:
+		t.Error("provider contacted for an unauthorized request")
+	default:
+	}
+}
+
+func TestLinkProtocolIllegalTransition(t *testing.T) {
+	//Link set as opening message
+	f := newLinkFixture(t, 1, nil)
+	f.start(t, hecomm.FPortLinkSet, hecomm.LinkContract{InfType: 1, ReqDevEUI: []byte(f.req.DevID), Linked: true})
+	f.requester.expectResponse(false)
+	if err := f.wait(t); !errors.Is(err, ErrProtocolViolation) {
+		t.Errorf("handleLinkProtocol() on link set in %v = %v, want %v", LinkIdle, err, ErrProtocolViolation)
+	}
+
+	//Link set from the provider before it accepted
+	f = newLinkFixture(t, 1, nil)
+	lc := hecomm.LinkContract{InfType: 1, ReqDevEUI: []byte(f.req.DevID)}
+	f.start(t, hecomm.FPortLinkReq, lc)
+	prov := f.provider(t)
+	prov.expect(hecomm.FPortLinkReq)
+	lc.Linked = true
+	prov.sendContract(hecomm.FPortLinkSet, lc)
+	f.requester.expectResponse(false)
+	prov.expectResponse(false)
+	if err := f.wait(t); !errors.Is(err, ErrProtocolViolation) {
+		t.Errorf("handleLinkProtocol() on provider link set = %v, want %v", err, ErrProtocolViolation)
+	}
+	if links, _ := f.store.GetLinks(); len(links) != 0 {
+		t.Errorf("GetLinks() after illegal transition = %v", links)
+	}
+}
@@ -0,0 +1,160 @@
+package fogcore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	ns "github.com/joriwind/hecomm-fog/api/ns"
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/iotInterface/cilorawan"
+)
+
+//storeKeys OTAA keys of the LoRaWAN nodes in the store
+type storeKeys struct {
+	store dbconnection.Store
+}
+
+//GetDeviceKeys Keys of the node with DevEUI devEUI, nil if the node or its keys are unknown
+func (s storeKeys) GetDeviceKeys(devEUI []byte) (*cilorawan.DeviceKeys, error) {
+	node, err := s.store.FindNode(devEUI)
+	if err != nil || node.ID == 0 {
+		return nil, err
+	}
+	k, err := s.store.GetDeviceKeys(node.ID)
+	if err != nil || k.NodeID == 0 {
+		return nil, err
+	}
+	return &cilorawan.DeviceKeys{
+		DevEUI:    devEUI,
+		AppEUI:    k.AppEUI,
+		AppKey:    k.AppKey,
+		DevAddr:   k.DevAddr,
+		NwkSKey:   k.NwkSKey,
+		AppSKey:   k.AppSKey,
+		DevNonces: k.DevNonces,
+		FCntUp:    k.FCntUp,
+	}, nil
+}
+
+//SetSession Store the session of a node that joined
+func (s storeKeys) SetSession(k *cilorawan.DeviceKeys) error {
+	node, err := s.store.FindNode(k.DevEUI)
+	if err != nil {
+		return err
+	}
+	if node.ID == 0 {
+		return ErrUnknownNode
+	}
+	return s.store.SetDeviceKeys(&dbconnection.DeviceKeys{
+		NodeID:    node.ID,
+		AppEUI:    k.AppEUI,
+		AppKey:    k.AppKey,
+		DevAddr:   k.DevAddr,
+		NwkSKey:   k.NwkSKey,
+		AppSKey:   k.AppSKey,
+		DevNonces: k.DevNonces,
+		FCntUp:    k.FCntUp,
+	})
+}
+
+//networkSessions Sessions created on the network server of a LoRaWAN platform, over the shared client
+type networkSessions struct {
+	conns    *connManager
+	platform dbconnection.Platform
+}
+
+//CreateNodeSession Create the session of a node that joined
+func (n networkSessions) CreateNodeSession(ctx context.Context, req *ns.CreateNodeSessionRequest) error {
+	client, err := n.conns.NetworkClient(lorawanNSAddress(n.platform), platformCredentials(n.platform))
+	if err != nil {
+		return err
+	}
+	return client.CreateNodeSession(ctx, req)
+}
+
+//lorawanNSAddress Network server of a LoRaWAN platform: its "nsAddress" ciarg, else cilorawan.ConfNSAddress
+func lorawanNSAddress(platform dbconnection.Platform) string {
+	if address, ok := platform.CIArgs["nsAddress"].(string); ok && address != "" {
+		return address
+	}
+	return cilorawan.ConfNSAddress
+}
+
+//lorawanASAddress Listen address of the application server of a LoRaWAN platform: its "asAddress" ciarg, else
+//cilorawan.ConfASAddress
+func lorawanASAddress(platform dbconnection.Platform) string {
+	if address, ok := platform.CIArgs["asAddress"].(string); ok && address != "" {
+		return address
+	}
+	return cilorawan.ConfASAddress
+}
+
+//lorawanServer Application server of a running LoRaWAN platform
+type lorawanServer struct {
+	//address Listen address of the application server
+	address   string
+	downlinks *cilorawan.DownlinkQueue
+	//stop Free the address, nil if the server does not listen
+	stop func()
+}
+
+//lorawanServers Application servers of the running LoRaWAN platforms, by platform address
+type lorawanServers struct {
+	mutex   sync.RWMutex
+	servers map[string]lorawanServer
+}
+
+func newLorawanServers() *lorawanServers {
+	return &lorawanServers{servers: make(map[string]lorawanServer)}
+}
+
+//start Stop the server of an earlier start of platform, then start the server of platform on address with start,
+//unless another platform listens there already
+func (l *lorawanServers) start(platform dbconnection.Platform, address string, start func() (lorawanServer, error)) error {
+	l.remove(platform)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for other, s := range l.servers {
+		if s.address == address {
+			return fmt.Errorf("%w: cilorawan: application server address %v already used by platform %v", ErrPlatformUnreachable, address, other)
+		}
+	}
+	s, err := start()
+	if err != nil {
+		return err
+	}
+	s.address = address
+	l.servers[platform.Address] = s
+	return nil
+}
+
+//remove Stop the application server of a stopped platform, closing its downlink queue
+func (l *lorawanServers) remove(platform dbconnection.Platform) {
+	l.mutex.Lock()
+	old, ok := l.servers[platform.Address]
+	delete(l.servers, platform.Address)
+	l.mutex.Unlock()
+	if ok {
+		old.close()
+	}
+}
+
+//close Stop s, its downlinks are queued again
+func (s lorawanServer) close() {
+	if s.stop != nil {
+		s.stop()
+	}
+	s.downlinks.Close()
+}
+
+//downlinks Downlink queue served to the network server of platform
+func (l *lorawanServers) downlinks(platform dbconnection.Platform) (*cilorawan.DownlinkQueue, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	s, ok := l.servers[platform.Address]
+	if !ok {
+		return nil, fmt.Errorf("%w: LoRaWAN platform %v is not running", ErrPlatformUnreachable, platform.Address)
+	}
+	return s.downlinks, nil
+}
@@ -0,0 +1,87 @@
+package fogcore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/joriwind/hecomm-api/hecomm"
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/iotInterface/cilorawan"
+)
+
+func TestStoreKeys(t *testing.T) {
+	store := dbconnection.NewMemoryStore()
+	node := dbconnection.Node{DevID: "\x01\x02\x03\x04\x05\x06\x07\x08", PlatformID: 1}
+	if err := store.InsertNode(&node); err != nil {
+		t.Fatal(err)
+	}
+	keys := storeKeys{store}
+	devEUI := []byte(node.DevID)
+	if k, err := keys.GetDeviceKeys(devEUI); err != nil || k != nil {
+		t.Fatalf("GetDeviceKeys() without keys = %+v, %v, want nil", k, err)
+	}
+	if err := store.SetDeviceKeys(&dbconnection.DeviceKeys{NodeID: node.ID, AppKey: make([]byte, 16)}); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := keys.GetDeviceKeys(devEUI)
+	if err != nil || k == nil || len(k.AppKey) != 16 || string(k.DevEUI) != node.DevID {
+		t.Fatalf("GetDeviceKeys() = %+v, %v", k, err)
+	}
+	k.DevAddr, k.DevNonces = []byte{1, 2, 3, 4}, []uint16{7}
+	if err := keys.SetSession(k); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := store.GetDeviceKeys(node.ID); string(stored.DevAddr) != "\x01\x02\x03\x04" || len(stored.DevNonces) != 1 {
+		t.Errorf("stored keys = %+v, want session", stored)
+	}
+	if err := keys.SetSession(&cilorawan.DeviceKeys{DevEUI: []byte("unknown")}); err == nil {
+		t.Error("SetSession() of unknown node succeeded")
+	}
+}
+
+func TestLorawanAddresses(t *testing.T) {
+	platform := dbconnection.Platform{Address: "[::1]:2000", CIType: int(hecomm.CILorawan)}
+	if lorawanNSAddress(platform) != cilorawan.ConfNSAddress || lorawanASAddress(platform) != cilorawan.ConfASAddress {
+		t.Errorf("addresses of platform without ciargs = %v, %v, want defaults", lorawanNSAddress(platform), lorawanASAddress(platform))
+	}
+	platform.CIArgs = map[string]interface{}{"nsAddress": "ns2:8000", "asAddress": ":8002"}
+	if lorawanNSAddress(platform) != "ns2:8000" || lorawanASAddress(platform) != ":8002" {
+		t.Errorf("addresses = %v, %v, want those of the ciargs", lorawanNSAddress(platform), lorawanASAddress(platform))
+	}
+}
+
+func TestLorawanServers(t *testing.T) {
+	servers := newLorawanServers()
+	first := dbconnection.Platform{Address: "[::1]:2000", CIType: int(hecomm.CILorawan)}
+	second := dbconnection.Platform{Address: "[::1]:2001", CIType: int(hecomm.CILorawan)}
+	stopped := 0
+	server := func() (lorawanServer, error) {
+		return lorawanServer{downlinks: cilorawan.NewDownlinkQueue(), stop: func() { stopped++ }}, nil
+	}
+
+	if err := servers.start(first, ":8001", server); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	//Only one platform per address
+	if err := servers.start(second, ":8001", server); !errors.Is(err, ErrPlatformUnreachable) {
+		t.Errorf("start() on used address = %v, want ErrPlatformUnreachable", err)
+	}
+	//A server that can not listen is not registered
+	failing := func() (lorawanServer, error) { return lorawanServer{}, ErrPlatformUnreachable }
+	if err := servers.start(second, ":8002", failing); !errors.Is(err, ErrPlatformUnreachable) {
+		t.Errorf("start() of failing server = %v, want ErrPlatformUnreachable", err)
+	}
+	if _, err := servers.downlinks(second); !errors.Is(err, ErrPlatformUnreachable) {
+		t.Errorf("downlinks() of failed platform = %v, want ErrPlatformUnreachable", err)
+	}
+
+	//Starting again stops the earlier server first, freeing its address
+	if err := servers.start(first, ":8001", server); err != nil || stopped != 1 {
+		t.Errorf("start() again = %v, stopped %v, want earlier server stopped", err, stopped)
+	}
+	servers.remove(first)
+	if _, err := servers.downlinks(first); !errors.Is(err, ErrPlatformUnreachable) || stopped != 2 {
+		t.Errorf("downlinks() after remove = %v, stopped %v", err, stopped)
+	}
+}
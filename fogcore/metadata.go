@@ -0,0 +1,127 @@
+package fogcore
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/joriwind/hecomm-api/hecomm"
+	"github.com/joriwind/hecomm-fog/iotInterface"
+)
+
+//Metrics of the uplinks, published by expvar
+var (
+	metricUplinks  = expvar.NewMap("fogcore_uplinks")
+	metricRSSI     = expvar.NewMap("fogcore_uplink_rssi")
+	metricSNR      = expvar.NewMap("fogcore_uplink_snr")
+	metricHopLimit = expvar.NewMap("fogcore_uplink_hop_limit")
+	metricFiltered = expvar.NewInt("fogcore_uplinks_filtered")
+)
+
+//recordUplink Count the uplink per interface and keep the reception of its origin
+func recordUplink(clm iotInterface.ComLinkMessage) {
+	switch clm.InterfaceType {
+	case hecomm.CILorawan:
+		metricUplinks.Add("lorawan", 1)
+	case hecomm.CISixlowpan:
+		metricUplinks.Add("sixlowpan", 1)
+	default:
+		metricUplinks.Add(strconv.Itoa(int(clm.InterfaceType)), 1)
+	}
+	//The DevEUI of a LoRaWAN node is binary
+	if l := clm.Metadata.LoRaWAN; l != nil {
+		origin := fmt.Sprintf("%x", clm.Origin)
+		if best := l.Best(); best != nil {
+			metricRSSI.Set(origin, gauge(float64(best.RSSI)))
+			metricSNR.Set(origin, gauge(best.SNR))
+		}
+	}
+	if s := clm.Metadata.Sixlowpan; s != nil {
+		metricHopLimit.Set(string(clm.Origin), gauge(float64(s.HopLimit)))
+	}
+}
+
+func gauge(v float64) *expvar.Float {
+	f := new(expvar.Float)
+	f.Set(v)
+	return f
+}
+
+/*
+ * matchesMetadata Whether the message passes the "metadata" ciarg of rt, e.g.
+ *	{"metadata": {"lorawan.rssi": ">=-110", "lorawan.gateway": "b827ebfffe000001"}}
+ * Every key must be present in the metadata of the message (see iotInterface.Metadata.Get) and match: a string may
+ * start with an operator =, !=, <, <=, > or >=, numbers are compared as numbers. Routes without the ciarg pass all.
+ */
+func matchesMetadata(clm *iotInterface.ComLinkMessage, rt route) (bool, error) {
+	v, ok := ciArg(rt, "metadata")
+	if !ok {
+		return true, nil
+	}
+	rules, ok := v.(map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("fogcore: metadata ciarg of %v is not an object: %v", rt.Node.DevID, v)
+	}
+	for key, rule := range rules {
+		value, ok := clm.Metadata.Get(key)
+		if !ok {
+			return false, nil
+		}
+		match, err := matchRule(value, rule)
+		if err != nil {
+			return false, fmt.Errorf("fogcore: metadata ciarg %q of %v: %v", key, rt.Node.DevID, err)
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+//matchRule Compare a metadata value with a rule from the ciargs
+func matchRule(value string, rule interface{}) (bool, error) {
+	var op, operand string
+	switch r := rule.(type) {
+	case string:
+		op, operand = "=", r
+		for _, o := range []string{"!=", "<=", ">=", "=", "<", ">"} {
+			if strings.HasPrefix(r, o) {
+				op, operand = o, strings.TrimSpace(r[len(o):])
+				break
+			}
+		}
+	case float64:
+		op, operand = "=", strconv.FormatFloat(r, 'f', -1, 64)
+	case bool:
+		op, operand = "=", strconv.FormatBool(r)
+	default:
+		return false, fmt.Errorf("unsupported rule %v", rule)
+	}
+
+	a, aerr := strconv.ParseFloat(value, 64)
+	b, berr := strconv.ParseFloat(operand, 64)
+	if aerr != nil || berr != nil {
+		switch op {
+		case "=":
+			return value == operand, nil
+		case "!=":
+			return value != operand, nil
+		}
+		return false, fmt.Errorf("%v %v needs numbers", op, operand)
+	}
+	switch op {
+	case "=":
+		return a == b, nil
+	case "!=":
+		return a != b, nil
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case ">":
+		return a > b, nil
+	default:
+		return a >= b, nil
+	}
+}
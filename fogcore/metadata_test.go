@@ -0,0 +1,69 @@
+package fogcore
+
+import (
+	"testing"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/iotInterface"
+)
+
+func TestMatchesMetadata(t *testing.T) {
+	clm := iotInterface.ComLinkMessage{Metadata: iotInterface.Metadata{
+		LoRaWAN: &iotInterface.LoRaWANMetadata{
+			FCnt:         7,
+			SpreadFactor: 7,
+			Bandwidth:    125,
+			Gateways: []iotInterface.GatewayRxInfo{
+				{MAC: []byte{1}, RSSI: -120, SNR: -5},
+				{MAC: []byte{2}, RSSI: -90, SNR: 8.5},
+			},
+		},
+		Values: map[string]string{"site": "north"},
+	}}
+	tests := []struct {
+		name    string
+		rules   interface{}
+		want    bool
+		wantErr bool
+	}{
+		{name: "no rules", want: true},
+		{name: "best gateway", rules: map[string]interface{}{"lorawan.rssi": ">=-100", "lorawan.gateway": "02"}, want: true},
+		{name: "weak", rules: map[string]interface{}{"lorawan.snr": ">10"}, want: false},
+		{name: "number", rules: map[string]interface{}{"lorawan.fcnt": float64(7), "lorawan.datarate": "SF7BW125"}, want: true},
+		{name: "value", rules: map[string]interface{}{"site": "!=south"}, want: true},
+		{name: "missing key", rules: map[string]interface{}{"sixlowpan.hoplimit": ">1"}, want: false},
+		{name: "not a number", rules: map[string]interface{}{"site": ">1"}, wantErr: true},
+		{name: "not an object", rules: "lorawan.rssi", wantErr: true},
+	}
+	for _, tt := range tests {
+		rt := route{Node: dbconnection.Node{DevID: "aaaa::1"}}
+		if tt.rules != nil {
+			rt.Link.CIArgs = map[string]interface{}{"metadata": tt.rules}
+		}
+		got, err := matchesMetadata(&clm, rt)
+		if (err != nil) != tt.wantErr || (err == nil && got != tt.want) {
+			t.Errorf("%q. matchesMetadata() = %v, %v, want %v, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestQueuedMetadata(t *testing.T) {
+	var delivered []iotInterface.ComLinkMessage
+	q, _, node := newQueueFixture(t)
+	clm := iotInterface.ComLinkMessage{Origin: []byte("aaaa::2"), Data: []byte{1}, Metadata: iotInterface.Metadata{
+		Sixlowpan: &iotInterface.SixlowpanMetadata{Source: "aaaa::2", HopLimit: 63, SourcePort: 5683},
+	}}
+	if _, err := q.Enqueue(clm, route{Node: node}); err != nil {
+		t.Fatal(err)
+	}
+	q.deliver = func(clm iotInterface.ComLinkMessage, rt route, m *dbconnection.QueuedMessage) error {
+		delivered = append(delivered, clm)
+		return nil
+	}
+	if _, err := q.Flush(node.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != 1 || delivered[0].Metadata.Sixlowpan == nil || *delivered[0].Metadata.Sixlowpan != *clm.Metadata.Sixlowpan {
+		t.Errorf("delivered = %+v, want metadata %+v", delivered, clm.Metadata.Sixlowpan)
+	}
+}
@@ -0,0 +1,348 @@
+package fogcore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/joriwind/hecomm-api/hecomm"
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/iotInterface"
+)
+
+//deliverFunc Send queued message m, as clm, to the destination node of rt over the interface of its platform. An
+//interface that reports the outcome later returns errInFlight, and passes the outcome to Settle.
+type deliverFunc func(clm iotInterface.ComLinkMessage, rt route, m *dbconnection.QueuedMessage) error
+
+//errInFlight The interface took the message, it stays queued until the interface settles it
+var errInFlight = errors.New("fogcore: message in flight")
+
+/*
+ * deliveryQueue Durable outbound queue, one per destination node.
+ * Every message is persisted before it is sent. The messages of a destination are delivered in order, a failed
+ * message is retried with exponential backoff and blocks the messages after it. A message that is still not
+ * delivered after ConfQueueTTL, or after ConfQueueMaxAttempts, or that can never be delivered, is moved to the
+ * dead letters, which stay until they are replayed or purged. A message taken by an interface that delivers it later,
+ * like the class-A queue of a LoRaWAN application server, stays queued in flight until the interface settles it.
+ */
+type deliveryQueue struct {
+	store   dbconnection.Store
+	deliver deliverFunc
+	mutex   sync.Mutex
+	//destinations Serializes the deliveries of each destination
+	destinations map[int]*sync.Mutex
+	wake         chan struct{}
+}
+
+func newDeliveryQueue(store dbconnection.Store, deliver deliverFunc) *deliveryQueue {
+	return &deliveryQueue{
+		store:        store,
+		deliver:      deliver,
+		destinations: make(map[int]*sync.Mutex),
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+//Enqueue Persist the message for the destination node of rt
+func (q *deliveryQueue) Enqueue(clm iotInterface.ComLinkMessage, rt route) (*dbconnection.QueuedMessage, error) {
+	now := time.Now()
+	received := clm.TimeReceived
+	if received.IsZero() {
+		received = now
+	}
+	metadata, err := json.Marshal(clm.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	m := dbconnection.QueuedMessage{
+		NodeID:        rt.Node.ID,
+		LinkID:        rt.Link.ID,
+		Origin:        clm.Origin,
+		InterfaceType: int(clm.InterfaceType),
+		Data:          clm.Data,
+		Metadata:      metadata,
+		Received:      received,
+		Expires:       now.Add(ConfQueueTTL),
+		NextAttempt:   now,
+	}
+	if err := q.store.EnqueueMessage(&m); err != nil {
+		return nil, fmt.Errorf("fogcore: unable to queue message for %v: %v", rt.Node.DevID, err)
+	}
+	return &m, nil
+}
+
+//destination Lock of the deliveries to node
+func (q *deliveryQueue) destination(nodeID int) *sync.Mutex {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	lock, ok := q.destinations[nodeID]
+	if !ok {
+		lock = &sync.Mutex{}
+		q.destinations[nodeID] = lock
+	}
+	return lock
+}
+
+//Flush Deliver the due messages of a destination in order, until one fails; returns the outcome per message attempted
+func (q *deliveryQueue) Flush(nodeID int) (map[int]error, error) {
+	lock := q.destination(nodeID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	messages, err := q.store.GetQueuedMessages(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[int]error)
+	for i := range messages {
+		m := &messages[i]
+		if m.InFlight {
+			//Ordered by the interface from here on
+			continue
+		}
+		now := time.Now()
+		if now.After(m.Expires) {
+			q.deadLetter(m, fmt.Sprintf("expired after %v attempts, last error: %v", m.Attempts, m.LastError))
+			continue
+		}
+		if now.Before(m.NextAttempt) {
+			//Backing off, the messages after it wait their turn
+			break
+		}
+
+		err := q.attempt(m)
+		if errors.Is(err, errInFlight) {
+			results[m.ID] = nil
+			m.Attempts++
+			m.InFlight = true
+			if err := q.store.UpdateQueuedMessage(m); err != nil {
+				return results, err
+			}
+			continue
+		}
+		results[m.ID] = err
+		if err == nil {
+			if err := q.store.DeleteQueuedMessage(m.ID); err != nil {
+				return results, err
+			}
+			continue
+		}
+		m.Attempts++
+		m.LastError = err.Error()
+		if !retryable(err) || (ConfQueueMaxAttempts > 0 && m.Attempts >= ConfQueueMaxAttempts) {
+			q.deadLetter(m, m.LastError)
+			continue
+		}
+		m.NextAttempt = now.Add(backoff(m.Attempts, ConfQueueRetryMin, ConfQueueRetryMax))
+		if err := q.store.UpdateQueuedMessage(m); err != nil {
+			return results, err
+		}
+		log.Printf("fogcore: delivery of message %v to node %v failed, attempt %v, retry at %v: %v\n", m.ID, nodeID, m.Attempts, m.NextAttempt.Format(time.RFC3339), err)
+		break
+	}
+	return results, nil
+}
+
+//attempt Deliver m to its destination as currently stored
+func (q *deliveryQueue) attempt(m *dbconnection.QueuedMessage) error {
+	node, err := q.store.GetNode(m.NodeID)
+	if err != nil {
+		return err
+	}
+	if node.ID == 0 {
+		return fmt.Errorf("%w: destination %v was removed", ErrUnknownNode, m.NodeID)
+	}
+	platform, err := q.store.GetPlatform(node.PlatformID)
+	if err != nil {
+		return err
+	}
+	if platform.ID == 0 {
+		return fmt.Errorf("%w: platform %v of destination %v was removed", ErrUnknownPlatform, node.PlatformID, node.DevID)
+	}
+	clm := iotInterface.ComLinkMessage{
+		InterfaceType: hecomm.CIType(m.InterfaceType),
+		Origin:        m.Origin,
+		Destination:   []byte(node.DevID),
+		TimeReceived:  m.Received,
+		Data:          m.Data,
+	}
+	if m.Metadata != nil {
+		if err := json.Unmarshal(m.Metadata, &clm.Metadata); err != nil {
+			log.Printf("fogcore: dropped unreadable metadata of message %v: %v\n", m.ID, err)
+		}
+	}
+	rt := route{Node: *node, Platform: *platform}
+	if m.LinkID != 0 {
+		//Settings of the link, a removed link leaves those of the node
+		links, err := q.store.GetLinksOfNode(node.ID)
+		if err != nil {
+			return err
+		}
+		for _, l := range links {
+			if l.ID == m.LinkID {
+				rt.Link = l
+			}
+		}
+	}
+	return q.deliver(clm, rt, m)
+}
+
+//retryable Whether a later attempt may succeed, a missing destination or interface never will
+func retryable(err error) bool {
+	return !errors.Is(err, ErrUnknownInterface) && !errors.Is(err, ErrUnknownNode) && !errors.Is(err, ErrUnknownPlatform) &&
+		!errors.Is(err, ErrUndeliverable)
+}
+
+//deadLetter Stop retrying m, keeping it for inspection
+func (q *deliveryQueue) deadLetter(m *dbconnection.QueuedMessage, reason string) {
+	m.Dead = true
+	m.LastError = reason
+	if err := q.store.UpdateQueuedMessage(m); err != nil {
+		log.Printf("fogcore: unable to dead-letter message %v: %v\n", m.ID, err)
+		return
+	}
+	log.Printf("fogcore: message %v to node %v dead-lettered: %v\n", m.ID, m.NodeID, reason)
+}
+
+//Settle Outcome of message id in flight: delivered if err is nil, queued again if the platform became unreachable,
+//else dead-lettered. Waits for a flush of the destination in progress, which may still mark the message in flight.
+func (q *deliveryQueue) Settle(nodeID int, id int, err error) {
+	lock := q.destination(nodeID)
+	lock.Lock()
+	defer lock.Unlock()
+	m, serr := q.store.GetQueuedMessage(id)
+	if serr != nil || m.ID == 0 || !m.InFlight {
+		log.Printf("fogcore: unable to settle message %v: %v\n", id, serr)
+		return
+	}
+	switch {
+	case err == nil:
+		if err := q.store.DeleteQueuedMessage(id); err != nil {
+			log.Printf("fogcore: unable to remove delivered message %v: %v\n", id, err)
+		}
+	case errors.Is(err, ErrPlatformUnreachable):
+		m.InFlight = false
+		m.LastError = err.Error()
+		m.NextAttempt = time.Now()
+		if err := q.store.UpdateQueuedMessage(m); err != nil {
+			log.Printf("fogcore: unable to queue message %v again: %v\n", id, err)
+		}
+		q.Wake()
+	default:
+		m.InFlight = false
+		q.deadLetter(m, err.Error())
+	}
+}
+
+//requeueInFlight Queue the messages left in flight by a previous run again, their interfaces lost them
+func (q *deliveryQueue) requeueInFlight() error {
+	nodes, err := q.store.GetPendingDestinations()
+	if err != nil {
+		return err
+	}
+	for _, nodeID := range nodes {
+		messages, err := q.store.GetQueuedMessages(nodeID)
+		if err != nil {
+			return err
+		}
+		for i := range messages {
+			m := &messages[i]
+			if !m.InFlight {
+				continue
+			}
+			m.InFlight = false
+			m.NextAttempt = time.Now()
+			if err := q.store.UpdateQueuedMessage(m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//Replay Queue a dead letter again, with a fresh TTL and attempts
+func (q *deliveryQueue) Replay(id int) error {
+	m, err := q.store.GetQueuedMessage(id)
+	if err != nil {
+		return err
+	}
+	if m.ID == 0 || !m.Dead {
+		return fmt.Errorf("fogcore: no dead letter %v", id)
+	}
+	now := time.Now()
+	m.Dead = false
+	m.Attempts = 0
+	m.NextAttempt = now
+	m.Expires = now.Add(ConfQueueTTL)
+	if err := q.store.UpdateQueuedMessage(m); err != nil {
+		return err
+	}
+	q.Wake()
+	return nil
+}
+
+//Purge Drop a dead letter
+func (q *deliveryQueue) Purge(id int) error {
+	m, err := q.store.GetQueuedMessage(id)
+	if err != nil {
+		return err
+	}
+	if m.ID == 0 || !m.Dead {
+		return fmt.Errorf("fogcore: no dead letter %v", id)
+	}
+	return q.store.DeleteQueuedMessage(id)
+}
+
+//Wake Check the queues now instead of at the next ConfQueueRetryInterval
+func (q *deliveryQueue) Wake() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+//run Retry the queued messages every ConfQueueRetryInterval, the destinations in parallel, until ctx is done
+func (q *deliveryQueue) run(ctx context.Context) {
+	ticker := time.NewTicker(ConfQueueRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+		nodes, err := q.store.GetPendingDestinations()
+		if err != nil {
+			log.Printf("fogcore: unable to read the delivery queue: %v\n", err)
+			continue
+		}
+		var wg sync.WaitGroup
+		for _, nodeID := range nodes {
+			wg.Add(1)
+			go func(nodeID int) {
+				defer wg.Done()
+				if _, err := q.Flush(nodeID); err != nil {
+					log.Printf("fogcore: delivery queue of node %v: %v\n", nodeID, err)
+				}
+			}(nodeID)
+		}
+		wg.Wait()
+	}
+}
+
+//backoff Delay after the given number of consecutive failures, doubling from min up to max
+func backoff(failures int, min time.Duration, max time.Duration) time.Duration {
+	delay := min
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
@@ -0,0 +1,270 @@
+package fogcore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joriwind/hecomm-api/hecomm"
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/iotInterface"
+	"github.com/joriwind/hecomm-fog/iotInterface/cilorawan"
+)
+
+//flakyPlatform Destination failing while down, recording what it received
+type flakyPlatform struct {
+	mutex    sync.Mutex
+	down     bool
+	err      error
+	received [][]byte
+}
+
+func (p *flakyPlatform) deliver(clm iotInterface.ComLinkMessage, rt route, m *dbconnection.QueuedMessage) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.down {
+		return p.err
+	}
+	p.received = append(p.received, clm.Data)
+	return nil
+}
+
+func (p *flakyPlatform) set(down bool, err error) {
+	p.mutex.Lock()
+	p.down, p.err = down, err
+	p.mutex.Unlock()
+}
+
+//newQueueFixture Queue delivering to a single destination node
+func newQueueFixture(t *testing.T) (*deliveryQueue, *flakyPlatform, dbconnection.Node) {
+	store := dbconnection.NewMemoryStore()
+	pl := dbconnection.Platform{Address: "[::1]:2000", CIType: 1}
+	if err := store.InsertPlatform(&pl); err != nil {
+		t.Fatal(err)
+	}
+	node := dbconnection.Node{DevID: "aaaa::1", PlatformID: pl.ID, InfType: 1}
+	if err := store.InsertNode(&node); err != nil {
+		t.Fatal(err)
+	}
+	platform := &flakyPlatform{}
+	return newDeliveryQueue(store, platform.deliver), platform, node
+}
+
+func setQueueConf(t *testing.T, ttl time.Duration, retry time.Duration) {
+	oldTTL, oldMin, oldMax := ConfQueueTTL, ConfQueueRetryMin, ConfQueueRetryMax
+	ConfQueueTTL, ConfQueueRetryMin, ConfQueueRetryMax = ttl, retry, 4*retry
+	t.Cleanup(func() { ConfQueueTTL, ConfQueueRetryMin, ConfQueueRetryMax = oldTTL, oldMin, oldMax })
+}
+
+func TestDeliveryQueueRetry(t *testing.T) {
+	setQueueConf(t, time.Hour, 20*time.Millisecond)
+	q, platform, node := newQueueFixture(t)
+	platform.set(true, ErrPlatformUnreachable)
+
+	first, err := q.Enqueue(iotInterface.ComLinkMessage{Origin: []byte("0102"), Data: []byte{1}}, route{Node: node})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := q.Flush(node.ID)
+	if err != nil || !errors.Is(results[first.ID], ErrPlatformUnreachable) {
+		t.Fatalf("Flush() = %v, %v, want %v for message %v", results, err, ErrPlatformUnreachable, first.ID)
+	}
+
+	//Queued behind the failed message, even once the platform is back
+	second, _ := q.Enqueue(iotInterface.ComLinkMessage{Origin: []byte("0102"), Data: []byte{2}}, route{Node: node})
+	platform.set(false, nil)
+	if results, _ := q.Flush(node.ID); len(results) != 0 {
+		t.Errorf("Flush() while backing off attempted %v", results)
+	}
+	stored, _ := q.store.GetQueuedMessage(first.ID)
+	if stored.Attempts != 1 || stored.LastError == "" || !stored.NextAttempt.After(stored.Received) {
+		t.Errorf("stored message after failure = %+v", stored)
+	}
+
+	time.Sleep(ConfQueueRetryMin)
+	results, err = q.Flush(node.ID)
+	if err != nil || len(results) != 2 || results[first.ID] != nil || results[second.ID] != nil {
+		t.Fatalf("Flush() after backoff = %v, %v, want both delivered", results, err)
+	}
+	if len(platform.received) != 2 || platform.received[0][0] != 1 || platform.received[1][0] != 2 {
+		t.Errorf("received %v, want messages in order", platform.received)
+	}
+	if pending, _ := q.store.GetPendingDestinations(); len(pending) != 0 {
+		t.Errorf("GetPendingDestinations() after delivery = %v", pending)
+	}
+}
+
+func TestDeliveryQueueDeadLetter(t *testing.T) {
+	setQueueConf(t, 30*time.Millisecond, 10*time.Millisecond)
+	q, platform, node := newQueueFixture(t)
+
+	//Expired after its TTL
+	platform.set(true, ErrPlatformUnreachable)
+	expiring, _ := q.Enqueue(iotInterface.ComLinkMessage{Origin: []byte("0102"), Data: []byte{1}}, route{Node: node})
+	q.Flush(node.ID)
+	time.Sleep(ConfQueueTTL)
+	q.Flush(node.ID)
+	dead, err := q.store.GetDeadLetters()
+	if err != nil || len(dead) != 1 || dead[0].ID != expiring.ID {
+		t.Fatalf("GetDeadLetters() = %v, %v, want expired %v", dead, err, expiring.ID)
+	}
+
+	//Never deliverable, dead-lettered right away
+	platform.set(true, ErrUnknownInterface)
+	hopeless, _ := q.Enqueue(iotInterface.ComLinkMessage{Origin: []byte("0102"), Data: []byte{2}}, route{Node: node})
+	if results, _ := q.Flush(node.ID); !errors.Is(results[hopeless.ID], ErrUnknownInterface) {
+		t.Errorf("Flush() = %v, want %v", results, ErrUnknownInterface)
+	}
+	if dead, _ := q.store.GetDeadLetters(); len(dead) != 2 {
+		t.Errorf("GetDeadLetters() = %v, want 2", dead)
+	}
+
+	//Replayed with a fresh TTL once the platform is back, purged otherwise
+	platform.set(false, nil)
+	if err := q.Replay(expiring.ID); err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+	if results, _ := q.Flush(node.ID); len(results) != 1 || results[expiring.ID] != nil || len(platform.received) != 1 {
+		t.Errorf("Flush() after replay = %v, received %v", results, platform.received)
+	}
+	if err := q.Purge(hopeless.ID); err != nil {
+		t.Errorf("Purge() error = %v", err)
+	}
+	if dead, _ := q.store.GetDeadLetters(); len(dead) != 0 {
+		t.Errorf("GetDeadLetters() after replay and purge = %v", dead)
+	}
+	if err := q.Replay(hopeless.ID); err == nil {
+		t.Error("Replay() of purged message succeeded")
+	}
+}
+
+func TestDeliverLorawanDownlink(t *testing.T) {
+	defer func(confirmed bool, retries int) {
+		cilorawan.ConfDownlinkConfirmed, cilorawan.ConfDownlinkRetries = confirmed, retries
+	}(cilorawan.ConfDownlinkConfirmed, cilorawan.ConfDownlinkRetries)
+	cilorawan.ConfDownlinkConfirmed, cilorawan.ConfDownlinkRetries = true, 0
+
+	f, err := NewFogcore(context.Background(), dbconnection.Config{Driver: dbconnection.DriverMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := dbconnection.Platform{Address: "[::1]:2000", CIType: int(hecomm.CILorawan)}
+	if err := f.store.InsertPlatform(&pl); err != nil {
+		t.Fatal(err)
+	}
+	node := dbconnection.Node{DevID: "\x01\x02\x03\x04\x05\x06\x07\x08", PlatformID: pl.ID, InfType: 1}
+	if err := f.store.InsertNode(&node); err != nil {
+		t.Fatal(err)
+	}
+
+	//Handed to the class-A queue of the platform, its network server fetches it in the next receive window
+	downlinks := cilorawan.NewDownlinkQueue()
+	startLorawan(t, f, pl, downlinks)
+	result := f.enqueue(iotInterface.ComLinkMessage{Origin: []byte("0102"), Data: []byte{1}}, route{Node: node, Platform: pl})
+	if result.Err != nil || result.Queued {
+		t.Fatalf("enqueue() = %+v, want delivered", result)
+	}
+	//Kept in the store until the network server got it, expiring with the queued message
+	queued, _ := f.store.GetQueuedMessages(node.ID)
+	if len(queued) != 1 || !queued[0].InFlight {
+		t.Fatalf("GetQueuedMessages() = %+v, want message in flight", queued)
+	}
+	devEUI := []byte(node.DevID)
+	d, _ := downlinks.Next(devEUI, 0, 1)
+	if d == nil || !d.Confirmed || d.FPort != cilorawan.ConfDownlinkFPort || !d.Expires.Equal(queued[0].Expires) {
+		t.Fatalf("Next() = %+v, want confirmed downlink expiring at %v", d, queued[0].Expires)
+	}
+	//A restart finds it in flight and queues it again
+	f.queue.requeueInFlight()
+	if queued, _ := f.store.GetQueuedMessages(node.ID); len(queued) != 1 || queued[0].InFlight {
+		t.Fatalf("GetQueuedMessages() after restart = %+v, want message queued", queued)
+	}
+	queued[0].InFlight = true
+	f.store.UpdateQueuedMessage(&queued[0])
+
+	//Never acknowledged, it becomes a dead letter
+	downlinks.Next(devEUI, 0, 2)
+	waitFor(t, "unacknowledged downlink dead-lettered", func() bool {
+		dead, _ := f.store.GetDeadLetters()
+		return len(dead) == 1 && dead[0].NodeID == node.ID && strings.Contains(dead[0].LastError, "not acknowledged")
+	})
+
+	//Delivered once the network server fetched it
+	f.enqueue(iotInterface.ComLinkMessage{Origin: []byte("0102"), Data: []byte{2}}, route{Node: node, Platform: pl})
+	downlinks.Next(devEUI, 0, 3)
+	downlinks.Ack(devEUI, 3)
+	waitFor(t, "acknowledged downlink removed", func() bool {
+		queued, _ := f.store.GetQueuedMessages(node.ID)
+		return len(queued) == 0
+	})
+
+	//A restarted application server gives its downlinks back to the queue of the fog
+	f.enqueue(iotInterface.ComLinkMessage{Origin: []byte("0102"), Data: []byte{3}}, route{Node: node, Platform: pl})
+	restarted := cilorawan.NewDownlinkQueue()
+	startLorawan(t, f, pl, restarted)
+	waitFor(t, "downlink queued again", func() bool {
+		queued, _ := f.store.GetQueuedMessages(node.ID)
+		return len(queued) == 1 && !queued[0].InFlight
+	})
+	f.queue.Flush(node.ID)
+	if restarted.Len(devEUI) != 1 {
+		t.Errorf("Len() after restart = %v, want the downlink pushed again", restarted.Len(devEUI))
+	}
+
+	//A stopped platform is retried later
+	f.lorawan.remove(pl)
+	waitFor(t, "downlink of the stopped platform queued again", func() bool {
+		queued, _ := f.store.GetQueuedMessages(node.ID)
+		return len(queued) == 1 && !queued[0].InFlight
+	})
+	result = f.enqueue(iotInterface.ComLinkMessage{Origin: []byte("0102"), Data: []byte{4}}, route{Node: node, Platform: pl})
+	if result.Err != nil || !result.Queued {
+		t.Errorf("enqueue() = %+v, want queued behind the failed downlink", result)
+	}
+	if queued, _ := f.store.GetQueuedMessages(node.ID); len(queued) != 2 || !strings.Contains(queued[0].LastError, "not running") {
+		t.Errorf("GetQueuedMessages() = %+v, want both downlinks queued until the platform runs", queued)
+	}
+}
+
+func TestLorawanDownlinkArgs(t *testing.T) {
+	node := dbconnection.Node{CIArgs: map[string]interface{}{"fport": 10.0, "confirmed": true, "priority": 1.0}}
+	link := dbconnection.Link{CIArgs: map[string]interface{}{"fport": 20.0, "confirmed": false}}
+
+	if d := lorawanDownlink(iotInterface.ComLinkMessage{}, route{}); d.FPort != cilorawan.ConfDownlinkFPort || d.Confirmed != cilorawan.ConfDownlinkConfirmed {
+		t.Errorf("lorawanDownlink() = %+v, want defaults", d)
+	}
+	if d := lorawanDownlink(iotInterface.ComLinkMessage{}, route{Node: node}); d.FPort != 10 || !d.Confirmed || d.Priority != 1 {
+		t.Errorf("lorawanDownlink() = %+v, want arguments of the node", d)
+	}
+	if d := lorawanDownlink(iotInterface.ComLinkMessage{}, route{Node: node, Link: link}); d.FPort != 20 || d.Confirmed || d.Priority != 1 {
+		t.Errorf("lorawanDownlink() = %+v, want arguments of the link before the node", d)
+	}
+	link.CIArgs["fport"] = 224.0
+	if d := lorawanDownlink(iotInterface.ComLinkMessage{}, route{Node: node, Link: link}); d.FPort != cilorawan.ConfDownlinkFPort {
+		t.Errorf("lorawanDownlink() FPort = %v, want default for reserved port", d.FPort)
+	}
+}
+
+//startLorawan Run platform with an application server serving downlinks, not listening
+func startLorawan(t *testing.T, f *Fogcore, platform dbconnection.Platform, downlinks *cilorawan.DownlinkQueue) {
+	t.Helper()
+	err := f.lorawan.start(platform, lorawanASAddress(platform), func() (lorawanServer, error) {
+		return lorawanServer{downlinks: downlinks}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+//waitFor Wait until cond holds, outcomes settled in the background take a moment
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %v", what)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package fogcore
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/iotInterface"
+)
+
+//maxUnrouted Number of origins without destinations remembered
+const maxUnrouted = 1024
+
+//route One destination of the uplinks of a node, over Link
+type route struct {
+	Node     dbconnection.Node
+	Platform dbconnection.Platform
+	Link     dbconnection.Link
+}
+
+//RoutingStats Statistics of the routing table
+type RoutingStats struct {
+	Origins int
+	Routes  int
+	Hits    uint64
+	Misses  uint64
+}
+
+/*
+ * routingTable In-memory table of origin DevID -> destinations, in front of the store.
+ * Every mutation passes through the table, so it reloads itself whenever the
+ * platforms, nodes or links change.
+ */
+type routingTable struct {
+	dbconnection.Store
+	mutex  sync.RWMutex
+	routes map[string][]route
+	//unrouted Origins without destinations, ErrUnknownNode or ErrNoRoute, at most maxUnrouted
+	unrouted map[string]error
+	//generation Number of reloads, a lookup in the store is only cached if no reload happened during it
+	generation uint64
+	hits       uint64
+	misses     uint64
+}
+
+//newRoutingTable Wrap store with a routing table, loaded with the current links
+func newRoutingTable(store dbconnection.Store) (*routingTable, error) {
+	r := &routingTable{Store: store}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//reload Rebuild the table from the store
+func (r *routingTable) reload() error {
+	platforms, err := r.Store.GetPlatforms()
+	if err != nil {
+		return err
+	}
+	nodes, err := r.Store.GetNodes()
+	if err != nil {
+		return err
+	}
+	links, err := r.Store.GetLinks()
+	if err != nil {
+		return err
+	}
+
+	pls := make(map[int]dbconnection.Platform)
+	for _, pl := range platforms {
+		pls[pl.ID] = pl
+	}
+	ns := make(map[int]dbconnection.Node)
+	for _, n := range nodes {
+		ns[n.ID] = n
+	}
+	routes := make(map[string][]route)
+	add := func(src int, dst int, l dbconnection.Link) {
+		srcNode, ok := ns[src]
+		if !ok {
+			return
+		}
+		dstNode, ok := ns[dst]
+		if !ok {
+			return
+		}
+		pl, ok := pls[dstNode.PlatformID]
+		if !ok {
+			return
+		}
+		routes[srcNode.DevID] = append(routes[srcNode.DevID], route{Node: dstNode, Platform: pl, Link: l})
+	}
+	for _, l := range links {
+		add(l.ProvNode, l.ReqNode, l)
+		add(l.ReqNode, l.ProvNode, l)
+	}
+
+	r.mutex.Lock()
+	r.routes = routes
+	r.unrouted = make(map[string]error)
+	r.generation++
+	r.mutex.Unlock()
+	log.Printf("fogcore: routing table loaded: %v origins\n", len(routes))
+	return nil
+}
+
+//invalidate Reload after a mutation of the store, passing on the error of the mutation
+func (r *routingTable) invalidate(err error) error {
+	if err != nil {
+		return err
+	}
+	if err := r.reload(); err != nil {
+		log.Printf("fogcore: unable to reload routing table: %v\n", err)
+	}
+	return nil
+}
+
+//known The origin is a registered node
+func (r *routingTable) known(origin string) bool {
+	r.mutex.RLock()
+	_, ok := r.routes[origin]
+	unrouted, cached := r.unrouted[origin]
+	generation := r.generation
+	r.mutex.RUnlock()
+	if ok {
+		return true
+	}
+	if cached {
+		return !errors.Is(unrouted, ErrUnknownNode)
+	}
+	node, err := r.Store.FindNode([]byte(origin))
+	if err != nil {
+		return false
+	}
+	if node.ID == 0 {
+		r.remember(generation, []byte(origin), nil, fmt.Errorf("%w: origin: %s", ErrUnknownNode, origin))
+		return false
+	}
+	return true
+}
+
+//Lookup Retrieve all destinations of the origin of the message
+func (r *routingTable) Lookup(message *iotInterface.ComLinkMessage) ([]route, error) {
+	r.mutex.RLock()
+	rts, ok := r.routes[string(message.Origin)]
+	unrouted, cached := r.unrouted[string(message.Origin)]
+	generation := r.generation
+	r.mutex.RUnlock()
+	if ok {
+		atomic.AddUint64(&r.hits, 1)
+		return rts, nil
+	}
+	if cached {
+		atomic.AddUint64(&r.hits, 1)
+		return nil, unrouted
+	}
+	atomic.AddUint64(&r.misses, 1)
+
+	//Not in the table: without destinations at the last reload, or not a node at all
+	srcnode, err := r.Store.FindNode(message.Origin)
+	if err != nil {
+		return nil, err
+	}
+	if srcnode.ID == 0 {
+		return nil, r.remember(generation, message.Origin, nil, fmt.Errorf("%w: origin: %s", ErrUnknownNode, message.Origin))
+	}
+	links, err := r.Store.GetLinksOfNode(srcnode.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range links {
+		dst := l.ProvNode
+		if dst == srcnode.ID {
+			dst = l.ReqNode
+		}
+		dstnode, err := r.Store.GetNode(dst)
+		if err != nil {
+			return nil, err
+		}
+		if dstnode.ID == 0 {
+			continue
+		}
+		platform, err := r.Store.GetPlatform(dstnode.PlatformID)
+		if err != nil {
+			return nil, err
+		}
+		if platform.ID == 0 {
+			continue
+		}
+		rts = append(rts, route{Node: *dstnode, Platform: *platform, Link: l})
+	}
+	if len(rts) == 0 {
+		return nil, r.remember(generation, message.Origin, nil, fmt.Errorf("%w: origin: %s", ErrNoRoute, message.Origin))
+	}
+	return rts, r.remember(generation, message.Origin, rts, nil)
+}
+
+//remember Cache the destinations of origin read from the store, or err if it has none, until the next reload.
+//Nothing is cached if the table was reloaded since generation, the store may have changed after it was read.
+//Returns err
+func (r *routingTable) remember(generation uint64, origin []byte, rts []route, err error) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.generation != generation {
+		return err
+	}
+	if err != nil {
+		//Any origin can send, forget an arbitrary one when full
+		if len(r.unrouted) >= maxUnrouted {
+			for o := range r.unrouted {
+				delete(r.unrouted, o)
+				break
+			}
+		}
+		r.unrouted[string(origin)] = err
+	} else {
+		r.routes[string(origin)] = rts
+	}
+	return err
+}
+
+//Stats Current statistics of the routing table
+func (r *routingTable) Stats() RoutingStats {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	stats := RoutingStats{
+		Origins: len(r.routes),
+		Hits:    atomic.LoadUint64(&r.hits),
+		Misses:  atomic.LoadUint64(&r.misses),
+	}
+	for _, rts := range r.routes {
+		stats.Routes += len(rts)
+	}
+	return stats
+}
+
+//InsertPlatform Insert platform and reload routes
+func (r *routingTable) InsertPlatform(pl *dbconnection.Platform) error {
+	return r.invalidate(r.Store.InsertPlatform(pl))
+}
+
+//UpdatePlatform Update platform and reload routes
+func (r *routingTable) UpdatePlatform(pl *dbconnection.Platform) error {
+	return r.invalidate(r.Store.UpdatePlatform(pl))
+}
+
+//DeletePlatform Delete platform and reload routes
+func (r *routingTable) DeletePlatform(id int) error {
+	return r.invalidate(r.Store.DeletePlatform(id))
+}
+
+//InsertNode Insert node and reload routes
+func (r *routingTable) InsertNode(n *dbconnection.Node) error {
+	return r.invalidate(r.Store.InsertNode(n))
+}
+
+//UpdateNode Update node and reload routes
+func (r *routingTable) UpdateNode(n *dbconnection.Node) error {
+	return r.invalidate(r.Store.UpdateNode(n))
+}
+
+//DeleteNode Delete node and reload routes
+func (r *routingTable) DeleteNode(id int) error {
+	return r.invalidate(r.Store.DeleteNode(id))
+}
+
+//InsertLink Insert link and reload routes
+func (r *routingTable) InsertLink(l *dbconnection.Link) error {
+	return r.invalidate(r.Store.InsertLink(l))
+}
+
+//UpdateLink Update link and reload routes
+func (r *routingTable) UpdateLink(l *dbconnection.Link) error {
+	return r.invalidate(r.Store.UpdateLink(l))
+}
+
+//DeleteLink Delete link and reload routes
+func (r *routingTable) DeleteLink(id int) error {
+	return r.invalidate(r.Store.DeleteLink(id))
+}
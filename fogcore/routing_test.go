@@ -0,0 +1,146 @@
+package fogcore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/iotInterface"
+)
+
+func TestRoutingTable(t *testing.T) {
+	r, err := newRoutingTable(dbconnection.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := dbconnection.Platform{Address: "[::1]:2000", CIType: 1}
+	if err := r.InsertPlatform(&pl); err != nil {
+		t.Fatal(err)
+	}
+	prov := dbconnection.Node{DevID: "0102030405060708", PlatformID: pl.ID, IsProvider: true, InfType: 1}
+	req := dbconnection.Node{DevID: "aaaa::1", PlatformID: pl.ID, InfType: 1}
+	req2 := dbconnection.Node{DevID: "aaaa::2", PlatformID: pl.ID, InfType: 1}
+	for _, n := range []*dbconnection.Node{&prov, &req, &req2} {
+		if err := r.InsertNode(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//No link yet
+	message := iotInterface.ComLinkMessage{Origin: []byte(prov.DevID)}
+	if _, err := r.Lookup(&message); err == nil {
+		t.Errorf("Lookup() without link: expected error")
+	}
+
+	link := dbconnection.Link{ProvNode: prov.ID, ReqNode: req.ID}
+	link2 := dbconnection.Link{ProvNode: prov.ID, ReqNode: req2.ID}
+	for _, l := range []*dbconnection.Link{&link, &link2} {
+		if err := r.InsertLink(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//The provider fans out to both requesters
+	rts, err := r.Lookup(&message)
+	if err != nil {
+		t.Fatalf("Lookup() error = %v", err)
+	}
+	if len(rts) != 2 || rts[0].Node.ID != req.ID || rts[1].Node.ID != req2.ID || rts[0].Platform.ID != pl.ID {
+		t.Errorf("Lookup() = %v, want %v and %v on %v", rts, req, req2, pl)
+	}
+	//Both directions are routed
+	back := iotInterface.ComLinkMessage{Origin: []byte(req.DevID)}
+	if rts, err := r.Lookup(&back); err != nil || len(rts) != 1 || rts[0].Node.ID != prov.ID {
+		t.Errorf("Lookup() reverse = %v, %v, want %v", rts, err, prov)
+	}
+
+	if err := r.DeleteLink(link.ID); err != nil {
+		t.Fatal(err)
+	}
+	if rts, err := r.Lookup(&message); err != nil || len(rts) != 1 || rts[0].Node.ID != req2.ID {
+		t.Errorf("Lookup() after DeleteLink = %v, %v, want %v", rts, err, req2)
+	}
+	if _, err := r.Lookup(&back); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("Lookup() reverse after DeleteLink = %v, want ErrNoRoute", err)
+	}
+	//Origins without destinations are remembered until the next mutation
+	unknown := iotInterface.ComLinkMessage{Origin: []byte("ffff")}
+	for i := 0; i < 2; i++ {
+		if _, err := r.Lookup(&back); !errors.Is(err, ErrNoRoute) {
+			t.Errorf("Lookup() reverse again = %v, want ErrNoRoute", err)
+		}
+		if _, err := r.Lookup(&unknown); !errors.Is(err, ErrUnknownNode) {
+			t.Errorf("Lookup() of unknown origin = %v, want ErrUnknownNode", err)
+		}
+	}
+	if !r.known(req.DevID) || r.known("ffff") {
+		t.Errorf("known() = %v, %v, want true, false", r.known(req.DevID), r.known("ffff"))
+	}
+	//Unknown origins are remembered by known too, a bounded number of them
+	for i := 0; i < maxUnrouted+10; i++ {
+		if r.known(fmt.Sprintf("bbbb::%x", i)) {
+			t.Errorf("known() of unknown origin %v = true", i)
+		}
+	}
+	r.mutex.RLock()
+	unrouted, cached := len(r.unrouted), r.unrouted[fmt.Sprintf("bbbb::%x", maxUnrouted+9)]
+	r.mutex.RUnlock()
+	if unrouted != maxUnrouted || !errors.Is(cached, ErrUnknownNode) {
+		t.Errorf("unrouted origins = %v, last %v, want %v, ErrUnknownNode", unrouted, cached, maxUnrouted)
+	}
+
+	stats := r.Stats()
+	if stats.Origins != 2 || stats.Routes != 2 || stats.Hits != 6 || stats.Misses != 3 {
+		t.Errorf("Stats() = %+v, want 2 origins, 2 routes, 6 hits, 3 misses", stats)
+	}
+
+	if err := r.InsertLink(&dbconnection.Link{ProvNode: prov.ID, ReqNode: req.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if rts, err := r.Lookup(&back); err != nil || len(rts) != 1 || rts[0].Node.ID != prov.ID {
+		t.Errorf("Lookup() reverse after InsertLink = %v, %v, want %v", rts, err, prov)
+	}
+}
+
+//racingStore Store that runs during once, after looking up a node
+type racingStore struct {
+	dbconnection.Store
+	during func()
+}
+
+func (s *racingStore) FindNode(devID []byte) (*dbconnection.Node, error) {
+	n, err := s.Store.FindNode(devID)
+	if s.during != nil {
+		during := s.during
+		s.during = nil
+		during()
+	}
+	return n, err
+}
+
+func TestRoutingTableReloadDuringLookup(t *testing.T) {
+	store := &racingStore{Store: dbconnection.NewMemoryStore()}
+	r, err := newRoutingTable(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := dbconnection.Platform{Address: "[::1]:2000", CIType: 1}
+	if err := r.InsertPlatform(&pl); err != nil {
+		t.Fatal(err)
+	}
+
+	//The node is inserted after the lookup missed it, that answer is not cached
+	node := dbconnection.Node{DevID: "aaaa::1", PlatformID: pl.ID, InfType: 1}
+	store.during = func() {
+		if err := r.InsertNode(&node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	message := iotInterface.ComLinkMessage{Origin: []byte(node.DevID)}
+	if _, err := r.Lookup(&message); !errors.Is(err, ErrUnknownNode) {
+		t.Errorf("Lookup() during reload = %v, want ErrUnknownNode", err)
+	}
+	if _, err := r.Lookup(&message); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("Lookup() after reload = %v, want ErrNoRoute", err)
+	}
+}
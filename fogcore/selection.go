@@ -0,0 +1,180 @@
+package fogcore
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+)
+
+//Names of the provider selection policies
+const (
+	PolicyFirstFit      string = "first-fit"
+	PolicyLeastLoaded   string = "least-loaded"
+	PolicyRoundRobin    string = "round-robin"
+	PolicySamePlatform  string = "same-platform"
+	PolicyLowestLatency string = "lowest-latency"
+)
+
+//ConfProviderPolicy Policy used to order the candidate providers of a link request
+var ConfProviderPolicy = PolicyFirstFit
+
+//candidate Provider node able to serve a link request
+type candidate struct {
+	Node     dbconnection.Node
+	Platform dbconnection.Platform
+	//Load Number of links the provider already takes part in
+	Load int
+}
+
+//ProviderPolicy Decides in which order the candidate providers of a link request are contacted
+type ProviderPolicy interface {
+	Name() string
+	//Order Sort the candidates for the requesting node, the first is contacted first
+	Order(reqNode dbconnection.Node, candidates []candidate) []candidate
+}
+
+//NewProviderPolicy Create the policy known by name, latencies are only used by the lowest-latency policy
+func NewProviderPolicy(name string, latencies *latencyTracker) (ProviderPolicy, error) {
+	switch name {
+	case PolicyFirstFit, "":
+		return firstFit{}, nil
+	case PolicyLeastLoaded:
+		return leastLoaded{}, nil
+	case PolicyRoundRobin:
+		return &roundRobin{}, nil
+	case PolicySamePlatform:
+		return samePlatform{}, nil
+	case PolicyLowestLatency:
+		if latencies == nil {
+			latencies = newLatencyTracker()
+		}
+		return lowestLatency{latencies: latencies}, nil
+	default:
+		return nil, fmt.Errorf("fogcore: unknown provider policy: %v", name)
+	}
+}
+
+//firstFit Keep the order of the store, the lowest node id first
+type firstFit struct{}
+
+func (firstFit) Name() string { return PolicyFirstFit }
+
+func (firstFit) Order(reqNode dbconnection.Node, candidates []candidate) []candidate {
+	return candidates
+}
+
+//leastLoaded Providers with the least links first
+type leastLoaded struct{}
+
+func (leastLoaded) Name() string { return PolicyLeastLoaded }
+
+func (leastLoaded) Order(reqNode dbconnection.Node, candidates []candidate) []candidate {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Load < candidates[j].Load
+	})
+	return candidates
+}
+
+//roundRobin Rotate the first candidate on every request
+type roundRobin struct {
+	mutex sync.Mutex
+	next  int
+}
+
+func (r *roundRobin) Name() string { return PolicyRoundRobin }
+
+func (r *roundRobin) Order(reqNode dbconnection.Node, candidates []candidate) []candidate {
+	if len(candidates) == 0 {
+		return candidates
+	}
+	r.mutex.Lock()
+	start := r.next % len(candidates)
+	r.next++
+	r.mutex.Unlock()
+	ordered := make([]candidate, 0, len(candidates))
+	ordered = append(ordered, candidates[start:]...)
+	return append(ordered, candidates[:start]...)
+}
+
+//samePlatform Providers on the platform of the requester first, no traffic leaves the platform
+type samePlatform struct{}
+
+func (samePlatform) Name() string { return PolicySamePlatform }
+
+func (samePlatform) Order(reqNode dbconnection.Node, candidates []candidate) []candidate {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Platform.ID == reqNode.PlatformID && candidates[j].Platform.ID != reqNode.PlatformID
+	})
+	return candidates
+}
+
+//lowestLatency Providers on the platform with the fastest last connection first, unmeasured platforms last
+type lowestLatency struct {
+	latencies *latencyTracker
+}
+
+func (lowestLatency) Name() string { return PolicyLowestLatency }
+
+func (l lowestLatency) Order(reqNode dbconnection.Node, candidates []candidate) []candidate {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		di, oki := l.latencies.Get(candidates[i].Platform.ID)
+		dj, okj := l.latencies.Get(candidates[j].Platform.ID)
+		if oki != okj {
+			return oki
+		}
+		return di < dj
+	})
+	return candidates
+}
+
+//latencyTracker Time needed to set up the last connection to each platform
+type latencyTracker struct {
+	mutex     sync.RWMutex
+	latencies map[int]time.Duration
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{latencies: make(map[int]time.Duration)}
+}
+
+//Record Remember the connection setup time to platform
+func (l *latencyTracker) Record(platformID int, d time.Duration) {
+	l.mutex.Lock()
+	l.latencies[platformID] = d
+	l.mutex.Unlock()
+}
+
+//Get Last connection setup time to platform, false if never measured
+func (l *latencyTracker) Get(platformID int) (time.Duration, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	d, ok := l.latencies[platformID]
+	return d, ok
+}
+
+//findCandidates All providers able to serve the link request of reqNode, ordered by policy
+func findCandidates(store dbconnection.Store, policy ProviderPolicy, reqNode dbconnection.Node, infType int) ([]candidate, error) {
+	nodes, err := store.FindAvailableProviderNodes(infType, reqNode.ID)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []candidate
+	for _, node := range nodes {
+		platform, err := store.GetPlatform(node.PlatformID)
+		if err != nil {
+			return nil, err
+		}
+		if platform.ID == 0 {
+			continue
+		}
+		links, err := store.GetLinksOfNode(node.ID)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, candidate{Node: node, Platform: *platform, Load: len(links)})
+	}
+	return policy.Order(reqNode, candidates), nil
+}
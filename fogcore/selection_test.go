@@ -0,0 +1,100 @@
+package fogcore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+)
+
+//candidateIDs Node ids of the candidates, in order
+func candidateIDs(candidates []candidate) []int {
+	var ids []int
+	for _, c := range candidates {
+		ids = append(ids, c.Node.ID)
+	}
+	return ids
+}
+
+func equalIDs(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestProviderPolicy(t *testing.T) {
+	latencies := newLatencyTracker()
+	latencies.Record(2, 5*time.Millisecond)
+	latencies.Record(3, time.Millisecond)
+	reqNode := dbconnection.Node{ID: 10, PlatformID: 3}
+	candidates := func() []candidate {
+		return []candidate{
+			{Node: dbconnection.Node{ID: 1}, Platform: dbconnection.Platform{ID: 1}, Load: 2},
+			{Node: dbconnection.Node{ID: 2}, Platform: dbconnection.Platform{ID: 2}, Load: 0},
+			{Node: dbconnection.Node{ID: 3}, Platform: dbconnection.Platform{ID: 3}, Load: 1},
+		}
+	}
+	tests := []struct {
+		name string
+		want [][]int
+	}{
+		{name: PolicyFirstFit, want: [][]int{{1, 2, 3}, {1, 2, 3}}},
+		{name: PolicyLeastLoaded, want: [][]int{{2, 3, 1}}},
+		{name: PolicyRoundRobin, want: [][]int{{1, 2, 3}, {2, 3, 1}, {3, 1, 2}, {1, 2, 3}}},
+		{name: PolicySamePlatform, want: [][]int{{3, 1, 2}}},
+		{name: PolicyLowestLatency, want: [][]int{{3, 2, 1}}},
+	}
+	for _, tt := range tests {
+		policy, err := NewProviderPolicy(tt.name, latencies)
+		if err != nil {
+			t.Fatalf("%q. NewProviderPolicy() error = %v", tt.name, err)
+		}
+		for i, want := range tt.want {
+			if got := candidateIDs(policy.Order(reqNode, candidates())); !equalIDs(got, want) {
+				t.Errorf("%q. Order() request %v = %v, want %v", tt.name, i, got, want)
+			}
+		}
+	}
+	if _, err := NewProviderPolicy("random", nil); err == nil {
+		t.Errorf("NewProviderPolicy() of unknown policy: expected error")
+	}
+}
+
+func TestFindCandidates(t *testing.T) {
+	store := dbconnection.NewMemoryStore()
+	pl := dbconnection.Platform{Address: "[::1]:2000", CIType: 1}
+	if err := store.InsertPlatform(&pl); err != nil {
+		t.Fatal(err)
+	}
+	prov := dbconnection.Node{DevID: "0102030405060708", PlatformID: pl.ID, IsProvider: true, InfType: 1}
+	prov2 := dbconnection.Node{DevID: "0102030405060709", PlatformID: pl.ID, IsProvider: true, InfType: 1}
+	req := dbconnection.Node{DevID: "aaaa::1", PlatformID: pl.ID, InfType: 1}
+	req2 := dbconnection.Node{DevID: "aaaa::2", PlatformID: pl.ID, InfType: 1}
+	for _, n := range []*dbconnection.Node{&prov, &prov2, &req, &req2} {
+		if err := store.InsertNode(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.InsertLink(&dbconnection.Link{ProvNode: prov.ID, ReqNode: req2.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	candidates, err := findCandidates(store, leastLoaded{}, req, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := candidateIDs(candidates); !equalIDs(got, []int{prov2.ID, prov.ID}) || candidates[1].Load != 1 {
+		t.Errorf("findCandidates() = %+v, want %v then %v", candidates, prov2.ID, prov.ID)
+	}
+	//Already linked providers are no candidates
+	candidates, err = findCandidates(store, firstFit{}, req2, 1)
+	if err != nil || !equalIDs(candidateIDs(candidates), []int{prov2.ID}) {
+		t.Errorf("findCandidates() for linked requester = %+v, %v, want %v", candidates, err, prov2.ID)
+	}
+}
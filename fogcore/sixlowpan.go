@@ -0,0 +1,125 @@
+package fogcore
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/iotInterface/cisixlowpan"
+)
+
+//sixlowpanLinkConfig Line to the border router of a 6LoWPAN platform: its "transport" (serial, tun or udp),
+//"device", "baud", "listen", "prefix", "source" and "filterDestination" ciargs. Serial lines default to SixlowpanPort and
+//cisixlowpan.ConfBaudRate, other transports need a device.
+func sixlowpanLinkConfig(platform dbconnection.Platform) (cisixlowpan.LinkConfig, error) {
+	config := cisixlowpan.LinkConfig{
+		Transport:         cisixlowpan.TransportSerial,
+		Baud:              cisixlowpan.ConfBaudRate,
+		Listen:            cisixlowpan.ConfUDPListen,
+		Prefix:            cisixlowpan.ConfPrefix,
+		FilterDestination: cisixlowpan.ConfFilterDestination,
+		DebugLevel:        SixlowpanDebugLevel,
+	}
+	if v, ok := platform.CIArgs["transport"]; ok {
+		transport, _ := v.(string)
+		switch transport {
+		case cisixlowpan.TransportSerial, cisixlowpan.TransportTUN, cisixlowpan.TransportUDP:
+			config.Transport = transport
+		default:
+			return config, fmt.Errorf("fogcore: platform %v: %w: %v", platform.Address, cisixlowpan.ErrUnknownTransport, v)
+		}
+	}
+	if device, ok := platform.CIArgs["device"].(string); ok && device != "" {
+		config.Device = device
+	} else if config.Transport == cisixlowpan.TransportSerial {
+		config.Device = SixlowpanPort
+	} else {
+		return config, fmt.Errorf("fogcore: platform %v: %v transport without device", platform.Address, config.Transport)
+	}
+	if listen, ok := platform.CIArgs["listen"].(string); ok && listen != "" {
+		config.Listen = listen
+	}
+	if v, ok := platform.CIArgs["baud"]; ok {
+		baud, ok := v.(float64)
+		if !ok || baud <= 0 || baud != float64(int(baud)) {
+			return config, fmt.Errorf("fogcore: platform %v: invalid baud rate: %v", platform.Address, v)
+		}
+		config.Baud = int(baud)
+	}
+	if v, ok := platform.CIArgs["prefix"]; ok {
+		prefix, _ := v.(string)
+		_, network, err := net.ParseCIDR(prefix)
+		if err != nil || network.IP.To4() != nil {
+			return config, fmt.Errorf("fogcore: platform %v: invalid IPv6 prefix: %v", platform.Address, v)
+		}
+		config.Prefix = network
+	}
+	if v, ok := platform.CIArgs["source"]; ok {
+		source, _ := v.(string)
+		ip := net.ParseIP(source)
+		if ip == nil || ip.To4() != nil || !config.Prefix.Contains(ip) {
+			return config, fmt.Errorf("fogcore: platform %v: source address %v not in %v", platform.Address, v, config.Prefix)
+		}
+		config.Source = ip
+	}
+	if v, ok := platform.CIArgs["filterDestination"]; ok {
+		filter, ok := v.(bool)
+		if !ok {
+			return config, fmt.Errorf("fogcore: platform %v: invalid filterDestination: %v", platform.Address, v)
+		}
+		config.FilterDestination = filter
+	}
+	return config, nil
+}
+
+//sixlowpanLinks Lines to the border routers of the running 6LoWPAN platforms, by platform address
+type sixlowpanLinks struct {
+	mutex sync.RWMutex
+	links map[string]*cisixlowpan.Link
+}
+
+func newSixlowpanLinks() *sixlowpanLinks {
+	return &sixlowpanLinks{links: make(map[string]*cisixlowpan.Link)}
+}
+
+//open Open the line of platform, closing the one of an earlier start first so the device can be reused
+func (s *sixlowpanLinks) open(platform dbconnection.Platform) (*cisixlowpan.Link, error) {
+	config, err := sixlowpanLinkConfig(platform)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if link, ok := s.links[platform.Address]; ok {
+		link.Close()
+		delete(s.links, platform.Address)
+	}
+	link, err := cisixlowpan.OpenLink(config)
+	if err != nil {
+		return nil, err
+	}
+	s.links[platform.Address] = link
+	return link, nil
+}
+
+//remove Close the line of a stopped platform
+func (s *sixlowpanLinks) remove(platform dbconnection.Platform) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if link, ok := s.links[platform.Address]; ok {
+		link.Close()
+		delete(s.links, platform.Address)
+	}
+}
+
+//link Line to the border router of platform
+func (s *sixlowpanLinks) link(platform dbconnection.Platform) (*cisixlowpan.Link, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	link, ok := s.links[platform.Address]
+	if !ok {
+		return nil, fmt.Errorf("%w: 6LoWPAN platform %v is not running", ErrPlatformUnreachable, platform.Address)
+	}
+	return link, nil
+}
@@ -0,0 +1,172 @@
+package fogcore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/joriwind/hecomm-api/hecomm"
+	"github.com/joriwind/hecomm-fog/dbconnection"
+	"github.com/joriwind/hecomm-fog/iotInterface"
+	"github.com/joriwind/hecomm-fog/iotInterface/cisixlowpan"
+)
+
+func TestSixlowpanLinkConfig(t *testing.T) {
+	config, err := sixlowpanLinkConfig(dbconnection.Platform{})
+	if err != nil || config.Device != SixlowpanPort || config.Baud != cisixlowpan.ConfBaudRate || config.Prefix != cisixlowpan.ConfPrefix {
+		t.Errorf("sixlowpanLinkConfig() = %+v, %v, want defaults", config, err)
+	}
+
+	config, err = sixlowpanLinkConfig(dbconnection.Platform{CIArgs: map[string]interface{}{
+		"device": "/dev/ttyACM1", "baud": float64(460800), "prefix": "fd00:1::/64",
+	}})
+	if err != nil || config.Device != "/dev/ttyACM1" || config.Baud != 460800 || config.Prefix.String() != "fd00:1::/64" {
+		t.Errorf("sixlowpanLinkConfig() = %+v, %v, want ciargs", config, err)
+	}
+
+	config, err = sixlowpanLinkConfig(dbconnection.Platform{CIArgs: map[string]interface{}{
+		"transport": "udp", "device": "[fd00::1]:5683", "listen": "[::]:5684",
+	}})
+	if err != nil || config.Transport != cisixlowpan.TransportUDP || config.Device != "[fd00::1]:5683" || config.Listen != "[::]:5684" {
+		t.Errorf("sixlowpanLinkConfig() = %+v, %v, want udp transport", config, err)
+	}
+
+	for _, args := range []map[string]interface{}{
+		{"transport": "ble"},
+		{"transport": "tun"},
+		{"baud": "fast"},
+		{"baud": float64(-1)},
+		{"prefix": "10.0.0.0/8"},
+		{"prefix": "fd00::"},
+		{"filterDestination": "yes"},
+	} {
+		if _, err := sixlowpanLinkConfig(dbconnection.Platform{CIArgs: args}); err == nil {
+			t.Errorf("sixlowpanLinkConfig(%v) = nil, want error", args)
+		}
+	}
+}
+
+func TestDeliverSixlowpan(t *testing.T) {
+	f, err := NewFogcore(context.Background(), dbconnection.Config{Driver: dbconnection.DriverMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Border router reached over UDP
+	router, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	pl := dbconnection.Platform{Address: "[::1]:2001", CIType: int(hecomm.CISixlowpan),
+		CIArgs: map[string]interface{}{"transport": "udp", "device": router.LocalAddr().String(), "listen": "[::1]:0"}}
+	if err := f.store.InsertPlatform(&pl); err != nil {
+		t.Fatal(err)
+	}
+	node := dbconnection.Node{DevID: "aaaa::2", PlatformID: pl.ID, InfType: 1}
+	if err := f.store.InsertNode(&node); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.sixlowpan.open(pl); err != nil {
+		t.Fatal(err)
+	}
+	defer f.sixlowpan.remove(pl)
+
+	//Written to the line of the platform
+	sent := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 256)
+		router.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, _ := router.ReadFrom(buf)
+		sent <- buf[:n]
+	}()
+	result := f.enqueue(iotInterface.ComLinkMessage{Origin: []byte("0102"), Data: []byte("down")}, route{Node: node, Platform: pl})
+	if result.Err != nil || result.Queued {
+		t.Fatalf("enqueue() = %+v, want delivered", result)
+	}
+	select {
+	case frame := <-sent:
+		if !bytes.Contains(frame, []byte("down")) {
+			t.Errorf("sent %x, want the downlink", frame)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("downlink not sent")
+	}
+
+	//A node outside the prefix of the border router can not be reached
+	outside := dbconnection.Node{DevID: "bbbb::2", PlatformID: pl.ID, InfType: 1}
+	if err := f.store.InsertNode(&outside); err != nil {
+		t.Fatal(err)
+	}
+	result = f.enqueue(iotInterface.ComLinkMessage{Origin: []byte("0102"), Data: []byte{1}}, route{Node: outside, Platform: pl})
+	if !errors.Is(result.Err, ErrUndeliverable) || result.Queued {
+		t.Errorf("enqueue() = %+v, want undeliverable", result)
+	}
+
+	//A stopped platform is retried later
+	f.sixlowpan.remove(pl)
+	result = f.enqueue(iotInterface.ComLinkMessage{Origin: []byte("0102"), Data: []byte{2}}, route{Node: node, Platform: pl})
+	if !errors.Is(result.Err, ErrPlatformUnreachable) || !result.Queued {
+		t.Errorf("enqueue() = %+v, want queued until the platform runs", result)
+	}
+}
+
+func TestSixlowpanDatagram(t *testing.T) {
+	clm := iotInterface.ComLinkMessage{Data: []byte{1}}
+	for _, tc := range []struct {
+		name     string
+		node     dbconnection.Node
+		link     dbconnection.Link
+		port     uint16
+		hopLimit int
+	}{
+		{name: "default", node: dbconnection.Node{DevID: "aaaa::2"}},
+		{name: "application", node: dbconnection.Node{DevID: "[aaaa::2]:5684", CIArgs: map[string]interface{}{"port": float64(7)}}, port: 5684},
+		{name: "node port", node: dbconnection.Node{DevID: "aaaa::2", CIArgs: map[string]interface{}{"port": float64(5685), "hopLimit": float64(8)}}, port: 5685, hopLimit: 8},
+		{name: "link port", node: dbconnection.Node{DevID: "aaaa::2", CIArgs: map[string]interface{}{"port": float64(5685)}},
+			link: dbconnection.Link{CIArgs: map[string]interface{}{"port": float64(5686)}}, port: 5686},
+		{name: "invalid", node: dbconnection.Node{DevID: "aaaa::2", CIArgs: map[string]interface{}{"port": float64(70000), "hopLimit": float64(0)}}},
+	} {
+		d, err := sixlowpanDatagram(clm, route{Node: tc.node, Link: tc.link})
+		if err != nil || !d.Destination.Equal(net.ParseIP("aaaa::2")) || d.Port != tc.port || d.HopLimit != tc.hopLimit {
+			t.Errorf("%v: sixlowpanDatagram() = %+v, %v, want port %v, hop limit %v", tc.name, d, err, tc.port, tc.hopLimit)
+		}
+	}
+
+	if _, err := sixlowpanDatagram(clm, route{Node: dbconnection.Node{DevID: "0102"}}); !errors.Is(err, ErrUndeliverable) {
+		t.Errorf("sixlowpanDatagram() to invalid address = %v, want ErrUndeliverable", err)
+	}
+}
+
+func TestSixlowpanOrigin(t *testing.T) {
+	f, err := NewFogcore(context.Background(), dbconnection.Config{Driver: dbconnection.DriverMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := dbconnection.Platform{Address: "[::1]:2001", CIType: int(hecomm.CISixlowpan)}
+	if err := f.store.InsertPlatform(&pl); err != nil {
+		t.Fatal(err)
+	}
+	for _, devID := range []string{"aaaa::2", "[aaaa::2]:5684"} {
+		if err := f.store.InsertNode(&dbconnection.Node{DevID: devID, PlatformID: pl.ID, InfType: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	uplink := func(port uint16) iotInterface.ComLinkMessage {
+		return iotInterface.ComLinkMessage{
+			InterfaceType: hecomm.CISixlowpan,
+			Origin:        []byte("aaaa::2"),
+			Metadata:      iotInterface.Metadata{Sixlowpan: &iotInterface.SixlowpanMetadata{Source: "aaaa::2", SourcePort: port}},
+		}
+	}
+	//The application on port 5684 is a node of its own, the other ports belong to the node
+	if origin := f.sixlowpanOrigin(uplink(5684)); string(origin) != "[aaaa::2]:5684" {
+		t.Errorf("sixlowpanOrigin() = %s, want the application", origin)
+	}
+	if origin := f.sixlowpanOrigin(uplink(5683)); string(origin) != "aaaa::2" {
+		t.Errorf("sixlowpanOrigin() = %s, want the node", origin)
+	}
+}
@@ -2,13 +2,31 @@ package cilorawan
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"time"
 
 	ns "github.com/joriwind/hecomm-fog/api/ns"
-	"github.com/joriwind/hecomm-fog/iotInterface"
+	"github.com/joriwind/hecomm-fog/pki"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
+//clientConfigs TLS configurations of the network servers dialed, by credentials
+var clientConfigs = pki.NewCache()
+
+func init() {
+	//Configurations of rotated certificates are loaded again on the next dial
+	pki.DefaultWatcher.AddCache(clientConfigs)
+}
+
+//DefaultCredentials Credentials used for network servers of platforms without their own
+func DefaultCredentials() pki.Credentials {
+	return pki.Credentials{Cert: ConfCILorawanCert, Key: ConfCILorawanKey, CaCert: ConfCILorawanCaCert}
+}
+
 //NetworkClient Object for interfacing LoRaWAN Network server client
 type NetworkClient struct {
 	ctx                 context.Context
@@ -18,20 +36,21 @@ type NetworkClient struct {
 	networkServerClient ns.NetworkServerClient
 }
 
-//NewNetworkClient Create connection with LoRaWAN Network server
-func NewNetworkClient(ctx context.Context, host string) (*NetworkClient, error) {
+//NewNetworkClient Create connection with LoRaWAN Network server, using the credentials of its platform
+func NewNetworkClient(ctx context.Context, host string, creds pki.Credentials) (*NetworkClient, error) {
 	//Does the fog use secured connection?
 	var n NetworkClient
 	var nsDialOptions []grpc.DialOption
-	nsDialOptions = append(nsDialOptions, grpc.WithTransportCredentials(
-		mustGetTransportCredentials(ConfCILorawanCert, ConfCILorawanKey, ConfCILorawanCaCert, true),
-	))
+	config, err := clientConfigs.ClientConfig(creds.Or(DefaultCredentials()))
+	if err != nil {
+		return &n, err
+	}
+	nsDialOptions = append(nsDialOptions, grpc.WithTransportCredentials(credentials.NewTLS(config)))
 	//nsDialOptions = append(nsDialOptions, grpc.WithInsecure())
 	//host := "192.168.1.1:8000"
 	nsConn, err := grpc.Dial(host, nsDialOptions...) //TODO: when close connection?
 	if err != nil {
-		log.Fatalf("application-server (FOG) dial error: %s", err)
-		return &n, err
+		return &n, fmt.Errorf("application-server (FOG) dial error: %v", err)
 	}
 	//defer asConn.Close() //TODO: Do not forget to close connection!
 	networkServerClient := ns.NewNetworkServerClient(nsConn)
@@ -45,38 +64,54 @@ func NewNetworkClient(ctx context.Context, host string) (*NetworkClient, error)
 	return &n, nil
 }
 
-//SendData Send data from fogCore to LoRaWAN Network Server
-func (n *NetworkClient) SendData(message iotInterface.ComLinkMessage) error {
-	pushDataDownReq := &ns.PushDataDownRequest{
-		DevEUI:    message.Destination,
-		Confirmed: false,
-		FCnt:      0,
-		FPort:     255,
-		Data:      message.Data,
-	}
-
-	//Find the right FCnt
-	nodeSessionRequest := &ns.GetNodeSessionRequest{
-		DevEUI: message.Destination,
-	}
-	if nodeSessionResponse, err := n.networkServerClient.GetNodeSession(n.ctx, nodeSessionRequest); err != nil {
-		//log.Printf("LoRaWAN interface: GetNodeSession did not work: %v", err)
+//CreateNodeSession Create the session of a node that joined, replacing the session of an earlier join
+func (n *NetworkClient) CreateNodeSession(ctx context.Context, req *ns.CreateNodeSessionRequest) error {
+	_, err := n.networkServerClient.DeleteNodeSession(ctx, &ns.DeleteNodeSessionRequest{DevEUI: req.DevEUI})
+	if err != nil && status.Code(err) != codes.NotFound {
 		return err
-	} else {
-		log.Printf("FCntDown(f): %v\n", nodeSessionResponse.GetFCntDown())
-		log.Printf("FCntDown(v): %v\n", nodeSessionResponse.FCntDown)
-		pushDataDownReq.FCnt = nodeSessionResponse.FCntDown
 	}
+	_, err = n.networkServerClient.CreateNodeSession(ctx, req)
+	return err
+}
 
-	//Send packet down to Network server
-	if _, err := n.networkServerClient.PushDataDown(n.ctx, pushDataDownReq); err != nil {
-		return err
+//gatewayPageSize Gateways requested per ListGateways call
+const gatewayPageSize = 100
+
+//ListGateways Inventory of the gateways of the network server
+func (n *NetworkClient) ListGateways(ctx context.Context) ([]*ns.GetGatewayResponse, error) {
+	var gateways []*ns.GetGatewayResponse
+	for {
+		resp, err := n.networkServerClient.ListGateways(ctx, &ns.ListGatewayRequest{Limit: gatewayPageSize, Offset: int32(len(gateways))})
+		if err != nil {
+			return gateways, err
+		}
+		gateways = append(gateways, resp.Result...)
+		if len(resp.Result) == 0 || len(gateways) >= int(resp.TotalCount) {
+			return gateways, nil
+		}
 	}
+}
 
-	return nil
+//GatewayStats Packet counters of the gateway with mac between start and end, per minute
+func (n *NetworkClient) GatewayStats(ctx context.Context, mac []byte, start time.Time, end time.Time) ([]*ns.GatewayStats, error) {
+	resp, err := n.networkServerClient.GetGatewayStats(ctx, &ns.GetGatewayStatsRequest{
+		Mac:            mac,
+		Interval:       ns.AggregationInterval_MINUTE,
+		StartTimestamp: start.UTC().Format(time.RFC3339Nano),
+		EndTimestamp:   end.UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Result, nil
 }
 
 //Close Close the connection!
 func (n *NetworkClient) Close() {
 	n.nsConn.Close()
 }
+
+//Closed The connection was shut down and can not be used anymore, transient failures are reconnected by gRPC
+func (n *NetworkClient) Closed() bool {
+	return n.nsConn.GetState() == connectivity.Shutdown
+}
@@ -1,10 +1,15 @@
 package cilorawan
 
+import "time"
+
 //Configuration of client and server
 
-//ConfNSAddress Address of lora Network server
+//ConfNSAddress Address of lora Network server, for platforms without an "nsAddress" ciarg
 var ConfNSAddress = "192.168.2.104:8000"
 
+//ConfASAddress Listen address of the application server of platforms without an "asAddress" ciarg
+var ConfASAddress = ":8001"
+
 //ConfCILorawanCert Certificate to use
 var ConfCILorawanCert = "certs/fogcore.cert.pem"
 
@@ -13,3 +18,40 @@ var ConfCILorawanCaCert = "certs/ca-chain.cert.pem"
 
 //ConfCILorawanKey Corresponding key to certificate
 var ConfCILorawanKey = "private/fogcore.key.pem"
+
+//ConfDownlinkFPort FPort of downlinks
+var ConfDownlinkFPort uint32 = 1
+
+//ConfDownlinkConfirmed Whether downlinks request an acknowledgement of the node
+var ConfDownlinkConfirmed = false
+
+//ConfDownlinkRetries Retransmissions of an unacknowledged confirmed downlink before it fails
+var ConfDownlinkRetries = 2
+
+//ConfDownlinkTTL Time a downlink without expiry waits for a receive window of its node, downlinks of the fog expire
+//with their queued message
+var ConfDownlinkTTL = time.Hour
+
+//ConfDownlinkExpiryInterval Interval of the check for expired downlinks of nodes that stopped sending uplinks
+var ConfDownlinkExpiryInterval = time.Minute
+
+//ConfMaxPayloadSize Largest downlink payload sent whole, 51 bytes fit in every data rate; larger payloads are fragmented
+var ConfMaxPayloadSize = 51
+
+//ConfFragmentFPort FPort of the fragments of payloads larger than ConfMaxPayloadSize
+var ConfFragmentFPort uint32 = 200
+
+//ConfReassemblyTimeout Time the fragments of an uplink are kept waiting for the missing ones
+var ConfReassemblyTimeout = 10 * time.Minute
+
+//ConfJoinRxDelay Delay of the first receive window after an uplink, in seconds, given to joining nodes
+var ConfJoinRxDelay uint8 = 1
+
+//ConfJoinRx1DROffset Data rate offset of the first receive window given to joining nodes
+var ConfJoinRx1DROffset uint8
+
+//ConfJoinRx2DR Data rate of the second receive window given to joining nodes
+var ConfJoinRx2DR uint8
+
+//ConfDevNonceHistory DevNonces remembered per node to refuse replayed join-requests
+var ConfDevNonceHistory = 100
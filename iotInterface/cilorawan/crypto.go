@@ -0,0 +1,217 @@
+package cilorawan
+
+import (
+	"crypto/aes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+/* LoRaWAN 1.0 cryptography of the application server, with AES-128 keys */
+
+//ErrInvalidMIC The message integrity code does not match the key
+var ErrInvalidMIC = errors.New("cilorawan: invalid MIC")
+
+//Message types in the MHDR, major version LoRaWAN R1
+const (
+	mTypeJoinRequest uint8 = 0x00
+	mTypeJoinAccept  uint8 = 0x20
+)
+
+//cmac AES-CMAC (RFC 4493) of data with key
+func cmac(key []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	//Subkeys from the encrypted zero block
+	k1 := make([]byte, aes.BlockSize)
+	block.Encrypt(k1, k1)
+	k1 = shiftSubkey(k1)
+	k2 := shiftSubkey(append([]byte(nil), k1...))
+
+	n := (len(data) + aes.BlockSize - 1) / aes.BlockSize
+	complete := n > 0 && len(data)%aes.BlockSize == 0
+	if n == 0 {
+		n = 1
+	}
+	last := make([]byte, aes.BlockSize)
+	copy(last, data[(n-1)*aes.BlockSize:])
+	if complete {
+		xor(last, k1)
+	} else {
+		last[len(data)-(n-1)*aes.BlockSize] = 0x80
+		xor(last, k2)
+	}
+
+	x := make([]byte, aes.BlockSize)
+	for i := 0; i < n-1; i++ {
+		xor(x, data[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		block.Encrypt(x, x)
+	}
+	xor(x, last)
+	block.Encrypt(x, x)
+	return x, nil
+}
+
+//shiftSubkey Left shift of b by one bit, xor-ed with the constant Rb when the top bit falls off
+func shiftSubkey(b []byte) []byte {
+	carry := b[0] >> 7
+	for i := 0; i < len(b)-1; i++ {
+		b[i] = b[i]<<1 | b[i+1]>>7
+	}
+	b[len(b)-1] <<= 1
+	if carry == 1 {
+		b[len(b)-1] ^= 0x87
+	}
+	return b
+}
+
+func xor(dst []byte, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+//reversed Copy of b in the opposite byte order, LoRaWAN frames are little endian
+func reversed(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+//mic First 4 bytes of the CMAC of data
+func mic(key []byte, data []byte) ([]byte, error) {
+	m, err := cmac(key, data)
+	if err != nil {
+		return nil, err
+	}
+	return m[:4], nil
+}
+
+//joinRequest Fields of a join-request PHYPayload, EUIs in big endian
+type joinRequest struct {
+	AppEUI   []byte
+	DevEUI   []byte
+	DevNonce uint16
+	//devNonce As in the frame, for the key derivation
+	devNonce []byte
+}
+
+//parseJoinRequest Decode the PHYPayload of a join-request, its MIC is checked by verifyJoinRequest
+func parseJoinRequest(phy []byte) (*joinRequest, error) {
+	if len(phy) != 23 {
+		return nil, fmt.Errorf("cilorawan: join-request of %v bytes, want 23", len(phy))
+	}
+	if phy[0] != mTypeJoinRequest {
+		return nil, fmt.Errorf("cilorawan: MHDR %#x is not a join-request", phy[0])
+	}
+	return &joinRequest{
+		AppEUI:   reversed(phy[1:9]),
+		DevEUI:   reversed(phy[9:17]),
+		DevNonce: uint16(phy[17]) | uint16(phy[18])<<8,
+		devNonce: append([]byte(nil), phy[17:19]...),
+	}, nil
+}
+
+//verifyJoinRequest Check the MIC of a join-request with the AppKey of its node
+func verifyJoinRequest(phy []byte, appKey []byte) error {
+	expected, err := mic(appKey, phy[:19])
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(expected, phy[19:23]) != 1 {
+		return ErrInvalidMIC
+	}
+	return nil
+}
+
+//joinAccept Fields of a join-accept, DevAddr and NetID in big endian
+type joinAccept struct {
+	AppNonce    []byte //3 bytes, as in the frame
+	NetID       []byte
+	DevAddr     []byte
+	Rx1DROffset uint8
+	Rx2DR       uint8
+	RxDelay     uint8
+}
+
+//encrypt PHYPayload of the join-accept, signed and encrypted with appKey
+func (j *joinAccept) encrypt(appKey []byte) ([]byte, error) {
+	if len(j.AppNonce) != 3 || len(j.NetID) != 3 || len(j.DevAddr) != 4 {
+		return nil, fmt.Errorf("cilorawan: invalid join-accept: %+v", j)
+	}
+	msg := []byte{mTypeJoinAccept}
+	msg = append(msg, j.AppNonce...)
+	msg = append(msg, reversed(j.NetID)...)
+	msg = append(msg, reversed(j.DevAddr)...)
+	msg = append(msg, j.Rx1DROffset<<4|j.Rx2DR&0x0f, j.RxDelay)
+	m, err := mic(appKey, msg)
+	if err != nil {
+		return nil, err
+	}
+	plain := append(msg[1:], m...)
+
+	//The node decrypts with AES encrypt, so the server encrypts with AES decrypt
+	block, err := aes.NewCipher(appKey)
+	if err != nil {
+		return nil, err
+	}
+	phy := []byte{mTypeJoinAccept}
+	for i := 0; i < len(plain); i += aes.BlockSize {
+		out := make([]byte, aes.BlockSize)
+		block.Decrypt(out, plain[i:i+aes.BlockSize])
+		phy = append(phy, out...)
+	}
+	return phy, nil
+}
+
+//sessionKeys Derive the NwkSKey and AppSKey of the session started by the join-accept
+func (j *joinAccept) sessionKeys(appKey []byte, devNonce []byte) (nwkSKey []byte, appSKey []byte, err error) {
+	block, err := aes.NewCipher(appKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	derive := func(prefix byte) []byte {
+		in := make([]byte, aes.BlockSize)
+		in[0] = prefix
+		copy(in[1:4], j.AppNonce)
+		copy(in[4:7], reversed(j.NetID))
+		copy(in[7:9], devNonce)
+		out := make([]byte, aes.BlockSize)
+		block.Encrypt(out, in)
+		return out
+	}
+	return derive(0x01), derive(0x02), nil
+}
+
+//encryptFRMPayload Encrypt, or decrypt as it is the same, the FRMPayload of a frame of the session with devAddr
+func encryptFRMPayload(key []byte, uplink bool, devAddr []byte, fCnt uint32, data []byte) ([]byte, error) {
+	if len(devAddr) != 4 {
+		return nil, fmt.Errorf("cilorawan: invalid DevAddr %x", devAddr)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	a := make([]byte, aes.BlockSize)
+	a[0] = 0x01
+	if !uplink {
+		a[5] = 0x01
+	}
+	copy(a[6:10], reversed(devAddr))
+	a[10], a[11], a[12], a[13] = byte(fCnt), byte(fCnt>>8), byte(fCnt>>16), byte(fCnt>>24)
+
+	out := make([]byte, len(data))
+	s := make([]byte, aes.BlockSize)
+	for i := 0; i < len(data); i += aes.BlockSize {
+		a[15] = byte(i/aes.BlockSize + 1)
+		block.Encrypt(s, a)
+		for j := i; j < len(data) && j < i+aes.BlockSize; j++ {
+			out[j] = data[j] ^ s[j-i]
+		}
+	}
+	return out, nil
+}
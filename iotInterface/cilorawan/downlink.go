@@ -0,0 +1,320 @@
+package cilorawan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//Errors reported for downlinks that could not be delivered
+var (
+	//ErrPayloadTooLarge The payload does not fit in the fragments of a downlink
+	ErrPayloadTooLarge = errors.New("cilorawan: downlink payload too large")
+	//ErrNotAcknowledged A confirmed downlink was not acknowledged after ConfDownlinkRetries retransmissions
+	ErrNotAcknowledged = errors.New("cilorawan: downlink not acknowledged")
+	//ErrDownlinkExpired The node did not open a receive window before the downlink expired
+	ErrDownlinkExpired = errors.New("cilorawan: downlink expired")
+	//ErrQueueClosed The application server stopped before the downlink was delivered, it may be queued again
+	ErrQueueClosed = errors.New("cilorawan: downlink queue closed")
+)
+
+//Downlink Payload waiting for the network server to fetch it in a receive window of the node
+type Downlink struct {
+	Data      []byte
+	FPort     uint32
+	Confirmed bool
+	//Priority Served before the queued downlinks of a lower priority
+	Priority int
+	Expires  time.Time
+	//Done Called once with the outcome: nil when handed to the network server, or when acknowledged if confirmed.
+	//Called after the queue is unlocked, but still within the call to the queue that finished the downlink.
+	Done func(err error)
+
+	fCnt          uint32
+	transmissions int
+	//group Fragments of the same payload, nil if not fragmented
+	group *fragmentGroup
+}
+
+//fragmentGroup Outcome of the fragments of payload, guarded by the lock of the queue
+type fragmentGroup struct {
+	payload   *Downlink
+	remaining int
+	failed    bool
+}
+
+//outcome Downlink finished with err
+type outcome struct {
+	d   *Downlink
+	err error
+}
+
+//outcomes Downlinks finished while holding the lock of the queue, their Done is called after it is released
+type outcomes []outcome
+
+//add Finish d with err, a fragment finishes its payload when it is the first to fail or the last to be done
+func (o *outcomes) add(d *Downlink, err error) {
+	if g := d.group; g != nil {
+		if g.failed {
+			return
+		}
+		if err != nil {
+			g.failed = true
+		} else if g.remaining--; g.remaining > 0 {
+			return
+		}
+		d = g.payload
+	}
+	*o = append(*o, outcome{d: d, err: err})
+}
+
+//finish Report the outcomes, without holding the lock of the queue
+func (o *outcomes) finish() {
+	for _, f := range *o {
+		if f.d.Done != nil {
+			f.d.Done(f.err)
+		}
+	}
+}
+
+//fragments Split d in downlinks on ConfFragmentFPort, which together finish d
+func (d *Downlink) fragments(id uint8) ([]*Downlink, error) {
+	payloads, err := fragment(d.Data, d.FPort, id, ConfMaxPayloadSize)
+	if err != nil {
+		return nil, err
+	}
+	group := &fragmentGroup{payload: d, remaining: len(payloads)}
+	downlinks := make([]*Downlink, len(payloads))
+	for i, payload := range payloads {
+		downlinks[i] = &Downlink{
+			Data:      payload,
+			FPort:     ConfFragmentFPort,
+			Confirmed: d.Confirmed,
+			Priority:  d.Priority,
+			Expires:   d.Expires,
+			group:     group,
+		}
+	}
+	return downlinks, nil
+}
+
+/*
+ * DownlinkQueue Downlinks of class-A nodes, per DevEUI.
+ * A class-A node only listens right after an uplink, the network server then asks for a payload with GetDataDown.
+ * The downlinks of a node are served by priority, in order within a priority. A confirmed downlink is kept until HandleDataDownACK arrives and is
+ * sent again in the next receive window when it did not, the downlinks after it wait.
+ */
+type DownlinkQueue struct {
+	mutex   sync.Mutex
+	queues  map[string][]*Downlink
+	pending map[string]*Downlink
+	//fragmentIDs Last message id of the fragmented downlinks of each node
+	fragmentIDs map[string]uint8
+	closed      bool
+}
+
+//NewDownlinkQueue Create an empty queue
+func NewDownlinkQueue() *DownlinkQueue {
+	return &DownlinkQueue{
+		queues:      make(map[string][]*Downlink),
+		pending:     make(map[string]*Downlink),
+		fragmentIDs: make(map[string]uint8),
+	}
+}
+
+//Push Queue d for the node until its next receive window, after the downlinks of the same or a higher priority;
+//a payload larger than ConfMaxPayloadSize is fragmented
+func (q *DownlinkQueue) Push(devEUI []byte, d *Downlink) error {
+	if d.Expires.IsZero() {
+		d.Expires = time.Now().Add(ConfDownlinkTTL)
+	}
+	var finished outcomes
+	defer finished.finish()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	key := string(devEUI)
+	downlinks := []*Downlink{d}
+	if len(d.Data) > ConfMaxPayloadSize {
+		id := q.fragmentIDs[key] + 1
+		fragments, err := d.fragments(id)
+		if err != nil {
+			return err
+		}
+		q.fragmentIDs[key] = id
+		downlinks = fragments
+	}
+	q.expire(key, time.Now(), &finished)
+
+	queue := q.queues[key]
+	i := len(queue)
+	for i > 0 && queue[i-1].Priority < d.Priority {
+		i--
+	}
+	queue = append(queue[:i], append(downlinks, queue[i:]...)...)
+	q.queues[key] = queue
+	return nil
+}
+
+//Next Downlink to transmit with fCnt in the current receive window, if one fits in maxPayloadSize (0 for no limit);
+//moreData tells whether downlinks are left for the following windows
+func (q *DownlinkQueue) Next(devEUI []byte, maxPayloadSize uint32, fCnt uint32) (d *Downlink, moreData bool) {
+	var finished outcomes
+	defer finished.finish()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	key := string(devEUI)
+	q.expire(key, time.Now(), &finished)
+	fits := func(d *Downlink) bool {
+		return maxPayloadSize == 0 || uint32(len(d.Data)) <= maxPayloadSize
+	}
+
+	//The node sent an uplink without acknowledging the last confirmed downlink
+	if p := q.pending[key]; p != nil {
+		if p.transmissions > ConfDownlinkRetries {
+			delete(q.pending, key)
+			finished.add(p, fmt.Errorf("%w: %v transmissions", ErrNotAcknowledged, p.transmissions))
+		} else if !fits(p) {
+			return nil, true
+		} else {
+			p.fCnt = fCnt
+			p.transmissions++
+			return p, len(q.queues[key]) > 0
+		}
+	}
+
+	queue := q.queues[key]
+	//Fragments of a payload that failed are not sent anymore
+	for len(queue) > 0 && queue[0].group != nil && queue[0].group.failed {
+		queue = queue[1:]
+	}
+	q.queues[key] = queue
+	if len(queue) == 0 {
+		delete(q.queues, key)
+		return nil, false
+	}
+	d = queue[0]
+	if !fits(d) {
+		//Waits for a window at a higher data rate
+		return nil, true
+	}
+	queue = queue[1:]
+	if len(queue) == 0 {
+		delete(q.queues, key)
+	} else {
+		q.queues[key] = queue
+	}
+	d.fCnt = fCnt
+	d.transmissions++
+	if d.Confirmed {
+		q.pending[key] = d
+	} else {
+		finished.add(d, nil)
+	}
+	return d, len(queue) > 0
+}
+
+//Ack Acknowledgement of the confirmed downlink sent with fCnt, false when none is pending
+func (q *DownlinkQueue) Ack(devEUI []byte, fCnt uint32) bool {
+	var finished outcomes
+	defer finished.finish()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	key := string(devEUI)
+	p := q.pending[key]
+	if p == nil || p.fCnt != fCnt {
+		return false
+	}
+	delete(q.pending, key)
+	finished.add(p, nil)
+	return true
+}
+
+//Len Number of downlinks of the node not delivered yet, including an unacknowledged one
+func (q *DownlinkQueue) Len(devEUI []byte) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	key := string(devEUI)
+	n := len(q.queues[key])
+	if q.pending[key] != nil {
+		n++
+	}
+	return n
+}
+
+//Expire Drop the downlinks of all nodes past their expiry, also of the nodes that stopped sending uplinks
+func (q *DownlinkQueue) Expire(now time.Time) {
+	var finished outcomes
+	defer finished.finish()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	keys := make(map[string]bool)
+	for key := range q.queues {
+		keys[key] = true
+	}
+	for key := range q.pending {
+		keys[key] = true
+	}
+	for key := range keys {
+		q.expire(key, now, &finished)
+	}
+}
+
+//Run Expire the downlinks every ConfDownlinkExpiryInterval until ctx is done
+func (q *DownlinkQueue) Run(ctx context.Context) {
+	ticker := time.NewTicker(ConfDownlinkExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			q.Expire(now)
+		}
+	}
+}
+
+//Close Give up all downlinks not delivered yet with ErrQueueClosed, later pushes fail
+func (q *DownlinkQueue) Close() {
+	var finished outcomes
+	defer finished.finish()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	for key, p := range q.pending {
+		finished.add(p, ErrQueueClosed)
+		delete(q.pending, key)
+	}
+	for key, queue := range q.queues {
+		for _, d := range queue {
+			finished.add(d, ErrQueueClosed)
+		}
+		delete(q.queues, key)
+	}
+}
+
+//expire Drop the downlinks of key past their expiry into finished, caller holds the lock
+func (q *DownlinkQueue) expire(key string, now time.Time, finished *outcomes) {
+	if p := q.pending[key]; p != nil && now.After(p.Expires) {
+		delete(q.pending, key)
+		finished.add(p, fmt.Errorf("%w: after %v transmissions", ErrDownlinkExpired, p.transmissions))
+	}
+	queue := q.queues[key]
+	kept := queue[:0]
+	for _, d := range queue {
+		if now.After(d.Expires) {
+			finished.add(d, ErrDownlinkExpired)
+			continue
+		}
+		kept = append(kept, d)
+	}
+	if len(kept) == 0 {
+		delete(q.queues, key)
+	} else {
+		q.queues[key] = kept
+	}
+}
@@ -0,0 +1,206 @@
+package cilorawan
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	as "github.com/joriwind/hecomm-fog/api/as"
+)
+
+func TestDownlinkQueue(t *testing.T) {
+	devEUI := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	var outcomes []error
+	done := func(err error) { outcomes = append(outcomes, err) }
+
+	q := NewDownlinkQueue()
+	if err := q.Push(devEUI, &Downlink{Data: make([]byte, (ConfMaxPayloadSize-fragmentHeaderSize)*maxFragments+1), Done: done}); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("Push() error = %v, want %v", err, ErrPayloadTooLarge)
+	}
+	for _, d := range []*Downlink{
+		{Data: []byte{1, 2, 3}, Done: done},
+		{Data: []byte{4}, Confirmed: true, Done: done},
+		{Data: []byte{5}, Done: done},
+	} {
+		if err := q.Push(devEUI, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//Too large for the data rate of the window, nothing is skipped
+	if d, more := q.Next(devEUI, 2, 10); d != nil || !more {
+		t.Fatalf("Next() = %v, %v, want nothing and more data", d, more)
+	}
+	if d, more := q.Next(devEUI, 11, 11); d == nil || d.Data[0] != 1 || !more {
+		t.Fatalf("Next() = %v, %v, want first downlink and more data", d, more)
+	}
+	if len(outcomes) != 1 || outcomes[0] != nil {
+		t.Fatalf("outcomes = %v, want unconfirmed downlink done", outcomes)
+	}
+
+	//Confirmed downlink is sent again until acknowledged, the next one waits
+	if d, _ := q.Next(devEUI, 0, 12); d == nil || d.Data[0] != 4 {
+		t.Fatalf("Next() = %v, want confirmed downlink", d)
+	}
+	if d, _ := q.Next(devEUI, 0, 13); d == nil || d.Data[0] != 4 {
+		t.Fatalf("Next() = %v, want retransmission of confirmed downlink", d)
+	}
+	if q.Ack(devEUI, 12) {
+		t.Error("Ack() of earlier transmission = true, want false")
+	}
+	if !q.Ack(devEUI, 13) {
+		t.Fatal("Ack() = false, want true")
+	}
+	if len(outcomes) != 2 || outcomes[1] != nil {
+		t.Fatalf("outcomes = %v, want confirmed downlink done", outcomes)
+	}
+	if d, more := q.Next(devEUI, 0, 14); d == nil || d.Data[0] != 5 || more {
+		t.Fatalf("Next() = %v, %v, want last downlink without more data", d, more)
+	}
+	if n := q.Len(devEUI); n != 0 {
+		t.Errorf("Len() = %v, want 0", n)
+	}
+}
+
+func TestDownlinkQueueFailures(t *testing.T) {
+	defer func(retries int) { ConfDownlinkRetries = retries }(ConfDownlinkRetries)
+	ConfDownlinkRetries = 1
+	devEUI := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	var outcomes []error
+	done := func(err error) { outcomes = append(outcomes, err) }
+
+	q := NewDownlinkQueue()
+	q.Push(devEUI, &Downlink{Data: []byte{1}, Confirmed: true, Done: done})
+	q.Push(devEUI, &Downlink{Data: []byte{2}, Expires: time.Now().Add(-time.Second), Done: done})
+	q.Push(devEUI, &Downlink{Data: []byte{3}, Done: done})
+	if len(outcomes) != 1 || !errors.Is(outcomes[0], ErrDownlinkExpired) {
+		t.Fatalf("outcomes = %v, want expired downlink", outcomes)
+	}
+
+	for fCnt := uint32(1); fCnt <= 2; fCnt++ {
+		if d, _ := q.Next(devEUI, 0, fCnt); d == nil || d.Data[0] != 1 {
+			t.Fatalf("Next() = %v, want confirmed downlink", d)
+		}
+	}
+	//Out of retransmissions, the next downlink is served instead
+	if d, _ := q.Next(devEUI, 0, 3); d == nil || d.Data[0] != 3 {
+		t.Fatalf("Next() = %v, want downlink after unacknowledged one", d)
+	}
+	if len(outcomes) != 3 || !errors.Is(outcomes[1], ErrNotAcknowledged) || outcomes[2] != nil {
+		t.Errorf("outcomes = %v, want not acknowledged and done", outcomes)
+	}
+
+	//Expired without an uplink of the node, queued and waiting for an acknowledgement alike
+	silent := []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	expires := time.Now().Add(time.Minute)
+	q.Push(silent, &Downlink{Data: []byte{4}, Confirmed: true, Expires: expires, Done: done})
+	q.Next(silent, 0, 1)
+	q.Push(silent, &Downlink{Data: []byte{5}, Expires: expires, Done: done})
+	q.Expire(time.Now())
+	if len(outcomes) != 3 {
+		t.Fatalf("outcomes = %v, want nothing expired yet", outcomes)
+	}
+	q.Expire(expires.Add(time.Second))
+	if len(outcomes) != 5 || !errors.Is(outcomes[3], ErrDownlinkExpired) || !errors.Is(outcomes[4], ErrDownlinkExpired) || q.Len(silent) != 0 {
+		t.Errorf("outcomes = %v, Len() = %v, want both downlinks expired", outcomes, q.Len(silent))
+	}
+}
+
+func TestGetDataDown(t *testing.T) {
+	a := &ApplicationServerAPI{ctx: context.Background(), downlinks: NewDownlinkQueue(), sessions: NewSessions(nil)}
+	devEUI := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	a.downlinks.Push(devEUI, &Downlink{Data: []byte{1}, FPort: 2, Confirmed: true})
+	a.downlinks.Push(devEUI, &Downlink{Data: []byte{2}, FPort: 2})
+
+	resp, err := a.GetDataDown(context.Background(), &as.GetDataDownRequest{DevEUI: devEUI, MaxPayloadSize: 51, FCnt: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Data) != "\x01" || resp.FPort != 2 || !resp.Confirmed || !resp.MoreData {
+		t.Errorf("GetDataDown() = %+v, want confirmed downlink with more data", resp)
+	}
+	if _, err := a.HandleDataDownACK(context.Background(), &as.HandleDataDownACKRequest{DevEUI: devEUI, FCnt: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if n := a.downlinks.Len(devEUI); n != 1 {
+		t.Errorf("Len() after ack = %v, want 1", n)
+	}
+}
+
+func TestDownlinkDoneUnlocked(t *testing.T) {
+	devEUI := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	q := NewDownlinkQueue()
+	//Done may use the queue, e.g. to push the next downlink, it is called after the lock is released
+	var lengths []int
+	done := func(err error) { lengths = append(lengths, q.Len(devEUI)) }
+	q.Push(devEUI, &Downlink{Data: []byte{1}, Done: done})
+	q.Push(devEUI, &Downlink{Data: []byte{2}, Confirmed: true, Done: done})
+	q.Push(devEUI, &Downlink{Data: []byte{3}, Done: done})
+	q.Next(devEUI, 0, 1)
+	q.Next(devEUI, 0, 2)
+	q.Ack(devEUI, 2)
+	q.Close()
+	if len(lengths) != 3 || lengths[0] != 2 || lengths[1] != 1 || lengths[2] != 0 {
+		t.Errorf("Len() in Done = %v, want [2 1 0]", lengths)
+	}
+}
+
+func TestDownlinkQueuePriority(t *testing.T) {
+	devEUI := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	q := NewDownlinkQueue()
+	for i, priority := range []int{0, 1, 0, 2, 1} {
+		q.Push(devEUI, &Downlink{Data: []byte{byte(i)}, Priority: priority})
+	}
+	var order []byte
+	for d, _ := q.Next(devEUI, 0, 0); d != nil; d, _ = q.Next(devEUI, 0, 0) {
+		order = append(order, d.Data[0])
+	}
+	if string(order) != "\x03\x01\x04\x00\x02" {
+		t.Errorf("Next() order = %v, want [3 1 4 0 2]", order)
+	}
+}
+
+func TestDownlinkFragments(t *testing.T) {
+	devEUI := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	payload := make([]byte, 100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	var outcomes []error
+	q := NewDownlinkQueue()
+	if err := q.Push(devEUI, &Downlink{Data: payload, FPort: 3, Done: func(err error) { outcomes = append(outcomes, err) }}); err != nil {
+		t.Fatal(err)
+	}
+	if n := q.Len(devEUI); n != 3 {
+		t.Fatalf("Len() = %v, want 3 fragments", n)
+	}
+
+	r := NewReassembler()
+	var fragments []*Downlink
+	for d, _ := q.Next(devEUI, 0, 0); d != nil; d, _ = q.Next(devEUI, 0, 0) {
+		if len(d.Data) > ConfMaxPayloadSize || d.FPort != ConfFragmentFPort {
+			t.Fatalf("fragment of %v bytes on FPort %v", len(d.Data), d.FPort)
+		}
+		fragments = append(fragments, d)
+	}
+	if len(outcomes) != 1 || outcomes[0] != nil {
+		t.Errorf("outcomes = %v, want payload done once", outcomes)
+	}
+	//Reassembled in any order
+	for _, i := range []int{2, 0, 1} {
+		data, fport, complete, err := r.Add(devEUI, fragments[i].Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if complete != (i == 1) {
+			t.Fatalf("Add() of fragment %v complete = %v", i, complete)
+		}
+		if complete && (fport != 3 || string(data) != string(payload)) {
+			t.Errorf("Add() = %v on FPort %v, want %v on FPort 3", data, fport, payload)
+		}
+	}
+	if _, _, _, err := r.Add(devEUI, []byte{3, 1, 2, 2}); !errors.Is(err, ErrInvalidFragment) {
+		t.Errorf("Add() of invalid header error = %v, want %v", err, ErrInvalidFragment)
+	}
+}
@@ -0,0 +1,104 @@
+package cilorawan
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+ * Payloads larger than ConfMaxPayloadSize, e.g. from 6LoWPAN nodes, are split in fragments sent on
+ * ConfFragmentFPort. Every fragment starts with a header for the reassembly:
+ *
+ *	| FPort of the payload | message id | fragment index | fragment count | data ... |
+ *
+ * Uplinks on ConfFragmentFPort are reassembled the same way before they are forwarded.
+ */
+
+//fragmentHeaderSize Bytes of the header before the data of a fragment
+const fragmentHeaderSize = 4
+
+//maxFragments Fragments a payload can be split in, limited by the header
+const maxFragments = 255
+
+//ErrInvalidFragment An uplink on ConfFragmentFPort without a valid fragment header
+var ErrInvalidFragment = errors.New("cilorawan: invalid fragment")
+
+//fragment Split data sent on fport in fragments of at most size bytes, header included
+func fragment(data []byte, fport uint32, id uint8, size int) ([][]byte, error) {
+	chunk := size - fragmentHeaderSize
+	if chunk <= 0 {
+		return nil, fmt.Errorf("%w: fragments of %v bytes", ErrPayloadTooLarge, size)
+	}
+	count := (len(data) + chunk - 1) / chunk
+	if count > maxFragments {
+		return nil, fmt.Errorf("%w: %v bytes in more than %v fragments", ErrPayloadTooLarge, len(data), maxFragments)
+	}
+	fragments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunk
+		if end > len(data) {
+			end = len(data)
+		}
+		f := append([]byte{uint8(fport), id, uint8(i), uint8(count)}, data[i*chunk:end]...)
+		fragments = append(fragments, f)
+	}
+	return fragments, nil
+}
+
+//partial Fragments of a payload received so far
+type partial struct {
+	fport     uint32
+	fragments [][]byte
+	received  int
+	expires   time.Time
+}
+
+//Reassembler Reassembles the fragmented uplinks of the nodes
+type Reassembler struct {
+	mutex    sync.Mutex
+	partials map[string]*partial
+}
+
+//NewReassembler Create a reassembler without fragments
+func NewReassembler() *Reassembler {
+	return &Reassembler{partials: make(map[string]*partial)}
+}
+
+//Add Fragment received from devEUI, returns the payload and its FPort once all fragments arrived
+func (r *Reassembler) Add(devEUI []byte, fragment []byte) (data []byte, fport uint32, complete bool, err error) {
+	if len(fragment) < fragmentHeaderSize || fragment[3] == 0 || fragment[2] >= fragment[3] {
+		return nil, 0, false, fmt.Errorf("%w: header %x", ErrInvalidFragment, fragment)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	for key, p := range r.partials {
+		if now.After(p.expires) {
+			delete(r.partials, key)
+		}
+	}
+	key := fmt.Sprintf("%x/%d", devEUI, fragment[1])
+	index, count := int(fragment[2]), int(fragment[3])
+	p := r.partials[key]
+	if p == nil || len(p.fragments) != count {
+		//Fragments of an earlier message with the same id are dropped
+		p = &partial{fport: uint32(fragment[0]), fragments: make([][]byte, count)}
+		r.partials[key] = p
+	}
+	p.expires = now.Add(ConfReassemblyTimeout)
+	if p.fragments[index] == nil {
+		p.received++
+	}
+	p.fragments[index] = append([]byte(nil), fragment[fragmentHeaderSize:]...)
+	if p.received < count {
+		return nil, 0, false, nil
+	}
+	delete(r.partials, key)
+	for _, f := range p.fragments {
+		data = append(data, f...)
+	}
+	return data, p.fport, true, nil
+}
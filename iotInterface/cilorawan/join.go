@@ -0,0 +1,136 @@
+package cilorawan
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+
+	as "github.com/joriwind/hecomm-fog/api/as"
+	ns "github.com/joriwind/hecomm-fog/api/ns"
+)
+
+//Errors refusing a join-request
+var (
+	//ErrUnknownDevice The node has no AppKey, it can not join over the air
+	ErrUnknownDevice = errors.New("cilorawan: unknown device")
+	//ErrDevNonceReused The DevNonce of the join-request was accepted before, it may be replayed
+	ErrDevNonceReused = errors.New("cilorawan: DevNonce reused")
+)
+
+//DeviceKeys OTAA root keys of a node and the session of its last join, EUIs and DevAddr in big endian
+type DeviceKeys struct {
+	DevEUI    []byte
+	AppEUI    []byte //Accepted application EUI, any if empty
+	AppKey    []byte
+	DevAddr   []byte
+	NwkSKey   []byte
+	AppSKey   []byte
+	DevNonces []uint16 //Nonces of the accepted join-requests
+	FCntUp    uint32   //Next expected uplink frame counter of the session
+}
+
+//KeyStore Keys of the nodes allowed to join
+type KeyStore interface {
+	//GetDeviceKeys Keys of the node, nil if it has none
+	GetDeviceKeys(devEUI []byte) (*DeviceKeys, error)
+	//SetSession Persist the session and DevNonces of a node that joined
+	SetSession(k *DeviceKeys) error
+}
+
+//SessionCreator Network server handed the session of a node that joined
+type SessionCreator interface {
+	CreateNodeSession(ctx context.Context, req *ns.CreateNodeSessionRequest) error
+}
+
+//JoinServer Handles the over-the-air activation of the nodes of a KeyStore
+type JoinServer struct {
+	keys     KeyStore
+	sessions SessionCreator
+}
+
+//NewJoinServer Create a join server accepting the nodes of keys and creating their sessions on sessions
+func NewJoinServer(keys KeyStore, sessions SessionCreator) *JoinServer {
+	return &JoinServer{keys: keys, sessions: sessions}
+}
+
+//Join Validate a join-request and answer with the encrypted join-accept, after the session is created on the
+//network server
+func (j *JoinServer) Join(ctx context.Context, req *as.JoinRequestRequest) (*as.JoinRequestResponse, error) {
+	jr, err := parseJoinRequest(req.PhyPayload)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := j.keys.GetDeviceKeys(jr.DevEUI)
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil || len(keys.AppKey) == 0 {
+		return nil, fmt.Errorf("%w: %x", ErrUnknownDevice, jr.DevEUI)
+	}
+	if len(keys.AppEUI) > 0 && string(keys.AppEUI) != string(jr.AppEUI) {
+		return nil, fmt.Errorf("%w: %x with AppEUI %x", ErrUnknownDevice, jr.DevEUI, jr.AppEUI)
+	}
+	if err := verifyJoinRequest(req.PhyPayload, keys.AppKey); err != nil {
+		return nil, fmt.Errorf("%w: join-request of %x", err, jr.DevEUI)
+	}
+	for _, n := range keys.DevNonces {
+		if n == jr.DevNonce {
+			return nil, fmt.Errorf("%w: %x, DevNonce %v", ErrDevNonceReused, jr.DevEUI, jr.DevNonce)
+		}
+	}
+
+	ja := joinAccept{
+		AppNonce:    make([]byte, 3),
+		NetID:       req.NetID,
+		DevAddr:     req.DevAddr,
+		Rx1DROffset: ConfJoinRx1DROffset,
+		Rx2DR:       ConfJoinRx2DR,
+		RxDelay:     ConfJoinRxDelay,
+	}
+	if _, err := rand.Read(ja.AppNonce); err != nil {
+		return nil, err
+	}
+	phy, err := ja.encrypt(keys.AppKey)
+	if err != nil {
+		return nil, err
+	}
+	nwkSKey, appSKey, err := ja.sessionKeys(keys.AppKey, jr.devNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	//The nonce is spent, also when the network server fails
+	keys.DevNonces = append(keys.DevNonces, jr.DevNonce)
+	if len(keys.DevNonces) > ConfDevNonceHistory {
+		keys.DevNonces = keys.DevNonces[len(keys.DevNonces)-ConfDevNonceHistory:]
+	}
+	keys.DevAddr, keys.NwkSKey, keys.AppSKey = req.DevAddr, nwkSKey, appSKey
+	if err := j.keys.SetSession(keys); err != nil {
+		return nil, err
+	}
+	err = j.sessions.CreateNodeSession(ctx, &ns.CreateNodeSessionRequest{
+		DevAddr:     req.DevAddr,
+		AppEUI:      jr.AppEUI,
+		DevEUI:      jr.DevEUI,
+		NwkSKey:     nwkSKey,
+		RxDelay:     uint32(ConfJoinRxDelay),
+		Rx1DROffset: uint32(ConfJoinRx1DROffset),
+		RxWindow:    ns.RXWindow_RX1,
+		Rx2DR:       uint32(ConfJoinRx2DR),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cilorawan: unable to create session of %x: %v", jr.DevEUI, err)
+	}
+	log.Printf("cilorawan: node %x joined with DevAddr %x\n", jr.DevEUI, req.DevAddr)
+
+	return &as.JoinRequestResponse{
+		PhyPayload:  phy,
+		NwkSKey:     nwkSKey,
+		RxDelay:     uint32(ConfJoinRxDelay),
+		Rx1DROffset: uint32(ConfJoinRx1DROffset),
+		RxWindow:    as.RXWindow_RX1,
+		Rx2DR:       uint32(ConfJoinRx2DR),
+	}, nil
+}
@@ -0,0 +1,176 @@
+package cilorawan
+
+import (
+	"context"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+
+	as "github.com/joriwind/hecomm-fog/api/as"
+	ns "github.com/joriwind/hecomm-fog/api/ns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCMAC(t *testing.T) {
+	//Test vectors of RFC 4493
+	key, _ := hex.DecodeString("2b7e151628aed2a6abf7158809cf4f3c")
+	msg, _ := hex.DecodeString("6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e5130c81c46a35ce411")
+	tests := []struct {
+		length int
+		want   string
+	}{
+		{0, "bb1d6929e95937287fa37d129b756746"},
+		{16, "070a16b46b4d4144f79bdd9dd04a287c"},
+		{40, "dfa66747de9ae63030ca32611497c827"},
+	}
+	for _, tt := range tests {
+		got, err := cmac(key, msg[:tt.length])
+		if err != nil || hex.EncodeToString(got) != tt.want {
+			t.Errorf("cmac() of %v bytes = %x, %v, want %v", tt.length, got, err, tt.want)
+		}
+	}
+}
+
+//memoryKeys KeyStore of a single node
+type memoryKeys struct {
+	keys *DeviceKeys
+}
+
+func (m *memoryKeys) GetDeviceKeys(devEUI []byte) (*DeviceKeys, error) {
+	if m.keys == nil || string(m.keys.DevEUI) != string(devEUI) {
+		return nil, nil
+	}
+	k := *m.keys
+	return &k, nil
+}
+
+func (m *memoryKeys) SetSession(k *DeviceKeys) error {
+	m.keys = k
+	return nil
+}
+
+//stubSessions Network server recording the sessions created
+type stubSessions struct {
+	created []*ns.CreateNodeSessionRequest
+	err     error
+}
+
+func (s *stubSessions) CreateNodeSession(ctx context.Context, req *ns.CreateNodeSessionRequest) error {
+	s.created = append(s.created, req)
+	return s.err
+}
+
+//joinRequestPayload PHYPayload of a join-request as sent by a node
+func joinRequestPayload(t *testing.T, appKey []byte, appEUI []byte, devEUI []byte, devNonce uint16) []byte {
+	phy := []byte{mTypeJoinRequest}
+	phy = append(phy, reversed(appEUI)...)
+	phy = append(phy, reversed(devEUI)...)
+	phy = append(phy, byte(devNonce), byte(devNonce>>8))
+	m, err := mic(appKey, phy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(phy, m...)
+}
+
+func TestJoin(t *testing.T) {
+	appKey, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	appEUI := []byte{1, 1, 1, 1, 1, 1, 1, 1}
+	devEUI := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	keys := &memoryKeys{keys: &DeviceKeys{DevEUI: devEUI, AppEUI: appEUI, AppKey: appKey}}
+	sessions := &stubSessions{}
+	a := &ApplicationServerAPI{join: NewJoinServer(keys, sessions)}
+
+	req := &as.JoinRequestRequest{
+		PhyPayload: joinRequestPayload(t, appKey, appEUI, devEUI, 0x1234),
+		DevAddr:    []byte{0x26, 0x01, 0x02, 0x03},
+		NetID:      []byte{0, 0, 0x13},
+	}
+	resp, err := a.JoinRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Decrypted as the node does, with AES encrypt
+	if len(resp.PhyPayload) != 17 || resp.PhyPayload[0] != mTypeJoinAccept {
+		t.Fatalf("join-accept = %x, want MHDR and one block", resp.PhyPayload)
+	}
+	block, _ := aes.NewCipher(appKey)
+	plain := make([]byte, 16)
+	block.Encrypt(plain, resp.PhyPayload[1:])
+	m, _ := mic(appKey, append([]byte{mTypeJoinAccept}, plain[:12]...))
+	if string(m) != string(plain[12:]) {
+		t.Errorf("join-accept MIC = %x, want %x", plain[12:], m)
+	}
+	if string(plain[3:6]) != "\x13\x00\x00" || string(plain[6:10]) != "\x03\x02\x01\x26" || plain[11] != ConfJoinRxDelay {
+		t.Errorf("join-accept = %x, want NetID, DevAddr and RxDelay of the request", plain)
+	}
+	nwkSKey := make([]byte, 16)
+	block.Encrypt(nwkSKey, append(append([]byte{1}, plain[:6]...), 0x34, 0x12, 0, 0, 0, 0, 0, 0, 0))
+	if string(resp.NwkSKey) != string(nwkSKey) || string(keys.keys.NwkSKey) != string(nwkSKey) || len(keys.keys.AppSKey) != 16 {
+		t.Errorf("NwkSKey = %x, stored %x, want %x", resp.NwkSKey, keys.keys.NwkSKey, nwkSKey)
+	}
+	if len(sessions.created) != 1 || string(sessions.created[0].DevEUI) != string(devEUI) || string(sessions.created[0].NwkSKey) != string(nwkSKey) {
+		t.Errorf("created sessions = %v, want session of %x", sessions.created, devEUI)
+	}
+
+	tests := []struct {
+		name string
+		phy  []byte
+		want codes.Code
+	}{
+		{name: "replayed", phy: req.PhyPayload, want: codes.PermissionDenied},
+		{name: "wrong key", phy: joinRequestPayload(t, make([]byte, 16), appEUI, devEUI, 1), want: codes.PermissionDenied},
+		{name: "unknown device", phy: joinRequestPayload(t, appKey, appEUI, appEUI, 1), want: codes.NotFound},
+		{name: "other application", phy: joinRequestPayload(t, appKey, devEUI, devEUI, 1), want: codes.NotFound},
+	}
+	for _, tt := range tests {
+		_, err := a.JoinRequest(context.Background(), &as.JoinRequestRequest{PhyPayload: tt.phy, DevAddr: req.DevAddr, NetID: req.NetID})
+		if status.Code(err) != tt.want {
+			t.Errorf("%q. JoinRequest() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	if len(sessions.created) != 1 {
+		t.Errorf("created sessions = %v after refused joins", len(sessions.created))
+	}
+}
+
+//stubNetworkServer Network server client answering the session calls
+type stubNetworkServer struct {
+	ns.NetworkServerClient
+	deleteErr error
+	calls     []string
+}
+
+func (s *stubNetworkServer) DeleteNodeSession(ctx context.Context, in *ns.DeleteNodeSessionRequest, opts ...grpc.CallOption) (*ns.DeleteNodeSessionResponse, error) {
+	s.calls = append(s.calls, "delete")
+	return &ns.DeleteNodeSessionResponse{}, s.deleteErr
+}
+
+func (s *stubNetworkServer) CreateNodeSession(ctx context.Context, in *ns.CreateNodeSessionRequest, opts ...grpc.CallOption) (*ns.CreateNodeSessionResponse, error) {
+	s.calls = append(s.calls, "create")
+	return &ns.CreateNodeSessionResponse{}, nil
+}
+
+func TestCreateNodeSession(t *testing.T) {
+	tests := []struct {
+		name      string
+		deleteErr error
+		calls     int
+		wantErr   bool
+	}{
+		{name: "rejoin", calls: 2},
+		{name: "first join", deleteErr: status.Error(codes.NotFound, "not found"), calls: 2},
+		{name: "unavailable", deleteErr: status.Error(codes.Unavailable, "down"), calls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		server := &stubNetworkServer{deleteErr: tt.deleteErr}
+		n := &NetworkClient{ctx: context.Background(), networkServerClient: server}
+		err := n.CreateNodeSession(context.Background(), &ns.CreateNodeSessionRequest{DevEUI: []byte{1}})
+		if (err != nil) != tt.wantErr || len(server.calls) != tt.calls {
+			t.Errorf("%q. CreateNodeSession() error = %v, calls %v, want error %v and %v calls", tt.name, err, server.calls, tt.wantErr, tt.calls)
+		}
+	}
+}
@@ -7,15 +7,16 @@ package cilorawan
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"io/ioutil"
+	"errors"
 	"log"
 	"net"
 
 	"golang.org/x/net/context"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 
 	//"github.com/brocaar/lora-app-server/internal/common"
 
@@ -24,38 +25,113 @@ import (
 	"github.com/joriwind/hecomm-api/hecomm"
 	as "github.com/joriwind/hecomm-fog/api/as"
 	"github.com/joriwind/hecomm-fog/iotInterface"
+	"github.com/joriwind/hecomm-fog/pki"
 )
 
 // ApplicationServerAPI implements the as.ApplicationServerServer interface.
 type ApplicationServerAPI struct {
 	ctx     context.Context
 	comlink chan iotInterface.ComLinkMessage
-	port    string
+	address string
 	options []grpc.ServerOption
+	//listener Bound by Listen, or by StartServer
+	listener net.Listener
+	//downlinks Served in the receive windows of the nodes
+	downlinks *DownlinkQueue
+	//fragments Uplinks not yet reassembled
+	fragments *Reassembler
+	//sessions Session keys and frame counters of the nodes
+	sessions *Sessions
+	//join Over-the-air activation, refused when nil
+	join *JoinServer
+	//errors Notified of the errors the network server reports, may be nil
+	errors ErrorHandler
 }
 
-// NewApplicationServerAPI returns a new ApplicationServerAPI.
-func NewApplicationServerAPI(ctx context.Context, comlink chan iotInterface.ComLinkMessage) *ApplicationServerAPI {
-	//Set static config
+//NodeError Error the network server reported for a node
+type NodeError struct {
+	DevEUI []byte
+	AppEUI []byte
+	//Type Generic, OTAA, DATA_UP_FCNT or DATA_UP_MIC
+	Type  string
+	Error string
+	Time  time.Time
+}
+
+//ErrorHandler Called with every error reported by the network server
+type ErrorHandler func(e NodeError)
+
+// NewApplicationServerAPI returns a new ApplicationServerAPI listening on address, ConfASAddress if empty, with the
+// credentials of its platform; empty fields fall back to DefaultCredentials.
+func NewApplicationServerAPI(ctx context.Context, comlink chan iotInterface.ComLinkMessage, address string, platformCreds pki.Credentials) (*ApplicationServerAPI, error) {
+	if address == "" {
+		address = ConfASAddress
+	}
+	c := platformCreds.Or(DefaultCredentials())
 	var nsOpts []grpc.ServerOption
-	nsOpts = append(nsOpts, grpc.Creds(mustGetTransportCredentials(ConfCILorawanCert, ConfCILorawanKey, ConfCILorawanCaCert, true)))
+	creds, err := getTransportCredentials(c.Cert, c.Key, c.CaCert, true)
+	if err != nil {
+		return nil, err
+	}
+	nsOpts = append(nsOpts, grpc.Creds(creds))
 
 	return &ApplicationServerAPI{
-		ctx:     ctx,
-		comlink: comlink,
-		port:    ":8001",
-		options: nsOpts,
-	}
+		ctx:       ctx,
+		comlink:   comlink,
+		address:   address,
+		options:   nsOpts,
+		downlinks: NewDownlinkQueue(),
+		fragments: NewReassembler(),
+		sessions:  NewSessions(nil),
+	}, nil
 
 }
 
-//StartServer creates a new server
-func (a *ApplicationServerAPI) StartServer() error {
-	lis, err := net.Listen("tcp", a.port)
+//SetKeyStore Keep the sessions of the nodes in keys and accept their over-the-air activations, creating the sessions
+//on network
+func (a *ApplicationServerAPI) SetKeyStore(keys KeyStore, network SessionCreator) {
+	a.sessions = NewSessions(keys)
+	a.join = NewJoinServer(a.sessions, network)
+}
+
+//Downlinks Queue of the downlinks served to the network server of this application server
+func (a *ApplicationServerAPI) Downlinks() *DownlinkQueue {
+	return a.downlinks
+}
+
+//SetErrorHandler Notify h of the errors reported by the network server
+func (a *ApplicationServerAPI) SetErrorHandler(h ErrorHandler) {
+	a.errors = h
+}
+
+//Listen Bind the address of the application server, before StartServer, so a failure is known before it serves
+func (a *ApplicationServerAPI) Listen() error {
+	lis, err := net.Listen("tcp", a.address)
 	if err != nil {
 		return err
 	}
+	a.listener = lis
+	return nil
+}
+
+//Stop Close the listener, StartServer returns and the address is free when Stop returns
+func (a *ApplicationServerAPI) Stop() {
+	if a.listener != nil {
+		a.listener.Close()
+	}
+}
+
+//StartServer creates a new server, on the listener of Listen if called before
+func (a *ApplicationServerAPI) StartServer() error {
+	if a.listener == nil {
+		if err := a.Listen(); err != nil {
+			return err
+		}
+	}
+	lis := a.listener
 	defer lis.Close()
+	//Nodes that stop sending uplinks never ask for their downlinks
+	go a.downlinks.Run(a.ctx)
 	//Check if ctx is done
 	go func() {
 		select {
@@ -69,18 +145,28 @@ func (a *ApplicationServerAPI) StartServer() error {
 	as.RegisterApplicationServerServer(grpcServer, a)
 	/* // Register reflection service on gRPC server.
 	reflection.Register(grpcServer) */
-	log.Println("cilorawan: Start listening!")
-	if err := grpcServer.Serve(lis); err != nil {
-		return err
-	}
-
-	return err
+	log.Printf("cilorawan: Start listening on %v!\n", a.address)
+	return grpcServer.Serve(lis)
 }
 
 // JoinRequest handles a join-request.
 func (a *ApplicationServerAPI) JoinRequest(ctx context.Context, req *as.JoinRequestRequest) (*as.JoinRequestResponse, error) {
-	log.Println("cilorawan: received JoinRequest???")
-	return &as.JoinRequestResponse{}, nil
+	if a.join == nil {
+		return nil, status.Error(codes.Unimplemented, "cilorawan: over-the-air activation not enabled")
+	}
+	resp, err := a.join.Join(ctx, req)
+	if err != nil {
+		log.Printf("cilorawan: join refused: %v\n", err)
+		switch {
+		case errors.Is(err, ErrUnknownDevice):
+			return nil, status.Error(codes.NotFound, err.Error())
+		case errors.Is(err, ErrInvalidMIC), errors.Is(err, ErrDevNonceReused):
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	return resp, nil
 }
 
 // HandleDataUp handles incoming (uplink) data.
@@ -88,14 +174,34 @@ func (a *ApplicationServerAPI) HandleDataUp(ctx context.Context, req *as.HandleD
 	/*if len(req.RxInfo) == 0 {
 		return nil, grpc.Errorf(codes.InvalidArgument, "RxInfo must have length > 0")
 	}*/
-	log.Printf("cilorawan: Received data from %v: %v", req.DevEUI, req.Data)
+	log.Printf("cilorawan: Received data from %v, fCnt: %v, fPort: %v: %v", req.DevEUI, req.FCnt, req.FPort, req.Data)
+
+	data, err := a.sessions.Uplink(req.DevEUI, req.FCnt, req.FPort, req.Data)
+	if err != nil {
+		log.Printf("cilorawan: dropped uplink of %x: %v\n", req.DevEUI, err)
+		return &as.HandleDataUpResponse{}, nil
+	}
+	fPort := req.FPort
+	if fPort == ConfFragmentFPort {
+		payload, port, complete, err := a.fragments.Add(req.DevEUI, data)
+		if err != nil {
+			log.Printf("cilorawan: dropped uplink of %x: %v\n", req.DevEUI, err)
+			return &as.HandleDataUpResponse{}, nil
+		}
+		if !complete {
+			return &as.HandleDataUpResponse{}, nil
+		}
+		data, fPort = payload, port
+	}
 
 	message := iotInterface.ComLinkMessage{
-		Data:          req.Data,
+		Data:          data,
 		Destination:   nil,
 		InterfaceType: hecomm.CILorawan,
 		Origin:        req.DevEUI,
 		TimeReceived:  time.Now(),
+		FPort:         fPort,
+		Metadata:      iotInterface.Metadata{LoRaWAN: uplinkMetadata(req)},
 	}
 	a.comlink <- message
 
@@ -103,21 +209,60 @@ func (a *ApplicationServerAPI) HandleDataUp(ctx context.Context, req *as.HandleD
 
 }
 
+//uplinkMetadata Radio details of an uplink as reported by the network server
+func uplinkMetadata(req *as.HandleDataUpRequest) *iotInterface.LoRaWANMetadata {
+	m := &iotInterface.LoRaWANMetadata{FCnt: req.FCnt}
+	if tx := req.TxInfo; tx != nil {
+		m.Frequency, m.CodeRate, m.ADR = tx.Frequency, tx.CodeRate, tx.Adr
+		if dr := tx.DataRate; dr != nil {
+			m.Modulation, m.Bandwidth, m.SpreadFactor, m.Bitrate = dr.Modulation, dr.BandWidth, dr.SpreadFactor, dr.Bitrate
+		}
+	}
+	for _, rx := range req.RxInfo {
+		if rx == nil {
+			continue
+		}
+		m.Gateways = append(m.Gateways, iotInterface.GatewayRxInfo{
+			MAC:       rx.Mac,
+			Name:      rx.Name,
+			Time:      rx.Time,
+			RSSI:      rx.Rssi,
+			SNR:       rx.LoRaSNR,
+			Latitude:  rx.Latitude,
+			Longitude: rx.Longitude,
+			Altitude:  rx.Altitude,
+		})
+	}
+	return m
+}
+
 // GetDataDown returns the first payload from the datadown queue.
 func (a *ApplicationServerAPI) GetDataDown(ctx context.Context, req *as.GetDataDownRequest) (*as.GetDataDownResponse, error) {
-	/*var devEUI lorawan.EUI64
-	copy(devEUI[:], req.DevEUI)*/
-	log.Printf("Datadown requested\n")
+	d, moreData := a.downlinks.Next(req.DevEUI, req.MaxPayloadSize, req.FCnt)
+	if d == nil {
+		return &as.GetDataDownResponse{MoreData: moreData}, nil
+	}
+	log.Printf("cilorawan: downlink to %x, fCnt: %v, confirmed: %v, more: %v\n", req.DevEUI, req.FCnt, d.Confirmed, moreData)
+	//Encrypted with the fCnt of every transmission
+	data, err := a.sessions.Downlink(req.DevEUI, req.FCnt, d.Data)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 
-	return &as.GetDataDownResponse{}, nil
+	return &as.GetDataDownResponse{
+		Data:      data,
+		Confirmed: d.Confirmed,
+		FPort:     d.FPort,
+		MoreData:  moreData,
+	}, nil
 
 }
 
 // HandleDataDownACK handles an ack on a downlink transmission.
 func (a *ApplicationServerAPI) HandleDataDownACK(ctx context.Context, req *as.HandleDataDownACKRequest) (*as.HandleDataDownACKResponse, error) {
-	/*var devEUI lorawan.EUI64
-	copy(devEUI[:], req.DevEUI)*/
-	log.Printf("HandleDatadownAck requested\n")
+	if !a.downlinks.Ack(req.DevEUI, req.FCnt) {
+		log.Printf("cilorawan: ack of %x for fCnt %v without pending downlink\n", req.DevEUI, req.FCnt)
+	}
 
 	return &as.HandleDataDownACKResponse{}, nil
 
@@ -125,43 +270,58 @@ func (a *ApplicationServerAPI) HandleDataDownACK(ctx context.Context, req *as.Ha
 
 // HandleError handles an incoming error.
 func (a *ApplicationServerAPI) HandleError(ctx context.Context, req *as.HandleErrorRequest) (*as.HandleErrorResponse, error) {
-	/*var devEUI lorawan.EUI64
-	copy(devEUI[:], req.DevEUI)*/
-	log.Println("cilorawan: HandleError request???")
+	log.Printf("cilorawan: network server error for %x, type: %v: %v\n", req.DevEUI, req.Type, req.Error)
+	if a.errors != nil {
+		a.errors(NodeError{
+			DevEUI: req.DevEUI,
+			AppEUI: req.AppEUI,
+			Type:   req.Type.String(),
+			Error:  req.Error,
+			Time:   time.Now(),
+		})
+	}
 
 	return &as.HandleErrorResponse{}, nil
 }
 
 func mustGetTransportCredentials(tlsCert, tlsKey, caCert string, verifyClientCert bool) credentials.TransportCredentials {
-	var caCertPool *x509.CertPool
-	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	creds, err := getTransportCredentials(tlsCert, tlsKey, caCert, verifyClientCert)
 	if err != nil {
-		log.Fatalf("load key-pair error: %s\n", err)
+		log.Fatalf("%v\n", err)
 	}
+	return creds
+}
 
-	if caCert != "" {
-		rawCaCert, err := ioutil.ReadFile(caCert)
+//getTransportCredentials Credentials reloaded by the pki watcher when the files change, the CA is optional without verifyClientCert
+func getTransportCredentials(tlsCert, tlsKey, caCert string, verifyClientCert bool) (credentials.TransportCredentials, error) {
+	keyPair, err := pki.LoadKeyPair(tlsCert, tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	pki.DefaultWatcher.AddKeyPair(keyPair)
+
+	if verifyClientCert {
+		caPool, err := pki.LoadCAPool(caCert)
 		if err != nil {
-			log.Fatalf("load ca cert error: %s\n", err)
+			return nil, err
 		}
-
-		caCertPool = x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(rawCaCert)
+		pki.DefaultWatcher.AddCAPool(caPool)
+		return credentials.NewTLS(pki.ServerConfig(keyPair, caPool)), nil
 	}
 
-	if verifyClientCert {
-		return credentials.NewTLS(&tls.Config{
-			Certificates: []tls.Certificate{cert},
-			RootCAs:      caCertPool,
-			ClientCAs:    caCertPool,
-			ClientAuth:   tls.RequireAndVerifyClientCert,
-		})
-	} else {
-		return credentials.NewTLS(&tls.Config{
-			Certificates:       []tls.Certificate{cert},
-			RootCAs:            caCertPool,
-			ClientCAs:          caCertPool,
-			InsecureSkipVerify: true,
-		})
+	config := &tls.Config{
+		GetCertificate:       keyPair.GetCertificate,
+		GetClientCertificate: keyPair.GetClientCertificate,
+		InsecureSkipVerify:   true,
+	}
+	if caCert != "" {
+		caPool, err := pki.LoadCAPool(caCert)
+		if err != nil {
+			return nil, err
+		}
+		pki.DefaultWatcher.AddCAPool(caPool)
+		config.RootCAs = caPool.Pool()
+		config.ClientCAs = caPool.Pool()
 	}
+	return credentials.NewTLS(config), nil
 }
@@ -3,26 +3,34 @@ package cilorawan
 import (
 	"context"
 	"fmt"
-	"log"
+	"os"
 	"testing"
 	"time"
 
-	"github.com/joriwind/hecomm-fog/fogcore"
-
 	"google.golang.org/grpc"
 
 	as "github.com/joriwind/hecomm-fog/api/as"
 	"github.com/joriwind/hecomm-fog/iotInterface"
+	"github.com/joriwind/hecomm-fog/pki"
 )
 
 func TestStartServer(t *testing.T) {
 	type args struct {
 		message iotInterface.ComLinkMessage
 	}
+	//The server, and the client below, need the certificates of the fog
+	for _, file := range []string{ConfCILorawanCert, ConfCILorawanKey, ConfCILorawanCaCert} {
+		if _, err := os.Stat(file); err != nil {
+			t.Skipf("no certificates: %v", err)
+		}
+	}
 	comLink := make(chan iotInterface.ComLinkMessage, 5)
 	ctx := context.Background()
 
-	asAPI := NewApplicationServerAPI(ctx, comLink)
+	asAPI, err := NewApplicationServerAPI(ctx, comLink, ConfASAddress, pki.Credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
 	go asAPI.StartServer()
 
 	tests := []struct {
@@ -61,6 +69,24 @@ func TestStartServer(t *testing.T) {
 	}
 }
 
+func TestListen(t *testing.T) {
+	a := &ApplicationServerAPI{ctx: context.Background(), address: "127.0.0.1:0"}
+	if err := a.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	//The address is taken until Stop
+	b := &ApplicationServerAPI{ctx: context.Background(), address: a.listener.Addr().String()}
+	if err := b.Listen(); err == nil {
+		b.Stop()
+		t.Fatal("Listen() on used address succeeded")
+	}
+	a.Stop()
+	if err := b.Listen(); err != nil {
+		t.Errorf("Listen() after Stop() = %v", err)
+	}
+	b.Stop()
+}
+
 func testEq(a, b []byte) bool {
 
 	if a == nil && b == nil {
@@ -88,17 +114,15 @@ func sendToAsServer(message iotInterface.ComLinkMessage, asDialOptions []grpc.Di
 	//Create connection to server:
 	//asDialOptions = append(asDialOptions, grpc.WithInsecure())
 	asDialOptions = append(asDialOptions, grpc.WithTransportCredentials(
-		mustGetTransportCredentials(fogcore.ConfFogcoreCert, fogcore.ConfFogcoreKey, ConfCILorawanCaCert, true),
+		mustGetTransportCredentials(ConfCILorawanCert, ConfCILorawanKey, ConfCILorawanCaCert, true),
 	))
 	//}
 	//host := "192.168.1.1:8000"
-	asConn, err := grpc.Dial("localhost:8000", asDialOptions...) //TODO: when close connection?
-	defer asConn.Close()
+	asConn, err := grpc.Dial("localhost"+ConfASAddress, asDialOptions...)
 	if err != nil {
-		log.Fatalf("application-server (FOG) dial error: %s", err)
-		return err
+		return fmt.Errorf("application-server (FOG) dial error: %s", err)
 	}
-	//defer asConn.Close() //TODO: Do not forget to close connection!
+	defer asConn.Close()
 	asClient := as.NewApplicationServerClient(asConn)
 
 	//Send packet!
@@ -0,0 +1,127 @@
+package cilorawan
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+//ErrFCntReplay An uplink with a frame counter that was seen before, a duplicate from another gateway or a replay
+var ErrFCntReplay = errors.New("cilorawan: frame counter replayed")
+
+//session Keys and uplink frame counter of a node
+type session struct {
+	//keys Stored keys of the node, nil if it has none
+	keys *DeviceKeys
+	//fCntUp Next expected uplink frame counter, of nodes with keys only
+	fCntUp uint32
+}
+
+/*
+ * Sessions Session keys and uplink frame counters of the nodes, in front of a KeyStore.
+ * The payloads of nodes with an AppSKey are decrypted and encrypted, those of other nodes pass unchanged. The frame
+ * counters of nodes with stored keys are checked and persisted with their session. Those of other nodes are left to
+ * the network server holding their keys, which also sees their counters reset.
+ */
+type Sessions struct {
+	mutex    sync.Mutex
+	store    KeyStore
+	sessions map[string]*session
+}
+
+//NewSessions Create the sessions of the nodes in store, nil to count frames in memory only
+func NewSessions(store KeyStore) *Sessions {
+	return &Sessions{store: store, sessions: make(map[string]*session)}
+}
+
+//GetDeviceKeys Keys of the node as stored, so a join uses the current AppKey
+func (s *Sessions) GetDeviceKeys(devEUI []byte) (*DeviceKeys, error) {
+	if s.store == nil {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if ss := s.sessions[string(devEUI)]; ss != nil && ss.keys != nil {
+			k := *ss.keys
+			return &k, nil
+		}
+		return nil, nil
+	}
+	return s.store.GetDeviceKeys(devEUI)
+}
+
+//SetSession Start the session of a node that joined, its frame counter starts at 0
+func (s *Sessions) SetSession(k *DeviceKeys) error {
+	k.FCntUp = 0
+	if s.store != nil {
+		if err := s.store.SetSession(k); err != nil {
+			return err
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := *k
+	s.sessions[string(k.DevEUI)] = &session{keys: &keys}
+	return nil
+}
+
+//session Session of the node, loaded from the store once, caller holds the lock
+func (s *Sessions) session(devEUI []byte) (*session, error) {
+	if ss := s.sessions[string(devEUI)]; ss != nil {
+		return ss, nil
+	}
+	ss := &session{}
+	if s.store != nil {
+		keys, err := s.store.GetDeviceKeys(devEUI)
+		if err != nil {
+			return nil, err
+		}
+		if keys != nil && len(keys.DevAddr) > 0 {
+			ss.keys = keys
+			ss.fCntUp = keys.FCntUp
+		}
+	}
+	s.sessions[string(devEUI)] = ss
+	return ss, nil
+}
+
+//Uplink Check the frame counter of an uplink and decrypt its FRMPayload
+func (s *Sessions) Uplink(devEUI []byte, fCnt uint32, fPort uint32, data []byte) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ss, err := s.session(devEUI)
+	if err != nil {
+		return nil, err
+	}
+	if ss.keys == nil {
+		return data, nil
+	}
+	if fCnt < ss.fCntUp {
+		return nil, fmt.Errorf("%w: %x sent %v, expected at least %v", ErrFCntReplay, devEUI, fCnt, ss.fCntUp)
+	}
+
+	ss.fCntUp = fCnt + 1
+	ss.keys.FCntUp = ss.fCntUp
+	if s.store != nil {
+		if err := s.store.SetSession(ss.keys); err != nil {
+			return nil, err
+		}
+	}
+	//FPort 0 carries MAC commands for the network server
+	if fPort == 0 || len(data) == 0 || len(ss.keys.AppSKey) == 0 {
+		return data, nil
+	}
+	return encryptFRMPayload(ss.keys.AppSKey, true, ss.keys.DevAddr, fCnt, data)
+}
+
+//Downlink Encrypt the FRMPayload of a downlink sent with fCnt
+func (s *Sessions) Downlink(devEUI []byte, fCnt uint32, data []byte) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ss, err := s.session(devEUI)
+	if err != nil {
+		return nil, err
+	}
+	if ss.keys == nil || len(ss.keys.AppSKey) == 0 || len(data) == 0 {
+		return data, nil
+	}
+	return encryptFRMPayload(ss.keys.AppSKey, false, ss.keys.DevAddr, fCnt, data)
+}
@@ -0,0 +1,138 @@
+package cilorawan
+
+import (
+	"context"
+	"crypto/aes"
+	"errors"
+	"testing"
+
+	as "github.com/joriwind/hecomm-fog/api/as"
+	"github.com/joriwind/hecomm-fog/iotInterface"
+)
+
+func TestEncryptFRMPayload(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	devAddr := []byte{0x26, 0x01, 0x02, 0x03}
+	data := []byte("a payload of more than one block")
+
+	//First block of the key stream, as the node computes it
+	block, _ := aes.NewCipher(key)
+	a := []byte{1, 0, 0, 0, 0, 0, 0x03, 0x02, 0x01, 0x26, 0x2a, 0x01, 0, 0, 0, 1}
+	s := make([]byte, 16)
+	block.Encrypt(s, a)
+
+	encrypted, err := encryptFRMPayload(key, true, devAddr, 0x012a, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted[0] != data[0]^s[0] || encrypted[15] != data[15]^s[15] {
+		t.Errorf("encryptFRMPayload() = %x, want key stream %x", encrypted[:16], s)
+	}
+	decrypted, _ := encryptFRMPayload(key, true, devAddr, 0x012a, encrypted)
+	if string(decrypted) != string(data) {
+		t.Errorf("decrypted = %q, want %q", decrypted, data)
+	}
+	down, _ := encryptFRMPayload(key, false, devAddr, 0x012a, data)
+	if string(down) == string(encrypted) {
+		t.Errorf("downlink encrypted as uplink")
+	}
+}
+
+func TestSessionsUplink(t *testing.T) {
+	devEUI := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	appSKey := []byte("0123456789abcdef")
+	devAddr := []byte{0x26, 0x01, 0x02, 0x03}
+	keys := &memoryKeys{keys: &DeviceKeys{DevEUI: devEUI, DevAddr: devAddr, AppSKey: appSKey, FCntUp: 5}}
+	s := NewSessions(keys)
+
+	plain := []byte("hello")
+	frame := func(fCnt uint32) []byte {
+		b, _ := encryptFRMPayload(appSKey, true, devAddr, fCnt, plain)
+		return b
+	}
+	tests := []struct {
+		name    string
+		fCnt    uint32
+		wantErr error
+	}{
+		{name: "before the session", fCnt: 4, wantErr: ErrFCntReplay},
+		{name: "expected", fCnt: 5},
+		{name: "duplicate", fCnt: 5, wantErr: ErrFCntReplay},
+		{name: "frames lost", fCnt: 9},
+	}
+	for _, tt := range tests {
+		data, err := s.Uplink(devEUI, tt.fCnt, 1, frame(tt.fCnt))
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%q. Uplink() error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && string(data) != string(plain) {
+			t.Errorf("%q. Uplink() = %q, want %q", tt.name, data, plain)
+		}
+	}
+	if keys.keys.FCntUp != 10 {
+		t.Errorf("stored FCntUp = %v, want 10", keys.keys.FCntUp)
+	}
+
+	//A join starts counting again
+	if err := s.SetSession(&DeviceKeys{DevEUI: devEUI, DevAddr: devAddr, AppSKey: appSKey, FCntUp: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Uplink(devEUI, 0, 1, frame(0)); err != nil {
+		t.Errorf("Uplink() after join error = %v", err)
+	}
+
+	//The counters of nodes without keys are not checked, they reset without a join the fog sees
+	other := []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	for _, fCnt := range []uint32{100, 0} {
+		if data, err := s.Uplink(other, fCnt, 1, plain); err != nil || string(data) != string(plain) {
+			t.Errorf("Uplink(%v) of node without keys = %q, %v", fCnt, data, err)
+		}
+	}
+}
+
+func TestHandleDataUp(t *testing.T) {
+	comlink := make(chan iotInterface.ComLinkMessage, 2)
+	devEUI := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	//A session without AppSKey, its payload passes unchanged
+	keys := &memoryKeys{keys: &DeviceKeys{DevEUI: devEUI, DevAddr: []byte{0x26, 0x01, 0x02, 0x03}}}
+	a := &ApplicationServerAPI{ctx: context.Background(), comlink: comlink, fragments: NewReassembler(), sessions: NewSessions(keys)}
+	req := &as.HandleDataUpRequest{
+		DevEUI: devEUI, FCnt: 1, FPort: 10, Data: []byte("data"),
+		TxInfo: &as.TXInfo{Frequency: 868100000, DataRate: &as.DataRate{Modulation: "LORA", BandWidth: 125, SpreadFactor: 7}},
+		RxInfo: []*as.RXInfo{{Mac: []byte{1}, Rssi: -110, LoRaSNR: -2}, {Mac: []byte{2}, Rssi: -80, LoRaSNR: 9}},
+	}
+
+	//Received by two gateways
+	for i := 0; i < 2; i++ {
+		if _, err := a.HandleDataUp(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(comlink) != 1 {
+		t.Fatalf("forwarded %v messages, want 1", len(comlink))
+	}
+	m := <-comlink
+	if m.FPort != 10 || string(m.Data) != "data" {
+		t.Errorf("message = %+v, want data on FPort 10", m)
+	}
+	if rssi, _ := m.Metadata.Get("lorawan.rssi"); rssi != "-80" || m.Metadata.LoRaWAN.DataRate() != "SF7BW125" || m.Metadata.LoRaWAN.FCnt != 1 {
+		t.Errorf("metadata = %v, want best gateway and data rate of the uplink", m.Metadata)
+	}
+}
+
+func TestHandleError(t *testing.T) {
+	var reported []NodeError
+	a := &ApplicationServerAPI{ctx: context.Background()}
+	req := &as.HandleErrorRequest{DevEUI: []byte{1}, Type: as.ErrorType_DATA_UP_FCNT, Error: "invalid FCnt"}
+	if _, err := a.HandleError(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	a.SetErrorHandler(func(e NodeError) { reported = append(reported, e) })
+	if _, err := a.HandleError(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 1 || reported[0].Type != "DATA_UP_FCNT" || reported[0].Error != "invalid FCnt" || reported[0].Time.IsZero() {
+		t.Errorf("reported = %+v, want the FCnt error", reported)
+	}
+}
@@ -2,90 +2,93 @@ package cisixlowpan
 
 import (
 	"fmt"
-	"io"
 	"log"
 	"net"
+	"strconv"
 
 	"github.com/joriwind/hecomm-fog/iotInterface"
 	"github.com/joriwind/hecomm-interface-6lowpan"
 	"golang.org/x/net/ipv6"
 )
 
-//Client Link with sixlowpan destination
-type Client struct {
-	config sixlowpan.Config
-	conn   io.WriteCloser
+//Datagram UDP datagram from the fog to an application on a node
+type Datagram struct {
+	Destination net.IP
+	//Port UDP port of the application on the node, ConfPort if 0
+	Port uint16
+	//HopLimit ConfHopLimit if 0
+	HopLimit int
+	Data     []byte
 }
 
-//NewClient Create connection with destination
-func NewClient(config sixlowpan.Config) (*Client, error) {
-	var err error
-
-	client := Client{
-		config: config,
-		conn:   nil,
-	}
-	if config.PortName == "" {
-		client.config = sixlowpan.Config{
-			DebugLevel: sixlowpan.DebugAll,
-			PortName:   "/dev/ttyUSB0",
+//ParseAddress Address of a node from its DevID: "aaaa::2" for the node, "[aaaa::2]:5684" for the application on
+//port 5684 of the node. The port is 0 when not given.
+func ParseAddress(devID string) (net.IP, uint16, error) {
+	host, port := devID, uint16(0)
+	if h, p, err := net.SplitHostPort(devID); err == nil {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || n == 0 {
+			return nil, 0, fmt.Errorf("%w: invalid port: %q", ErrInvalidAddress, devID)
 		}
-	} else {
-		client.config = config
+		host, port = h, uint16(n)
 	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil {
+		return nil, 0, fmt.Errorf("%w: %q", ErrInvalidAddress, devID)
+	}
+	return ip, port, nil
+}
 
-	client.conn, err = sixlowpan.Open(config)
+//SendData Send message to the node, or the application on a node, of its destination
+func (l *Link) SendData(message iotInterface.ComLinkMessage) error {
+	dst, port, err := ParseAddress(string(message.Destination))
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	return &client, nil
+	return l.Send(Datagram{Destination: dst, Port: port, Data: message.Data})
 }
 
-//SendData Send message to destination
-func (c *Client) SendData(message iotInterface.ComLinkMessage) error {
-	if c.conn == nil {
-		return fmt.Errorf("cisixlowpan: connection not available: config: %v", c.config)
+//Send Send d to its destination in the network behind the border router, from the address of the fog
+func (l *Link) Send(d Datagram) error {
+	if l.config.Prefix != nil && !l.config.Prefix.Contains(d.Destination) {
+		return fmt.Errorf("%w: %v not in %v", ErrOutsidePrefix, d.Destination, l.config.Prefix)
+	}
+	if d.Port == 0 {
+		d.Port = ConfPort
+	}
+	if d.HopLimit == 0 {
+		d.HopLimit = ConfHopLimit
 	}
 
-	log.Println("Compiling packet for 6lowpan...")
-	buf, err := compilePacket(message)
+	buf, err := compilePacket(l.source, ConfPort, d)
 	if err != nil {
 		return err
 	}
-	log.Printf("Sending: %x\n", buf)
-
-	n, err := c.conn.Write(buf)
-	if err != nil {
+	if err := l.write(buf); err != nil {
 		return fmt.Errorf("cisixlowpan: did not send error: %v", err)
 	}
-	log.Printf("cisixlowpan: send %v bytes to %x", n, message.Destination)
+	log.Printf("cisixlowpan: send %v bytes to [%v]:%v over %v", len(buf), d.Destination, d.Port, l.config.Device)
 	return nil
 }
 
-//Close the connection
-func (c *Client) Close() {
-	c.conn.Close()
-}
-
-func compilePacket(message iotInterface.ComLinkMessage) ([]byte, error) {
-	//buf := make([]byte, ipv6.HeaderLen+sixlowpan.UdpHeaderLen+len(message.Data))
-
+//compilePacket IPv6 packet carrying d from port srcPort of src
+func compilePacket(src net.IP, srcPort uint16, d Datagram) ([]byte, error) {
 	iph := ipv6.Header{
 		Version:      6,
 		TrafficClass: 0,
 		FlowLabel:    0,
-		PayloadLen:   sixlowpan.UdpHeaderLen + len(message.Data),
+		PayloadLen:   sixlowpan.UdpHeaderLen + len(d.Data),
 		NextHeader:   17,
-		HopLimit:     255,
-		Src:          net.ParseIP("aaaa::c30c:0:0:5"), //TODO: variable source IP, depending on IP set for udp-slip
-		Dst:          net.ParseIP(string(message.Destination[:]))}
+		HopLimit:     d.HopLimit,
+		Src:          src,
+		Dst:          d.Destination,
+	}
 
 	udph := sixlowpan.UDPHeader{
-		DstPort: 5683,
-		Length:  uint16(sixlowpan.UdpHeaderLen + len(message.Data)),
-		Payload: message.Data,
-		SrcPort: 5683,
+		DstPort: d.Port,
+		Length:  uint16(sixlowpan.UdpHeaderLen + len(d.Data)),
+		Payload: d.Data,
+		SrcPort: srcPort,
 		Chksum:  0,
 	}
 
@@ -1,5 +1,42 @@
 package cisixlowpan
 
+import (
+	"net"
+)
+
 const (
-	confCISixlowpanAddress = "[::1]:5684"
+	//confLinkBuffer Received packets waiting for the server
+	confLinkBuffer = 16
+	//confMaxPacketSize Largest IPv6 packet read from a TUN interface or UDP socket
+	confMaxPacketSize = 1 << 16
 )
+
+//ConfUDPListen Local address of UDP links without one configured
+var ConfUDPListen = "[::1]:5684"
+
+//ConfBaudRate Baud rate of serial lines without one configured
+var ConfBaudRate = 115200
+
+//ConfPrefix IPv6 prefix of border routers without one configured
+var ConfPrefix = mustParsePrefix("aaaa::/64")
+
+//ConfInterfaceID Interface ID of the fog, its address in a network is the prefix of the network with this ID. The
+//default keeps the address the fog always had, aaaa::c30c:0:0:5 in the default prefix.
+var ConfInterfaceID = net.ParseIP("::c30c:0:0:5")
+
+//ConfPort UDP port of the fog, and of applications on nodes without a port configured
+var ConfPort uint16 = 5683
+
+//ConfHopLimit Hop limit of the packets sent by the fog
+var ConfHopLimit = 255
+
+//ConfFilterDestination Drop the uplinks not addressed to the fog on links without the setting configured
+var ConfFilterDestination = false
+
+func mustParsePrefix(prefix string) *net.IPNet {
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
@@ -0,0 +1,227 @@
+package cisixlowpan
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/joriwind/hecomm-interface-6lowpan"
+)
+
+var (
+	//ErrDeviceInUse The device already carries the link of another platform
+	ErrDeviceInUse = errors.New("cisixlowpan: device in use")
+	//ErrUnknownTransport The transport is not serial, tun or udp
+	ErrUnknownTransport = errors.New("cisixlowpan: unknown transport")
+	//ErrInvalidAddress The destination is not an IPv6 address
+	ErrInvalidAddress = errors.New("cisixlowpan: invalid destination address")
+	//ErrOutsidePrefix The destination is not in the network behind the border router
+	ErrOutsidePrefix = errors.New("cisixlowpan: destination outside prefix")
+)
+
+//Transports to a border router
+const (
+	//TransportSerial SLIP over a serial line, Device is the serial device, e.g. "/dev/ttyUSB0"
+	TransportSerial = "serial"
+	//TransportTUN Linux TUN device, Device is the interface name, e.g. "tun0"
+	TransportTUN = "tun"
+	//TransportUDP One IPv6 packet per UDP datagram, Device is the address of the border router, e.g. "[::1]:5683"
+	TransportUDP = "udp"
+)
+
+//LinkConfig Line to a 6LoWPAN border router
+type LinkConfig struct {
+	//Transport TransportSerial, TransportTUN or TransportUDP, serial if empty
+	Transport string
+	//Device Serial device, TUN interface or border router address, depending on Transport
+	Device string
+	//Baud Baud rate of the serial line
+	Baud int
+	//Listen Local UDP address the border router sends to
+	Listen string
+	//Prefix IPv6 prefix of the network behind the border router
+	Prefix *net.IPNet
+	//Source Address of the fog in the network, the prefix with interface ID ConfInterfaceID if nil
+	Source net.IP
+	//FilterDestination Drop the uplinks not addressed to Source or to a multicast group
+	FilterDestination bool
+	//DebugLevel sixlowpan.DebugNone, DebugPackets or DebugAll
+	DebugLevel uint8
+}
+
+func (c LinkConfig) transport() string {
+	if c.Transport == "" {
+		return TransportSerial
+	}
+	return c.Transport
+}
+
+//source Address of the fog in the network behind the border router
+func (c LinkConfig) source() net.IP {
+	if c.Source != nil {
+		return c.Source
+	}
+	prefix := c.Prefix
+	if prefix == nil {
+		prefix = ConfPrefix
+	}
+	src := make(net.IP, net.IPv6len)
+	id := ConfInterfaceID.To16()
+	for i := range src {
+		src[i] = prefix.IP[i]&prefix.Mask[i] | id[i]&^prefix.Mask[i]
+	}
+	return src
+}
+
+func (c LinkConfig) key() string {
+	return c.transport() + ":" + c.Device
+}
+
+//packetConn Carries whole IPv6 packets to and from the border router
+type packetConn interface {
+	ReadPacket() ([]byte, error)
+	WritePacket(packet []byte) error
+	Close() error
+}
+
+//Link Line to a border router, shared by the server receiving from its network and the senders towards it
+type Link struct {
+	config  LinkConfig
+	source  net.IP
+	conn    packetConn
+	writer  sync.Mutex
+	packets chan []byte
+	done    chan struct{}
+	close   sync.Once
+	//err Why receiving stopped, set before packets is closed
+	err error
+}
+
+//devices Links by transport and device, a device is opened once
+var devices = struct {
+	sync.Mutex
+	open map[string]*Link
+}{open: make(map[string]*Link)}
+
+//OpenLink Open the line of config, until Close no other link can use the device
+func OpenLink(config LinkConfig) (*Link, error) {
+	devices.Lock()
+	defer devices.Unlock()
+	if _, ok := devices.open[config.key()]; ok {
+		return nil, fmt.Errorf("%w: %v", ErrDeviceInUse, config.Device)
+	}
+	var conn packetConn
+	var err error
+	switch config.transport() {
+	case TransportSerial:
+		var port io.ReadWriteCloser
+		port, err = openSerial(config.Device, config.Baud)
+		if err == nil {
+			conn = newSlipConn(port)
+		}
+	case TransportTUN:
+		conn, err = openTUN(config.Device)
+	case TransportUDP:
+		conn, err = openUDP(config.Listen, config.Device)
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnknownTransport, config.Transport)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cisixlowpan: unable to open %v %v: %v", config.transport(), config.Device, err)
+	}
+	link := newLink(config, conn)
+	devices.open[config.key()] = link
+	log.Printf("cisixlowpan: opened %v %v for %v, fog address %v\n", config.transport(), config.Device, config.Prefix, link.source)
+	return link, nil
+}
+
+//NewLink SLIP link over an already opened line to a border router, e.g. a pipe to a simulated one; Close closes port
+func NewLink(config LinkConfig, port io.ReadWriteCloser) *Link {
+	return newLink(config, newSlipConn(port))
+}
+
+//newLink Start receiving the packets on conn
+func newLink(config LinkConfig, conn packetConn) *Link {
+	l := &Link{
+		config:  config,
+		source:  config.source(),
+		conn:    conn,
+		packets: make(chan []byte, confLinkBuffer),
+		done:    make(chan struct{}),
+	}
+	go l.receive()
+	return l
+}
+
+//Config Configuration the link was opened with
+func (l *Link) Config() LinkConfig {
+	return l.config
+}
+
+//Source Address of the fog in the network behind the border router
+func (l *Link) Source() net.IP {
+	return l.source
+}
+
+//Packets IPv6 packets received from the border router, closed when the line fails or the link is closed
+func (l *Link) Packets() <-chan []byte {
+	return l.packets
+}
+
+//Err Why the packets channel was closed
+func (l *Link) Err() error {
+	return l.err
+}
+
+func (l *Link) receive() {
+	defer close(l.packets)
+	for {
+		packet, err := l.conn.ReadPacket()
+		if err != nil {
+			l.err = err
+			return
+		}
+		if l.config.DebugLevel >= sixlowpan.DebugPackets {
+			log.Printf("cisixlowpan: %v: received %x\n", l.config.Device, packet)
+		}
+		select {
+		case l.packets <- packet:
+		case <-l.done:
+			l.err = io.ErrClosedPipe
+			return
+		}
+	}
+}
+
+//write Send an IPv6 packet to the border router
+func (l *Link) write(packet []byte) error {
+	l.writer.Lock()
+	defer l.writer.Unlock()
+	select {
+	case <-l.done:
+		return io.ErrClosedPipe
+	default:
+	}
+	if l.config.DebugLevel >= sixlowpan.DebugPackets {
+		log.Printf("cisixlowpan: %v: sending %x\n", l.config.Device, packet)
+	}
+	return l.conn.WritePacket(packet)
+}
+
+//Close Close the line, the device can be opened again
+func (l *Link) Close() error {
+	var err error
+	l.close.Do(func() {
+		close(l.done)
+		err = l.conn.Close()
+		devices.Lock()
+		if devices.open[l.config.key()] == l {
+			delete(devices.open, l.config.key())
+		}
+		devices.Unlock()
+	})
+	return err
+}
@@ -0,0 +1,197 @@
+package cisixlowpan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/joriwind/hecomm-fog/iotInterface"
+	"github.com/joriwind/hecomm-interface-6lowpan"
+	"golang.org/x/net/ipv6"
+)
+
+func TestSlip(t *testing.T) {
+	packets := [][]byte{
+		{1, 2, 3},
+		{slipEnd, slipEsc, slipEscEnd, slipEscEsc},
+		{0x60, slipEnd},
+	}
+	var line []byte
+	for _, p := range packets {
+		line = append(line, slipEncode(p)...)
+	}
+	if !bytes.Equal(slipEncode([]byte{slipEnd, slipEsc}), []byte{slipEnd, slipEsc, slipEscEnd, slipEsc, slipEscEsc, slipEnd}) {
+		t.Errorf("slipEncode() = %x", slipEncode([]byte{slipEnd, slipEsc}))
+	}
+
+	reader := newSlipReader(bytes.NewReader(line))
+	for _, want := range packets {
+		got, err := reader.ReadPacket()
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("ReadPacket() = %x, %v, want %x", got, err, want)
+		}
+	}
+	if _, err := reader.ReadPacket(); err == nil {
+		t.Error("ReadPacket() at end of line, want error")
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	for _, tc := range []struct {
+		devID string
+		ip    string
+		port  uint16
+		ok    bool
+	}{
+		{devID: "aaaa::2", ip: "aaaa::2", ok: true},
+		{devID: "[aaaa::2]:5684", ip: "aaaa::2", port: 5684, ok: true},
+		{devID: "[aaaa::2]:0"},
+		{devID: "[aaaa::2]:70000"},
+		{devID: "10.0.0.2"},
+		{devID: "node"},
+	} {
+		ip, port, err := ParseAddress(tc.devID)
+		if tc.ok != (err == nil) || (tc.ok && (!ip.Equal(net.ParseIP(tc.ip)) || port != tc.port)) {
+			t.Errorf("ParseAddress(%q) = %v, %v, %v", tc.devID, ip, port, err)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("ParseAddress(%q) = %v, want ErrInvalidAddress", tc.devID, err)
+		}
+	}
+}
+
+func TestLink(t *testing.T) {
+	fog, router := net.Pipe()
+	defer router.Close()
+	link := NewLink(LinkConfig{Device: "pipe", Prefix: mustParsePrefix("aaaa::/64"), FilterDestination: true}, fog)
+	defer link.Close()
+
+	//Received by the server of the platform
+	comlink := make(chan iotInterface.ComLinkMessage, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- NewServer(ctx, comlink, link).Start() }()
+
+	//With the filter only the packets for the fog, derived from the prefix, reach the server
+	if !link.Source().Equal(net.ParseIP("aaaa::c30c:0:0:5")) {
+		t.Errorf("Source() = %v, want aaaa::c30c:0:0:5", link.Source())
+	}
+	for _, dst := range []string{"aaaa::3", "aaaa::c30c:0:0:5"} {
+		uplink, err := compilePacket(net.ParseIP("aaaa::2"), 5684, Datagram{Destination: net.ParseIP(dst), Port: 5683, HopLimit: 64, Data: []byte("up " + dst)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := router.Write(slipEncode(uplink)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case m := <-comlink:
+		if string(m.Data) != "up aaaa::c30c:0:0:5" || m.Metadata.Sixlowpan.SourcePort != 5684 || m.Metadata.Sixlowpan.DestinationPort != 5683 {
+			t.Errorf("received %+v, want the uplink to the fog", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("uplink not received")
+	}
+
+	//Sent over the same line
+	sent := make(chan []byte, 1)
+	go func() {
+		p, _ := newSlipReader(router).ReadPacket()
+		sent <- p
+	}()
+	if err := link.SendData(iotInterface.ComLinkMessage{Destination: []byte("[aaaa::2]:5684"), Data: []byte("down")}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-sent:
+		iph, err := ipv6.ParseHeader(p)
+		if err != nil || !iph.Src.Equal(link.Source()) || !iph.Dst.Equal(net.ParseIP("aaaa::2")) || iph.HopLimit != ConfHopLimit {
+			t.Fatalf("sent %x, %v, want packet from the fog to aaaa::2", p, err)
+		}
+		udph, err := sixlowpan.UnmarshalUDP(p[ipv6.HeaderLen:])
+		if err != nil || udph.SrcPort != ConfPort || udph.DstPort != 5684 || string(udph.Payload) != "down" {
+			t.Errorf("sent %+v, %v, want datagram to port 5684", udph, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("downlink not sent")
+	}
+
+	if err := link.SendData(iotInterface.ComLinkMessage{Destination: []byte("bbbb::2")}); !errors.Is(err, ErrOutsidePrefix) {
+		t.Errorf("SendData() outside prefix = %v, want ErrOutsidePrefix", err)
+	}
+	if err := link.SendData(iotInterface.ComLinkMessage{Destination: []byte("node")}); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("SendData() to invalid address = %v, want ErrInvalidAddress", err)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Start() = %v, want context.Canceled", err)
+	}
+}
+
+func TestOpenLinkInUse(t *testing.T) {
+	fog, router := net.Pipe()
+	defer router.Close()
+	link := NewLink(LinkConfig{Device: "/dev/ttyTEST"}, fog)
+	devices.Lock()
+	devices.open["serial:/dev/ttyTEST"] = link
+	devices.Unlock()
+
+	if _, err := OpenLink(LinkConfig{Device: "/dev/ttyTEST"}); !errors.Is(err, ErrDeviceInUse) {
+		t.Errorf("OpenLink() = %v, want ErrDeviceInUse", err)
+	}
+	//Closing releases the device
+	link.Close()
+	devices.Lock()
+	_, ok := devices.open["serial:/dev/ttyTEST"]
+	devices.Unlock()
+	if ok {
+		t.Error("device still open after Close()")
+	}
+}
+
+func TestUDPLink(t *testing.T) {
+	router, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	link, err := OpenLink(LinkConfig{Transport: TransportUDP, Device: router.LocalAddr().String(), Listen: "[::1]:0", Prefix: ConfPrefix})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer link.Close()
+	fog := link.conn.(*udpConn).conn.LocalAddr()
+
+	//Every datagram is an IPv6 packet
+	if err := link.SendData(iotInterface.ComLinkMessage{Destination: []byte("aaaa::2"), Data: []byte("down")}); err != nil {
+		t.Fatal(err)
+	}
+	router.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 256)
+	n, addr, err := router.ReadFrom(buf)
+	if err != nil || addr.String() != fog.String() || !bytes.HasSuffix(buf[:n], []byte("down")) {
+		t.Fatalf("border router received %x from %v, %v", buf[:n], addr, err)
+	}
+
+	//Datagrams of others are dropped
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.WriteTo([]byte("other"), fog)
+	router.WriteTo([]byte("up"), fog)
+	select {
+	case p := <-link.Packets():
+		if string(p) != "up" {
+			t.Errorf("received %q, want only the packet of the border router", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet not received")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package cisixlowpan
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+//openSerial Serial lines are configured with termios, only on linux
+func openSerial(device string, baud int) (io.ReadWriteCloser, error) {
+	return nil, fmt.Errorf("serial devices are not supported on %v", runtime.GOOS)
+}
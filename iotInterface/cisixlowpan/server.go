@@ -2,7 +2,9 @@ package cisixlowpan
 
 import (
 	"context"
+	"expvar"
 	"fmt"
+	"net"
 
 	"golang.org/x/net/ipv6"
 
@@ -15,68 +17,63 @@ import (
 	"github.com/joriwind/hecomm-interface-6lowpan"
 )
 
+//metricDropped Uplinks dropped by the destination filter, per device
+var metricDropped = expvar.NewMap("cisixlowpan_uplinks_dropped")
+
 //Server Object defining the Server
 type Server struct {
 	ctx     context.Context
 	comlink chan iotInterface.ComLinkMessage
-	options sixlowpan.Config
+	link    *Link
 }
 
-//NewServer Setup the cisixlowpan server
-func NewServer(ctx context.Context, comlink chan iotInterface.ComLinkMessage, config sixlowpan.Config) *Server {
-	var server Server
-	server.ctx = ctx
-	server.comlink = comlink
-	if config.PortName == "" {
-		server.options = sixlowpan.Config{
-			DebugLevel: sixlowpan.DebugAll,
-			PortName:   "/dev/ttyUSB0",
-		}
-	} else {
-		server.options = config
+//NewServer Setup the cisixlowpan server, receiving from the border router on link
+func NewServer(ctx context.Context, comlink chan iotInterface.ComLinkMessage, link *Link) *Server {
+	return &Server{
+		ctx:     ctx,
+		comlink: comlink,
+		link:    link,
 	}
-
-	return &server
 }
 
-//Start Create socket and start listening
+//Start Listen on the link until ctx is done or the link fails
 func (s *Server) Start() error {
-	reader, err := sixlowpan.Open(s.options)
-	if err != nil {
-		return err
-	}
-	defer reader.Close()
-
-	log.Printf("cisixlowpan: listening on %v\n", s.options.PortName)
-
-	buf := make([]byte, 1024)
+	log.Printf("cisixlowpan: listening on %v\n", s.link.config.Device)
 
 	for {
-		//n, addr, err := ln.ReadFrom(buf)
-		n, err := reader.Read(buf)
-		if err != nil {
-			log.Printf("Unable to read serial line: %v\n", err)
-			return err
-		}
-
-		log.Printf("Received packet from SLIP\n")
-		message, err := toComLinkMessage(buf[0:n])
-		if err != nil {
-			log.Printf("Could not translate slip packet: %v\n", err)
+		select {
+		case <-s.ctx.Done():
+			return s.ctx.Err()
 
-		} else {
+		case packet, ok := <-s.link.Packets():
+			if !ok {
+				if s.ctx.Err() != nil {
+					return s.ctx.Err()
+				}
+				log.Printf("Unable to read %v: %v\n", s.link.config.Device, s.link.Err())
+				return s.link.Err()
+			}
+			message, err := toComLinkMessage(packet)
+			if err != nil {
+				log.Printf("Could not translate slip packet: %v\n", err)
+				continue
+			}
+			//Optionally only datagrams for the fog, the border router may forward everything it hears
+			dst := net.ParseIP(message.Metadata.Sixlowpan.Destination)
+			if s.link.config.FilterDestination && !dst.Equal(s.link.source) && !dst.IsMulticast() {
+				metricDropped.Add(s.link.config.Device, 1)
+				log.Printf("WARNING cisixlowpan: %v: dropped uplink from %v to %v, the fog is %v\n", s.link.config.Device, message.Metadata.Sixlowpan.Source, dst, s.link.source)
+				continue
+			}
 			//Communicate to main thread
 			log.Printf("Packet succesfully parsed, received from: %v", message.Origin)
-			s.comlink <- message
-		}
-
-		//Check if ctx is expired
-		if s.ctx.Err() != nil {
-			return s.ctx.Err()
+			select {
+			case s.comlink <- message:
+			case <-s.ctx.Done():
+				return s.ctx.Err()
+			}
 		}
-
 	}
-
 }
 
 //toComLinkMessage parses ipv6 & udp header to create comlinkmessage
@@ -90,6 +87,10 @@ func toComLinkMessage(buf []byte) (m iotInterface.ComLinkMessage, err error) {
 		return m, err
 	}
 
+	if iph.NextHeader != 17 {
+		return m, fmt.Errorf("Not a UDP packet, next header: %v", iph.NextHeader)
+	}
+
 	//Unmarshalling UDP header to get to the payload
 	udph, err := sixlowpan.UnmarshalUDP(buf[ipv6.HeaderLen:])
 	if err != nil {
@@ -107,6 +108,17 @@ func toComLinkMessage(buf []byte) (m iotInterface.ComLinkMessage, err error) {
 		Origin:        []byte(iph.Src.String()),
 		TimeReceived:  time.Now(),
 		Destination:   nil, //Destination was fog, now should be something else
+		Metadata: iotInterface.Metadata{
+			Sixlowpan: &iotInterface.SixlowpanMetadata{
+				Source:          iph.Src.String(),
+				Destination:     iph.Dst.String(),
+				HopLimit:        iph.HopLimit,
+				TrafficClass:    iph.TrafficClass,
+				FlowLabel:       iph.FlowLabel,
+				SourcePort:      udph.SrcPort,
+				DestinationPort: udph.DstPort,
+			},
+		},
 	}
 	return m, err
 }
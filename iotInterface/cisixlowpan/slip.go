@@ -0,0 +1,96 @@
+package cisixlowpan
+
+import (
+	"bufio"
+	"io"
+)
+
+//SLIP special characters (RFC 1055)
+const (
+	slipEnd    = 0xC0
+	slipEsc    = 0xDB
+	slipEscEnd = 0xDC
+	slipEscEsc = 0xDD
+)
+
+//slipEncode Frame an IPv6 packet for the serial line, the leading END flushes noise the border router received
+func slipEncode(packet []byte) []byte {
+	frame := make([]byte, 0, len(packet)+2)
+	frame = append(frame, slipEnd)
+	for _, b := range packet {
+		switch b {
+		case slipEnd:
+			frame = append(frame, slipEsc, slipEscEnd)
+		case slipEsc:
+			frame = append(frame, slipEsc, slipEscEsc)
+		default:
+			frame = append(frame, b)
+		}
+	}
+	return append(frame, slipEnd)
+}
+
+//slipReader Reads the packets framed by the border router
+type slipReader struct {
+	r *bufio.Reader
+}
+
+func newSlipReader(r io.Reader) *slipReader {
+	return &slipReader{r: bufio.NewReader(r)}
+}
+
+//ReadPacket Next non-empty packet on the line
+func (s *slipReader) ReadPacket() ([]byte, error) {
+	var packet []byte
+	for {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch b {
+		case slipEnd:
+			if len(packet) > 0 {
+				return packet, nil
+			}
+		case slipEsc:
+			b, err = s.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			switch b {
+			case slipEscEnd:
+				packet = append(packet, slipEnd)
+			case slipEscEsc:
+				packet = append(packet, slipEsc)
+			default:
+				//Protocol violation, RFC 1055 keeps the byte
+				packet = append(packet, b)
+			}
+		default:
+			packet = append(packet, b)
+		}
+	}
+}
+
+//slipConn IPv6 packets framed with SLIP on a serial line
+type slipConn struct {
+	port   io.ReadWriteCloser
+	reader *slipReader
+}
+
+func newSlipConn(port io.ReadWriteCloser) *slipConn {
+	return &slipConn{port: port, reader: newSlipReader(port)}
+}
+
+func (s *slipConn) ReadPacket() ([]byte, error) {
+	return s.reader.ReadPacket()
+}
+
+func (s *slipConn) WritePacket(packet []byte) error {
+	_, err := s.port.Write(slipEncode(packet))
+	return err
+}
+
+func (s *slipConn) Close() error {
+	return s.port.Close()
+}
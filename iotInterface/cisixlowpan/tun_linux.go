@@ -0,0 +1,68 @@
+package cisixlowpan
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+//tunConn IPv6 packets on a Linux TUN interface, one packet per read or write
+type tunConn struct {
+	file *os.File
+	buf  []byte
+}
+
+//openTUN Attach to the TUN interface name, created when it does not exist
+func openTUN(name string) (*tunConn, error) {
+	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	//Fd would switch the file to blocking mode, Close then no longer interrupts the receiving link
+	raw, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	var ioctlErr error
+	err = raw.Control(func(fd uintptr) {
+		ioctlErr = unix.IoctlIfreq(int(fd), unix.TUNSETIFF, ifr)
+	})
+	if err == nil {
+		err = ioctlErr
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to attach to %v: %v", name, err)
+	}
+	return &tunConn{file: file, buf: make([]byte, confMaxPacketSize)}, nil
+}
+
+func (t *tunConn) ReadPacket() ([]byte, error) {
+	for {
+		n, err := t.file.Read(t.buf)
+		if err != nil {
+			return nil, err
+		}
+		//The kernel routes IPv4 to the interface as well
+		if n > 0 && t.buf[0]>>4 == 6 {
+			return append([]byte(nil), t.buf[:n]...), nil
+		}
+	}
+}
+
+func (t *tunConn) WritePacket(packet []byte) error {
+	_, err := t.file.Write(packet)
+	return err
+}
+
+func (t *tunConn) Close() error {
+	return t.file.Close()
+}
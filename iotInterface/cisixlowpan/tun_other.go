@@ -0,0 +1,13 @@
+//go:build !linux
+
+package cisixlowpan
+
+import (
+	"fmt"
+	"runtime"
+)
+
+//openTUN TUN interfaces are attached with the Linux TUNSETIFF ioctl
+func openTUN(name string) (packetConn, error) {
+	return nil, fmt.Errorf("TUN interfaces are not supported on %v", runtime.GOOS)
+}
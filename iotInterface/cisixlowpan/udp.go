@@ -0,0 +1,63 @@
+package cisixlowpan
+
+import (
+	"fmt"
+	"log"
+	"net"
+)
+
+//udpConn IPv6 packets tunneled in UDP datagrams to a border router or a simulated network
+type udpConn struct {
+	conn   *net.UDPConn
+	remote *net.UDPAddr
+	buf    []byte
+}
+
+//openUDP Listen on listen for the border router at remote
+func openUDP(listen, remote string) (*udpConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", remote)
+	if err != nil {
+		return nil, err
+	}
+	if listen == "" {
+		listen = ConfUDPListen
+	}
+	laddr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{conn: conn, remote: raddr, buf: make([]byte, confMaxPacketSize)}, nil
+}
+
+//ReadPacket Next packet from the border router, datagrams of other senders are dropped
+func (u *udpConn) ReadPacket() ([]byte, error) {
+	for {
+		n, addr, err := u.conn.ReadFromUDP(u.buf)
+		if err != nil {
+			return nil, err
+		}
+		if !addr.IP.Equal(u.remote.IP) || addr.Port != u.remote.Port {
+			log.Printf("cisixlowpan: dropped datagram from %v, border router is %v\n", addr, u.remote)
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+		return append([]byte(nil), u.buf[:n]...), nil
+	}
+}
+
+func (u *udpConn) WritePacket(packet []byte) error {
+	if _, err := u.conn.WriteToUDP(packet, u.remote); err != nil {
+		return fmt.Errorf("unable to send to %v: %v", u.remote, err)
+	}
+	return nil
+}
+
+func (u *udpConn) Close() error {
+	return u.conn.Close()
+}
@@ -0,0 +1,165 @@
+package iotInterface
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//Metadata Reception details of a message, the section of its interface is set
+type Metadata struct {
+	LoRaWAN   *LoRaWANMetadata   `json:"lorawan,omitempty"`
+	Sixlowpan *SixlowpanMetadata `json:"sixlowpan,omitempty"`
+	//Values Further details as key values, for details without a field
+	Values map[string]string `json:"values,omitempty"`
+}
+
+//LoRaWANMetadata Radio details of a LoRaWAN uplink, as reported by the network server
+type LoRaWANMetadata struct {
+	FCnt         uint32          `json:"fcnt"`
+	Frequency    int64           `json:"frequency,omitempty"` //Hz
+	Modulation   string          `json:"modulation,omitempty"`
+	Bandwidth    uint32          `json:"bandwidth,omitempty"` //kHz
+	SpreadFactor uint32          `json:"spreadFactor,omitempty"`
+	Bitrate      uint32          `json:"bitrate,omitempty"` //FSK only
+	CodeRate     string          `json:"codeRate,omitempty"`
+	ADR          bool            `json:"adr,omitempty"`
+	Gateways     []GatewayRxInfo `json:"gateways,omitempty"`
+}
+
+//GatewayRxInfo Reception of an uplink by a single gateway
+type GatewayRxInfo struct {
+	MAC       []byte  `json:"mac"`
+	Name      string  `json:"name,omitempty"`
+	Time      string  `json:"time,omitempty"`
+	RSSI      int32   `json:"rssi"`
+	SNR       float64 `json:"snr"`
+	Latitude  float64 `json:"latitude,omitempty"`
+	Longitude float64 `json:"longitude,omitempty"`
+	Altitude  float64 `json:"altitude,omitempty"`
+}
+
+//SixlowpanMetadata IPv6 and UDP header details of a 6LoWPAN packet
+type SixlowpanMetadata struct {
+	Source          string `json:"source"`
+	Destination     string `json:"destination"`
+	HopLimit        int    `json:"hopLimit"`
+	TrafficClass    int    `json:"trafficClass,omitempty"`
+	FlowLabel       int    `json:"flowLabel,omitempty"`
+	SourcePort      uint16 `json:"sourcePort"`
+	DestinationPort uint16 `json:"destinationPort"`
+}
+
+//Best Gateway with the strongest reception, nil without gateways
+func (l *LoRaWANMetadata) Best() *GatewayRxInfo {
+	var best *GatewayRxInfo
+	for i, g := range l.Gateways {
+		if best == nil || g.SNR > best.SNR || (g.SNR == best.SNR && g.RSSI > best.RSSI) {
+			best = &l.Gateways[i]
+		}
+	}
+	return best
+}
+
+//Set Add a key value to the metadata
+func (m *Metadata) Set(key string, value string) {
+	if m.Values == nil {
+		m.Values = make(map[string]string)
+	}
+	m.Values[key] = value
+}
+
+/*
+ * Get Value of a metadata key, as used by the routing rules:
+ *	lorawan.fcnt, lorawan.frequency, lorawan.datarate (e.g. SF7BW125), lorawan.sf, lorawan.bandwidth, lorawan.adr,
+ *	lorawan.gateways (number of gateways), lorawan.gateway, lorawan.rssi and lorawan.snr (of the best gateway),
+ *	sixlowpan.source, sixlowpan.destination, sixlowpan.hoplimit, sixlowpan.trafficclass, sixlowpan.flowlabel,
+ *	sixlowpan.sourceport, sixlowpan.destinationport,
+ * or any key of Values.
+ */
+func (m *Metadata) Get(key string) (string, bool) {
+	if l := m.LoRaWAN; l != nil && strings.HasPrefix(key, "lorawan.") {
+		best := l.Best()
+		switch key {
+		case "lorawan.fcnt":
+			return strconv.FormatUint(uint64(l.FCnt), 10), true
+		case "lorawan.frequency":
+			return strconv.FormatInt(l.Frequency, 10), true
+		case "lorawan.datarate":
+			return l.DataRate(), true
+		case "lorawan.sf":
+			return strconv.FormatUint(uint64(l.SpreadFactor), 10), true
+		case "lorawan.bandwidth":
+			return strconv.FormatUint(uint64(l.Bandwidth), 10), true
+		case "lorawan.adr":
+			return strconv.FormatBool(l.ADR), true
+		case "lorawan.gateways":
+			return strconv.Itoa(len(l.Gateways)), true
+		case "lorawan.gateway":
+			if best != nil {
+				return hex.EncodeToString(best.MAC), true
+			}
+		case "lorawan.rssi":
+			if best != nil {
+				return strconv.FormatInt(int64(best.RSSI), 10), true
+			}
+		case "lorawan.snr":
+			if best != nil {
+				return strconv.FormatFloat(best.SNR, 'f', -1, 64), true
+			}
+		}
+	}
+	if s := m.Sixlowpan; s != nil && strings.HasPrefix(key, "sixlowpan.") {
+		switch key {
+		case "sixlowpan.source":
+			return s.Source, true
+		case "sixlowpan.destination":
+			return s.Destination, true
+		case "sixlowpan.hoplimit":
+			return strconv.Itoa(s.HopLimit), true
+		case "sixlowpan.trafficclass":
+			return strconv.Itoa(s.TrafficClass), true
+		case "sixlowpan.flowlabel":
+			return strconv.Itoa(s.FlowLabel), true
+		case "sixlowpan.sourceport":
+			return strconv.Itoa(int(s.SourcePort)), true
+		case "sixlowpan.destinationport":
+			return strconv.Itoa(int(s.DestinationPort)), true
+		}
+	}
+	v, ok := m.Values[key]
+	return v, ok
+}
+
+//DataRate Name of the LoRa data rate, e.g. SF7BW125, or the bitrate of FSK
+func (l *LoRaWANMetadata) DataRate() string {
+	if l.Modulation == "FSK" {
+		return fmt.Sprintf("FSK%v", l.Bitrate)
+	}
+	return fmt.Sprintf("SF%vBW%v", l.SpreadFactor, l.Bandwidth)
+}
+
+//String Short description for the logs
+func (m Metadata) String() string {
+	var parts []string
+	if l := m.LoRaWAN; l != nil {
+		parts = append(parts, fmt.Sprintf("fCnt %v, %v at %v Hz, %v gateways", l.FCnt, l.DataRate(), l.Frequency, len(l.Gateways)))
+		if best := l.Best(); best != nil {
+			parts = append(parts, fmt.Sprintf("best %x rssi %v snr %v", best.MAC, best.RSSI, best.SNR))
+		}
+	}
+	if s := m.Sixlowpan; s != nil {
+		parts = append(parts, fmt.Sprintf("[%v]:%v to [%v]:%v, hop limit %v", s.Source, s.SourcePort, s.Destination, s.DestinationPort, s.HopLimit))
+	}
+	keys := make([]string, 0, len(m.Values))
+	for k := range m.Values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%v=%v", k, m.Values[k]))
+	}
+	return strings.Join(parts, ", ")
+}
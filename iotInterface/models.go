@@ -13,4 +13,8 @@ type ComLinkMessage struct {
 	Destination   []byte
 	TimeReceived  time.Time
 	Data          []byte
+	//FPort LoRaWAN port the data was sent on, 0 for other interfaces
+	FPort uint32
+	//Metadata Reception details from the interface
+	Metadata Metadata
 }
@@ -14,19 +14,29 @@ import (
 
 	"strings"
 
+	"encoding/hex"
 	"encoding/json"
 
 	"log"
 
+	"time"
+
+	"net"
+	"net/http"
+
+	"path/filepath"
+
 	"github.com/joriwind/hecomm-fog/dbconnection"
 	"github.com/joriwind/hecomm-fog/fogcore"
 	"github.com/joriwind/hecomm-fog/iotInterface/cilorawan"
+	"github.com/joriwind/hecomm-fog/iotInterface/cisixlowpan"
+	"github.com/joriwind/hecomm-fog/pki"
 )
 
 func main() {
 	//Flag init
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage of %s: [flags] [migrate | ca init|issue|list|revoke ...]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
@@ -36,16 +46,67 @@ func main() {
 	fcCaCert := flag.String("fcCaCert", fogcore.ConfFogcoreCaCert, "The *unencrypted* key used by TLS listener")
 	fcKey := flag.String("fcKey", fogcore.ConfFogcoreKey, "The *unencrypted* key used by TLS listener")
 	fcAddress := flag.String("fcAddress", fogcore.ConfFogcoreAddress, "Server address of TLS listener")
+	fcAdmins := flag.String("fcAdmins", fogcore.ConfAdminIdentities, "Comma separated certificate names allowed to manage every platform")
+	fcAuditLog := flag.String("fcAuditLog", fogcore.ConfAuditLog, "File the audit trail of management commands is appended to, empty for the standard log")
+	fcProviderPolicy := flag.String("fcProviderPolicy", fogcore.ConfProviderPolicy, "Order in which providers are offered a link: \"first-fit\", \"least-loaded\", \"round-robin\", \"same-platform\" or \"lowest-latency\"")
+	fcFraming := flag.String("fcFraming", fogcore.ConfFraming.String(), "Framing towards platforms without a \"framing\" ciarg: \"length\" (length-prefixed) or \"json\" (legacy)")
+	fcMaxMessage := flag.Int("fcMaxMessage", fogcore.ConfMaxMessageSize, "Largest accepted hecomm message in bytes")
+	fcProviderTimeout := flag.Duration("fcProviderTimeout", fogcore.ConfProviderDialTimeout, "Maximum time to reach a provider platform before trying the next")
+	fcPoolMaxIdle := flag.Int("fcPoolMaxIdle", fogcore.ConfPoolMaxIdle, "Maximum idle connections kept per platform")
+	fcPoolMinIdle := flag.Int("fcPoolMinIdle", fogcore.ConfPoolMinIdle, "Idle connections kept open to every platform used, 0 to only keep connections after sessions")
+	fcPoolIdleTimeout := flag.Duration("fcPoolIdleTimeout", fogcore.ConfPoolIdleTimeout, "Idle connections unused for this long are closed")
+	fcPoolHealth := flag.Duration("fcPoolHealth", fogcore.ConfPoolHealthInterval, "Interval between health checks of idle connections")
+	fcReconnectMax := flag.Duration("fcReconnectMax", fogcore.ConfReconnectMax, "Maximum backoff before dialing an unreachable platform again")
+	fcQueueTTL := flag.Duration("fcQueueTTL", fogcore.ConfQueueTTL, "Queued downlinks not delivered within this period are dead-lettered")
+	fcQueueMaxAttempts := flag.Int("fcQueueMaxAttempts", fogcore.ConfQueueMaxAttempts, "Failed attempts after which a downlink is dead-lettered, 0 to retry until its TTL")
+	fcQueueRetryMax := flag.Duration("fcQueueRetryMax", fogcore.ConfQueueRetryMax, "Maximum backoff before retrying a failed downlink")
+	fcAlertWebhook := flag.String("fcAlertWebhook", "", "URL every alert is posted to as JSON, empty to only log alerts")
 
 	//6LoWPAN
-	s6Serialport := flag.String("s6Serialport", fogcore.SixlowpanPortConst, "Serial SLIP connection to 6lowpan e.g. \"/dev/ttyUSB0\"")
+	s6Serialport := flag.String("s6Serialport", fogcore.SixlowpanPortConst, "Serial SLIP connection to 6lowpan e.g. \"/dev/ttyUSB0\", for platforms without a \"device\" ciarg")
+	s6Baud := flag.Int("s6Baud", cisixlowpan.ConfBaudRate, "Baud rate of the serial SLIP connection, for platforms without a \"baud\" ciarg")
+	s6Listen := flag.String("s6Listen", cisixlowpan.ConfUDPListen, "Local address of the udp transport, for platforms without a \"listen\" ciarg")
+	s6Prefix := flag.String("s6Prefix", cisixlowpan.ConfPrefix.String(), "IPv6 prefix behind the border router, for platforms without a \"prefix\" ciarg")
+	s6InterfaceID := flag.String("s6InterfaceID", cisixlowpan.ConfInterfaceID.String(), "Interface ID of the fog, its address is the prefix of the platform with this ID unless a \"source\" ciarg is set")
+	s6Port := flag.Uint("s6Port", uint(cisixlowpan.ConfPort), "UDP port of the fog, and of node applications without port")
+	s6HopLimit := flag.Int("s6HopLimit", cisixlowpan.ConfHopLimit, "Hop limit of the packets sent to 6lowpan nodes without a \"hopLimit\" ciarg")
+	s6FilterDestination := flag.Bool("s6FilterDestination", cisixlowpan.ConfFilterDestination, "Drop 6lowpan uplinks not addressed to the fog, for platforms without a \"filterDestination\" ciarg")
 	s6Debuglevel := flag.String("s6Debuglevel", strconv.Itoa(int(fogcore.SixlowpanDebugLevelConst)), "Debug level of sixlowpan interface: 0 (none) - 1 (packets) - 2 (all)")
 
 	//LoRa
-	lwNSAddress := flag.String("lwNSAddress", cilorawan.ConfNSAddress, "The IP address of LoRaWAN network server")
+	lwNSAddress := flag.String("lwNSAddress", cilorawan.ConfNSAddress, "The IP address of LoRaWAN network server, for platforms without an \"nsAddress\" ciarg")
+	lwASAddress := flag.String("lwASAddress", cilorawan.ConfASAddress, "Listen address of the LoRaWAN application server, for platforms without an \"asAddress\" ciarg")
 	lwCert := flag.String("lwCert", cilorawan.ConfCILorawanCert, "The certificate used by LoRaWAN certificate")
 	lwCaCert := flag.String("lwCaCert", cilorawan.ConfCILorawanCaCert, "The certificate used by LoRaWAN certificate")
 	lwKey := flag.String("lwKey", cilorawan.ConfCILorawanKey, "The certificate used by LoRaWAN certificate")
+	lwFPort := flag.Uint("lwFPort", uint(cilorawan.ConfDownlinkFPort), "FPort of LoRaWAN downlinks")
+	lwConfirmed := flag.Bool("lwConfirmed", cilorawan.ConfDownlinkConfirmed, "Send LoRaWAN downlinks confirmed, retried until acknowledged")
+	lwRetries := flag.Int("lwRetries", cilorawan.ConfDownlinkRetries, "Retransmissions of an unacknowledged confirmed LoRaWAN downlink")
+	lwMaxPayload := flag.Int("lwMaxPayload", cilorawan.ConfMaxPayloadSize, "Largest LoRaWAN downlink payload sent whole, larger ones are fragmented")
+	lwFragmentFPort := flag.Uint("lwFragmentFPort", uint(cilorawan.ConfFragmentFPort), "FPort of LoRaWAN fragments, in both directions")
+	lwGatewayPoll := flag.Duration("lwGatewayPoll", fogcore.ConfGatewayPollInterval, "Interval between polls of the LoRaWAN gateways and their statistics, 0 to disable")
+	lwGatewayWindow := flag.Duration("lwGatewayWindow", fogcore.ConfGatewayStatsWindow, "Period the packet counters of a LoRaWAN gateway are summed over")
+	lwGatewayOffline := flag.Duration("lwGatewayOffline", fogcore.ConfGatewayOffline, "A LoRaWAN gateway not seen for this long is reported offline")
+
+	//Certificates
+	pkiReload := flag.Duration("pkiReload", pki.ConfReloadInterval, "Interval between checks of the certificate files for changes, SIGHUP reloads immediately")
+	pkiExpiryWarning := flag.Duration("pkiExpiryWarning", pki.ConfExpiryWarning, "Warn about certificates expiring within this period")
+	metricsAddress := flag.String("metricsAddress", "", "Address serving the metrics on /debug/vars, empty to disable")
+
+	//Certificate authority
+	caCert := flag.String("caCert", fogcore.ConfCACert, "Root certificate of the built-in CA issuing platform certificates")
+	caKey := flag.String("caKey", fogcore.ConfCAKey, "Key of the built-in CA")
+	caValidity := flag.Duration("caValidity", fogcore.ConfCertValidity, "Validity of issued platform certificates")
+	caOut := flag.String("caOut", ".", "Directory issued platform certificates and keys are written to")
+
+	//Storage, defaults can be overridden by the environment
+	dbDefault := dbconnection.DefaultConfig()
+	dbDriver := flag.String("dbDriver", envString("HECOMM_DB_DRIVER", dbDefault.Driver), "Storage backend: \"mysql\", \"sqlite3\" or \"memory\" (env HECOMM_DB_DRIVER)")
+	dbSource := flag.String("dbSource", envString("HECOMM_DB_SOURCE", ""), "DSN of the storage backend, empty for the default of the backend (env HECOMM_DB_SOURCE)")
+	dbMaxOpen := flag.Int("dbMaxOpen", envInt("HECOMM_DB_MAXOPEN", dbDefault.MaxOpenConns), "Maximum open database connections (env HECOMM_DB_MAXOPEN)")
+	dbMaxIdle := flag.Int("dbMaxIdle", envInt("HECOMM_DB_MAXIDLE", dbDefault.MaxIdleConns), "Maximum idle database connections (env HECOMM_DB_MAXIDLE)")
+	dbMigrate := flag.Bool("dbMigrate", dbDefault.Migrate, "Apply pending schema migrations on startup")
+	dbLifetime := flag.Duration("dbLifetime", envDuration("HECOMM_DB_LIFETIME", dbDefault.ConnMaxLifetime), "Maximum lifetime of a database connection (env HECOMM_DB_LIFETIME)")
 
 	flag.Parse()
 
@@ -54,6 +115,12 @@ func main() {
 	cilorawan.ConfCILorawanCert = *lwCert
 	cilorawan.ConfCILorawanKey = *lwKey
 	cilorawan.ConfNSAddress = *lwNSAddress
+	cilorawan.ConfASAddress = *lwASAddress
+	cilorawan.ConfDownlinkFPort = uint32(*lwFPort)
+	cilorawan.ConfDownlinkConfirmed = *lwConfirmed
+	cilorawan.ConfDownlinkRetries = *lwRetries
+	cilorawan.ConfMaxPayloadSize = *lwMaxPayload
+	cilorawan.ConfFragmentFPort = uint32(*lwFragmentFPort)
 
 	//6lowpan configuration
 	fogcore.SixlowpanPort = *s6Serialport
@@ -62,18 +129,128 @@ func main() {
 		log.Fatalf("Debug level of 6lowpan interface was not valid: %v\n", err)
 	}
 	fogcore.SixlowpanDebugLevel = uint8(sixlevel)
+	cisixlowpan.ConfBaudRate = *s6Baud
+	cisixlowpan.ConfUDPListen = *s6Listen
+	_, cisixlowpan.ConfPrefix, err = net.ParseCIDR(*s6Prefix)
+	if err != nil {
+		log.Fatalf("IPv6 prefix of 6lowpan interface was not valid: %v\n", err)
+	}
+	cisixlowpan.ConfInterfaceID = net.ParseIP(*s6InterfaceID)
+	if cisixlowpan.ConfInterfaceID == nil || cisixlowpan.ConfInterfaceID.To4() != nil {
+		log.Fatalf("Interface ID of 6lowpan interface was not valid: %v\n", *s6InterfaceID)
+	}
+	if *s6Port == 0 || *s6Port > 0xFFFF {
+		log.Fatalf("UDP port of 6lowpan interface was not valid: %v\n", *s6Port)
+	}
+	cisixlowpan.ConfPort = uint16(*s6Port)
+	if *s6HopLimit < 1 || *s6HopLimit > 0xFF {
+		log.Fatalf("Hop limit of 6lowpan interface was not valid: %v\n", *s6HopLimit)
+	}
+	cisixlowpan.ConfHopLimit = *s6HopLimit
+	cisixlowpan.ConfFilterDestination = *s6FilterDestination
 
 	//Fogcore configuration
 	fogcore.ConfFogcoreAddress = *fcAddress
 	fogcore.ConfFogcoreCert = *fcCert
 	fogcore.ConfFogcoreKey = *fcKey
 	fogcore.ConfFogcoreCaCert = *fcCaCert
+	fogcore.ConfAdminIdentities = *fcAdmins
+	fogcore.ConfAuditLog = *fcAuditLog
+	fogcore.ConfProviderPolicy = *fcProviderPolicy
+	fogcore.ConfProviderDialTimeout = *fcProviderTimeout
+	fogcore.ConfPoolMaxIdle = *fcPoolMaxIdle
+	fogcore.ConfPoolMinIdle = *fcPoolMinIdle
+	fogcore.ConfPoolIdleTimeout = *fcPoolIdleTimeout
+	fogcore.ConfPoolHealthInterval = *fcPoolHealth
+	fogcore.ConfReconnectMax = *fcReconnectMax
+	fogcore.ConfQueueTTL = *fcQueueTTL
+	cilorawan.ConfDownlinkTTL = *fcQueueTTL
+	fogcore.ConfQueueMaxAttempts = *fcQueueMaxAttempts
+	fogcore.ConfQueueRetryMax = *fcQueueRetryMax
+	fogcore.ConfGatewayPollInterval = *lwGatewayPoll
+	fogcore.ConfGatewayStatsWindow = *lwGatewayWindow
+	fogcore.ConfGatewayOffline = *lwGatewayOffline
+	fogcore.ConfMaxMessageSize = *fcMaxMessage
+	fogcore.ConfFraming, err = fogcore.ParseFraming(*fcFraming)
+	if err != nil {
+		log.Fatalf("Framing was not valid: %v\n", err)
+	}
+
+	//Certificate configuration
+	fogcore.ConfCACert = *caCert
+	fogcore.ConfCAKey = *caKey
+	fogcore.ConfCertValidity = *caValidity
+	pki.ConfReloadInterval = *pkiReload
+	pki.ConfExpiryWarning = *pkiExpiryWarning
+
+	//Storage configuration
+	dbConfig := dbconnection.Config{
+		Driver:          *dbDriver,
+		Source:          *dbSource,
+		MaxOpenConns:    *dbMaxOpen,
+		MaxIdleConns:    *dbMaxIdle,
+		ConnMaxLifetime: *dbLifetime,
+		Migrate:         *dbMigrate,
+	}
+
+	//Subcommands
+	switch flag.Arg(0) {
+	case "migrate":
+		dbConfig.Migrate = true
+		store, err := dbconnection.Open(dbConfig)
+		if err != nil {
+			log.Fatalf("Migration failed: %v\n", err)
+		}
+		defer store.Close()
+		if migrator, ok := store.(dbconnection.Migrator); ok {
+			version, err := migrator.SchemaVersion()
+			if err != nil {
+				log.Fatalf("Unable to read schema version: %v\n", err)
+			}
+			fmt.Printf("Schema at version %v\n", version)
+		}
+		return
+	case "ca":
+		store, err := dbconnection.Open(dbConfig)
+		if err != nil {
+			log.Fatalf("Unable to open storage backend: %v\n", err)
+		}
+		defer store.Close()
+		if err := caCommand(store, flag.Args()[1:], *caOut); err != nil {
+			log.Fatalf("CA: %v\n", err)
+		}
+		return
+	case "":
+	default:
+		log.Fatalf("Unknown subcommand: %v\n", flag.Arg(0))
+	}
 
 	//Startup fogcore
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	fogcore := fogcore.NewFogcore(ctx)
+	//Watch the certificates loaded from here on
+	go pki.DefaultWatcher.Run(ctx)
+	if *metricsAddress != "" {
+		go func() {
+			log.Printf("Metrics served on %v/debug/vars\n", *metricsAddress)
+			err := http.ListenAndServe(*metricsAddress, nil)
+			log.Printf("Metrics server exited: %v\n", err)
+		}()
+	}
+
+	var alertHook fogcore.AlertHook
+	if *fcAlertWebhook != "" {
+		alertHook = fogcore.WebhookAlertHook(*fcAlertWebhook)
+	}
+	fogcore, err := fogcore.NewFogcore(ctx, dbConfig)
+	if err != nil {
+		log.Fatalf("Unable to open storage backend: %v\n", err)
+	}
+	store := fogcore.Store()
+	if alertHook != nil {
+		fogcore.AddAlertHook(alertHook)
+	}
 	go func() {
 		err := fogcore.Start()
 		if err != nil {
@@ -106,7 +283,7 @@ func main() {
 						fmt.Printf("Not valid Node data: value: %v, error: %v\n", node, err)
 						break
 					}
-					err = dbconnection.InsertNode(&node)
+					err = store.InsertNode(&node)
 					if err != nil {
 						fmt.Printf("Error in inserting node in db: node: %v, error: %v\n", node, err)
 						break
@@ -120,7 +297,7 @@ func main() {
 						fmt.Printf("Not valid Platform data: value: %v, error: %v\n", platform, err)
 						break
 					}
-					err = dbconnection.InsertPlatform(&platform)
+					err = store.InsertPlatform(&platform)
 					if err != nil {
 						fmt.Printf("Error in inserting platform in db: node: %v, error: %v\n", platform, err)
 						break
@@ -134,7 +311,7 @@ func main() {
 						fmt.Printf("Not valid Link data: value: %v, error: %v\n", link, err)
 						break
 					}
-					err = dbconnection.InsertLink(&link)
+					err = store.InsertLink(&link)
 					if err != nil {
 						fmt.Printf("Error in inserting link in db: node: %v, error: %v\n", link, err)
 						break
@@ -145,6 +322,27 @@ func main() {
 					fmt.Printf("Not a valid element: %v\n", subcommand[0])
 				}
 
+			case "update":
+				subcommand := strings.SplitN(command[1], " ", 2)
+				switch subcommand[0] {
+				case "platform":
+					var platform dbconnection.Platform
+					err := json.Unmarshal(([]byte(subcommand[1])), &platform)
+					if err != nil || platform.ID == 0 {
+						fmt.Printf("Not valid Platform data: value: %v, error: %v\n", platform, err)
+						break
+					}
+					err = store.UpdatePlatform(&platform)
+					if err != nil {
+						fmt.Printf("Error in updating platform in db: platform: %v, error: %v\n", platform, err)
+						break
+					}
+					log.Printf("Updated platform in db: value: %v\n", platform)
+
+				default:
+					fmt.Printf("Not a valid element: %v\n", subcommand[0])
+				}
+
 			case "delete":
 				subcommand := strings.SplitN(command[1], " ", 2)
 				switch subcommand[0] {
@@ -154,7 +352,7 @@ func main() {
 						fmt.Printf("Error in conversion to integer ID: value: %v\n", subcommand[1])
 						break
 					}
-					err = dbconnection.DeleteNode(id)
+					err = store.DeleteNode(id)
 					if err != nil {
 						fmt.Printf("Error in deleting node in db: id: %v, error: %v\n", id, err)
 						break
@@ -167,7 +365,7 @@ func main() {
 						fmt.Printf("Error in conversion to integer ID: value: %v\n", subcommand[1])
 						break
 					}
-					err = dbconnection.DeletePlatform(id)
+					err = store.DeletePlatform(id)
 					if err != nil {
 						fmt.Printf("Error in deleting platform in db: id: %v, error: %v\n", id, err)
 						break
@@ -180,7 +378,7 @@ func main() {
 						fmt.Printf("Error in conversion to integer ID: value: %v\n", subcommand[1])
 						break
 					}
-					err = dbconnection.DeleteLink(id)
+					err = store.DeleteLink(id)
 					if err != nil {
 						fmt.Printf("Error in deleting Link in db: id: %v, error: %v\n", id, err)
 						break
@@ -195,43 +393,130 @@ func main() {
 				subcommand := strings.SplitN(command[1], " ", 2)
 				switch subcommand[0] {
 				case "nodes":
-					nodes, err := dbconnection.GetNodes()
+					nodes, err := store.GetNodes()
 					if err != nil {
 						fmt.Printf("Something went wrong: %v\n", err)
 					}
 					fmt.Printf("Nodes: %v\n", nodes)
 
 				case "platforms":
-					platforms, err := dbconnection.GetPlatforms()
+					platforms, err := store.GetPlatforms()
 					if err != nil {
 						fmt.Printf("Something went wrong: %v\n", err)
 					}
 					fmt.Printf("Platforms: %v\n", platforms)
 
 				case "links":
-					links, err := dbconnection.GetLinks()
+					links, err := store.GetLinks()
 					if err != nil {
 						fmt.Printf("Something went wrong: %v\n", err)
 					}
 					fmt.Printf("Links: %v\n", links)
 
+				case "routes":
+					stats := fogcore.RoutingStats()
+					fmt.Printf("Origins: %v, routes: %v, hits: %v, misses: %v\n", stats.Origins, stats.Routes, stats.Hits, stats.Misses)
+
+				case "conns":
+					for _, pool := range fogcore.PoolStats() {
+						state := "connected"
+						if pool.Failures > 0 {
+							state = fmt.Sprintf("%v failures, retry at %v: %v", pool.Failures, pool.RetryAt.Format(time.RFC3339), pool.LastError)
+						}
+						fmt.Printf("Platform %v (%v): %v idle, %v\n", pool.PlatformID, pool.Address, pool.Idle, state)
+					}
+
+				case "gateways":
+					for _, gw := range fogcore.Gateways() {
+						state := "offline"
+						if gw.Online {
+							state = "online"
+						}
+						fmt.Printf("Platform %v gateway %x (%v): %v, last seen %v, rx %v (%v ok), tx %v (%v emitted)\n", gw.PlatformID, gw.MAC, gw.Name, state, gw.LastSeen.Format(time.RFC3339), gw.RxReceived, gw.RxReceivedOK, gw.TxReceived, gw.TxEmitted)
+						if gw.StatsError != nil {
+							fmt.Printf("	statistics of %v: %v\n", gw.Polled.Format(time.RFC3339), gw.StatsError)
+						}
+					}
+
+				case "errors":
+					nodeID := 0
+					if len(subcommand) > 1 {
+						nodeID, err = strconv.Atoi(subcommand[1])
+						if err != nil {
+							fmt.Printf("Error in conversion to integer ID: value: %v\n", subcommand[1])
+							break
+						}
+					}
+					errs, err := fogcore.NodeErrors(nodeID)
+					if err != nil {
+						fmt.Printf("Unable to get node errors: %v\n", err)
+						break
+					}
+					for _, e := range errs {
+						fmt.Printf("%v node %v (%x) on platform %v: %v: %v\n", e.Time.Format(time.RFC3339), e.NodeID, e.DevID, e.PlatformID, e.Type, e.Message)
+					}
+
+				case "certs":
+					for _, cert := range pki.DefaultWatcher.CheckExpiry() {
+						warning := ""
+						if cert.Expiring {
+							warning = " EXPIRING"
+						}
+						fmt.Printf("%v (%v): expires %v%v\n", cert.File, cert.Subject, cert.NotAfter.Format(time.RFC3339), warning)
+					}
+
 				default:
 					fmt.Printf("Not a valid element: %v\n", subcommand[0])
 				}
 
+			case "queue":
+				var args []string
+				if len(command) > 1 {
+					args = strings.Fields(command[1])
+				}
+				if err := queueCommand(fogcore, args); err != nil {
+					fmt.Printf("Queue: %v\n", err)
+				}
+
+			case "ca":
+				var args []string
+				if len(command) > 1 {
+					args = strings.Fields(command[1])
+				}
+				if err := caCommand(store, args, *caOut); err != nil {
+					fmt.Printf("CA: %v\n", err)
+				}
+
+			case "otaa":
+				var args []string
+				if len(command) > 1 {
+					args = strings.Fields(command[1])
+				}
+				if err := otaaCommand(store, args); err != nil {
+					fmt.Printf("OTAA: %v\n", err)
+				}
+
 			case "help":
-				commands := []string{"insert", "delete", "get"}
-				elements := [][]string{{"node", "{\"id\":X,\"devid\":\"XXXX\",\"platformid\":X,\"isprovider\":bool,\"inftype\":X}"},
+				commands := []string{"insert", "update", "delete", "get", "queue", "ca", "otaa"}
+				elements := [][]string{{"node", "{\"id\":X,\"devid\":\"XXXX\",\"platformid\":X,\"isprovider\":bool,\"inftype\":X,\"ciargs\":{}}"},
 					{"platform", "{\"id\":X,\"address\":\"XXXX\",\"tlscert\":\"XXX\",\"tlskey\":\"XXXX\",\"citype\":X,\"ciargs\":{}}"},
-					{"link", "{\"id\":X,\"provnode\":X,\"reqnode\":X}"}}
+					{"link", "{\"id\":X,\"provnode\":X,\"reqnode\":X,\"ciargs\":{}}"}}
 				fmt.Println("HECOMM-FOG")
 				fmt.Println("Available commands:")
 				for _, command := range commands {
 					switch command {
 					case "get":
-						fmt.Printf("	%v $ELEMENT(S)\n", command)
+						fmt.Printf("	%v $ELEMENT(S) | routes | conns | certs | gateways | errors [$NODEID]\n", command)
+					case "update":
+						fmt.Printf("	%v platform $DATA, replacing every field of the platform with the id in $DATA\n", command)
 					case "delete":
 						fmt.Printf("	%v $ELEMENT $ID\n", command)
+					case "queue":
+						fmt.Printf("	%v [dead | replay $ID|all | purge $ID]\n", command)
+					case "ca":
+						fmt.Printf("	%v init [$CN] | issue $PLATFORMID [$SAN...] | list [$PLATFORMID] | revoke $SERIAL\n", command)
+					case "otaa":
+						fmt.Printf("	%v set $NODEID $APPKEY [$APPEUI] | get $NODEID | delete $NODEID\n", command)
 
 					default:
 						fmt.Printf("	%v $ELEMENT $(OPT)DATA\n", command)
@@ -249,3 +534,242 @@ func main() {
 		}
 	}
 }
+
+//queueCommand Show the pending downlinks, or inspect, replay and purge the dead letters
+func queueCommand(fc *fogcore.Fogcore, args []string) error {
+	if len(args) == 0 {
+		pending, err := fc.PendingMessages()
+		if err != nil {
+			return err
+		}
+		for _, m := range pending {
+			fmt.Printf("%v to node %v from %s: %x, attempts %v, next %v, expires %v, last error: %v, metadata: %s\n", m.ID, m.NodeID, m.Origin, m.Data, m.Attempts, m.NextAttempt.Format(time.RFC3339), m.Expires.Format(time.RFC3339), m.LastError, m.Metadata)
+		}
+		fmt.Printf("%v pending\n", len(pending))
+		return nil
+	}
+	switch args[0] {
+	case "dead":
+		dead, err := fc.DeadLetters()
+		if err != nil {
+			return err
+		}
+		for _, m := range dead {
+			fmt.Printf("%v to node %v from %s: %x, received %v, attempts %v: %v, metadata: %s\n", m.ID, m.NodeID, m.Origin, m.Data, m.Received.Format(time.RFC3339), m.Attempts, m.LastError, m.Metadata)
+		}
+		fmt.Printf("%v dead letters\n", len(dead))
+
+	case "replay", "purge":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: %v $ID|all", args[0])
+		}
+		var ids []int
+		if args[1] == "all" {
+			dead, err := fc.DeadLetters()
+			if err != nil {
+				return err
+			}
+			for _, m := range dead {
+				ids = append(ids, m.ID)
+			}
+		} else {
+			id, err := strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("not a valid message id: %v", args[1])
+			}
+			ids = append(ids, id)
+		}
+		for _, id := range ids {
+			var err error
+			if args[0] == "replay" {
+				err = fc.ReplayDeadLetter(id)
+			} else {
+				err = fc.PurgeDeadLetter(id)
+			}
+			if err != nil {
+				return err
+			}
+			log.Printf("Dead letter %v: %v\n", id, args[0])
+		}
+
+	default:
+		return fmt.Errorf("unknown command: %v", args[0])
+	}
+	return nil
+}
+
+//caCommand Run a command of the built-in CA: init, issue, list or revoke
+func caCommand(store dbconnection.Store, args []string, outDir string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command: init, issue, list or revoke")
+	}
+	switch args[0] {
+	case "init":
+		commonName := "hecomm-fog CA"
+		if len(args) > 1 {
+			commonName = strings.Join(args[1:], " ")
+		}
+		ca, err := pki.InitCA(fogcore.ConfCACert, fogcore.ConfCAKey, commonName, 10*fogcore.ConfCertValidity)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created CA %q in %v, valid until %v\n", commonName, fogcore.ConfCACert, ca.Cert.NotAfter.Format(time.RFC3339))
+		fmt.Printf("Add %v to the CA chain of -fcCaCert to accept the platforms it issues\n", fogcore.ConfCACert)
+
+	case "issue":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: issue $PLATFORMID [$SAN...]")
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("not a valid platform id: %v", args[1])
+		}
+		ca, err := pki.LoadCA(fogcore.ConfCACert, fogcore.ConfCAKey)
+		if err != nil {
+			return err
+		}
+		issued, err := fogcore.IssuePlatformCertificate(store, ca, id, args[2:])
+		if err != nil {
+			return err
+		}
+		serial := pki.SerialString(issued.Cert.SerialNumber)
+		base := filepath.Join(outDir, fmt.Sprintf("platform%v-%v", id, serial))
+		if err := issued.WriteFiles(base+".cert.pem", base+".key.pem"); err != nil {
+			return err
+		}
+		fmt.Printf("Issued %v for platform %v: %v.cert.pem, valid until %v\n", serial, id, base, issued.Cert.NotAfter.Format(time.RFC3339))
+
+	case "list":
+		var certs []dbconnection.Certificate
+		var err error
+		if len(args) > 1 {
+			id, cerr := strconv.Atoi(args[1])
+			if cerr != nil {
+				return fmt.Errorf("not a valid platform id: %v", args[1])
+			}
+			certs, err = store.GetCertificatesOfPlatform(id)
+		} else {
+			certs, err = store.GetCertificates()
+		}
+		if err != nil {
+			return err
+		}
+		for _, cert := range certs {
+			state := "valid"
+			if cert.Revoked {
+				state = "revoked"
+			} else if time.Now().After(cert.NotAfter) {
+				state = "expired"
+			}
+			fmt.Printf("%v platform %v %q until %v: %v\n", cert.Serial, cert.PlatformID, cert.CommonName, cert.NotAfter.Format(time.RFC3339), state)
+		}
+
+	case "revoke":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: revoke $SERIAL")
+		}
+		if err := fogcore.RevokePlatformCertificate(store, strings.ToLower(args[1])); err != nil {
+			return err
+		}
+		log.Printf("Revoked certificate %v\n", args[1])
+
+	default:
+		return fmt.Errorf("unknown command: %v", args[0])
+	}
+	return nil
+}
+
+//envString Value of the environment variable, def if not set
+func envString(key string, def string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return def
+}
+
+//envInt Integer value of the environment variable, def if not set
+func envInt(key string, def int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Environment variable %v is not a valid integer: %v\n", key, err)
+	}
+	return i
+}
+
+//envDuration Duration value of the environment variable, def if not set
+func envDuration(key string, def time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Environment variable %v is not a valid duration: %v\n", key, err)
+	}
+	return d
+}
+
+//otaaCommand Manage the over-the-air activation keys of LoRaWAN nodes, keys and EUIs in hex
+func otaaCommand(store dbconnection.Store, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: set $NODEID $APPKEY [$APPEUI] | get $NODEID | delete $NODEID")
+	}
+	id, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("not a valid node id: %v", args[1])
+	}
+	switch args[0] {
+	case "set":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: set $NODEID $APPKEY [$APPEUI]")
+		}
+		node, err := store.GetNode(id)
+		if err != nil {
+			return err
+		}
+		if node.ID == 0 {
+			return fmt.Errorf("unknown node: %v", id)
+		}
+		keys := dbconnection.DeviceKeys{NodeID: id}
+		if keys.AppKey, err = hex.DecodeString(args[2]); err != nil || len(keys.AppKey) != 16 {
+			return fmt.Errorf("AppKey has to be 16 bytes in hex: %v", args[2])
+		}
+		if len(args) > 3 {
+			if keys.AppEUI, err = hex.DecodeString(args[3]); err != nil || len(keys.AppEUI) != 8 {
+				return fmt.Errorf("AppEUI has to be 8 bytes in hex: %v", args[3])
+			}
+		}
+		//New keys, the node has to join again
+		if err := store.SetDeviceKeys(&keys); err != nil {
+			return err
+		}
+		fmt.Printf("Node %v can join with AppKey\n", id)
+
+	case "get":
+		keys, err := store.GetDeviceKeys(id)
+		if err != nil {
+			return err
+		}
+		if keys.NodeID == 0 {
+			return fmt.Errorf("node %v has no keys", id)
+		}
+		if len(keys.DevAddr) == 0 {
+			fmt.Printf("Node %v, AppEUI %x: not joined\n", id, keys.AppEUI)
+			break
+		}
+		fmt.Printf("Node %v, AppEUI %x: joined as DevAddr %x, %v join-requests\n", id, keys.AppEUI, keys.DevAddr, len(keys.DevNonces))
+
+	case "delete":
+		if err := store.DeleteDeviceKeys(id); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown command: %v", args[0])
+	}
+	return nil
+}
@@ -6,13 +6,13 @@ import (
 )
 
 //ConvertToLink Search for nodes in the database and create Link element
-func ConvertToLink(lc hecomm.LinkContract) (*dbconnection.Link, error) {
+func ConvertToLink(store dbconnection.Store, lc hecomm.LinkContract) (*dbconnection.Link, error) {
 	var link dbconnection.Link
-	prov, err := dbconnection.FindNode(lc.ProvDevEUI)
+	prov, err := store.FindNode(lc.ProvDevEUI)
 	if err != nil {
 		return &link, err
 	}
-	req, err := dbconnection.FindNode(lc.ReqDevEUI)
+	req, err := store.FindNode(lc.ReqDevEUI)
 	if err != nil {
 		return &link, err
 	}
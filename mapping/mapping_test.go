@@ -0,0 +1,32 @@
+package mapping
+
+import (
+	"testing"
+
+	"github.com/joriwind/hecomm-api/hecomm"
+	"github.com/joriwind/hecomm-fog/dbconnection"
+)
+
+func TestConvertToLink(t *testing.T) {
+	store := dbconnection.NewMemoryStore()
+	prov := dbconnection.Node{DevID: "0102030405060708", PlatformID: 1, IsProvider: true, InfType: 1}
+	req := dbconnection.Node{DevID: "aaaa::1", PlatformID: 2, InfType: 1}
+	for _, n := range []*dbconnection.Node{&prov, &req} {
+		if err := store.InsertNode(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lc := hecomm.LinkContract{
+		InfType:    1,
+		ProvDevEUI: []byte(prov.DevID),
+		ReqDevEUI:  []byte(req.DevID),
+	}
+	link, err := ConvertToLink(store, lc)
+	if err != nil {
+		t.Fatalf("ConvertToLink() error = %v", err)
+	}
+	if link.ID != 0 || link.ProvNode != prov.ID || link.ReqNode != req.ID {
+		t.Errorf("ConvertToLink() = %v, want provnode %v, reqnode %v", link, prov.ID, req.ID)
+	}
+}
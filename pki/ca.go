@@ -0,0 +1,188 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+//CA Certificate authority of the fog, signing the certificates of platforms
+type CA struct {
+	Cert *x509.Certificate
+	key  crypto.Signer
+}
+
+//CertificateRequest Subject and names of a certificate to issue
+type CertificateRequest struct {
+	CommonName string
+	//Names DNS names and IP addresses, added as SANs
+	Names    []string
+	Validity time.Duration
+}
+
+//IssuedCertificate Signed certificate with its new key, PEM encoded
+type IssuedCertificate struct {
+	Cert    *x509.Certificate
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+//InitCA Create a self-signed root for commonName, refusing to overwrite existing files
+func InitCA(certFile string, keyFile string, commonName string, validity time.Duration) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeNew(keyFile, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := writeNew(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		os.Remove(keyFile)
+		return nil, err
+	}
+	return &CA{Cert: cert, key: key}, nil
+}
+
+//LoadCA Read the root created by InitCA
+func LoadCA(certFile string, keyFile string) (*CA, error) {
+	kp, err := LoadKeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert := kp.Certificate()
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok || !cert.Leaf.IsCA {
+		return nil, fmt.Errorf("pki: %v is not a certificate authority", certFile)
+	}
+	return &CA{Cert: cert.Leaf, key: signer}, nil
+}
+
+//Issue Sign a new key for req, usable as server and as client certificate
+func (ca *CA) Issue(req CertificateRequest) (*IssuedCertificate, error) {
+	if req.CommonName == "" {
+		return nil, fmt.Errorf("pki: certificate without common name")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: req.CommonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(req.Validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if template.NotAfter.After(ca.Cert.NotAfter) {
+		template.NotAfter = ca.Cert.NotAfter
+	}
+	for _, name := range req.Names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if name != "" {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.Cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &IssuedCertificate{
+		Cert:    cert,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  keyPEM,
+	}, nil
+}
+
+//WriteFiles Store the certificate and key, refusing to overwrite existing files
+func (ic *IssuedCertificate) WriteFiles(certFile string, keyFile string) error {
+	if err := writeNew(keyFile, ic.KeyPEM, 0600); err != nil {
+		return err
+	}
+	if err := writeNew(certFile, ic.CertPEM, 0644); err != nil {
+		os.Remove(keyFile)
+		return err
+	}
+	return nil
+}
+
+//SerialString Serial number as stored with the platform, lowercase hexadecimal
+func SerialString(serial *big.Int) string {
+	return serial.Text(16)
+}
+
+//newSerial Random 128 bit serial number
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+//writeNew Write data to a file that does not exist yet
+func writeNew(file string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return fmt.Errorf("pki: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,157 @@
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//revokedSerials Revocation checker on a fixed set of serials
+type revokedSerials map[string]bool
+
+func (r revokedSerials) IsRevoked(cert *x509.Certificate) (bool, error) {
+	return r[SerialString(cert.SerialNumber)], nil
+}
+
+func TestCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caCert, caKey := filepath.Join(dir, "ca.cert.pem"), filepath.Join(dir, "ca.key.pem")
+	if _, err := InitCA(caCert, caKey, "test CA", 24*time.Hour); err != nil {
+		t.Fatalf("InitCA() error = %v", err)
+	}
+	if _, err := InitCA(caCert, caKey, "test CA", 24*time.Hour); err == nil {
+		t.Error("InitCA() overwrote existing CA")
+	}
+	ca, err := LoadCA(caCert, caKey)
+	if err != nil {
+		t.Fatalf("LoadCA() error = %v", err)
+	}
+
+	issued, err := ca.Issue(CertificateRequest{CommonName: "platform-a", Names: []string{"192.168.2.107", "platform-a.local"}, Validity: 365 * 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	cert := issued.Cert
+	if len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("192.168.2.107")) || len(cert.DNSNames) != 1 || cert.DNSNames[0] != "platform-a.local" {
+		t.Errorf("Issue() SANs = %v %v", cert.IPAddresses, cert.DNSNames)
+	}
+	if cert.NotAfter.After(ca.Cert.NotAfter) {
+		t.Errorf("Issue() NotAfter %v beyond CA %v", cert.NotAfter, ca.Cert.NotAfter)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: "192.168.2.107", KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("issued certificate does not verify: %v", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "a.cert.pem"), filepath.Join(dir, "a.key.pem")
+	if err := issued.WriteFiles(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeyPair(certFile, keyFile); err != nil {
+		t.Errorf("LoadKeyPair() of issued files error = %v", err)
+	}
+	if SerialString(big.NewInt(255)) != "ff" {
+		t.Errorf("SerialString(255) = %v", SerialString(big.NewInt(255)))
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caCert, caKey := filepath.Join(dir, "ca.cert.pem"), filepath.Join(dir, "ca.key.pem")
+	ca, err := InitCA(caCert, caKey, "test CA", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string) Credentials {
+		issued, err := ca.Issue(CertificateRequest{CommonName: name, Names: []string{"127.0.0.1"}, Validity: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		creds := Credentials{Cert: filepath.Join(dir, name+".cert.pem"), Key: filepath.Join(dir, name+".key.pem"), CaCert: caCert}
+		if err := issued.WriteFiles(creds.Cert, creds.Key); err != nil {
+			t.Fatal(err)
+		}
+		return creds
+	}
+	fog := write("fog")
+	good := write("good")
+	revoked := write("revoked")
+	kp, _ := LoadKeyPair(revoked.Cert, revoked.Key)
+	SetRevocationChecker(revokedSerials{SerialString(kp.Leaf().SerialNumber): true})
+	defer SetRevocationChecker(nil)
+
+	serverKeyPair, err := LoadKeyPair(fog.Cert, fog.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPool, err := LoadCAPool(caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", ServerConfig(serverKeyPair, caPool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	dial := func(creds Credentials) error {
+		config, err := creds.ClientConfig()
+		if err != nil {
+			return err
+		}
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", listener.Addr().String(), config)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		//TLS 1.3 reports a refused client certificate on the first read, an accepted one is closed
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err = conn.Read(make([]byte, 1)); errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+	if err := dial(good); err != nil {
+		t.Errorf("dial with valid certificate = %v", err)
+	}
+	if err := dial(revoked); err == nil {
+		t.Error("listener accepted revoked client certificate")
+	}
+
+	//Outbound dials refuse a revoked server
+	SetRevocationChecker(revokedSerials{SerialString(serverKeyPair.Leaf().SerialNumber): true})
+	config, err := good.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.Dial("tcp", listener.Addr().String(), config); !errors.Is(err, ErrRevoked) {
+		t.Errorf("dial to revoked server = %v, want %v", err, ErrRevoked)
+	}
+}
@@ -0,0 +1,146 @@
+package pki
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+//Credentials TLS material of a platform, as file paths; empty fields are not used
+type Credentials struct {
+	Cert       string
+	Key        string
+	CaCert     string
+	ServerName string //Expected name in the certificate of the peer, instead of the dialed host
+}
+
+//IsZero No credentials are configured
+func (c Credentials) IsZero() bool {
+	return c == Credentials{}
+}
+
+//Or Credentials with the empty fields of c taken from defaults, the key pair only as a whole
+func (c Credentials) Or(defaults Credentials) Credentials {
+	if c.Cert == "" && c.Key == "" {
+		c.Cert = defaults.Cert
+		c.Key = defaults.Key
+	}
+	if c.CaCert == "" {
+		c.CaCert = defaults.CaCert
+	}
+	if c.ServerName == "" {
+		c.ServerName = defaults.ServerName
+	}
+	return c
+}
+
+//ClientConfig Load the files of c into a configuration to dial a peer
+func (c Credentials) ClientConfig() (*tls.Config, error) {
+	config, _, _, err := c.load()
+	return config, err
+}
+
+//load Configuration to dial with c, with the key pair and CA pool it was built from, if any
+func (c Credentials) load() (*tls.Config, *KeyPair, *CAPool, error) {
+	var kp *KeyPair
+	var ca *CAPool
+	var err error
+	config := &tls.Config{ServerName: c.ServerName, VerifyConnection: verifyNotRevoked}
+	if c.Cert != "" || c.Key != "" {
+		kp, err = LoadKeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		config.GetClientCertificate = kp.GetClientCertificate
+	}
+	if c.CaCert != "" {
+		ca, err = LoadCAPool(c.CaCert)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		config.RootCAs = ca.Pool()
+	}
+	return config, kp, ca, nil
+}
+
+//cacheEntry Configuration loaded for a set of credentials
+type cacheEntry struct {
+	config  *tls.Config
+	keyPair *KeyPair
+	caPool  *CAPool
+}
+
+//Cache Client configurations by credentials, files are only loaded once
+type Cache struct {
+	mutex   sync.Mutex
+	entries map[Credentials]cacheEntry
+}
+
+//NewCache Create an empty cache
+func NewCache() *Cache {
+	return &Cache{entries: make(map[Credentials]cacheEntry)}
+}
+
+//ClientConfig Configuration to dial with creds, loaded on first use; do not modify the result
+func (c *Cache) ClientConfig(creds Credentials) (*tls.Config, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if entry, ok := c.entries[creds]; ok {
+		return entry.config, nil
+	}
+	config, kp, ca, err := creds.load()
+	if err != nil {
+		return nil, err
+	}
+	c.entries[creds] = cacheEntry{config: config, keyPair: kp, caPool: ca}
+	return config, nil
+}
+
+//Forget Drop every configuration loaded from file, to reload it on next use
+func (c *Cache) Forget(file string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for creds := range c.entries {
+		if creds.Cert == file || creds.Key == file || creds.CaCert == file {
+			delete(c.entries, creds)
+		}
+	}
+}
+
+//Clear Drop every configuration
+func (c *Cache) Clear() {
+	c.mutex.Lock()
+	c.entries = make(map[Credentials]cacheEntry)
+	c.mutex.Unlock()
+}
+
+//Files Files the cached configurations were loaded from
+func (c *Cache) Files() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var files []string
+	for creds := range c.entries {
+		for _, file := range []string{creds.Cert, creds.Key, creds.CaCert} {
+			if file != "" {
+				files = append(files, file)
+			}
+		}
+	}
+	return files
+}
+
+//loaded Key pairs and CA pools of the cached configurations
+func (c *Cache) loaded() ([]*KeyPair, []*CAPool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var kps []*KeyPair
+	var cas []*CAPool
+	for _, entry := range c.entries {
+		if entry.keyPair != nil {
+			kps = append(kps, entry.keyPair)
+		}
+		if entry.caPool != nil {
+			cas = append(cas, entry.caPool)
+		}
+	}
+	return kps, cas
+}
@@ -0,0 +1,136 @@
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//writeSelfSigned Write a self-signed certificate for name, valid for validity, and its key into dir
+func writeSelfSigned(t *testing.T, dir string, name string, validity time.Duration) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestCredentialsOr(t *testing.T) {
+	defaults := Credentials{Cert: "fog.crt", Key: "fog.key", CaCert: "ca.crt", ServerName: "fog"}
+	if got := (Credentials{}).Or(defaults); got != defaults {
+		t.Errorf("Or() of empty credentials = %v, want %v", got, defaults)
+	}
+	own := Credentials{Cert: "pl.crt", Key: "pl.key", ServerName: "platform"}
+	want := Credentials{Cert: "pl.crt", Key: "pl.key", CaCert: "ca.crt", ServerName: "platform"}
+	if got := own.Or(defaults); got != want {
+		t.Errorf("Or() = %v, want %v", got, want)
+	}
+	//Half a key pair is never completed with the defaults
+	half := Credentials{Cert: "pl.crt"}
+	if got := half.Or(defaults); got.Key != "" {
+		t.Errorf("Or() completed key pair: %v", got)
+	}
+}
+
+func TestCacheClientConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverCert, serverKey := writeSelfSigned(t, dir, "provider", time.Hour)
+	otherCert, _ := writeSelfSigned(t, dir, "other", time.Hour)
+
+	pair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pair}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	cache := NewCache()
+	dial := func(creds Credentials) error {
+		config, err := cache.ClientConfig(creds)
+		if err != nil {
+			return err
+		}
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", listener.Addr().String(), config)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	//Platform trusting the provider and expecting its name instead of the dialed address
+	trusted := Credentials{CaCert: serverCert, ServerName: "provider"}
+	if err := dial(trusted); err != nil {
+		t.Errorf("dial with platform CA = %v", err)
+	}
+	if err := dial(Credentials{CaCert: otherCert, ServerName: "provider"}); err == nil {
+		t.Error("dial with other CA succeeded")
+	}
+
+	first, _ := cache.ClientConfig(trusted)
+	if second, _ := cache.ClientConfig(trusted); first != second {
+		t.Error("ClientConfig() loaded cached credentials again")
+	}
+	cache.Forget(serverCert)
+	if third, _ := cache.ClientConfig(trusted); first == third {
+		t.Error("ClientConfig() after Forget() returned the stale configuration")
+	}
+
+	if _, err := cache.ClientConfig(Credentials{CaCert: filepath.Join(dir, "missing.crt")}); err == nil {
+		t.Error("ClientConfig() with missing CA succeeded")
+	}
+}
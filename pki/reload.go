@@ -0,0 +1,151 @@
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+//KeyPair Certificate and key read from their files, replaced in place on Reload
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+}
+
+//LoadKeyPair Read the key pair from its files
+func LoadKeyPair(certFile string, keyFile string) (*KeyPair, error) {
+	kp := KeyPair{CertFile: certFile, KeyFile: keyFile}
+	if err := kp.Reload(); err != nil {
+		return nil, err
+	}
+	return &kp, nil
+}
+
+//Reload Read the files again, the previous certificate stays in use if they are invalid
+func (kp *KeyPair) Reload() error {
+	cert, err := tls.LoadX509KeyPair(kp.CertFile, kp.KeyFile)
+	if err != nil {
+		return fmt.Errorf("pki: load key-pair %v error: %v", kp.CertFile, err)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("pki: parse certificate %v error: %v", kp.CertFile, err)
+		}
+	}
+	kp.mutex.Lock()
+	kp.cert = &cert
+	kp.mutex.Unlock()
+	return nil
+}
+
+//Certificate Key pair currently in use
+func (kp *KeyPair) Certificate() *tls.Certificate {
+	kp.mutex.RLock()
+	defer kp.mutex.RUnlock()
+	return kp.cert
+}
+
+//Leaf Parsed certificate currently in use
+func (kp *KeyPair) Leaf() *x509.Certificate {
+	return kp.Certificate().Leaf
+}
+
+//GetCertificate Callback of tls.Config for listeners
+func (kp *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return kp.Certificate(), nil
+}
+
+//GetClientCertificate Callback of tls.Config for dialers
+func (kp *KeyPair) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return kp.Certificate(), nil
+}
+
+//CAPool CA certificates read from a PEM file, replaced in place on Reload
+type CAPool struct {
+	File  string
+	mutex sync.RWMutex
+	pool  *x509.CertPool
+	certs []*x509.Certificate
+}
+
+//LoadCAPool Read the CA certificates from file
+func LoadCAPool(file string) (*CAPool, error) {
+	ca := CAPool{File: file}
+	if err := ca.Reload(); err != nil {
+		return nil, err
+	}
+	return &ca, nil
+}
+
+//Reload Read the file again, the previous pool stays in use if it is invalid
+func (ca *CAPool) Reload() error {
+	raw, err := ioutil.ReadFile(ca.File)
+	if err != nil {
+		return fmt.Errorf("pki: load ca cert %v error: %v", ca.File, err)
+	}
+	pool := x509.NewCertPool()
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("pki: parse ca cert %v error: %v", ca.File, err)
+		}
+		pool.AddCert(cert)
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("pki: no certificates in %v", ca.File)
+	}
+	ca.mutex.Lock()
+	ca.pool = pool
+	ca.certs = certs
+	ca.mutex.Unlock()
+	return nil
+}
+
+//Pool Pool currently in use
+func (ca *CAPool) Pool() *x509.CertPool {
+	ca.mutex.RLock()
+	defer ca.mutex.RUnlock()
+	return ca.pool
+}
+
+//Certificates Parsed certificates currently in the pool
+func (ca *CAPool) Certificates() []*x509.Certificate {
+	ca.mutex.RLock()
+	defer ca.mutex.RUnlock()
+	return ca.certs
+}
+
+/*
+ * ServerConfig Configuration of a listener presenting kp and requiring clients signed by ca.
+ * Both are read on every handshake, so reloading them takes effect without restarting the listener.
+ * The configuration can also be used to dial, presenting kp and trusting the pool of ca at creation.
+ * Peers with a revoked certificate are refused, see SetRevocationChecker.
+ */
+func ServerConfig(kp *KeyPair, ca *CAPool) *tls.Config {
+	config := &tls.Config{
+		GetCertificate:       kp.GetCertificate,
+		GetClientCertificate: kp.GetClientCertificate,
+		RootCAs:              ca.Pool(),
+		ClientCAs:            ca.Pool(),
+		ClientAuth:           tls.RequireAndVerifyClientCert,
+		VerifyConnection:     verifyNotRevoked,
+	}
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		current := config.Clone()
+		current.ClientCAs = ca.Pool()
+		current.GetConfigForClient = nil
+		return current, nil
+	}
+	return config
+}
@@ -0,0 +1,49 @@
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+//ErrRevoked The peer presented a revoked certificate
+var ErrRevoked = errors.New("pki: certificate revoked")
+
+//RevocationChecker Source of the revoked certificates
+type RevocationChecker interface {
+	IsRevoked(cert *x509.Certificate) (bool, error)
+}
+
+var (
+	revocationMutex sync.RWMutex
+	revocations     RevocationChecker
+)
+
+//SetRevocationChecker Refuse peers with a certificate revoked according to checker, on every connection configured by this package
+func SetRevocationChecker(checker RevocationChecker) {
+	revocationMutex.Lock()
+	revocations = checker
+	revocationMutex.Unlock()
+}
+
+//verifyNotRevoked VerifyConnection callback refusing revoked peer certificates
+func verifyNotRevoked(state tls.ConnectionState) error {
+	revocationMutex.RLock()
+	checker := revocations
+	revocationMutex.RUnlock()
+	if checker == nil {
+		return nil
+	}
+	for _, cert := range state.PeerCertificates {
+		revoked, err := checker.IsRevoked(cert)
+		if err != nil {
+			return fmt.Errorf("pki: revocation check of %v: %v", cert.Subject.CommonName, err)
+		}
+		if revoked {
+			return fmt.Errorf("%w: %v, serial %v", ErrRevoked, cert.Subject.CommonName, SerialString(cert.SerialNumber))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package pki
+
+import (
+	"context"
+	"crypto/x509"
+	"expvar"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//ConfReloadInterval Interval between checks of the certificate files for changes
+var ConfReloadInterval = 30 * time.Second
+
+//ConfExpiryWarning Certificates expiring within this period are warned about
+var ConfExpiryWarning = 30 * 24 * time.Hour
+
+//ConfExpiryWarningRepeat Interval between repeated warnings about the same certificate
+var ConfExpiryWarningRepeat = 24 * time.Hour
+
+//Metrics, published by expvar
+var (
+	metricReloads      = expvar.NewInt("pki_reloads")
+	metricReloadErrors = expvar.NewInt("pki_reload_errors")
+	metricExpiring     = expvar.NewInt("pki_certificates_expiring")
+	metricExpiry       = expvar.NewMap("pki_certificate_expiry_seconds")
+)
+
+//DefaultWatcher Watcher of the certificates used by the fog
+var DefaultWatcher = NewWatcher()
+
+//CertificateStatus Expiry of a certificate in use
+type CertificateStatus struct {
+	File     string
+	Subject  string
+	NotAfter time.Time
+	//Expiring NotAfter is within ConfExpiryWarning
+	Expiring bool
+}
+
+//Watcher Reloads certificates when their files change or on SIGHUP, and warns about their expiry
+type Watcher struct {
+	mutex    sync.Mutex
+	keyPairs []*KeyPair
+	caPools  []*CAPool
+	caches   []*Cache
+	//modTimes Modification time of every watched file at the last check
+	modTimes map[string]time.Time
+	warned   map[string]time.Time
+}
+
+//NewWatcher Create a watcher without certificates
+func NewWatcher() *Watcher {
+	return &Watcher{modTimes: make(map[string]time.Time), warned: make(map[string]time.Time)}
+}
+
+//AddKeyPair Reload kp when its files change
+func (w *Watcher) AddKeyPair(kp *KeyPair) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.keyPairs = append(w.keyPairs, kp)
+	w.stamp(kp.CertFile, kp.KeyFile)
+}
+
+//AddCAPool Reload ca when its file changes
+func (w *Watcher) AddCAPool(ca *CAPool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.caPools = append(w.caPools, ca)
+	w.stamp(ca.File)
+}
+
+//AddCache Drop the configurations of c loaded from changed files
+func (w *Watcher) AddCache(c *Cache) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.caches = append(w.caches, c)
+}
+
+//stamp Remember the current modification time of files, if not known yet
+func (w *Watcher) stamp(files ...string) {
+	for _, file := range files {
+		if _, ok := w.modTimes[file]; ok {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			w.modTimes[file] = info.ModTime()
+		}
+	}
+}
+
+//changedFiles Watched files modified since the last check, remembering their new modification times
+func (w *Watcher) changedFiles() map[string]bool {
+	files := make(map[string]bool)
+	for _, kp := range w.keyPairs {
+		files[kp.CertFile] = false
+		files[kp.KeyFile] = false
+	}
+	for _, ca := range w.caPools {
+		files[ca.File] = false
+	}
+	for _, c := range w.caches {
+		for _, file := range c.Files() {
+			files[file] = false
+		}
+	}
+	for file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			//Being replaced, retried on the next check
+			continue
+		}
+		last, ok := w.modTimes[file]
+		w.modTimes[file] = info.ModTime()
+		files[file] = ok && !info.ModTime().Equal(last)
+	}
+	return files
+}
+
+//Reload Reload the certificates of changed files, or all of them when forced
+func (w *Watcher) Reload(force bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	changed := w.changedFiles()
+	for _, kp := range w.keyPairs {
+		if force || changed[kp.CertFile] || changed[kp.KeyFile] {
+			w.reload(kp.CertFile, kp.Reload)
+		}
+	}
+	for _, ca := range w.caPools {
+		if force || changed[ca.File] {
+			w.reload(ca.File, ca.Reload)
+		}
+	}
+	for _, c := range w.caches {
+		if force {
+			c.Clear()
+			continue
+		}
+		for _, file := range c.Files() {
+			if changed[file] {
+				log.Printf("pki: %v changed, reloading on next use\n", file)
+				c.Forget(file)
+			}
+		}
+	}
+}
+
+//reload Reload the certificates of file, keeping the previous ones on failure
+func (w *Watcher) reload(file string, reload func() error) {
+	if err := reload(); err != nil {
+		metricReloadErrors.Add(1)
+		log.Printf("pki: reload of %v failed, keeping the previous certificate: %v\n", file, err)
+		return
+	}
+	metricReloads.Add(1)
+	log.Printf("pki: reloaded %v\n", file)
+}
+
+//Certificates Status of every certificate in use, the first to expire first
+func (w *Watcher) Certificates() []CertificateStatus {
+	w.mutex.Lock()
+	keyPairs := append([]*KeyPair(nil), w.keyPairs...)
+	caPools := append([]*CAPool(nil), w.caPools...)
+	for _, c := range w.caches {
+		kps, cas := c.loaded()
+		keyPairs = append(keyPairs, kps...)
+		caPools = append(caPools, cas...)
+	}
+	w.mutex.Unlock()
+
+	var statuses []CertificateStatus
+	seen := make(map[string]bool)
+	add := func(file string, cert *x509.Certificate) {
+		key := file + "|" + cert.SerialNumber.String()
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		statuses = append(statuses, CertificateStatus{
+			File:     file,
+			Subject:  cert.Subject.CommonName,
+			NotAfter: cert.NotAfter,
+			Expiring: time.Until(cert.NotAfter) < ConfExpiryWarning,
+		})
+	}
+	for _, kp := range keyPairs {
+		add(kp.CertFile, kp.Leaf())
+	}
+	for _, ca := range caPools {
+		for _, cert := range ca.Certificates() {
+			add(ca.File, cert)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].NotAfter.Before(statuses[j].NotAfter)
+	})
+	return statuses
+}
+
+//CheckExpiry Publish the expiry of every certificate and warn about the expiring ones
+func (w *Watcher) CheckExpiry() []CertificateStatus {
+	statuses := w.Certificates()
+	now := time.Now()
+	expiring := 0
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, status := range statuses {
+		left := status.NotAfter.Sub(now)
+		seconds := new(expvar.Float)
+		seconds.Set(left.Seconds())
+		metricExpiry.Set(status.File+":"+status.Subject, seconds)
+		if !status.Expiring {
+			continue
+		}
+		expiring++
+		key := status.File + ":" + status.Subject
+		if last, ok := w.warned[key]; ok && now.Sub(last) < ConfExpiryWarningRepeat {
+			continue
+		}
+		w.warned[key] = now
+		if left <= 0 {
+			log.Printf("pki: certificate %q of %v expired on %v\n", status.Subject, status.File, status.NotAfter)
+		} else {
+			log.Printf("pki: certificate %q of %v expires in %v, on %v\n", status.Subject, status.File, left.Round(time.Hour), status.NotAfter)
+		}
+	}
+	metricExpiring.Set(int64(expiring))
+	return statuses
+}
+
+//Run Check the files every ConfReloadInterval and reload everything on SIGHUP, until ctx is done
+func (w *Watcher) Run(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	ticker := time.NewTicker(ConfReloadInterval)
+	defer ticker.Stop()
+
+	w.CheckExpiry()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			log.Println("pki: SIGHUP, reloading all certificates")
+			w.Reload(true)
+			w.CheckExpiry()
+		case <-ticker.C:
+			w.Reload(false)
+			w.CheckExpiry()
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package pki
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+//touch Move the modification time of files forward, as a rotation within the same second would not
+func touch(t *testing.T, files ...string) {
+	later := time.Now().Add(time.Minute)
+	for _, file := range files {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWatcherReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeSelfSigned(t, dir, "fog", 365*24*time.Hour)
+	kp, err := LoadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := LoadCAPool(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCache()
+	if _, err := cache.ClientConfig(Credentials{Cert: certFile, Key: keyFile}); err != nil {
+		t.Fatal(err)
+	}
+	w := NewWatcher()
+	w.AddKeyPair(kp)
+	w.AddCAPool(ca)
+	w.AddCache(cache)
+	w.Reload(false)
+	first := kp.Leaf().SerialNumber
+
+	//Unchanged files are not reloaded
+	w.Reload(false)
+	if kp.Leaf().SerialNumber.Cmp(first) != 0 {
+		t.Fatal("Reload() replaced unchanged certificate")
+	}
+
+	//Rotated certificate is used by the next handshake
+	writeSelfSigned(t, dir, "fog", 365*24*time.Hour)
+	touch(t, certFile, keyFile)
+	w.Reload(false)
+	rotated := kp.Leaf().SerialNumber
+	if rotated.Cmp(first) == 0 {
+		t.Error("Reload() kept rotated certificate")
+	}
+	if got, _ := kp.GetCertificate(nil); got.Leaf.SerialNumber.Cmp(rotated) != 0 {
+		t.Error("GetCertificate() returned previous certificate")
+	}
+	if ca.Certificates()[0].SerialNumber.Cmp(rotated) != 0 {
+		t.Error("Reload() kept rotated CA")
+	}
+	if files := cache.Files(); len(files) != 0 {
+		t.Errorf("cache still holds configurations of rotated files: %v", files)
+	}
+
+	//Invalid files keep the previous certificate in use
+	if err := ioutil.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, certFile)
+	w.Reload(true)
+	if kp.Certificate() == nil || kp.Leaf().SerialNumber.Cmp(rotated) != 0 {
+		t.Error("Reload() of invalid file replaced the certificate")
+	}
+}
+
+func TestWatcherCheckExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	expiringCert, expiringKey := writeSelfSigned(t, dir, "expiring", 24*time.Hour)
+	validCert, validKey := writeSelfSigned(t, dir, "valid", 365*24*time.Hour)
+
+	w := NewWatcher()
+	for _, files := range [][2]string{{validCert, validKey}, {expiringCert, expiringKey}} {
+		kp, err := LoadKeyPair(files[0], files[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.AddKeyPair(kp)
+	}
+	statuses := w.CheckExpiry()
+	if len(statuses) != 2 || statuses[0].Subject != "expiring" || !statuses[0].Expiring || statuses[1].Expiring {
+		t.Fatalf("CheckExpiry() = %v, want expiring certificate first", statuses)
+	}
+	if metricExpiring.Value() != 1 {
+		t.Errorf("pki_certificates_expiring = %v, want 1", metricExpiring.Value())
+	}
+	if _, ok := w.warned[expiringCert+":expiring"]; !ok {
+		t.Error("CheckExpiry() did not warn about the expiring certificate")
+	}
+}